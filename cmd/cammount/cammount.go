@@ -17,6 +17,7 @@ limitations under the License.
 package main
 
 import (
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
@@ -32,13 +33,49 @@ import (
 	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/cacher"
 	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/context"
 	"camlistore.org/pkg/fs"
+	"camlistore.org/pkg/schema"
 	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
 )
 
 var (
-	debug = flag.Bool("debug", false, "print debugging messages.")
-	xterm = flag.Bool("xterm", false, "Run an xterm in the mounted directory. Shut down when xterm ends.")
+	debug        = flag.Bool("debug", false, "print debugging messages.")
+	logLevel     = flag.String("log_level", "info", "The least severe file system messages to log: debug (a line per operation), info, warn or error. -debug implies debug.")
+	xterm        = flag.Bool("xterm", false, "Run an xterm in the mounted directory. Shut down when xterm ends.")
+	lazySizes    = flag.Bool("lazy_sizes", false, "List mutable directories without fetching file sizes; look them up on first stat instead.")
+	popDepth     = flag.Int("populate_depth", fs.DefaultPopulateDepth, "Depth of the search describe used to list a mutable directory. Lower values fetch less per listing, at the cost of follow-up requests for children not reached.")
+	sharedWrites = flag.Bool("shared_writes", false, "Let read-only handles of a file see writes through its open writable handles before they are closed.")
+	wbBytes      = flag.Int64("write_behind_bytes", 0, "If positive, store a file being written in the background after this many new bytes, so a crash loses less of it.")
+	wbInterval   = flag.Duration("write_behind_interval", 0, "If non-zero, store a file being written in the background this long after unstored writes.")
+	tempDir      = flag.String("temp_dir", "", "Directory for the temporary copies of files open for writing, which can be as large as the files. Defaults to the system temp directory.")
+	maxWrites    = flag.Int("max_open_writes", 0, "If positive, the most files open for writing at once, each holding a temporary copy. Further opens for writing wait for one to be closed.")
+	fileMode     = flag.String("file_mode", "", "If non-empty, the permissions in octal, e.g. 0640, to record for files created, rather than none, which show as 0600.")
+	dirMode      = flag.String("dir_mode", "", "If non-empty, the permissions in octal, e.g. 2750, to record for directories created, rather than none, which show as 0700.")
+	checkSpace   = flag.Bool("check_space", false, "Before storing a file's contents, ask the server whether its blob storage has room for them, and fail with ENOSPC up front if not, rather than after uploading part of the file.")
+	readOnly     = flag.Bool("read_only", false, "Mount read-only: reject all changes to files and directories.")
+	dryRun       = flag.Bool("dry_run", false, "Log the claims and blobs changes would upload, rather than uploading them, and let the changes succeed. For seeing what an application does to the file system.")
+	versions     = flag.Bool("versions", false, "Give each file a hidden, read-only sibling directory, file.versions, holding all its past contents.")
+	attrFiles    = flag.Bool("attr_files", false, "Give each file a hidden sibling, file.camli-attr, to read and set its permanode attributes as key=value lines.")
+	recursiveRm  = flag.Bool("recursive_remove", false, "When a directory is removed, also unlink everything below it, rather than leaving the subtree linked but unreachable.")
+	moveContent  = flag.Bool("rename_moves_content", false, "When a file is renamed over another, as editors do on save, give the replaced file the new content rather than replacing it, so the name keeps its inode number.")
+	copies       = flag.Bool("detect_copies", false, "When a file is written with the bytes of a file just read in full, as cp does, reuse the stored contents rather than upload them again. Costs hashing the bytes of every open file.")
+	signEACCES   = flag.Bool("signing_eacces", false, "Fail changes with EACCES, rather than EIO, when claims can't be signed for lack of a signing key.")
+	conflicts    = flag.Bool("show_conflicts", false, "When a name in a directory has several links, e.g. added by racing clients, show those besides the latest as name.conflict-1 and so on, so they can be looked at and removed.")
+	statContents = flag.Bool("stat_contents", false, "When listing a directory, check that the server has its files' contents, and leave out those it doesn't, e.g. not replicated yet.")
+	chunkCache   = flag.Int64("chunk_cache", 0, "If positive, how many bytes of recently read file chunks to keep in memory, so re-reading files doesn't fetch them again.")
+	readAhead    = flag.Int64("read_ahead", 0, "If positive, how many bytes past those read to fetch in the background when a file is read sequentially, for faster reads of large files from a distant server.")
+	uploadRate   = flag.Int64("upload_rate", 0, "If positive, the most bytes per second of file contents to upload, so copying a large tree in doesn't saturate the link.")
+	downloadRate = flag.Int64("download_rate", 0, "If positive, the most bytes per second of file contents to fetch from the server.")
+	maxChunk     = flag.Int("max_chunk", 0, "If positive, the largest blob, up to 1 MB, to cut the contents of files written into. Smaller chunks dedup better among similar files.")
+	fixedChunks  = flag.Bool("fixed_chunks", false, "Cut the contents of files written into chunks of exactly -max_chunk bytes (1 MB by default), rather than at content-defined boundaries.")
+	noFirstChunk = flag.Bool("no_first_chunk", false, "Cut the start of files written at content-defined boundaries too, rather than keeping their first 256 KB whole, so that edits near the start of a file don't change all the chunks up to 256 KB.")
+	claimBatch   = flag.Duration("claim_batch", 0, "If non-zero, upload the claims recording changes in the background, batched over this long, rather than one request per change. Failures are then only reported by fsync.")
+	claimLog     = flag.String("claim_log", "", "If non-empty, a file to log claims in before uploading them, so that those a crash keeps from being uploaded are uploaded on the next mount with the same log.")
+	attrValid    = flag.Duration("attr_valid", fs.DefaultAttrValid, "How long the kernel may cache file and directory attributes. Longer means fewer requests for stat-heavy programs, but changes by other clients take that long to show.")
+	pnRoot       = flag.Bool("permanode", false, "The root blobref is of a permanode, to mount as a mutable directory, rather than of a static directory.")
+	describeTTL  = flag.Duration("describe_cache", 0, "If non-zero, how long to reuse a search describe response before asking the server again. Changes made by other clients may take this long to appear.")
+	debugHTTP    = flag.String("debug_http", "", "If non-empty, the address to serve file system statistics on, at /debug/vars, including search describe latencies and describe cache hits. Implies stats tracking.")
 )
 
 func usage() {
@@ -98,24 +135,101 @@ func main() {
 		cl.SetHTTPClient(&http.Client{Transport: cl.TransportForConfig(nil)})
 	}
 
+	cl.SetDescribeCacheTTL(*describeTTL)
+
 	diskCacheFetcher, err := cacher.NewDiskCache(cl)
 	if err != nil {
 		log.Fatalf("Error setting up local disk cache: %v", err)
 	}
 	defer diskCacheFetcher.Clean()
-	if root != nil {
+	if root != nil && !*pnRoot {
 		var err error
 		camfs, err = fs.NewRootedCamliFileSystem(diskCacheFetcher, root)
 		if err != nil {
 			log.Fatalf("Error creating root with %v: %v", root, err)
 		}
 	} else {
-		camfs = fs.NewCamliFileSystem(cl, diskCacheFetcher)
+		if root != nil {
+			var err error
+			camfs, err = fs.NewPermanodeCamliFileSystem(cl, diskCacheFetcher, root)
+			if err != nil {
+				log.Fatalf("Error creating root with %v: %v", root, err)
+			}
+		} else {
+			camfs = fs.NewCamliFileSystem(cl, diskCacheFetcher)
+		}
+		camfs.LazySizes = *lazySizes
+		camfs.PopulateDepth = *popDepth
+		camfs.SharedWrites = *sharedWrites
+		camfs.Versions = *versions
+		camfs.AttrFiles = *attrFiles
+		camfs.StatContents = *statContents
+		camfs.ShowConflicts = *conflicts
+		camfs.RenameMovesContent = *moveContent
+		camfs.RecursiveRemove = *recursiveRm
+		camfs.DetectCopies = *copies
+		camfs.WriteBehindBytes = *wbBytes
+		camfs.WriteBehindInterval = *wbInterval
+		camfs.TempDir = *tempDir
+		camfs.MaxOpenWrites = *maxWrites
+		camfs.ClaimBatchWindow = *claimBatch
+		camfs.AttrValid = *attrValid
+		camfs.UploadBytesPerSecond = *uploadRate
+		if *maxChunk > 0 || *fixedChunks || *noFirstChunk {
+			camfs.Chunking = &schema.ChunkOptions{Fixed: *fixedChunks, MaxSize: *maxChunk, NoFirstChunk: *noFirstChunk}
+			if err := camfs.Chunking.Validate(); err != nil {
+				log.Fatalf("Bad -max_chunk: %v", err)
+			}
+		}
+		if *claimLog != "" {
+			if err := camfs.OpenClaimLog(*claimLog); err != nil {
+				log.Fatalf("Error opening claim log: %v", err)
+			}
+		}
+	}
+	camfs.ReadOnly = *readOnly
+	camfs.CheckSpace = *checkSpace
+	camfs.DryRun = *dryRun
+	camfs.SigningEACCES = *signEACCES
+	camfs.ChunkCacheBytes = *chunkCache
+	camfs.ReadAheadBytes = *readAhead
+	camfs.DownloadBytesPerSecond = *downloadRate
+	if *fileMode != "" {
+		if camfs.DefaultFileMode, err = fs.ParseMode(*fileMode); err != nil {
+			log.Fatalf("Bad -file_mode: %v", err)
+		}
+	}
+	if *dirMode != "" {
+		if camfs.DefaultDirMode, err = fs.ParseMode(*dirMode); err != nil {
+			log.Fatalf("Bad -dir_mode: %v", err)
+		}
+	}
+	if (root == nil || *pnRoot) && !*readOnly && cl.SignerPublicKeyBlobref() == nil {
+		log.Printf("Signing key unavailable: changes to the mount will fail (with EACCES if -signing_eacces is set). Have you run \"camput init\"?")
 	}
 
 	if *debug {
 		fuse.Debugf = log.Printf
-		// TODO: set fs's logger
+		camfs.LogLevel = fs.LogDebug
+	} else {
+		camfs.LogLevel, err = fs.ParseLogLevel(*logLevel)
+		if err != nil {
+			log.Fatalf("Bad -log_level: %v", err)
+		}
+	}
+
+	if *debugHTTP != "" {
+		fs.TrackStats = true
+		expvar.Publish("camli.client.describes", expvar.Func(func() interface{} {
+			return cl.Stats().Describes
+		}))
+		expvar.Publish("camli.client.describe-cache-hits", expvar.Func(func() interface{} {
+			return cl.Stats().DescribeCacheHits
+		}))
+		go func() {
+			log.Printf("Serving stats on http://%s/debug/vars", *debugHTTP)
+			log.Print(http.ListenAndServe(*debugHTTP, nil))
+		}()
 	}
 
 	// This doesn't appear to work on OS X:
@@ -165,6 +279,13 @@ func main() {
 		log.Printf("xterm done")
 	}
 
+	// Store the files still open, as their handles won't be
+	// released once unmounted, and upload the queued claims.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	if err := camfs.Close(ctx); err != nil {
+		log.Printf("Closing file system: %v", err)
+	}
+	cancel()
 	time.AfterFunc(2*time.Second, func() {
 		os.Exit(1)
 	})
@@ -44,6 +44,8 @@ type dbinitCmd struct {
 	wipe bool
 	keep bool
 	wal  bool // Write-Ahead Logging for SQLite
+
+	pageSize int // SQLite page size, or 0 for the default
 }
 
 func init() {
@@ -60,6 +62,7 @@ func init() {
 		flags.BoolVar(&cmd.keep, "ignoreexists", false, "Do nothing if database already exists.")
 		// Defaults to true, because it fixes http://camlistore.org/issues/114
 		flags.BoolVar(&cmd.wal, "wal", true, "Enable Write-Ahead Logging with SQLite, for better concurrency. Requires SQLite >= 3.7.0.")
+		flags.IntVar(&cmd.pageSize, "sqlite_page_size", 0, "If non-zero, the page size in bytes of a new SQLite database, a power of two from 512 to 65536. It can't be changed later.")
 
 		return cmd
 	})
@@ -162,6 +165,9 @@ func (c *dbinitCmd) RunCommand(args []string) error {
 		}
 		do(db, fmt.Sprintf(`REPLACE INTO meta VALUES ('version', '%d')`, mysql.SchemaVersion()))
 	case "sqlite":
+		if c.pageSize != 0 {
+			do(db, sqlite.PageSizePragma(c.pageSize))
+		}
 		for _, tableSql := range sqlite.SQLCreateTables() {
 			do(db, tableSql)
 		}
@@ -20,23 +20,25 @@ package blobref
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"hash"
 	"reflect"
 	"regexp"
+	"strings"
 )
 
 // Pattern is the regular expression which matches a blobref.
 // It does not contain ^ or $.
 const Pattern = `\b([a-z][a-z0-9]*)-([a-f0-9]+)\b`
 
-// whole blobref pattern
-var kBlobRefPattern = regexp.MustCompile("^" + Pattern + "$")
-
 var supportedDigests = map[string]func() hash.Hash{
 	"sha1": func() hash.Hash {
 		return sha1.New()
 	},
+	"sha256": func() hash.Hash {
+		return sha256.New()
+	},
 }
 
 // BlobRef is an immutable reference to a blob.
@@ -47,7 +49,9 @@ type BlobRef struct {
 	strValue string // "<hashname>-<digest>"
 }
 
-// AsUint64 returns the first 64-bits of the blobref as an integer.
+// AsUint64 returns the first 64-bits of the blobref's digest as an
+// integer. It doesn't depend on the hash type, so it's stable for both
+// SHA-1 and SHA-256 blobrefs.
 func (br *BlobRef) AsUint64() uint64 {
 	var ret uint64
 	for i := 0; i < 16; i++ {
@@ -85,7 +89,7 @@ type SizedBlobRef struct {
 }
 
 func (sb *SizedBlobRef) Equal(o SizedBlobRef) bool {
-	return sb.Size == o.Size && sb.BlobRef.String() == o.BlobRef.String()
+	return sb.Size == o.Size && sb.BlobRef.Equal(o.BlobRef)
 }
 
 func (sb SizedBlobRef) String() string {
@@ -121,6 +125,9 @@ func (br *BlobRef) DomID() string {
 	return "camli-" + br.String()
 }
 
+// Equal reports whether br and other refer to the same blob: both
+// nil, or of the same hash type and digest. Refs of different hash
+// types are never equal, even of the same bytes.
 func (br *BlobRef) Equal(other *BlobRef) bool {
 	if (br == nil) != (other == nil) {
 		return false
@@ -131,6 +138,21 @@ func (br *BlobRef) Equal(other *BlobRef) bool {
 	return br.hashName == other.hashName && br.digest == other.digest
 }
 
+// Less reports whether br sorts before other, which is the order of
+// their strings: by hash type, then digest. A nil BlobRef sorts
+// before all others.
+func (br *BlobRef) Less(other *BlobRef) bool {
+	if br == nil || other == nil {
+		return br == nil && other != nil
+	}
+	if br.hashName != other.hashName {
+		// As '-' sorts before all the characters of hash
+		// names, this matches the strings' order.
+		return br.hashName < other.hashName
+	}
+	return br.digest < other.digest
+}
+
 func (br *BlobRef) Hash() hash.Hash {
 	fn, ok := supportedDigests[br.hashName]
 	if !ok {
@@ -161,8 +183,9 @@ func (br *BlobRef) Sum32() uint32 {
 }
 
 var kExpectedDigestSize = map[string]int{
-	"md5":  32,
-	"sha1": 40,
+	"md5":    32,
+	"sha1":   40,
+	"sha256": 64,
 }
 
 func newBlob(hashName, digest string) *BlobRef {
@@ -175,30 +198,89 @@ func newBlob(hashName, digest string) *BlobRef {
 }
 
 func blobIfValid(hashname, digest string) *BlobRef {
-	expectedSize := kExpectedDigestSize[hashname]
-	if expectedSize != 0 && len(digest) != expectedSize {
+	if !validHashName(hashname) || !validDigest(hashname, digest) {
 		return nil
 	}
 	return newBlob(hashname, digest)
 }
 
+// validHashName reports whether name matches [a-z][a-z0-9]*.
+func validHashName(name string) bool {
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		c := name[i]
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// validDigest reports whether digest is non-empty lowercase hex and,
+// for known hash types, of the right length.
+func validDigest(hashname, digest string) bool {
+	if digest == "" {
+		return false
+	}
+	if size := kExpectedDigestSize[hashname]; size != 0 && len(digest) != size {
+		return false
+	}
+	for i := 0; i < len(digest); i++ {
+		c := digest[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// recommendedHash is the name of the hash type NewHash returns.
+var recommendedHash = "sha1"
+
+// SetRecommendedHash sets the hash type (e.g. "sha1" or "sha256")
+// returned by NewHash, and so used for new blobs by writers such as
+// schema.WriteFileFromReader. Blobs of any supported hash type remain
+// readable. It's meant to be called at startup, before any hashing.
+func SetRecommendedHash(hashName string) error {
+	if _, ok := supportedDigests[hashName]; !ok {
+		return fmt.Errorf("blobref: unsupported hash type %q", hashName)
+	}
+	recommendedHash = hashName
+	return nil
+}
+
 // NewHash returns a new hash.Hash of the currently recommended hash type.
-// Currently this is just SHA-1, but will likely change within the next
-// year or so.
+// That's SHA-1 unless changed with SetRecommendedHash.
 func NewHash() hash.Hash {
-	return sha1.New()
+	return supportedDigests[recommendedHash]()
 }
 
-var sha1Type = reflect.TypeOf(sha1.New())
+var (
+	sha1Type   = reflect.TypeOf(sha1.New())
+	sha256Type = reflect.TypeOf(sha256.New())
+)
 
 // FromHash returns a BlobRef representing the given hash.
 func FromHash(h hash.Hash) *BlobRef {
-	if reflect.TypeOf(h) == sha1Type {
+	switch reflect.TypeOf(h) {
+	case sha1Type:
 		return newBlob("sha1", fmt.Sprintf("%x", h.Sum(nil)))
+	case sha256Type:
+		return newBlob("sha256", fmt.Sprintf("%x", h.Sum(nil)))
 	}
 	panic(fmt.Sprintf("Currently-unsupported hash type %T", h))
 }
 
+// FromString returns a blobref of the provided string, of the
+// currently recommended hash type.
+func FromString(s string) *BlobRef {
+	h := NewHash()
+	h.Write([]byte(s))
+	return FromHash(h)
+}
+
 // SHA1FromString returns a SHA-1 blobref of the provided string.
 func SHA1FromString(s string) *BlobRef {
 	s1 := sha1.New()
@@ -223,8 +305,16 @@ func FromPattern(r *regexp.Regexp, s string) *BlobRef {
 	return blobIfValid(matches[1], matches[2])
 }
 
+// Parse parses a blobref of the form "<hashname>-<digest>". It returns
+// nil if ref is malformed: the hash name must match [a-z][a-z0-9]*, and
+// the digest must be lowercase hex, of the exact expected length for
+// known hash types (e.g. 40 for sha1, 64 for sha256).
 func Parse(ref string) *BlobRef {
-	return FromPattern(kBlobRefPattern, ref)
+	i := strings.Index(ref, "-")
+	if i < 0 {
+		return nil
+	}
+	return blobIfValid(ref[:i], ref[i+1:])
 }
 
 func (br *BlobRef) UnmarshalJSON(d []byte) error {
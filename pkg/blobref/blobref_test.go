@@ -164,4 +164,128 @@ func TestAsUint64(t *testing.T) {
 	if want := uint64(0xb123456789abcdef); got != want {
 		t.Errorf("got %x; want %x", got, want)
 	}
+
+	br = MustParse("sha256-2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae")
+	got = br.AsUint64()
+	if want := uint64(0x2c26b46b68ffc68f); got != want {
+		t.Errorf("sha256: got %x; want %x", got, want)
+	}
+}
+
+func TestSHA256(t *testing.T) {
+	const digest = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	br := Parse("sha256-" + digest)
+	if br == nil {
+		t.Fatal("failed to parse sha256 blobref")
+	}
+	if br.HashName() != "sha256" || br.Digest() != digest {
+		t.Errorf("parsed as %q, %q", br.HashName(), br.Digest())
+	}
+	if !br.IsSupported() {
+		t.Errorf("sha256 not supported")
+	}
+	h := br.Hash()
+	h.Write([]byte("foo"))
+	if !br.HashMatches(h) {
+		t.Errorf("sha256 of foo doesn't match")
+	}
+	if g := FromHash(h); !g.Equal(br) {
+		t.Errorf("FromHash = %v; want %v", g, br)
+	}
+	if Parse("sha256-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33") != nil {
+		t.Errorf("parsed a sha256 blobref with a SHA-1 sized digest")
+	}
+}
+
+func TestRecommendedHash(t *testing.T) {
+	defer SetRecommendedHash("sha1")
+	if g := FromString("foo").HashName(); g != "sha1" {
+		t.Errorf("default hash = %q; want sha1", g)
+	}
+	if err := SetRecommendedHash("sha256"); err != nil {
+		t.Fatal(err)
+	}
+	if g, w := FromString("foo").String(), "sha256-2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"; g != w {
+		t.Errorf("FromString = %s; want %s", g, w)
+	}
+	if err := SetRecommendedHash("md4"); err == nil {
+		t.Errorf("SetRecommendedHash of an unsupported hash succeeded")
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	bad := []string{
+		"",
+		"sha1",
+		"sha1-",
+		"-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33",
+		"sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a3",   // truncated
+		"sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a333", // too long
+		"sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a3g",  // not hex
+		"sha1-0BEEC7B5EA3F0FDBC95D0DD47F3C5BC275DA8A33",  // uppercase
+		"sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33 ",
+		"sha256-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33",
+		"SHA1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33",
+		"1sha-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33",
+		"foo-bar-0beec7b5",
+		"unknownfunc-xyz",
+	}
+	for _, s := range bad {
+		if br := Parse(s); br != nil {
+			t.Errorf("Parse(%q) = %v; want nil", s, br)
+		}
+	}
+	good := []string{
+		"sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33",
+		"sha256-2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		"unknownfunc-0beec7b5",
+	}
+	for _, s := range good {
+		if br := Parse(s); br == nil || br.String() != s {
+			t.Errorf("Parse(%q) = %v; want %s", s, br, s)
+		}
+	}
+}
+
+func TestEqualAndLess(t *testing.T) {
+	const (
+		sha1Foo   = "sha1-0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33"
+		sha1Bar   = "sha1-62cdb7020ff920e5aa642c3d4066950dd1f01f4d"
+		sha256Foo = "sha256-2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	)
+	foo, bar, foo256 := MustParse(sha1Foo), MustParse(sha1Bar), MustParse(sha256Foo)
+	var null *BlobRef
+	tests := []struct {
+		a, b        *BlobRef
+		equal, less bool
+	}{
+		{null, null, true, false},
+		{null, foo, false, true},
+		{foo, null, false, false},
+		{foo, MustParse(sha1Foo), true, false},
+		{foo, bar, false, true},
+		{bar, foo, false, false},
+		// Different hash types of the same bytes.
+		{foo, foo256, false, true},
+		{foo256, foo, false, false},
+		{foo256, bar, false, false},
+		// Same digest under other hash names.
+		{MustParse("abc-0beec7b5"), MustParse("abcd-0beec7b5"), false, true},
+		// Uppercase refs don't parse, so are nil and match nothing.
+		{Parse(strings.ToUpper(sha1Foo[:5]) + sha1Foo[5:]), foo, false, true},
+		{Parse(sha1Foo[:5] + strings.ToUpper(sha1Foo[5:])), foo, false, true},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Equal(tt.b); got != tt.equal {
+			t.Errorf("%v.Equal(%v) = %v; want %v", tt.a, tt.b, got, tt.equal)
+		}
+		if got := tt.a.Less(tt.b); got != tt.less {
+			t.Errorf("%v.Less(%v) = %v; want %v", tt.a, tt.b, got, tt.less)
+		}
+		if tt.a != nil && tt.b != nil {
+			if want := tt.a.String() < tt.b.String(); tt.a.Less(tt.b) != want {
+				t.Errorf("%v.Less(%v) doesn't match the strings' order", tt.a, tt.b)
+			}
+		}
+	}
 }
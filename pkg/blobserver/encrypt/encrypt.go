@@ -333,7 +333,7 @@ func (s *storage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string,
 		panic("TODO: support wait in EnumerateBlobs")
 	}
 	defer close(dest)
-	iter := s.index.Find(after)
+	iter := s.index.Find(after, "")
 	n := 0
 	for iter.Next() {
 		if iter.Key() == after {
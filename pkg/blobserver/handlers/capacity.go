@@ -0,0 +1,56 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/httputil"
+)
+
+// CreateCapacityHandler returns a handler reporting the size and free
+// space of storage, in bytes, if it's a blobserver.CapacityReporter.
+// Otherwise both are reported as zero, for unknown.
+func CreateCapacityHandler(storage blobserver.Storage) http.Handler {
+	return http.HandlerFunc(func(conn http.ResponseWriter, req *http.Request) {
+		handleCapacity(conn, req, storage)
+	})
+}
+
+func handleCapacity(conn http.ResponseWriter, req *http.Request, storage blobserver.Storage) {
+	if w, ok := storage.(blobserver.ContextWrapper); ok {
+		storage = w.WrapContext(req)
+	}
+	var total, free int64
+	if cr, ok := blobserver.Unwrap(storage).(blobserver.CapacityReporter); ok {
+		var err error
+		total, free, err = cr.StorageCapacity()
+		if err != nil {
+			conn.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Server error getting storage capacity: %v", err)
+			fmt.Fprintf(conn, "Server error")
+			return
+		}
+	}
+	httputil.ReturnJSON(conn, map[string]interface{}{
+		"total": total,
+		"free":  free,
+	})
+}
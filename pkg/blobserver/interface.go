@@ -66,6 +66,22 @@ func StatBlob(bs BlobStatter, br *blobref.BlobRef) (sb blobref.SizedBlobRef, err
 	return
 }
 
+// StatBlobSizes stats blobs with one StatBlobs call, which clients
+// send as one request, and returns the sizes of those that exist,
+// keyed by blobref string.
+func StatBlobSizes(bs BlobStatter, blobs []*blobref.BlobRef) (map[string]int64, error) {
+	c := make(chan blobref.SizedBlobRef, len(blobs))
+	if err := bs.StatBlobs(c, blobs, 0); err != nil {
+		return nil, err
+	}
+	close(c)
+	sizes := make(map[string]int64, len(blobs))
+	for sb := range c {
+		sizes[sb.BlobRef.String()] = sb.Size
+	}
+	return sizes, nil
+}
+
 type StatReceiver interface {
 	BlobReceiver
 	BlobStatter
@@ -163,6 +179,13 @@ type Generationer interface {
 	ResetStorageGeneration() error
 }
 
+// CapacityReporter is an optional interface implemented by Storage
+// values that know how much space they have. It's informational
+// only (e.g. for df on a FUSE mount); sizes are in bytes.
+type CapacityReporter interface {
+	StorageCapacity() (total, free int64, err error)
+}
+
 // Storage is the interface that must be implemented by a blobserver
 // storage type. (e.g. localdisk, s3, encrypt, shard, replica, remote)
 type Storage interface {
@@ -0,0 +1,38 @@
+// +build linux darwin freebsd
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"syscall"
+
+	"camlistore.org/pkg/blobserver"
+)
+
+var _ blobserver.CapacityReporter = (*DiskStorage)(nil)
+
+// StorageCapacity returns the size and free space of the file system
+// holding the storage's root directory.
+func (ds *DiskStorage) StorageCapacity() (total, free int64, err error) {
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(ds.root, &st); err != nil {
+		return
+	}
+	bsize := int64(st.Bsize)
+	return int64(st.Blocks) * bsize, int64(st.Bavail) * bsize, nil
+}
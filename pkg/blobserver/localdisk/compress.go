@@ -0,0 +1,166 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+)
+
+// gzipExt ends the name of a blob file stored compressed with gzip
+// (see DiskStorage.Compression), after the blob's uncompressed size,
+// e.g. sha1-c22b5f...2512.dat.gz. The size is recorded when the blob
+// is received so that enumerating and statting blobs doesn't have to
+// read their files. The suffix is how each blob records how it's
+// stored, so a store can hold both raw and compressed blobs, e.g.
+// after compression is turned on or off, and reads both whatever its
+// setting. It stands in for a store-wide codec marker, which would
+// describe only the blobs written since the setting last changed.
+const gzipExt = ".gz"
+
+// validCompression checks the name of a DiskStorage.Compression.
+func validCompression(name string) error {
+	switch name {
+	case "", "gzip":
+		return nil
+	}
+	return fmt.Errorf("localdisk: unknown compression %q; want \"gzip\" or none", name)
+}
+
+// parseBlobFileName returns the blob name of a blob file's base name,
+// and whether the file is compressed. The size is the blob's
+// uncompressed size, for a compressed file only; a raw file's size
+// is the blob's.
+func parseBlobFileName(name string) (blobName string, size int64, compressed, ok bool) {
+	if strings.HasSuffix(name, ".dat"+gzipExt) {
+		stem := strings.TrimSuffix(name, ".dat"+gzipExt)
+		i := strings.LastIndex(stem, ".")
+		if i < 0 {
+			return "", 0, false, false
+		}
+		size, err := strconv.ParseInt(stem[i+1:], 10, 64)
+		if err != nil || size < 0 {
+			return "", 0, false, false
+		}
+		return stem[:i], size, true, true
+	}
+	if strings.HasSuffix(name, ".dat") {
+		return strings.TrimSuffix(name, ".dat"), 0, false, true
+	}
+	return "", 0, false, false
+}
+
+// compressedPath returns the path of the compressed file of a blob
+// of size bytes whose raw file would be at path.
+func compressedPath(path string, size int64) string {
+	return strings.TrimSuffix(path, ".dat") + "." + strconv.FormatInt(size, 10) + ".dat" + gzipExt
+}
+
+// findCompressed returns the path of the compressed file of the blob
+// whose raw file would be at path, and the blob's size. As the name
+// has the size in it, it looks for it in the blob's directory. The
+// error is os.ErrNotExist if there's none.
+func findCompressed(path string) (zpath string, size int64, err error) {
+	dir, base := filepath.Split(path)
+	blobName := strings.TrimSuffix(base, ".dat")
+	d, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return "", 0, os.ErrNotExist
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return "", 0, err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, blobName+".") {
+			continue
+		}
+		if bn, size, compressed, ok := parseBlobFileName(name); ok && compressed && bn == blobName {
+			return filepath.Join(dir, name), size, nil
+		}
+	}
+	return "", 0, os.ErrNotExist
+}
+
+// findBlob returns the path of the file of blob b in partition,
+// raw or compressed, whether it's compressed, and the blob's size.
+// The error is os.ErrNotExist if there's neither.
+func (ds *DiskStorage) findBlob(partition string, b *blobref.BlobRef) (path string, compressed bool, size int64, err error) {
+	path = ds.blobPath(partition, b)
+	fi, err := os.Stat(path)
+	if err == nil && !fi.IsDir() {
+		return path, false, fi.Size(), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", false, 0, err
+	}
+	path, size, err = findCompressed(path)
+	return path, err == nil, size, err
+}
+
+// readCompressed returns the contents of the blob compressed in file.
+// If the file is corrupt, the error is blobserver.ErrCorruptBlob.
+func readCompressed(file *os.File) ([]byte, error) {
+	var buf bytes.Buffer
+	zr, err := gzip.NewReader(file)
+	if err == nil {
+		_, err = io.Copy(&buf, zr)
+	}
+	if isCorruptGzip(err) {
+		log.Printf("localdisk: compressed blob file %s is corrupt: %v", file.Name(), err)
+		return nil, blobserver.ErrCorruptBlob
+	}
+	if err != nil {
+		return nil, fmt.Errorf("localdisk: reading compressed blob file %s: %v", file.Name(), err)
+	}
+	return buf.Bytes(), nil
+}
+
+// isCorruptGzip reports whether err, from reading a gzip file, means
+// the file is corrupt.
+func isCorruptGzip(err error) bool {
+	switch err.(type) {
+	case flate.CorruptInputError:
+		return true
+	}
+	return err == gzip.ErrHeader || err == gzip.ErrChecksum || err == io.ErrUnexpectedEOF || err == io.EOF
+}
+
+// countWriter counts the bytes written to it.
+type countWriter struct {
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,330 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/context"
+	"camlistore.org/pkg/test"
+)
+
+// textBlob returns a blob of text that compresses well.
+func textBlob(i int) *test.Blob {
+	return &test.Blob{strings.Repeat("some log line that repeats a lot\n", 1000) + string(rune('a'+i%26))}
+}
+
+func fetchContents(t *testing.T, ds *DiskStorage, br *blobref.BlobRef) ([]byte, int64) {
+	rc, size, err := ds.Fetch(br)
+	if err != nil {
+		t.Fatalf("Fetch(%v): %v", br, err)
+	}
+	defer rc.Close()
+	slurp, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("reading %v: %v", br, err)
+	}
+	return slurp, size
+}
+
+func TestCompression(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	if _, err := ds.CreateQueue("some-queue"); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := &test.Blob{"stored before compression"}
+	raw.MustUpload(t, ds)
+
+	ds.Compression = "gzip"
+	tb := textBlob(0)
+	br := tb.BlobRef()
+	sb, err := ds.ReceiveBlob(br, tb.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sb.Size != int64(len(tb.Contents)) {
+		t.Errorf("ReceiveBlob size = %d; want %d", sb.Size, len(tb.Contents))
+	}
+	fi, err := os.Stat(compressedPath(ds.blobPath("", br), tb.Size()))
+	if err != nil {
+		t.Fatalf("compressed blob file: %v", err)
+	}
+	if fi.Size() >= int64(len(tb.Contents))/10 {
+		t.Errorf("compressed blob file is %d bytes for %d of text", fi.Size(), len(tb.Contents))
+	}
+	if _, err := os.Stat(ds.blobPath("", br)); !os.IsNotExist(err) {
+		t.Errorf("raw blob file of compressed blob: %v", err)
+	}
+
+	// Both blobs read back byte-identical, whatever the setting,
+	// with their uncompressed sizes.
+	for _, compression := range []string{"gzip", ""} {
+		ds.Compression = compression
+		for _, b := range []*test.Blob{raw, tb} {
+			slurp, size := fetchContents(t, ds, b.BlobRef())
+			if !bytes.Equal(slurp, []byte(b.Contents)) || size != b.Size() {
+				t.Errorf("compression %q: Fetch(%v) = %d bytes, size %d; want the %d bytes stored", compression, b.BlobRef(), len(slurp), size, b.Size())
+			}
+			sb, err := blobserver.StatBlob(ds, b.BlobRef())
+			if err != nil || sb.Size != b.Size() {
+				t.Errorf("compression %q: StatBlob(%v) = %v, %v; want size %d", compression, b.BlobRef(), sb, err, b.Size())
+			}
+		}
+	}
+	ds.VerifyOnRead = true
+	if slurp, _ := fetchContents(t, ds, br); !bytes.Equal(slurp, []byte(tb.Contents)) {
+		t.Errorf("Fetch with VerifyOnRead = %d bytes; want the %d stored", len(slurp), len(tb.Contents))
+	}
+	ds.VerifyOnRead = false
+
+	ch := make(chan blobref.SizedBlobRef, 10)
+	if err := ds.EnumerateBlobs(ch, "", 10, 0); err != nil {
+		t.Fatal(err)
+	}
+	sizes := map[string]int64{}
+	for sb := range ch {
+		sizes[sb.BlobRef.String()] = sb.Size
+	}
+	if len(sizes) != 2 || sizes[raw.BlobRef().String()] != raw.Size() || sizes[br.String()] != tb.Size() {
+		t.Errorf("EnumerateBlobs sizes = %v; want %v: %d, %v: %d", sizes, raw.BlobRef(), raw.Size(), br, tb.Size())
+	}
+
+	q, err := ds.CreateQueue("other-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Compression = "gzip"
+	tb2 := textBlob(1)
+	tb2.MustUpload(t, ds)
+	if sb, err := blobserver.StatBlob(q, tb2.BlobRef()); err != nil || sb.Size != tb2.Size() {
+		t.Errorf("compressed blob in queue: StatBlob = %v, %v; want size %d", sb, err, tb2.Size())
+	}
+
+	res, err := ds.Scrub(context.Background(), ScrubOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Checked != 3 || !res.OK() {
+		t.Errorf("Scrub = %+v; want 3 blobs checked, no problems", res)
+	}
+
+	// Storing a raw blob again compressed replaces its file.
+	raw.MustUpload(t, ds)
+	if _, err := os.Stat(ds.blobPath("", raw.BlobRef())); !os.IsNotExist(err) {
+		t.Errorf("raw blob file left after storing it compressed: %v", err)
+	}
+
+	if err := ds.RemoveBlobs([]*blobref.BlobRef{br, raw.BlobRef()}); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*blobref.BlobRef{br, raw.BlobRef()} {
+		if _, _, err := ds.Fetch(b); err != os.ErrNotExist {
+			t.Errorf("Fetch of removed %v = %v; want os.ErrNotExist", b, err)
+		}
+	}
+}
+
+// TestCompressionBothFiles checks a blob left with both a raw and a
+// compressed file, as by a crash while ReceiveBlob replaced one with
+// the other.
+func TestCompressionBothFiles(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	q, err := ds.CreateQueue("some-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := textBlob(0)
+	br := tb.BlobRef()
+	tb.MustUpload(t, ds)
+	path := ds.blobPath("", br)
+	if err := ioutil.WriteFile(compressedPath(path, tb.Size()), gzipped(t, tb.Contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stored again compressed, the blob isn't also added to the
+	// queue, which has it raw.
+	ds.Compression = "gzip"
+	tb.MustUpload(t, ds)
+	qs := q.(*DiskStorage)
+	if _, err := os.Stat(compressedPath(qs.blobPath(qs.partition, br), tb.Size())); !os.IsNotExist(err) {
+		t.Errorf("compressed copy mirrored to a queue holding the blob raw: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte(tb.Contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan blobref.SizedBlobRef, 10)
+	if err := ds.EnumerateBlobs(ch, "", 10, 0); err != nil {
+		t.Fatal(err)
+	}
+	var got []blobref.SizedBlobRef
+	for sb := range ch {
+		got = append(got, sb)
+	}
+	if len(got) != 1 || !got[0].BlobRef.Equal(br) || got[0].Size != tb.Size() {
+		t.Errorf("EnumerateBlobs = %v; want %v once, size %d", got, br, tb.Size())
+	}
+
+	if err := ds.RemoveBlobs([]*blobref.BlobRef{br}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, compressedPath(path, tb.Size())} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left after RemoveBlobs: %v", p, err)
+		}
+	}
+	if _, _, err := ds.Fetch(br); err != os.ErrNotExist {
+		t.Errorf("Fetch of removed blob = %v; want os.ErrNotExist", err)
+	}
+}
+
+// gzipped returns s compressed with gzip.
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompressionCorrupt(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	ds.Compression = "gzip"
+	tb := textBlob(0)
+	tb.MustUpload(t, ds)
+	path := compressedPath(ds.blobPath("", tb.BlobRef()), tb.Size())
+	zb, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zb[len(zb)/2] ^= 0x20
+	if err := ioutil.WriteFile(path, zb, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ds.Fetch(tb.BlobRef()); err != blobserver.ErrCorruptBlob {
+		t.Errorf("Fetch of a corrupt compressed blob = %v; want ErrCorruptBlob", err)
+	}
+
+	// Enumeration takes the size from the file name, without
+	// reading the file.
+	ch := make(chan blobref.SizedBlobRef, 10)
+	if err := ds.EnumerateBlobs(ch, "", 10, 0); err != nil {
+		t.Fatalf("EnumerateBlobs with a corrupt compressed blob: %v", err)
+	}
+	var got []blobref.SizedBlobRef
+	for sb := range ch {
+		got = append(got, sb)
+	}
+	if len(got) != 1 || got[0].Size != tb.Size() {
+		t.Errorf("EnumerateBlobs = %v; want %v, size %d", got, tb.BlobRef(), tb.Size())
+	}
+}
+
+func TestParseBlobFileName(t *testing.T) {
+	tests := []struct {
+		name       string
+		blobName   string
+		size       int64
+		compressed bool
+		ok         bool
+	}{
+		{"sha1-c22b5f.dat", "sha1-c22b5f", 0, false, true},
+		{"sha1-c22b5f.2512.dat.gz", "sha1-c22b5f", 2512, true, true},
+		{"sha1-c22b5f.dat.gz", "", 0, false, false},
+		{"sha1-c22b5f.-1.dat.gz", "", 0, false, false},
+		{"sha1-c22b5f.tmp", "", 0, false, false},
+	}
+	for _, tt := range tests {
+		blobName, size, compressed, ok := parseBlobFileName(tt.name)
+		if blobName != tt.blobName || size != tt.size || compressed != tt.compressed || ok != tt.ok {
+			t.Errorf("parseBlobFileName(%q) = %q, %d, %v, %v; want %q, %d, %v, %v", tt.name,
+				blobName, size, compressed, ok, tt.blobName, tt.size, tt.compressed, tt.ok)
+		}
+	}
+}
+
+func TestCompressionConfig(t *testing.T) {
+	if err := validCompression("gzip"); err != nil {
+		t.Error(err)
+	}
+	if err := validCompression("zip"); err == nil {
+		t.Error("no error for an unknown compression")
+	}
+}
+
+func benchmarkReceiveCompression(b *testing.B, compression string) {
+	ds := NewStorage(b)
+	defer cleanUp(ds)
+	ds.Compression = compression
+	blobs := make([]*test.Blob, 26)
+	for i := range blobs {
+		blobs[i] = textBlob(i)
+	}
+	b.SetBytes(blobs[0].Size())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tb := blobs[i%len(blobs)]
+		if _, err := ds.ReceiveBlob(tb.BlobRef(), tb.Reader()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkFetchCompression(b *testing.B, compression string) {
+	ds := NewStorage(b)
+	defer cleanUp(ds)
+	ds.Compression = compression
+	tb := textBlob(0)
+	if _, err := ds.ReceiveBlob(tb.BlobRef(), tb.Reader()); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(tb.Size())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rc, _, err := ds.Fetch(tb.BlobRef())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(rc); err != nil {
+			b.Fatal(err)
+		}
+		rc.Close()
+	}
+}
+
+// BenchmarkReceiveCompressed and BenchmarkFetchCompressed measure
+// the cost of DiskStorage.Compression on text, against
+// BenchmarkReceiveText and BenchmarkFetchText.
+func BenchmarkReceiveText(b *testing.B)       { benchmarkReceiveCompression(b, "") }
+func BenchmarkReceiveCompressed(b *testing.B) { benchmarkReceiveCompression(b, "gzip") }
+func BenchmarkFetchText(b *testing.B)         { benchmarkFetchCompression(b, "") }
+func BenchmarkFetchCompressed(b *testing.B)   { benchmarkFetchCompression(b, "gzip") }
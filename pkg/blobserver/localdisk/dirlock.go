@@ -17,22 +17,130 @@ limitations under the License.
 package localdisk
 
 import (
+	"expvar"
 	"sync"
+
+	"camlistore.org/pkg/context"
 )
 
 var (
 	dirLockMu sync.Mutex // guards rest:
 	locksOut  int64
-	dirLocks  = map[string]*sync.RWMutex{}
+	dirLocks  = map[string]*dirLock{}
 )
 
-func getDirLock(dir string) *sync.RWMutex {
+// A dirLock is the pair of locks of one directory.
+type dirLock struct {
+	keep keepMutex    // read-held while in use, held to delete it
+	list sync.RWMutex // read-held while listing it, held to add entries
+}
+
+// A keepMutex is a reader/writer lock whose writers can give up
+// waiting (see lockDone) without leaving anything queued. Unlike a
+// sync.RWMutex, a waiting writer doesn't hold off new readers: a
+// directory in constant use isn't deleted, rather than every
+// receive into it stalling behind the deletion.
+type keepMutex struct {
+	mu       sync.Mutex
+	readers  int
+	writer   bool
+	released chan struct{} // closed on the next unlock, or nil
+}
+
+// waitRelease returns a channel closed on the next unlock.
+// m.mu must be held.
+func (m *keepMutex) waitRelease() <-chan struct{} {
+	if m.released == nil {
+		m.released = make(chan struct{})
+	}
+	return m.released
+}
+
+// wake wakes those waiting for an unlock. m.mu must be held.
+func (m *keepMutex) wake() {
+	if m.released != nil {
+		close(m.released)
+		m.released = nil
+	}
+}
+
+func (m *keepMutex) RLock() {
+	for {
+		m.mu.Lock()
+		if !m.writer {
+			m.readers++
+			m.mu.Unlock()
+			return
+		}
+		released := m.waitRelease()
+		m.mu.Unlock()
+		<-released
+	}
+}
+
+func (m *keepMutex) RUnlock() {
+	m.mu.Lock()
+	m.readers--
+	if m.readers == 0 {
+		m.wake()
+	}
+	m.mu.Unlock()
+}
+
+func (m *keepMutex) Lock() {
+	m.lockDone(nil)
+}
+
+// lockDone locks m, unless done is closed first. It reports whether
+// it did.
+func (m *keepMutex) lockDone(done <-chan struct{}) bool {
+	for {
+		m.mu.Lock()
+		if !m.writer && m.readers == 0 {
+			m.writer = true
+			m.mu.Unlock()
+			return true
+		}
+		released := m.waitRelease()
+		m.mu.Unlock()
+		select {
+		case <-released:
+		case <-done:
+			return false
+		}
+	}
+}
+
+func (m *keepMutex) Unlock() {
+	m.mu.Lock()
+	m.writer = false
+	m.wake()
+	m.mu.Unlock()
+}
+
+// The number of directory locks handed out and not yet unlocked, and
+// of directories with locks. Both should keep returning to zero; if
+// they only grow, a lock is being leaked.
+func init() {
+	expvar.Publish("camli.localdisk.dirlocks-out", expvar.Func(func() interface{} {
+		dirLockMu.Lock()
+		defer dirLockMu.Unlock()
+		return locksOut
+	}))
+	expvar.Publish("camli.localdisk.dirlocks-dirs", expvar.Func(func() interface{} {
+		dirLockMu.Lock()
+		defer dirLockMu.Unlock()
+		return len(dirLocks)
+	}))
+}
+
+func getDirLock(dir string) *dirLock {
 	dirLockMu.Lock()
 	defer dirLockMu.Unlock()
 	locksOut++
 	l, ok := dirLocks[dir]
 	if !ok {
-		l = new(sync.RWMutex)
+		l = new(dirLock)
 		dirLocks[dir] = l
 	}
 	return l
@@ -43,7 +151,7 @@ func unlockDirLock() {
         defer dirLockMu.Unlock()
 	locksOut--
 	if locksOut == 0 {
-		dirLocks = map[string]*sync.RWMutex{}
+		dirLocks = map[string]*dirLock{}
 	}
 }
 
@@ -55,13 +163,18 @@ type unlocker interface {
 // Holding the lock prevents the directory from being deleted.
 // The caller must Unlock it when finished.
 func keepDirectoryLock(dir string) unlocker {
-	mu := getDirLock(dir)
+	mu := &getDirLock(dir).keep
 	mu.RLock()
 	return keepLock{mu}
 }
 
+// A readLocker is a lock read-held by keepLock.
+type readLocker interface {
+	RUnlock()
+}
+
 type keepLock struct {
-	mu *sync.RWMutex
+	mu readLocker
 }
 
 func (l keepLock) Unlock() {
@@ -73,16 +186,52 @@ func (l keepLock) Unlock() {
 // Holding the lock is necessary while deleting the directory.
 // The caller must Unlock it when finished.
 func deleteDirectoryLock(dir string) unlocker {
-	mu := getDirLock(dir)
+	mu := &getDirLock(dir).keep
 	mu.Lock()
 	return deleteLock{mu}
 }
 
+// deleteDirectoryLockContext is like deleteDirectoryLock, but gives
+// up and returns ctx's error if the lock isn't acquired before ctx
+// is done, e.g. because a reader never releases it. A lock given up
+// on leaves nothing behind: keepDirectoryLock calls on dir don't
+// wait for it.
+func deleteDirectoryLockContext(ctx context.Context, dir string) (unlocker, error) {
+	mu := &getDirLock(dir).keep
+	if !mu.lockDone(ctx.Done()) {
+		unlockDirLock()
+		return nil, ctx.Err()
+	}
+	return deleteLock{mu}, nil
+}
+
 type deleteLock struct {
-	mu *sync.RWMutex
+	mu sync.Locker
 }
 
 func (l deleteLock) Unlock() {
 	l.mu.Unlock()
 	unlockDirLock()
 }
+
+// listDirectoryLock locks directory for listing and returns the
+// locked object. Any number of listings may hold it at once, but
+// while it's held no blob file is added to the directory, so a
+// listing sees each entry exactly once, whole.
+// The caller must Unlock it when finished.
+func listDirectoryLock(dir string) unlocker {
+	mu := &getDirLock(dir).list
+	mu.RLock()
+	return keepLock{mu}
+}
+
+// addEntryLock locks directory and returns the locked object.
+// Holding the lock is necessary while moving a blob file into the
+// directory. It only waits for listings of that directory, and
+// should be held just long enough to make the new entry appear.
+// The caller must Unlock it when finished.
+func addEntryLock(dir string) unlocker {
+	mu := &getDirLock(dir).list
+	mu.Lock()
+	return deleteLock{mu}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"expvar"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/context"
+)
+
+func expvarValue(t *testing.T, name string) string {
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatalf("expvar %s not published", name)
+	}
+	return v.String()
+}
+
+func TestDirLockExpvars(t *testing.T) {
+	keep := keepDirectoryLock("/some/dir")
+	del := deleteDirectoryLock("/other/dir")
+	if g := expvarValue(t, "camli.localdisk.dirlocks-out"); g != "2" {
+		t.Errorf("dirlocks-out while locked = %s; want 2", g)
+	}
+	if g := expvarValue(t, "camli.localdisk.dirlocks-dirs"); g != "2" {
+		t.Errorf("dirlocks-dirs while locked = %s; want 2", g)
+	}
+	keep.Unlock()
+	del.Unlock()
+	for _, name := range []string{"camli.localdisk.dirlocks-out", "camli.localdisk.dirlocks-dirs"} {
+		if g := expvarValue(t, name); g != "0" {
+			t.Errorf("%s after unlocking = %s; want 0", name, g)
+		}
+	}
+}
+
+func TestDeleteDirectoryLockContext(t *testing.T) {
+	const dir = "/some/dir"
+	l, err := deleteDirectoryLockContext(context.Background(), dir)
+	if err != nil {
+		t.Fatalf("uncontended lock: %v", err)
+	}
+	l.Unlock()
+
+	keep := keepDirectoryLock(dir)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := deleteDirectoryLockContext(ctx, dir); err != context.DeadlineExceeded {
+		t.Fatalf("lock held by a reader: err = %v; want DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("gave up after %v", d)
+	}
+
+	// The abandoned attempt leaves nothing queued: new readers
+	// don't wait for it.
+	kept := make(chan unlocker)
+	go func() {
+		kept <- keepDirectoryLock(dir)
+	}()
+	select {
+	case l := <-kept:
+		l.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepDirectoryLock blocked by a timed out delete lock")
+	}
+	keep.Unlock()
+	if g := expvarValue(t, "camli.localdisk.dirlocks-out"); g != "0" {
+		t.Errorf("dirlocks-out after unlocking = %s; want 0", g)
+	}
+
+	locked := make(chan unlocker)
+	go func() {
+		l, err := deleteDirectoryLockContext(context.Background(), dir)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- l
+	}()
+	select {
+	case l := <-locked:
+		if l != nil {
+			l.Unlock()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not acquired after the readers left")
+	}
+}
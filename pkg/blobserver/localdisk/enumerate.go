@@ -18,7 +18,6 @@ package localdisk
 
 import (
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -27,14 +26,23 @@ import (
 	"time"
 
 	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/context"
 )
 
+// dirDeleteLockTimeout is how long enumeration waits to lock an empty
+// queue directory it removes.
+const dirDeleteLockTimeout = 10 * time.Second
+
 type readBlobRequest struct {
 	ch      chan<- blobref.SizedBlobRef
 	after   string
 	remain  *int // limit countdown
 	dirRoot string
 
+	// If non-zero, only blobs whose files were modified after
+	// this time are sent.
+	modifiedSince time.Time
+
 	// Not used on initial request, only on recursion
 	blobPrefix, pathInto string
 }
@@ -48,15 +56,40 @@ func (ee *enumerateError) Error() string {
 	return fmt.Sprintf("Enumerate error: %s: %v", ee.msg, ee.err)
 }
 
-func readBlobs(opts readBlobRequest) error {
-	dirFullPath := filepath.Join(opts.dirRoot, opts.pathInto)
+// listDir returns the names in dir, all read under its
+// listDirectoryLock so that no blob is added to it meanwhile.
+func listDir(dirFullPath string) ([]string, error) {
 	dir, err := os.Open(dirFullPath)
 	if err != nil {
-		return &enumerateError{"localdisk: opening directory " + dirFullPath, err}
+		return nil, &enumerateError{"localdisk: opening directory " + dirFullPath, err}
 	}
 	defer dir.Close()
-	names, err := dir.Readdirnames(32768)
-	if err == io.EOF {
+	defer listDirectoryLock(dirFullPath).Unlock()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, &enumerateError{"localdisk: readdirnames of " + dirFullPath, err}
+	}
+	return names, nil
+}
+
+// readBlobs sends the blobs under opts.dirRoot, in order.
+//
+// Each directory is listed at once, while blobs can't be added to
+// it (see listDirectoryLock), so the blobs of a shard directory are
+// those it held at some instant: a blob is never sent twice, nor
+// before its file is complete. Writers only wait for the listing of
+// the directory they add to. There's no snapshot of the whole
+// store, though: a blob received during the enumeration is sent if
+// its directory is listed after it arrived, and a blob removed
+// after its directory was listed may still be sent, if it's stat'ed
+// before the removal.
+func readBlobs(opts readBlobRequest) error {
+	dirFullPath := filepath.Join(opts.dirRoot, opts.pathInto)
+	names, err := listDir(dirFullPath)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
 		// remove empty blob dir if we are in a queue but not the queue root itself
 		if strings.Contains(dirFullPath, "queue-") &&
 			!strings.Contains(filepath.Base(dirFullPath), "queue-") {
@@ -64,16 +97,29 @@ func readBlobs(opts readBlobRequest) error {
 			// blob is coming in and creating this directory), then try to delete it,
 			// but ignore any error, because it might just be a new file appearing here
 			// (in the case of the directory already existing, but not being newly made)
-			dirLock := deleteDirectoryLock(dirFullPath)
+			// If the lock is held for long, just leave the directory
+			// for a later enumeration rather than block this one.
+			ctx, cancel := context.WithTimeout(context.Background(), dirDeleteLockTimeout)
+			dirLock, err := deleteDirectoryLockContext(ctx, dirFullPath)
+			cancel()
+			if err != nil {
+				log.Printf("localdisk: not removing empty directory %s: %v", dirFullPath, err)
+				return nil
+			}
 			os.Remove(dirFullPath)
 			dirLock.Unlock()
 		}
 		return nil
 	}
-	if err != nil {
-		return &enumerateError{"localdisk: readdirnames of " + dirFullPath, err}
-	}
+	// The directory isn't empty, so it's not ours to remove; keep
+	// RemoveBlobs from pruning it while we're in it. This lock is
+	// taken before those of subdirectories, as in keepBlobDirs.
+	defer keepDirectoryLock(dirFullPath).Unlock()
 	sort.Strings(names)
+	// A blob being stored again under the other codec briefly has
+	// both files (see ReceiveBlob); they sort next to each other,
+	// and only the first is sent.
+	var lastBlob string
 	for _, name := range names {
 		if *opts.remain == 0 {
 			return nil
@@ -88,6 +134,10 @@ func readBlobs(opts readBlobRequest) error {
 		}
 		fullPath := dirFullPath + "/" + name
 		fi, err := os.Stat(fullPath)
+		if os.IsNotExist(err) {
+			// Removed since we listed it.
+			continue
+		}
 		if err != nil {
 			return &enumerateError{"localdisk: stat of file " + fullPath, err}
 		}
@@ -115,15 +165,21 @@ func readBlobs(opts readBlobRequest) error {
 			continue
 		}
 
-		if !fi.IsDir() && strings.HasSuffix(name, ".dat") {
-			blobName := name[0 : len(name)-4]
-			if blobName <= opts.after {
+		if blobName, size, compressed, ok := parseBlobFileName(name); ok && !fi.IsDir() {
+			if blobName <= opts.after || blobName == lastBlob {
+				continue
+			}
+			if !opts.modifiedSince.IsZero() && !fi.ModTime().After(opts.modifiedSince) {
 				continue
 			}
 			blobRef := blobref.Parse(blobName)
 			if blobRef != nil {
-				opts.ch <- blobref.SizedBlobRef{BlobRef: blobRef, Size: fi.Size()}
+				if !compressed {
+					size = fi.Size()
+				}
+				opts.ch <- blobref.SizedBlobRef{BlobRef: blobRef, Size: size}
 				(*opts.remain)--
+				lastBlob = blobName
 			}
 			continue
 		}
@@ -177,3 +233,32 @@ func (ds *DiskStorage) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after st
 	}
 	return err
 }
+
+// EnumerateBlobsModifiedSince is like EnumerateBlobs (without waiting),
+// but only sends blobs whose files on disk were modified after since.
+// It's meant for incremental replication between two localdisk
+// stores, where the destination only wants to pull recent additions.
+//
+// Blobs are immutable once written, so a blob file's mtime is
+// normally the time it was received. That's only a hint, though:
+// the mtime comes from the local clock (which may jump), its
+// granularity depends on the filesystem (a second or two on some),
+// restoring or copying the blob directory without preserving times
+// resets it, and a blob mirrored into a queue partition by hard link
+// shares the original's mtime. Callers should ask for an overlapping
+// window (e.g. since the last sync minus a few minutes) and
+// periodically fall back to a full EnumerateBlobs.
+func (ds *DiskStorage) EnumerateBlobsModifiedSince(dest chan<- blobref.SizedBlobRef, after string, limit int, since time.Time) error {
+	defer close(dest)
+	if limit == 0 {
+		log.Printf("Warning: localdisk.EnumerateBlobsModifiedSince called with a limit of 0")
+	}
+	limitMutable := limit
+	return readBlobs(readBlobRequest{
+		ch:            dest,
+		dirRoot:       ds.PartitionRoot(ds.partition),
+		after:         after,
+		remain:        &limitMutable,
+		modifiedSince: since,
+	})
+}
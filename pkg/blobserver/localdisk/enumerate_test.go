@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"os"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -198,3 +199,106 @@ func TestEnumerateIsSorted(t *testing.T) {
 		}
 	}
 }
+
+func TestEnumerateModifiedSince(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+
+	old := []*test.Blob{{"foo"}, {"baar"}}
+	for _, tb := range old {
+		tb.MustUpload(t, ds)
+		// Backdate the first set, so the test doesn't depend on
+		// the filesystem's timestamp granularity.
+		longAgo := time.Now().Add(-1 * time.Hour)
+		ExpectNil(t, os.Chtimes(ds.blobPath("", tb.BlobRef()), longAgo, longAgo), "backdating blob")
+	}
+	since := time.Now().Add(-2 * time.Second)
+	recent := []*test.Blob{{"bazzz"}, {"quux"}}
+	for _, tb := range recent {
+		tb.MustUpload(t, ds)
+	}
+
+	ch := make(chan blobref.SizedBlobRef)
+	errCh := make(chan error)
+	go func() {
+		errCh <- ds.EnumerateBlobsModifiedSince(ch, "", 5000, since)
+	}()
+	got := map[string]bool{}
+	for sb := range ch {
+		got[sb.BlobRef.String()] = true
+	}
+	ExpectNil(t, <-errCh, "EnumerateBlobsModifiedSince return value")
+	ExpectInt(t, len(recent), len(got), "number of blobs modified since")
+	for _, tb := range recent {
+		Expect(t, got[tb.BlobRef().String()], "recent blob "+tb.BlobRef().String()+" enumerated")
+	}
+	for _, tb := range old {
+		Expect(t, !got[tb.BlobRef().String()], "old blob "+tb.BlobRef().String()+" skipped")
+	}
+}
+
+func TestEnumerateWhileWriting(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+
+	sizes := map[string]int64{} // blobref string to size
+	var blobs []*test.Blob
+	for i := 0; i < 400; i++ {
+		tb := &test.Blob{fmt.Sprintf("blob-%d-%s", i, strings.Repeat("x", i))}
+		sizes[tb.BlobRef().String()] = tb.Size()
+		blobs = append(blobs, tb)
+	}
+	const preexisting = 100
+	for _, tb := range blobs[:preexisting] {
+		tb.MustUpload(t, ds)
+	}
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for _, tb := range blobs[preexisting:] {
+			tb.MustUpload(t, ds)
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false // one last enumeration, after all writes
+		default:
+		}
+		ch := make(chan blobref.SizedBlobRef)
+		errCh := make(chan error)
+		go func() {
+			errCh <- ds.EnumerateBlobs(ch, "", len(blobs)+1, 0)
+		}()
+		seen := map[string]bool{}
+		var got []blobref.SizedBlobRef
+		for sb := range ch {
+			br := sb.BlobRef.String()
+			if seen[br] {
+				t.Errorf("blob %s enumerated twice", br)
+			}
+			seen[br] = true
+			if want := sizes[br]; sb.Size != want {
+				t.Errorf("blob %s enumerated with size %d; want %d", br, sb.Size, want)
+			}
+			got = append(got, sb)
+		}
+		ExpectNil(t, <-errCh, "EnumerateBlobs return value")
+		if !sort.IsSorted(SortedSizedBlobs(got)) {
+			t.Errorf("enumeration while writing not sorted")
+		}
+		for _, tb := range blobs[:preexisting] {
+			if !seen[tb.BlobRef().String()] {
+				t.Errorf("preexisting blob %s not enumerated", tb.BlobRef())
+			}
+		}
+		if !running && len(got) != len(blobs) {
+			t.Errorf("enumerated %d blobs after writing; want %d", len(got), len(blobs))
+		}
+		if t.Failed() {
+			return
+		}
+	}
+}
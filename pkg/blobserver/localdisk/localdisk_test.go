@@ -18,13 +18,17 @@ package localdisk
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
 
 	. "camlistore.org/pkg/test/asserts"
 	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/test"
 )
 
@@ -37,7 +41,7 @@ var (
 	rootEpoch = 0
 )
 
-func NewStorage(t *testing.T) *DiskStorage {
+func NewStorage(t testing.TB) *DiskStorage {
 	epochLock.Lock()
 	rootEpoch++
 	path := fmt.Sprintf("%s/camli-testroot-%d-%d", os.TempDir(), os.Getpid(), rootEpoch)
@@ -165,3 +169,298 @@ func TestMissingGetReturnsNoEnt(t *testing.T) {
 		t.Errorf("expected nil blob; got a value")
 	}
 }
+
+func TestStorageCapacity(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd":
+	default:
+		t.Skip("StorageCapacity not implemented on " + runtime.GOOS)
+	}
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	cr, ok := interface{}(ds).(blobserver.CapacityReporter)
+	if !ok {
+		t.Fatalf("DiskStorage doesn't implement CapacityReporter")
+	}
+	total, free, err := cr.StorageCapacity()
+	if err != nil {
+		t.Fatalf("StorageCapacity: %v", err)
+	}
+	if total <= 0 || free < 0 || free > total {
+		t.Errorf("StorageCapacity = %d, %d; want 0 <= free <= total, total > 0", total, free)
+	}
+}
+
+func TestReceiveSync(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	ds.Sync = true
+	q, err := ds.CreateQueue("some-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := &test.Blob{"Foo"}
+	tb.MustUpload(t, ds)
+	if _, err := blobserver.StatBlob(q, tb.BlobRef()); err != nil {
+		t.Errorf("blob not mirrored to queue: %v", err)
+	}
+}
+
+func benchmarkReceive(b *testing.B, sync bool) {
+	ds := NewStorage(b)
+	defer cleanUp(ds)
+	ds.Sync = sync
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tb := &test.Blob{fmt.Sprintf("blob %d", i)}
+		if _, err := ds.ReceiveBlob(tb.BlobRef(), tb.Reader()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReceive measures the cost of DiskStorage.Sync.
+func BenchmarkReceive(b *testing.B)     { benchmarkReceive(b, false) }
+func BenchmarkReceiveSync(b *testing.B) { benchmarkReceive(b, true) }
+
+func TestShardLayout(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	root := ds.root
+	os.RemoveAll(root)
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ds, err := NewLayout(root, 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tb := &test.Blob{"Foo"}
+	tb.MustUpload(t, ds)
+	d := tb.BlobRef().Digest()
+	if _, err := os.Stat(filepath.Join(root, "sha1", d[0:2], d[2:4], blobFileBaseName(tb.BlobRef()))); err != nil {
+		t.Errorf("blob not stored at depth 2: %v", err)
+	}
+
+	// Reopening uses the recorded layout.
+	ds, err = New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, _, err := ds.Fetch(tb.BlobRef())
+	if err != nil {
+		t.Fatalf("Fetch after reopen: %v", err)
+	}
+	rc.Close()
+	ch := make(chan blobref.SizedBlobRef, 10)
+	if err := ds.EnumerateBlobs(ch, "", 10, 0); err != nil {
+		t.Fatal(err)
+	}
+	if sb, ok := <-ch; !ok || sb.BlobRef.String() != tb.BlobRef().String() {
+		t.Errorf("enumerated %v; want %v", sb, tb.BlobRef())
+	}
+
+	if _, err := NewLayout(root, 3, 2); err == nil {
+		t.Errorf("NewLayout with a different layout than recorded succeeded")
+	}
+	if _, err := NewLayout(root, 5, 2); err == nil {
+		t.Errorf("NewLayout with an invalid layout succeeded")
+	}
+}
+
+func TestShardLayoutExistingStore(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	tb := &test.Blob{"Foo"}
+	tb.MustUpload(t, ds)
+	// As if created before layouts were recorded.
+	os.Remove(ds.layoutFile())
+	if _, err := NewLayout(ds.root, 3, 2); err == nil {
+		t.Errorf("NewLayout changed the layout of a store with blobs")
+	}
+	ds, err := New(ds.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ds.layout != defaultLayout {
+		t.Errorf("layout = %v; want default %v", ds.layout, defaultLayout)
+	}
+	if _, _, err := ds.Fetch(tb.BlobRef()); err != nil {
+		t.Errorf("Fetch: %v", err)
+	}
+}
+
+func TestRemoveBlobs(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	a, b, c := &test.Blob{"a"}, &test.Blob{"b"}, &test.Blob{"c"}
+	for _, tb := range []*test.Blob{a, b, c} {
+		tb.MustUpload(t, ds)
+	}
+	// A blob path which can't be removed.
+	bad := &test.Blob{"bad"}
+	badPath := ds.blobPath("", bad.BlobRef())
+	if err := os.MkdirAll(filepath.Join(badPath, "x"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	missing := &test.Blob{"missing"}
+
+	err := ds.RemoveBlobs([]*blobref.BlobRef{a.BlobRef(), bad.BlobRef(), missing.BlobRef(), b.BlobRef()})
+	re, ok := err.(RemoveError)
+	if !ok {
+		t.Fatalf("RemoveBlobs error = %v; want a RemoveError", err)
+	}
+	if len(re) != 1 || re[bad.BlobRef().String()] == nil {
+		t.Errorf("RemoveError = %v; want only %v", re, bad.BlobRef())
+	}
+	for _, tb := range []*test.Blob{a, b} {
+		if _, err := os.Stat(ds.blobPath("", tb.BlobRef())); !os.IsNotExist(err) {
+			t.Errorf("blob %v not removed: %v", tb.BlobRef(), err)
+		}
+		if _, err := os.Stat(ds.blobDirectory("", tb.BlobRef())); !os.IsNotExist(err) {
+			t.Errorf("empty directory of %v not removed: %v", tb.BlobRef(), err)
+		}
+	}
+	if _, _, err := ds.Fetch(c.BlobRef()); err != nil {
+		t.Errorf("Fetch of kept blob: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(ds.root, "sha1")); err != nil {
+		t.Errorf("hash name directory removed: %v", err)
+	}
+}
+
+func TestRemoveBlobsWaitsForKeepLock(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	tb := &test.Blob{"foo"}
+	tb.MustUpload(t, ds)
+	dir := ds.blobDirectory("", tb.BlobRef())
+
+	// As if a receive or enumeration were using the directory.
+	unlock := ds.keepBlobDirs(dir)
+	done := make(chan error, 1)
+	go func() {
+		done <- ds.RemoveBlobs(tb.BlobRefSlice())
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("RemoveBlobs returned %v while the directory was locked", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := os.Stat(ds.blobPath("", tb.BlobRef())); err != nil {
+		t.Fatalf("blob removed while its directory was locked: %v", err)
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("RemoveBlobs: %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("directory not removed after unlock: %v", err)
+	}
+}
+
+func TestRemoveBlobsDuringEnumerate(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	root := ds.root
+	os.RemoveAll(root)
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Few, shallow shard directories, so enumeration and removal
+	// keep meeting in the same ones.
+	ds, err := NewLayout(root, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 200
+	var blobs []*blobref.BlobRef
+	for i := 0; i < n; i++ {
+		tb := &test.Blob{fmt.Sprintf("blob %d", i)}
+		tb.MustUpload(t, ds)
+		blobs = append(blobs, tb.BlobRef())
+	}
+
+	stop := make(chan bool)
+	enumErr := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				enumErr <- nil
+				return
+			default:
+			}
+			ch := make(chan blobref.SizedBlobRef, n)
+			if err := ds.EnumerateBlobs(ch, "", n, 0); err != nil {
+				enumErr <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < n; i += 10 {
+		if err := ds.RemoveBlobs(blobs[i : i+10]); err != nil {
+			t.Fatalf("RemoveBlobs: %v", err)
+		}
+	}
+	close(stop)
+	if err := <-enumErr; err != nil {
+		t.Fatalf("EnumerateBlobs during removal: %v", err)
+	}
+
+	ch := make(chan blobref.SizedBlobRef, n)
+	if err := ds.EnumerateBlobs(ch, "", n, 0); err != nil {
+		t.Fatal(err)
+	}
+	if sb, ok := <-ch; ok {
+		t.Errorf("enumerated %v after removing all blobs", sb)
+	}
+	names, err := ioutil.ReadDir(filepath.Join(root, "sha1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("%d shard directories left after removing all blobs", len(names))
+	}
+}
+
+func TestVerifyOnRead(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	tb := &test.Blob{"some blob contents"}
+	tb.MustUpload(t, ds)
+	br := tb.BlobRef()
+
+	ds.VerifyOnRead = true
+	rc, size, err := ds.Fetch(br)
+	if err != nil {
+		t.Fatalf("Fetch of an intact blob: %v", err)
+	}
+	slurp, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(slurp) != tb.Contents || size != int64(len(tb.Contents)) {
+		t.Errorf("Fetch = %q, size %d; want %q", slurp, size, tb.Contents)
+	}
+
+	// Flip a bit, as a failing disk might.
+	corrupt := []byte(tb.Contents)
+	corrupt[3] ^= 0x20
+	if err := ioutil.WriteFile(ds.blobPath("", br), corrupt, 0600); err != nil {
+		t.Fatal(err)
+	}
+	before := verifyFailures.String()
+	if _, _, err := ds.FetchStreaming(br); err != blobserver.ErrCorruptBlob {
+		t.Errorf("FetchStreaming of a corrupt blob = %v; want ErrCorruptBlob", err)
+	}
+	if after := verifyFailures.String(); after == before {
+		t.Errorf("verify-failures stayed at %s", after)
+	}
+
+	ds.VerifyOnRead = false
+	rc, _, err = ds.Fetch(br)
+	if err != nil {
+		t.Fatalf("Fetch without VerifyOnRead: %v", err)
+	}
+	rc.Close()
+}
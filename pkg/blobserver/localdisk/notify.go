@@ -0,0 +1,140 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"errors"
+
+	"camlistore.org/pkg/blobref"
+)
+
+// A ChangeKind is the kind of a ChangeEvent.
+type ChangeKind int
+
+const (
+	// BlobReceived means a blob was stored.
+	BlobReceived ChangeKind = iota
+
+	// BlobRemoved means a blob was deleted.
+	BlobRemoved
+
+	// RescanNeeded means events were dropped because the
+	// subscriber's channel was full. The subscriber should
+	// enumerate the storage to catch up.
+	RescanNeeded
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case BlobReceived:
+		return "BlobReceived"
+	case BlobRemoved:
+		return "BlobRemoved"
+	case RescanNeeded:
+		return "RescanNeeded"
+	}
+	return "ChangeKind(?)"
+}
+
+// A ChangeEvent describes a change to a DiskStorage, as sent to
+// subscribers.
+type ChangeEvent struct {
+	Kind ChangeKind
+	// Blob is the blob received or removed. Its Size is zero for
+	// BlobRemoved, and Blob is entirely zero for RescanNeeded.
+	Blob blobref.SizedBlobRef
+}
+
+// subscriber is the delivery state of one subscribed channel.
+type subscriber struct {
+	ch chan<- ChangeEvent
+	// overflowed is whether events were dropped and a
+	// RescanNeeded sent, which the subscriber hasn't caught up
+	// with yet.
+	overflowed bool
+}
+
+// Subscribe registers ch to receive a ChangeEvent, in order, for
+// each blob received or removed by ds.
+//
+// Sends never block: the last slot of ch's buffer is reserved, and
+// once the rest is full, further events are coalesced into a single
+// RescanNeeded event until the subscriber has drained ch. ch must
+// therefore have a buffer of at least 2.
+func (ds *DiskStorage) Subscribe(ch chan<- ChangeEvent) error {
+	if cap(ch) < 2 {
+		return errors.New("localdisk: Subscribe channel needs a buffer of at least 2")
+	}
+	ds.subMu.Lock()
+	defer ds.subMu.Unlock()
+	if ds.closed {
+		return errors.New("localdisk: Subscribe on closed storage")
+	}
+	if ds.subs == nil {
+		ds.subs = make(map[chan<- ChangeEvent]*subscriber)
+	}
+	ds.subs[ch] = &subscriber{ch: ch}
+	return nil
+}
+
+// Unsubscribe stops sending events to ch. It doesn't close ch.
+func (ds *DiskStorage) Unsubscribe(ch chan<- ChangeEvent) {
+	ds.subMu.Lock()
+	defer ds.subMu.Unlock()
+	delete(ds.subs, ch)
+}
+
+// Close closes all subscribed channels and refuses new
+// subscriptions. ds can still be used to store and fetch blobs.
+func (ds *DiskStorage) Close() error {
+	ds.subMu.Lock()
+	defer ds.subMu.Unlock()
+	for ch := range ds.subs {
+		close(ch)
+	}
+	ds.subs = nil
+	ds.closed = true
+	return nil
+}
+
+// notifyChange tells all of ds's subscribers about a change.
+func (ds *DiskStorage) notifyChange(kind ChangeKind, sb blobref.SizedBlobRef) {
+	ds.subMu.Lock()
+	defer ds.subMu.Unlock()
+	for _, s := range ds.subs {
+		s.send(ChangeEvent{Kind: kind, Blob: sb})
+	}
+}
+
+// send sends ev to s without blocking. It must be called with the
+// DiskStorage's subMu held, so s.ch only ever drains concurrently.
+func (s *subscriber) send(ev ChangeEvent) {
+	if s.overflowed {
+		if len(s.ch) > 0 {
+			// The RescanNeeded is still queued, and the
+			// rescan will find this change.
+			return
+		}
+		s.overflowed = false
+	}
+	if len(s.ch) < cap(s.ch)-1 {
+		s.ch <- ev
+		return
+	}
+	s.ch <- ChangeEvent{Kind: RescanNeeded}
+	s.overflowed = true
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/test"
+)
+
+func TestSubscribe(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+
+	ch := make(chan ChangeEvent, 10)
+	if err := ds.Subscribe(ch); err != nil {
+		t.Fatal(err)
+	}
+	var want []ChangeEvent
+	for _, s := range []string{"foo", "bar", "baz"} {
+		tb := &test.Blob{s}
+		tb.MustUpload(t, ds)
+		want = append(want, ChangeEvent{BlobReceived, blobref.SizedBlobRef{tb.BlobRef(), tb.Size()}})
+	}
+	foo := &test.Blob{"foo"}
+	if err := ds.RemoveBlobs([]*blobref.BlobRef{foo.BlobRef()}); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, ChangeEvent{BlobRemoved, blobref.SizedBlobRef{BlobRef: foo.BlobRef()}})
+
+	for i, w := range want {
+		got := <-ch
+		if got.Kind != w.Kind || !got.Blob.BlobRef.Equal(w.Blob.BlobRef) || got.Blob.Size != w.Blob.Size {
+			t.Errorf("event %d = %v %v; want %v %v", i, got.Kind, got.Blob, w.Kind, w.Blob)
+		}
+	}
+
+	ds.Close()
+	if _, ok := <-ch; ok {
+		t.Errorf("channel still open after Close")
+	}
+	if err := ds.Subscribe(make(chan ChangeEvent, 10)); err == nil {
+		t.Errorf("Subscribe after Close succeeded")
+	}
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+
+	if err := ds.Subscribe(make(chan ChangeEvent, 1)); err == nil {
+		t.Errorf("Subscribe with a buffer of 1 succeeded")
+	}
+	ch := make(chan ChangeEvent, 2)
+	if err := ds.Subscribe(ch); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"a", "b", "c", "d"} {
+		(&test.Blob{s}).MustUpload(t, ds)
+	}
+	if ev := <-ch; ev.Kind != BlobReceived || !ev.Blob.BlobRef.Equal((&test.Blob{"a"}).BlobRef()) {
+		t.Errorf("first event = %v %v; want BlobReceived of a", ev.Kind, ev.Blob)
+	}
+	if ev := <-ch; ev.Kind != RescanNeeded {
+		t.Errorf("second event = %v; want RescanNeeded", ev.Kind)
+	}
+
+	// Once drained, events flow again.
+	e := &test.Blob{"e"}
+	e.MustUpload(t, ds)
+	if ev := <-ch; ev.Kind != BlobReceived || !ev.Blob.BlobRef.Equal(e.BlobRef()) {
+		t.Errorf("event after drain = %v %v; want BlobReceived of e", ev.Kind, ev.Blob)
+	}
+	ds.Unsubscribe(ch)
+	(&test.Blob{"f"}).MustUpload(t, ds)
+	if len(ch) != 0 {
+		t.Errorf("event sent after Unsubscribe")
+	}
+}
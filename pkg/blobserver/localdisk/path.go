@@ -18,6 +18,9 @@ package localdisk
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
 
 	"path/filepath"
 
@@ -25,16 +28,80 @@ import (
 	"net/url"
 )
 
+// A shardLayout is how blob files are spread in directories under a
+// hash name's directory: levels nested directories, each named by
+// the next width characters of the digest.
+type shardLayout struct {
+	levels, width int
+}
+
+// defaultLayout is the layout of stores predating configurable
+// layouts, e.g. sha1/c22/b5f/sha1-c22b5f...dat.
+var defaultLayout = shardLayout{levels: 2, width: 3}
+
+func (l shardLayout) String() string {
+	return fmt.Sprintf("levels=%d width=%d", l.levels, l.width)
+}
+
+func (l shardLayout) valid() error {
+	if l.levels < 1 || l.levels > 3 || l.width < 1 || l.width > 4 {
+		return fmt.Errorf("localdisk: invalid shard layout %v: want 1 to 3 levels of 1 to 4 characters", l)
+	}
+	return nil
+}
+
+func (ds *DiskStorage) shardLayout() shardLayout {
+	if ds.layout.levels == 0 {
+		return defaultLayout
+	}
+	return ds.layout
+}
+
+func (ds *DiskStorage) layoutFile() string {
+	return filepath.Join(ds.root, "LAYOUT.dat")
+}
+
+// readLayout returns the layout recorded in the storage root, and
+// whether there was one.
+func (ds *DiskStorage) readLayout() (l shardLayout, ok bool, err error) {
+	bs, err := ioutil.ReadFile(ds.layoutFile())
+	if os.IsNotExist(err) {
+		return l, false, nil
+	}
+	if err != nil {
+		return l, false, err
+	}
+	line := strings.SplitN(string(bs), "\n", 2)[0]
+	if _, err := fmt.Sscanf(line, "levels=%d width=%d", &l.levels, &l.width); err != nil {
+		return l, false, fmt.Errorf("localdisk: bad layout file %s: %v", ds.layoutFile(), err)
+	}
+	return l, true, l.valid()
+}
+
+func (ds *DiskStorage) writeLayout(l shardLayout) error {
+	return ioutil.WriteFile(ds.layoutFile(), []byte(l.String()+`
+
+This file's first line records how blob files are sharded into
+directories under this root. It's fixed when the storage is created;
+changing it would make existing blobs unreachable.
+`), 0644)
+}
+
 func blobFileBaseName(b *blobref.BlobRef) string {
 	return fmt.Sprintf("%s-%s.dat", b.HashName(), b.Digest())
 }
 
 func (ds *DiskStorage) blobDirectory(partition string, b *blobref.BlobRef) string {
+	l := ds.shardLayout()
 	d := b.Digest()
-	if len(d) < 6 {
-		d = d + "______"
+	if n := l.levels * l.width; len(d) < n {
+		d += strings.Repeat("_", n-len(d))
+	}
+	elem := []string{ds.PartitionRoot(partition), b.HashName()}
+	for i := 0; i < l.levels; i++ {
+		elem = append(elem, d[i*l.width:(i+1)*l.width])
 	}
-	return filepath.Join(ds.PartitionRoot(partition), b.HashName(), d[0:3], d[3:6])
+	return filepath.Join(elem...)
 }
 
 func (ds *DiskStorage) blobPath(partition string, b *blobref.BlobRef) string {
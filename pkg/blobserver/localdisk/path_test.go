@@ -39,3 +39,15 @@ func TestPaths(t *testing.T) {
 	}
 
 }
+
+func TestPathsLayout(t *testing.T) {
+	br := blobref.Parse("sha1-c22b5f9178342609428d6f51b2c5af4c0bde6a42")
+	ds := &DiskStorage{root: "/tmp/dir", layout: shardLayout{levels: 3, width: 2}}
+	if e, g := "/tmp/dir/sha1/c2/2b/5f", ds.blobDirectory("", br); e != g {
+		t.Errorf("3x2 layout dir; expected path %q; got %q", e, g)
+	}
+	br = blobref.Parse("digalg-abc")
+	if e, g := "/tmp/dir/digalg/ab/c_/__", ds.blobDirectory("", br); e != g {
+		t.Errorf("3x2 layout short blobref dir; expected path %q; got %q", e, g)
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package localdisk
 
 import (
+	"compress/gzip"
 	"errors"
 	"fmt"
 	"io"
@@ -36,6 +37,11 @@ func (ds *DiskStorage) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (
 		return
 	}
 	hashedDirectory := ds.blobDirectory(pname, blobRef)
+	// Keep RemoveBlobs from pruning the directory before the
+	// blob is in it.
+	defer ds.keepBlobDirs(hashedDirectory)()
+	_, statErr := os.Stat(hashedDirectory)
+	newDir := statErr != nil
 	err = os.MkdirAll(hashedDirectory, 0700)
 	if err != nil {
 		return
@@ -54,11 +60,25 @@ func (ds *DiskStorage) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (
 		}
 	}()
 
+	// onDisk counts the bytes of the file, which are fewer than
+	// those written if compressed.
+	onDisk := new(countWriter)
+	var dst io.Writer = io.MultiWriter(tempFile, onDisk)
+	var zw io.WriteCloser
+	if ds.Compression != "" {
+		zw = gzip.NewWriter(dst)
+		dst = zw
+	}
 	hash := blobRef.Hash()
-	written, err := io.Copy(io.MultiWriter(hash, tempFile), source)
+	written, err := io.Copy(io.MultiWriter(hash, dst), source)
 	if err != nil {
 		return
 	}
+	if zw != nil {
+		if err = zw.Close(); err != nil {
+			return
+		}
+	}
 	if err = tempFile.Sync(); err != nil {
 		return
 	}
@@ -73,21 +93,43 @@ func (ds *DiskStorage) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (
 	if err != nil {
 		return
 	}
-	if stat.Size() != written {
-		err = fmt.Errorf("temp file %q size %d didn't match written size %d", tempFile.Name(), stat.Size(), written)
+	if stat.Size() != onDisk.n {
+		err = fmt.Errorf("temp file %q size %d didn't match written size %d", tempFile.Name(), stat.Size(), onDisk.n)
 		return
 	}
 
-	fileName := ds.blobPath("", blobRef)
-	if err = os.Rename(tempFile.Name(), fileName); err != nil {
+	// The blob is stored either raw or compressed; the other file,
+	// if any, is from before Compression was changed. Replacing it
+	// can't be atomic, so until it's removed both exist: readers
+	// take either, enumeration sends the blob once, and
+	// RemoveBlobs removes both.
+	rawName := ds.blobPath("", blobRef)
+	fileName, otherName := rawName, ""
+	if ds.Compression != "" {
+		fileName, otherName = compressedPath(rawName, written), rawName
+	} else if zname, _, zerr := findCompressed(rawName); zerr == nil {
+		otherName = zname
+	}
+	entryLock := addEntryLock(hashedDirectory)
+	err = os.Rename(tempFile.Name(), fileName)
+	if err == nil && otherName != "" {
+		os.Remove(otherName)
+	}
+	entryLock.Unlock()
+	if err != nil {
 		return
 	}
+	if ds.Sync {
+		if err = ds.syncDirs(hashedDirectory, ds.PartitionRoot(""), newDir); err != nil {
+			return
+		}
+	}
 
 	stat, err = os.Lstat(fileName)
 	if err != nil {
 		return
 	}
-	if stat.Size() != written {
+	if stat.Size() != onDisk.n {
 		err = errors.New("Written size didn't match.")
 		return
 	}
@@ -99,39 +141,70 @@ func (ds *DiskStorage) ReceiveBlob(blobRef *blobref.BlobRef, source io.Reader) (
 		}
 		partitionDir := ds.blobDirectory(pname, blobRef)
 
-		// Prevent the directory from being unlinked by
-		// enumerate code, which cleans up.
-		defer keepDirectoryLock(partitionDir).Unlock()
-		defer keepDirectoryLock(filepath.Dir(partitionDir)).Unlock()
-		defer keepDirectoryLock(filepath.Dir(filepath.Dir(partitionDir))).Unlock()
+		// Prevent the directory (and its parents down to the
+		// hash name's) from being unlinked by enumerate code,
+		// which cleans up.
+		defer ds.keepBlobDirs(partitionDir)()
 
 		if err = os.MkdirAll(partitionDir, 0700); err != nil {
 			return blobref.SizedBlobRef{}, fmt.Errorf("localdisk.receive: MkdirAll(%q) after lock on it: %v", partitionDir, err)
 		}
 		partitionFileName := ds.blobPath(pname, blobRef)
-		pfi, err := os.Stat(partitionFileName)
-		if err == nil && !pfi.IsDir() {
+		if fileName != rawName {
+			partitionFileName = compressedPath(partitionFileName, written)
+		}
+		// The blob may be in the partition under either codec.
+		if _, _, _, err := ds.findBlob(pname, blobRef); err == nil {
 			log.Printf("Skipped dup on partition %q", pname)
 		} else {
-			if err = linkOrCopy(fileName, partitionFileName); err != nil && !linkAlreadyExists(err) {
+			// Without hard links the file is copied in place, so
+			// keep listings out until it's whole.
+			entryLock := addEntryLock(partitionDir)
+			err = linkOrCopy(fileName, partitionFileName)
+			entryLock.Unlock()
+			if err != nil && !linkAlreadyExists(err) {
 				log.Fatalf("got link or copy error %T %#v", err, err)
 				return blobref.SizedBlobRef{}, err
 			}
+			if ds.Sync {
+				// The directory may well be new, as enumeration
+				// removes emptied queue directories.
+				if err := ds.syncDirs(partitionDir, ds.PartitionRoot(pname), true); err != nil {
+					return blobref.SizedBlobRef{}, err
+				}
+			}
 			log.Printf("Mirrored blob %s to partition %q", blobRef, pname)
 		}
 	}
 
-	blobGot = blobref.SizedBlobRef{BlobRef: blobRef, Size: stat.Size()}
+	blobGot = blobref.SizedBlobRef{BlobRef: blobRef, Size: written}
 	success = true
 
 	hub := ds.GetBlobHub()
 	hub.NotifyBlobReceived(blobRef)
+	ds.notifyChange(BlobReceived, blobGot)
 	for _, mirror := range ds.mirrorPartitions {
 		mirror.GetBlobHub().NotifyBlobReceived(blobRef)
+		mirror.notifyChange(BlobReceived, blobGot)
 	}
 	return
 }
 
+// syncDirs fsyncs dir, so entries added to it are durable. If
+// created is true, dir was just created, and so are its parents
+// up to root synced too.
+func (ds *DiskStorage) syncDirs(dir, root string, created bool) error {
+	for {
+		if err := syncDir(dir); err != nil {
+			return fmt.Errorf("localdisk: syncing directory %q: %v", dir, err)
+		}
+		if !created || dir == root || len(dir) <= len(root) {
+			return nil
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
 func linkAlreadyExists(err error) bool {
 	if os.IsExist(err) {
 		return true
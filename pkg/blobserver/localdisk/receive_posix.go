@@ -33,3 +33,13 @@ func linkOrCopy(src, dst string) error {
 	}
 	return err
 }
+
+// syncDir fsyncs the directory dir.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
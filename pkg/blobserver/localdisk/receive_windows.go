@@ -19,3 +19,8 @@ package localdisk
 func linkOrCopy(src, dst string) error {
 	return copyFile(src, dst)
 }
+
+// syncDir is a no-op: directories can't be synced on Windows.
+func syncDir(dir string) error {
+	return nil
+}
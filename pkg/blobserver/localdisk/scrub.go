@@ -0,0 +1,284 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/context"
+)
+
+// ScrubOptions are the options of a Scrub.
+type ScrubOptions struct {
+	// After, if non-empty, resumes a previous scrub: only blobs
+	// whose names sort after it are checked. It's usually the
+	// Last of the interrupted scrub's result.
+	After string
+
+	// BytesPerSecond, if positive, limits how fast blob contents
+	// are read, to leave the disk to other users.
+	BytesPerSecond int64
+}
+
+// A ScrubProblem is a bad file found by Scrub.
+type ScrubProblem struct {
+	Path    string
+	BlobRef *blobref.BlobRef // nil if the file's name isn't a blobref
+	Problem string
+}
+
+func (p ScrubProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Path, p.Problem)
+}
+
+// ScrubResult is what a Scrub found.
+type ScrubResult struct {
+	Checked int   // blob files read
+	Bytes   int64 // bytes read from them
+
+	// Corrupt lists blobs whose contents don't hash to their name.
+	Corrupt []ScrubProblem
+	// Misfiled lists blob files that aren't where a blob of their
+	// name belongs, or whose names aren't blobrefs, and so can't
+	// be fetched.
+	Misfiled []ScrubProblem
+
+	// Last is the name of the last blob checked, to pass as
+	// ScrubOptions.After to resume the scrub if it was stopped.
+	Last string
+}
+
+// OK reports whether the scrub found no problems.
+func (r *ScrubResult) OK() bool {
+	return len(r.Corrupt) == 0 && len(r.Misfiled) == 0
+}
+
+// Scrub reads all the blobs of ds's partition, in name order, and
+// reports those whose contents don't match their digest and blob
+// files that are misfiled. It only reports: nothing is modified.
+//
+// If ctx is done before all the blobs are checked, Scrub returns
+// what it found so far along with ctx's error.
+func (ds *DiskStorage) Scrub(ctx context.Context, opts ScrubOptions) (*ScrubResult, error) {
+	sc := &scrubber{
+		ds:    ds,
+		ctx:   ctx,
+		opts:  opts,
+		res:   new(ScrubResult),
+		start: time.Now(),
+	}
+	err := sc.scrubDir(ds.PartitionRoot(ds.partition), "", 0)
+	return sc.res, err
+}
+
+type scrubber struct {
+	ds    *DiskStorage
+	ctx   context.Context
+	opts  ScrubOptions
+	res   *ScrubResult
+	start time.Time
+}
+
+// scrubDir scrubs dir, which is depth levels under the partition
+// root and whose blob files' names start with blobPrefix.
+func (sc *scrubber) scrubDir(dir, blobPrefix string, depth int) error {
+	// As in readBlobs, keep RemoveBlobs from pruning the directory
+	// while we're in it.
+	defer keepDirectoryLock(dir).Unlock()
+	f, err := os.Open(dir)
+	if err != nil {
+		return &enumerateError{"localdisk: opening directory " + dir, err}
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return &enumerateError{"localdisk: readdirnames of " + dir, err}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := sc.ctx.Err(); err != nil {
+			return err
+		}
+		if depth == 0 && (name == "partition" || name == "cache") {
+			// Other partitions are scrubbed through their
+			// own DiskStorage; see readBlobs for "cache".
+			continue
+		}
+		fullPath := filepath.Join(dir, name)
+		fi, err := os.Lstat(fullPath)
+		if os.IsNotExist(err) {
+			// Removed since we listed it.
+			continue
+		}
+		if err != nil {
+			return &enumerateError{"localdisk: stat of file " + fullPath, err}
+		}
+		if fi.IsDir() {
+			newBlobPrefix := blobPrefix + name
+			if blobPrefix == "" {
+				newBlobPrefix = name + "-"
+			}
+			if sc.skipDir(newBlobPrefix) {
+				continue
+			}
+			if err := sc.scrubDir(fullPath, newBlobPrefix, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		blobName, size, compressed, ok := parseBlobFileName(name)
+		if !ok {
+			continue
+		}
+		if depth == 0 && blobref.Parse(blobName) == nil {
+			// The store's own files, e.g. LAYOUT.dat.
+			continue
+		}
+		if blobName <= sc.opts.After {
+			continue
+		}
+		if err := sc.scrubFile(fullPath, blobName, size, compressed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipDir reports whether a directory whose blob files' names start
+// with blobPrefix only holds blobs already scrubbed.
+func (sc *scrubber) skipDir(blobPrefix string) bool {
+	after := sc.opts.After
+	if after == "" {
+		return false
+	}
+	n := len(blobPrefix)
+	if len(after) < n {
+		n = len(after)
+	}
+	return blobPrefix[:n] < after[:n]
+}
+
+// scrubFile checks the blob file at path. If it's compressed, size
+// is the blob size its name records.
+func (sc *scrubber) scrubFile(path, blobName string, size int64, compressed bool) error {
+	res := sc.res
+	br := blobref.Parse(blobName)
+	if br == nil {
+		res.Misfiled = append(res.Misfiled, ScrubProblem{Path: path, Problem: "file name isn't a blobref"})
+		return nil
+	}
+	misfiled := false
+	want := sc.ds.blobPath(sc.ds.partition, br)
+	if compressed {
+		want = compressedPath(want, size)
+	}
+	if path != want {
+		misfiled = true
+		res.Misfiled = append(res.Misfiled, ScrubProblem{
+			Path:    path,
+			BlobRef: br,
+			Problem: "blob belongs in " + want,
+		})
+	}
+	h := br.Hash()
+	if h == nil {
+		res.Corrupt = append(res.Corrupt, ScrubProblem{Path: path, BlobRef: br, Problem: "unsupported digest type"})
+		return nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Removed since we listed it.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var n int64
+	if compressed {
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(f); err == nil {
+			n, err = io.Copy(h, zr)
+		}
+	} else {
+		n, err = io.Copy(h, f)
+	}
+	f.Close()
+	if compressed && isCorruptGzip(err) {
+		// A corrupt compressed file usually fails to
+		// uncompress rather than hashing wrong.
+		res.Checked++
+		res.Corrupt = append(res.Corrupt, ScrubProblem{
+			Path:    path,
+			BlobRef: br,
+			Problem: "bad compressed file: " + err.Error(),
+		})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("localdisk: reading %s: %v", path, err)
+	}
+	res.Checked++
+	res.Bytes += n
+	if !misfiled {
+		// Only blobs where they belong are visited in name
+		// order. Resuming may check misfiled ones again.
+		res.Last = blobName
+	}
+	if compressed && n != size {
+		res.Corrupt = append(res.Corrupt, ScrubProblem{
+			Path:    path,
+			BlobRef: br,
+			Problem: fmt.Sprintf("uncompresses to %d bytes; name says %d", n, size),
+		})
+	}
+	if !br.HashMatches(h) {
+		res.Corrupt = append(res.Corrupt, ScrubProblem{
+			Path:    path,
+			BlobRef: br,
+			Problem: fmt.Sprintf("contents hash to %x", h.Sum(nil)),
+		})
+	}
+	return sc.throttle()
+}
+
+// throttle sleeps as long as needed for the bytes read so far not
+// to exceed the BytesPerSecond option, or until ctx is done.
+func (sc *scrubber) throttle() error {
+	if sc.opts.BytesPerSecond <= 0 {
+		return nil
+	}
+	due := sc.start.Add(time.Duration(float64(sc.res.Bytes) / float64(sc.opts.BytesPerSecond) * float64(time.Second)))
+	d := due.Sub(time.Now())
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-sc.ctx.Done():
+		return sc.ctx.Err()
+	}
+}
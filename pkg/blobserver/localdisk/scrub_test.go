@@ -0,0 +1,123 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/context"
+	"camlistore.org/pkg/test"
+)
+
+func TestScrub(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+
+	foo := &test.Blob{"foo"}   // 0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33
+	bar := &test.Blob{"baar"}  // b23361951dde70cb3eca44c0c674181673a129dc
+	baz := &test.Blob{"bazzz"} // e0eb17003ce1c2812ca8f19089fff44ca32b3710
+	foo.MustUpload(t, ds)
+	bar.MustUpload(t, ds)
+	baz.MustUpload(t, ds)
+
+	res, err := ds.Scrub(context.Background(), ScrubOptions{})
+	if err != nil {
+		t.Fatalf("Scrub: %v", err)
+	}
+	if !res.OK() || res.Checked != 3 || res.Bytes != 12 {
+		t.Fatalf("Scrub of intact store = %+v; want 3 good blobs of 12 bytes", res)
+	}
+
+	// Corrupt bar, and put a copy of an intact blob and a file
+	// that isn't a blob where they don't belong.
+	if err := ioutil.WriteFile(ds.blobPath("", bar.BlobRef()), []byte("bear"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	qux := &test.Blob{"qux"}
+	sha1Dir := filepath.Join(ds.root, "sha1")
+	if err := ioutil.WriteFile(filepath.Join(sha1Dir, blobFileBaseName(qux.BlobRef())), []byte(qux.Contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sha1Dir, "junk.dat"), []byte("junk"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	before := fileContents(t, ds.blobPath("", bar.BlobRef()))
+
+	res, err = ds.Scrub(context.Background(), ScrubOptions{})
+	if err != nil {
+		t.Fatalf("Scrub: %v", err)
+	}
+	if len(res.Corrupt) != 1 || res.Corrupt[0].BlobRef.String() != bar.BlobRef().String() {
+		t.Errorf("Corrupt = %v; want just %v", res.Corrupt, bar.BlobRef())
+	}
+	if len(res.Misfiled) != 2 {
+		t.Fatalf("Misfiled = %v; want qux and junk.dat", res.Misfiled)
+	}
+	for _, p := range res.Misfiled {
+		if p.BlobRef == nil && filepath.Base(p.Path) != "junk.dat" ||
+			p.BlobRef != nil && p.BlobRef.String() != qux.BlobRef().String() {
+			t.Errorf("unexpected misfiled file %v", p)
+		}
+	}
+	if after := fileContents(t, ds.blobPath("", bar.BlobRef())); after != before {
+		t.Errorf("Scrub changed corrupt blob from %q to %q", before, after)
+	}
+
+	// Resuming after foo skips it.
+	res, err = ds.Scrub(context.Background(), ScrubOptions{After: foo.BlobRef().String()})
+	if err != nil {
+		t.Fatalf("resumed Scrub: %v", err)
+	}
+	if res.Checked != 3 || res.Last != baz.BlobRef().String() {
+		t.Errorf("resumed Scrub checked %d blobs up to %q; want 3 (bar, qux, baz) up to %v", res.Checked, res.Last, baz.BlobRef())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ds.Scrub(ctx, ScrubOptions{}); err != context.Canceled {
+		t.Errorf("Scrub with a canceled context = %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestScrubThrottle(t *testing.T) {
+	ds := NewStorage(t)
+	defer cleanUp(ds)
+	(&test.Blob{"foo"}).MustUpload(t, ds)
+
+	// 3 bytes at 1 byte/s would take 3s: cancelation has to
+	// interrupt the wait.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	res, err := ds.Scrub(ctx, ScrubOptions{BytesPerSecond: 1})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("throttled Scrub = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if res.Checked != 1 {
+		t.Errorf("throttled Scrub checked %d blobs before its deadline; want 1", res.Checked)
+	}
+}
+
+func fileContents(t *testing.T, path string) string {
+	slurp, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(slurp)
+}
@@ -35,10 +35,10 @@ func (ds *DiskStorage) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blob
 	var missing []*blobref.BlobRef
 
 	statSend := func(ref *blobref.BlobRef, appendMissing bool) error {
-		fi, err := os.Stat(ds.blobPath(ds.partition, ref))
+		_, _, size, err := ds.findBlob(ds.partition, ref)
 		switch {
-		case err == nil && !fi.IsDir():
-			dest <- blobref.SizedBlobRef{BlobRef: ref, Size: fi.Size()}
+		case err == nil:
+			dest <- blobref.SizedBlobRef{BlobRef: ref, Size: size}
 		case err != nil && appendMissing && os.IsNotExist(err):
 			missingLock.Lock()
 			missing = append(missing, ref)
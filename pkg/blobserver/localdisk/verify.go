@@ -0,0 +1,55 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package localdisk
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"log"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/types"
+)
+
+// verifyFailures counts the blobs VerifyOnRead found corrupt.
+var verifyFailures = expvar.NewInt("camli.localdisk.verify-failures")
+
+// verify checks that slurp, the contents of the blob br read from
+// the file named name, hash to br, or returns
+// blobserver.ErrCorruptBlob.
+func (ds *DiskStorage) verify(br *blobref.BlobRef, name string, slurp []byte) error {
+	h := br.Hash()
+	h.Write(slurp)
+	if !br.HashMatches(h) {
+		verifyFailures.Add(1)
+		log.Printf("localdisk: blob %v in %s is corrupt: its contents hash to %x", br, name, h.Sum(nil))
+		return blobserver.ErrCorruptBlob
+	}
+	return nil
+}
+
+// bytesBlob returns a blob's contents read in memory as returned by
+// Fetch.
+func bytesBlob(slurp []byte) types.ReadSeekCloser {
+	return struct {
+		*bytes.Reader
+		io.Closer
+	}{bytes.NewReader(slurp), ioutil.NopCloser(nil)}
+}
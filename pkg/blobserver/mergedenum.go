@@ -60,7 +60,7 @@ func MergedEnumerate(dest chan<- blobref.SizedBlobRef, sources []Storage, after
 				continue
 			}
 			sb := peeker.Peek() // can't be nil if not Closed
-			if lowestIdx == -1 || sb.BlobRef.String() < lowest.BlobRef.String() {
+			if lowestIdx == -1 || sb.BlobRef.Less(lowest.BlobRef) {
 				lowestIdx = idx
 				lowest = *sb
 			}
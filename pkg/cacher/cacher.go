@@ -78,6 +78,16 @@ func (cf *CachingFetcher) faultIn(br *blobref.BlobRef) error {
 	return err
 }
 
+// StorageCapacity returns the capacity of the storage behind the
+// fetcher cf is backed by, e.g. a blob server through pkg/client, or
+// a zero total, for unknown, if it doesn't report one.
+func (cf *CachingFetcher) StorageCapacity() (total, free int64, err error) {
+	if cr, ok := cf.sf.(blobserver.CapacityReporter); ok {
+		return cr.StorageCapacity()
+	}
+	return 0, 0, nil
+}
+
 // A DiskCache is a blobref.StreamingFetcher and blobref.SeekFetcher
 // that serves from a local temp directory and is backed by a another
 // blobref.StreamingFetcher (usually the pkg/client HTTP client).
@@ -122,4 +132,6 @@ var (
 	_ blobref.SeekFetcher      = (*CachingFetcher)(nil)
 	_ blobref.StreamingFetcher = (*DiskCache)(nil)
 	_ blobref.SeekFetcher      = (*DiskCache)(nil)
+
+	_ blobserver.CapacityReporter = (*DiskCache)(nil)
 )
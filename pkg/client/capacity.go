@@ -0,0 +1,52 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"camlistore.org/pkg/blobserver"
+)
+
+var _ blobserver.CapacityReporter = (*Client)(nil)
+
+// StorageCapacity asks the server for the size and free space of its
+// blob storage, in bytes. A zero total means the server's storage
+// doesn't know its capacity.
+func (c *Client) StorageCapacity() (total, free int64, err error) {
+	pfx, err := c.prefix()
+	if err != nil {
+		return 0, 0, err
+	}
+	req := c.newRequest("GET", pfx+"/camli/capacity")
+	res, err := c.doReqGated(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return 0, 0, fmt.Errorf("capacity request: HTTP response code is %d", res.StatusCode)
+	}
+	var cr struct {
+		Total, Free int64
+	}
+	if err := json.NewDecoder(res.Body).Decode(&cr); err != nil {
+		return 0, 0, fmt.Errorf("capacity request: %v", err)
+	}
+	return cr.Total, cr.Free, nil
+}
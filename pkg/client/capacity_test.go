@@ -0,0 +1,67 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/blobserver/handlers"
+	"camlistore.org/pkg/test"
+)
+
+// sizedStorage is a blob storage reporting a fixed capacity.
+type sizedStorage struct {
+	*test.Fetcher
+	total, free int64
+}
+
+func (s *sizedStorage) StorageCapacity() (total, free int64, err error) {
+	return s.total, s.free, nil
+}
+
+func TestStorageCapacity(t *testing.T) {
+	tests := []struct {
+		sto         blobserver.Storage
+		total, free int64
+	}{
+		{&sizedStorage{new(test.Fetcher), 1 << 30, 1 << 20}, 1 << 30, 1 << 20},
+		{new(test.Fetcher), 0, 0}, // unknown
+	}
+	for i, tt := range tests {
+		ts := httptest.NewServer(handlers.CreateCapacityHandler(tt.sto))
+		c := newRetryTestClient(ts.URL, http.DefaultTransport)
+		total, free, err := c.StorageCapacity()
+		ts.Close()
+		if err != nil {
+			t.Errorf("%d. StorageCapacity: %v", i, err)
+			continue
+		}
+		if total != tt.total || free != tt.free {
+			t.Errorf("%d. StorageCapacity = %d, %d; want %d, %d", i, total, free, tt.total, tt.free)
+		}
+	}
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	c := newRetryTestClient(ts.URL, http.DefaultTransport)
+	if _, _, err := c.StorageCapacity(); err == nil {
+		t.Errorf("StorageCapacity from a server without the handler succeeded")
+	}
+}
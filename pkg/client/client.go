@@ -95,6 +95,13 @@ type Client struct {
 	statsMutex sync.Mutex
 	stats      Stats
 
+	describeMu    sync.Mutex // guards following; see describecache.go
+	describeTTL   time.Duration
+	describeCache map[string]*describeCacheEntry // keyed by request URL suffix
+
+	retryMu sync.Mutex
+	retry   RetryPolicy // for signed blob uploads; see retry.go
+
 	// via maps the access path from a share root to a desired target.
 	// It is non-nil when in "sharing" mode, where the Client is fetching
 	// a share.
@@ -116,6 +123,7 @@ func New(server string) *Client {
 		httpClient: http.DefaultClient,
 		reqGate:    make(chan bool, maxParallelHTTP),
 		haveCache:  noHaveCache{},
+		retry:      DefaultRetryPolicy,
 	}
 }
 
@@ -399,7 +407,7 @@ func (c *Client) GetPermanodesWithAttr(req *search.WithAttrRequest) (*search.Wit
 	return res, nil
 }
 
-func (c *Client) Describe(req *search.DescribeRequest) (*search.DescribeResponse, error) {
+func (c *Client) GetClaims(req *search.ClaimsRequest) (*search.ClaimsResponse, error) {
 	sr, err := c.SearchRoot()
 	if err != nil {
 		return nil, err
@@ -411,10 +419,68 @@ func (c *Client) Describe(req *search.DescribeRequest) (*search.DescribeResponse
 		return nil, err
 	}
 	defer hres.Body.Close()
-	res := new(search.DescribeResponse)
+	res := new(search.ClaimsResponse)
+	if err := json.NewDecoder(hres.Body).Decode(res); err != nil {
+		return nil, err
+	}
+	if err := res.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetSignerPaths returns the camliPath links to req.Target made by
+// req.Signer, with descriptions of the permanodes linking it.
+func (c *Client) GetSignerPaths(req *search.SignerPathsRequest) (*search.SignerPathsResponse, error) {
+	sr, err := c.SearchRoot()
+	if err != nil {
+		return nil, err
+	}
+	url := sr + req.URLSuffix()
+	hreq := c.newRequest("GET", url)
+	hres, err := c.doReqGated(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hres.Body.Close()
+	if hres.StatusCode != 200 {
+		return nil, fmt.Errorf("client: got status code %d from URL %s", hres.StatusCode, url)
+	}
+	res := new(search.SignerPathsResponse)
+	if err := json.NewDecoder(hres.Body).Decode(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (c *Client) Describe(req *search.DescribeRequest) (*search.DescribeResponse, error) {
+	sr, err := c.SearchRoot()
+	if err != nil {
+		return nil, err
+	}
+	suffix := req.URLSuffix()
+	res, cached := c.cachedDescribe(suffix)
+	c.statsMutex.Lock()
+	c.stats.Describes++
+	if cached {
+		c.stats.DescribeCacheHits++
+	}
+	c.statsMutex.Unlock()
+	if cached {
+		return res, nil
+	}
+	url := sr + suffix
+	hreq := c.newRequest("GET", url)
+	hres, err := c.doReqGated(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hres.Body.Close()
+	res = new(search.DescribeResponse)
 	if err := json.NewDecoder(hres.Body).Decode(res); err != nil {
 		return nil, err
 	}
+	c.cacheDescribe(suffix, res)
 	return res, nil
 }
 
@@ -786,13 +852,25 @@ func (c *Client) initEntityFetcher() {
 	}
 }
 
+// A SigningError is returned by SignBlob, and so by the methods that
+// upload signed blobs, when the client has no key to sign with: none
+// is configured, or the secret ring can't be read or doesn't hold
+// it. It lets callers tell a credentials problem from a failure to
+// talk to the server, such as fetching the public key.
+type SigningError struct {
+	Err error
+}
+
+func (e *SigningError) Error() string {
+	return "client: can't sign: " + e.Err.Error()
+}
+
 // sigTime optionally specifies the signature time.
 // If zero, the current time is used.
 func (c *Client) SignBlob(bb schema.Buildable, sigTime time.Time) (string, error) {
 	camliSigBlobref := c.SignerPublicKeyBlobref()
 	if camliSigBlobref == nil {
-		// TODO: more helpful error message
-		return "", errors.New("No public key configured.")
+		return "", &SigningError{errors.New(`no signing key configured; have you run "camput init"?`)}
 	}
 
 	b := bb.Builder().SetSigner(camliSigBlobref).Blob()
@@ -807,7 +885,33 @@ func (c *Client) UploadAndSignBlob(b schema.AnyBlob) (*PutResult, error) {
 	if err != nil {
 		return nil, err
 	}
-	return c.uploadString(signed)
+	pr, err := c.uploadStringRetry(signed)
+	if err == nil {
+		c.invalidateDescribesForClaim(pr.BlobRef, signed)
+	}
+	return pr, err
+}
+
+// UploadAndSignBlobs is like UploadAndSignBlob for several blobs,
+// which are signed in order and then uploaded together, with
+// UploadMany. The results are in the order of bs.
+func (c *Client) UploadAndSignBlobs(bs []schema.AnyBlob) ([]*PutResult, error) {
+	signed := make([]string, len(bs))
+	for i, b := range bs {
+		s, err := c.SignBlob(b.Blob(), time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		signed[i] = s
+	}
+	prs, err := c.uploadStringsRetry(signed)
+	if err != nil {
+		return nil, err
+	}
+	for i, pr := range prs {
+		c.invalidateDescribesForClaim(pr.BlobRef, signed[i])
+	}
+	return prs, nil
 }
 
 func (c *Client) UploadBlob(b schema.AnyBlob) (*PutResult, error) {
@@ -831,5 +935,5 @@ func (c *Client) UploadPlannedPermanode(key string, sigTime time.Time) (*PutResu
 	if err != nil {
 		return nil, err
 	}
-	return c.uploadString(signed)
+	return c.uploadStringRetry(signed)
 }
@@ -0,0 +1,118 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"strings"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
+)
+
+// describeCacheEntry is a cached Describe response.
+type describeCacheEntry struct {
+	res     *search.DescribeResponse
+	expires time.Time
+}
+
+// SetDescribeCacheTTL makes Describe serve a request from memory
+// if the same request (same blobrefs and depth) was answered within
+// ttl. A claim uploaded with UploadAndSignBlob evicts the cached
+// responses describing its permanode; changes made by other clients
+// may go unseen for up to ttl. A ttl of zero, the default, disables
+// the cache.
+//
+// Responses served from the cache are shared, and must not be
+// modified.
+func (c *Client) SetDescribeCacheTTL(ttl time.Duration) {
+	c.describeMu.Lock()
+	defer c.describeMu.Unlock()
+	c.describeTTL = ttl
+	c.describeCache = nil
+}
+
+// cachedDescribe returns the cached response for the request with
+// URL suffix key, if any.
+func (c *Client) cachedDescribe(key string) (*search.DescribeResponse, bool) {
+	c.describeMu.Lock()
+	defer c.describeMu.Unlock()
+	e, ok := c.describeCache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.describeCache, key)
+		return nil, false
+	}
+	return e.res, true
+}
+
+func (c *Client) cacheDescribe(key string, res *search.DescribeResponse) {
+	c.describeMu.Lock()
+	defer c.describeMu.Unlock()
+	if c.describeTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	if c.describeCache == nil {
+		c.describeCache = make(map[string]*describeCacheEntry)
+	}
+	// Drop expired entries now and then, so the cache
+	// doesn't grow with requests never repeated.
+	if len(c.describeCache)%64 == 63 {
+		for k, e := range c.describeCache {
+			if now.After(e.expires) {
+				delete(c.describeCache, k)
+			}
+		}
+	}
+	c.describeCache[key] = &describeCacheEntry{res: res, expires: now.Add(c.describeTTL)}
+}
+
+// invalidateDescribes evicts the cached responses describing
+// pn, because a claim modifying it was uploaded.
+func (c *Client) invalidateDescribes(pn *blobref.BlobRef) {
+	c.describeMu.Lock()
+	defer c.describeMu.Unlock()
+	for k, e := range c.describeCache {
+		if _, ok := e.res.Meta[pn.String()]; ok {
+			delete(c.describeCache, k)
+		}
+	}
+}
+
+// invalidateDescribesForClaim calls invalidateDescribes for the
+// permanode modified by the signed claim JSON uploaded as br, if any.
+func (c *Client) invalidateDescribesForClaim(br *blobref.BlobRef, signed string) {
+	c.describeMu.Lock()
+	enabled := len(c.describeCache) > 0
+	c.describeMu.Unlock()
+	if !enabled {
+		return
+	}
+	b, err := schema.BlobFromReader(br, strings.NewReader(signed))
+	if err != nil {
+		return
+	}
+	if cl, ok := b.AsClaim(); ok {
+		if pn := cl.ModifiedPermanode(); pn != nil {
+			c.invalidateDescribes(pn)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/search"
+)
+
+var (
+	cachePn    = blobref.MustParse("sha1-0000000000000000000000000000000000000001")
+	cacheOther = blobref.MustParse("sha1-0000000000000000000000000000000000000002")
+)
+
+// newDescribeTestClient returns a client whose search root is a test
+// server answering every describe with a response about cachePn, and
+// a pointer to the number of requests the server got.
+func newDescribeTestClient(t *testing.T) (c *Client, hits *int32, done func()) {
+	hits = new(int32)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		fmt.Fprintf(w, `{"meta": {%q: {"blobRef": %q, "camliType": "permanode"}}}`, cachePn, cachePn)
+	}))
+	c = New(ts.URL)
+	c.authMode = auth.None{}
+	c.discoOnce.Do(func() {})
+	c.searchRoot = ts.URL + "/my-search/"
+	return c, hits, ts.Close
+}
+
+func TestDescribeCache(t *testing.T) {
+	c, hits, done := newDescribeTestClient(t)
+	defer done()
+
+	describe := func(br *blobref.BlobRef, depth int) {
+		res, err := c.Describe(&search.DescribeRequest{BlobRef: br, Depth: depth})
+		if err != nil {
+			t.Fatalf("Describe: %v", err)
+		}
+		if res.Meta[cachePn.String()] == nil {
+			t.Fatalf("Describe response missing %v: %+v", cachePn, res.Meta)
+		}
+	}
+	wantHits := func(want int32) {
+		if got := atomic.LoadInt32(hits); got != want {
+			t.Fatalf("server got %d describe requests; want %d", got, want)
+		}
+	}
+
+	describe(cachePn, 1)
+	describe(cachePn, 1)
+	wantHits(2) // cache off by default
+
+	c.SetDescribeCacheTTL(time.Hour)
+	describe(cachePn, 1)
+	describe(cachePn, 1)
+	wantHits(3)
+	describe(cachePn, 2) // different depth
+	wantHits(4)
+
+	c.invalidateDescribes(cacheOther)
+	describe(cachePn, 1)
+	wantHits(4)
+	c.invalidateDescribes(cachePn)
+	describe(cachePn, 1)
+	describe(cachePn, 2)
+	wantHits(6)
+
+	c.SetDescribeCacheTTL(time.Nanosecond)
+	describe(cachePn, 1)
+	time.Sleep(time.Millisecond)
+	describe(cachePn, 1)
+	wantHits(8)
+
+	if st := c.Stats(); st.Describes != 10 || st.DescribeCacheHits != 2 {
+		t.Errorf("Stats describes/cache hits = %d/%d; want 10/2", st.Describes, st.DescribeCacheHits)
+	}
+}
+
+func TestDescribeCacheClaimInvalidates(t *testing.T) {
+	c, hits, done := newDescribeTestClient(t)
+	defer done()
+	c.SetDescribeCacheTTL(time.Hour)
+
+	req := &search.DescribeRequest{BlobRef: cachePn}
+	if _, err := c.Describe(req); err != nil {
+		t.Fatal(err)
+	}
+	// Signature validity doesn't matter for invalidation, only
+	// that the blob parses as a claim.
+	claim := func(pn *blobref.BlobRef) string {
+		return fmt.Sprintf(`{"camliVersion": 1,
+"camliType": "claim",
+"camliSigner": "sha1-0000000000000000000000000000000000000003",
+"claimDate": "2013-01-02T03:04:05Z",
+"claimType": "set-attribute",
+"permaNode": %q,
+"attribute": "title",
+"value": "x"
+,"camliSig":"fake"}
+`, pn)
+	}
+	c.invalidateDescribesForClaim(blobref.SHA1FromString(claim(cacheOther)), claim(cacheOther))
+	c.Describe(req)
+	if got := atomic.LoadInt32(hits); got != 1 {
+		t.Fatalf("after unrelated claim, server got %d requests; want 1", got)
+	}
+	c.invalidateDescribesForClaim(blobref.SHA1FromString(claim(cachePn)), claim(cachePn))
+	c.Describe(req)
+	if got := atomic.LoadInt32(hits); got != 2 {
+		t.Fatalf("after claim on described permanode, server got %d requests; want 2", got)
+	}
+}
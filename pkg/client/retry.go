@@ -0,0 +1,123 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how UploadAndSignBlob, UploadAndSignBlobs
+// and UploadPlannedPermanode retry uploads which failed transiently,
+// such as on a network error or a 5xx response from the server.
+// Blobs are content-addressed, so uploading one twice is harmless.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including
+	// the first. Values below 2 disable retrying.
+	MaxAttempts int
+
+	// InitialDelay is the wait before the first retry. It
+	// doubles for each retry after that, up to MaxDelay.
+	// Each wait is jittered down by up to half.
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of new clients.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:  4,
+	InitialDelay: 250 * time.Millisecond,
+	MaxDelay:     5 * time.Second,
+}
+
+// SetRetryPolicy sets how signed blob uploads are retried.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retryMu.Lock()
+	defer c.retryMu.Unlock()
+	c.retry = p
+}
+
+func (c *Client) retryPolicy() RetryPolicy {
+	c.retryMu.Lock()
+	defer c.retryMu.Unlock()
+	return c.retry
+}
+
+// delay returns how long to wait before retry number n, starting at 1.
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := p.InitialDelay
+	for i := 1; i < n && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if half := int64(d / 2); half > 0 {
+		d -= time.Duration(rand.Int63n(half))
+	}
+	return d
+}
+
+// transientError wraps an upload error which may not recur.
+type transientError struct {
+	error
+}
+
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case transientError:
+		return true
+	case *HTTPError:
+		// A full server stays full.
+		return e.StatusCode >= 500 && e.StatusCode != StatusInsufficientStorage
+	}
+	return false
+}
+
+// uploadStringRetry is like uploadString, but retries transient
+// failures according to the client's retry policy.
+func (c *Client) uploadStringRetry(s string) (*PutResult, error) {
+	p := c.retryPolicy()
+	for n := 1; ; n++ {
+		pr, err := c.uploadString(s)
+		if err == nil || !isTransient(err) || n >= p.MaxAttempts {
+			return pr, err
+		}
+		d := p.delay(n)
+		c.log.Printf("client: upload attempt %d of %d failed, retrying in %v: %v", n, p.MaxAttempts, d, err)
+		time.Sleep(d)
+	}
+}
+
+// uploadStringsRetry is like uploadStringRetry for several blobs,
+// uploaded together with UploadMany.
+func (c *Client) uploadStringsRetry(ss []string) ([]*PutResult, error) {
+	p := c.retryPolicy()
+	for n := 1; ; n++ {
+		hs := make([]*UploadHandle, len(ss))
+		for i, s := range ss {
+			hs[i] = NewUploadHandleFromString(s)
+		}
+		prs, err := c.UploadMany(hs)
+		if err == nil || !isTransient(err) || n >= p.MaxAttempts {
+			return prs, err
+		}
+		d := p.delay(n)
+		c.log.Printf("client: upload attempt %d of %d failed, retrying in %v: %v", n, p.MaxAttempts, d, err)
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/auth"
+	"camlistore.org/pkg/blobref"
+)
+
+// flakyTransport fails the first fail round trips, then
+// passes requests on to http.DefaultTransport.
+type flakyTransport struct {
+	mu    sync.Mutex
+	fail  int
+	tries int
+}
+
+func (t *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.tries++
+	fail := t.tries <= t.fail
+	t.mu.Unlock()
+	if fail {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, errors.New("flaky network")
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newUploadServer returns a server answering stat and upload
+// requests as though every blob uploaded was new.
+func newUploadServer() *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/camli/stat":
+			fmt.Fprintf(w, `{"stat": [], "maxUploadSize": 1048576, "uploadUrl": %q, "uploadUrlExpirationSeconds": 7200}`,
+				ts.URL+"/camli/upload")
+		case "/camli/upload":
+			mr, err := r.MultipartReader()
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			var received []string
+			for {
+				part, err := mr.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					http.Error(w, err.Error(), 400)
+					return
+				}
+				body, _ := ioutil.ReadAll(part)
+				received = append(received, fmt.Sprintf(`{"blobRef": %q, "size": %d}`, part.FormName(), len(body)))
+			}
+			fmt.Fprintf(w, `{"received": [%s]}`, strings.Join(received, ", "))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return ts
+}
+
+func newRetryTestClient(url string, tr http.RoundTripper) *Client {
+	c := New(url)
+	c.authMode = auth.None{}
+	c.SetLogger(nil)
+	c.discoOnce.Do(func() {})
+	c.prefixOnce.Do(func() {})
+	c.prefixv = url
+	c.SetHTTPClient(&http.Client{Transport: tr})
+	return c
+}
+
+func TestUploadRetry(t *testing.T) {
+	ts := newUploadServer()
+	defer ts.Close()
+	const blob = `{"camliVersion": 1, "camliType": "permanode", "random": "x"}`
+	policy := RetryPolicy{MaxAttempts: 4, InitialDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+
+	tests := []struct {
+		fail      int
+		wantErr   bool
+		wantTries int
+	}{
+		{fail: 0, wantTries: 2}, // one stat, one upload
+		{fail: 3, wantTries: 5}, // succeeds on the last attempt
+		{fail: 4, wantErr: true, wantTries: 4},
+	}
+	for _, tt := range tests {
+		tr := &flakyTransport{fail: tt.fail}
+		c := newRetryTestClient(ts.URL, tr)
+		c.SetRetryPolicy(policy)
+		pr, err := c.uploadStringRetry(blob)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("fail=%d: no error", tt.fail)
+			}
+		} else if err != nil {
+			t.Errorf("fail=%d: %v", tt.fail, err)
+		} else if want := blobref.SHA1FromString(blob); pr.BlobRef.String() != want.String() {
+			t.Errorf("fail=%d: uploaded %v; want %v", tt.fail, pr.BlobRef, want)
+		}
+		if tr.tries != tt.wantTries {
+			t.Errorf("fail=%d: %d round trips; want %d", tt.fail, tr.tries, tt.wantTries)
+		}
+	}
+}
+
+func TestUploadNoRetry(t *testing.T) {
+	ts := newUploadServer()
+	defer ts.Close()
+	tr := &flakyTransport{fail: 1}
+	c := newRetryTestClient(ts.URL, tr)
+	c.SetRetryPolicy(RetryPolicy{})
+	if _, err := c.uploadStringRetry("foo"); err == nil {
+		t.Fatal("no error with retries disabled")
+	}
+	if tr.tries != 1 {
+		t.Errorf("%d round trips; want 1", tr.tries)
+	}
+}
+
+func TestUploadHTTPError(t *testing.T) {
+	for _, code := range []int{StatusInsufficientStorage, http.StatusForbidden} {
+		var tries int
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tries++
+			http.Error(w, "no", code)
+		}))
+		c := newRetryTestClient(ts.URL, http.DefaultTransport)
+		c.SetRetryPolicy(RetryPolicy{MaxAttempts: 4, InitialDelay: time.Millisecond})
+		_, err := c.uploadStringRetry("foo")
+		if he, ok := err.(*HTTPError); !ok || he.StatusCode != code {
+			t.Errorf("status %d: error = %#v; want an HTTPError with that status", code, err)
+		}
+		if tries != 1 {
+			t.Errorf("status %d: %d requests; want 1", code, tries)
+		}
+		ts.Close()
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := RetryPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for n, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if d := p.delay(n + 1); d > max || d < max/2 {
+				t.Fatalf("delay(%d) = %v; want in [%v, %v]", n+1, d, max/2, max)
+			}
+		}
+	}
+}
+
+// testHaveCache is a HaveCache in memory.
+type testHaveCache struct {
+	mu sync.Mutex
+	m  map[string]int64
+}
+
+func (c *testHaveCache) StatBlobCache(br *blobref.BlobRef) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size, ok := c.m[br.String()]
+	return size, ok
+}
+
+func (c *testHaveCache) NoteBlobExists(br *blobref.BlobRef, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]int64)
+	}
+	c.m[br.String()] = size
+}
+
+func TestUploadMany(t *testing.T) {
+	ts := newUploadServer()
+	defer ts.Close()
+	blobs := []string{"foo", "bar", "baz"}
+	for _, fail := range []int{0, 1} {
+		tr := &flakyTransport{fail: fail}
+		c := newRetryTestClient(ts.URL, tr)
+		c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialDelay: time.Millisecond})
+		c.SetHaveCache(new(testHaveCache))
+		c.haveCache.NoteBlobExists(blobref.SHA1FromString("bar"), 3)
+		prs, err := c.uploadStringsRetry(blobs)
+		if err != nil {
+			t.Fatalf("fail=%d: %v", fail, err)
+		}
+		for i, pr := range prs {
+			if want := blobref.SHA1FromString(blobs[i]); pr.BlobRef.String() != want.String() || pr.Size != 3 {
+				t.Errorf("fail=%d: result %d = %v, %d bytes; want %v, 3 bytes", fail, i, pr.BlobRef, pr.Size, want)
+			}
+			if want := blobs[i] == "bar"; pr.Skipped != want {
+				t.Errorf("fail=%d: %q skipped = %v; want %v", fail, blobs[i], pr.Skipped, want)
+			}
+		}
+		// One stat and one upload for both new blobs.
+		if want := fail + 2; tr.tries != want {
+			t.Errorf("fail=%d: %d round trips; want %d", fail, tr.tries, want)
+		}
+	}
+}
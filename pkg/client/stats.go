@@ -28,6 +28,12 @@ type Stats struct {
 	// The uploads which were actually sent to the blobserver
 	// due to the server not having the blobs
 	Uploads ByCountAndBytes
+
+	// Describes is the number of Describe calls, of which
+	// DescribeCacheHits were answered from the describe cache
+	// (see SetDescribeCacheTTL) without asking the server.
+	Describes         int
+	DescribeCacheHits int
 }
 
 func (s *Stats) String() string {
@@ -67,6 +67,24 @@ type statResponse struct {
 
 type ResponseFormatError error
 
+// StatusInsufficientStorage is the HTTP status of a server refusing
+// an upload for lack of space or quota.
+const StatusInsufficientStorage = 507
+
+// An HTTPError is returned by the upload methods when the server
+// answers with an unexpected HTTP status, so that callers can tell,
+// say, a full server (StatusInsufficientStorage) or a refused upload
+// (401 or 403) from other failures. Those with a status of 500 or
+// more, except StatusInsufficientStorage, are retried.
+type HTTPError struct {
+	StatusCode int
+	Msg        string
+}
+
+func (e *HTTPError) Error() string {
+	return e.Msg
+}
+
 func calculateMultipartOverhead() int64 {
 	var b bytes.Buffer
 	w := multipart.NewWriter(&b)
@@ -371,6 +389,18 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 		c.log.Print(err.Error())
 		return nil, err
 	}
+	// transientf is like errorf, for failures which may not
+	// happen again; see isTransient.
+	transientf := func(msg string, arg ...interface{}) (*PutResult, error) {
+		_, err := errorf(msg, arg...)
+		return nil, transientError{err}
+	}
+	// statusf is like errorf, for an unexpected HTTP status.
+	statusf := func(code int, msg string, arg ...interface{}) (*PutResult, error) {
+		err := &HTTPError{StatusCode: code, Msg: fmt.Sprintf(msg, arg...)}
+		c.log.Print(err.Error())
+		return nil, err
+	}
 
 	bodyReader, bodySize, err := readerAndSize(h)
 	if err != nil {
@@ -404,12 +434,12 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 
 	resp, err := c.doReqGated(req)
 	if err != nil {
-		return errorf("stat http error: %v", err)
+		return transientf("stat http error: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return errorf("stat response had http status %d", resp.StatusCode)
+		return statusf(resp.StatusCode, "stat response had http status %d", resp.StatusCode)
 	}
 
 	stat, err := parseStatResponse(resp.Body)
@@ -468,7 +498,7 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 	req.ContentLength = multipartOverhead + bodySize + int64(len(blobrefStr))*2
 	resp, err = c.doReqGated(req)
 	if err != nil {
-		return errorf("upload http error: %v", err)
+		return transientf("upload http error: %v", err)
 	}
 	defer resp.Body.Close()
 
@@ -479,7 +509,7 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 
 	// The only valid HTTP responses are 200 and 303.
 	if resp.StatusCode != 200 && resp.StatusCode != 303 {
-		return errorf("invalid http response %d in upload response", resp.StatusCode)
+		return statusf(resp.StatusCode, "invalid http response %d in upload response", resp.StatusCode)
 	}
 
 	if resp.StatusCode == 303 {
@@ -549,3 +579,149 @@ func (c *Client) Upload(h *UploadHandle) (*PutResult, error) {
 
 	return nil, errors.New("Server didn't receive blob.")
 }
+
+// UploadMany uploads the blobs of hs, whose sizes must be known,
+// with one stat request and one upload request for all those the
+// server doesn't have yet, or more if they don't fit in the
+// server's maximum upload size. The results are in the order of hs.
+// Vivify isn't supported.
+func (c *Client) UploadMany(hs []*UploadHandle) ([]*PutResult, error) {
+	res := make([]*PutResult, len(hs))
+	var need []int // indexes in hs of the blobs to stat
+	for i, h := range hs {
+		if h.Size < 0 || h.Vivify {
+			return nil, fmt.Errorf("client: UploadMany of %v: unknown size or Vivify set", h.BlobRef)
+		}
+		c.statsMutex.Lock()
+		c.stats.UploadRequests.Blobs++
+		c.stats.UploadRequests.Bytes += h.Size
+		c.statsMutex.Unlock()
+		res[i] = &PutResult{BlobRef: h.BlobRef, Size: h.Size}
+		if _, ok := c.haveCache.StatBlobCache(h.BlobRef); ok {
+			res[i].Skipped = true
+			continue
+		}
+		need = append(need, i)
+	}
+	if len(need) == 0 {
+		return res, nil
+	}
+
+	pfx, err := c.prefix()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{"camliversion": {"1"}}
+	for n, i := range need {
+		form.Set(fmt.Sprintf("blob%d", n+1), hs[i].BlobRef.String())
+	}
+	req := c.newRequest("POST", pfx+"/camli/stat", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.doReqGated(req)
+	if err != nil {
+		return nil, transientError{fmt.Errorf("stat http error: %v", err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Msg: fmt.Sprintf("stat response had http status %d", resp.StatusCode)}
+	}
+	stat, err := parseStatResponse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	for _, sbr := range stat.HaveMap {
+		c.haveCache.NoteBlobExists(sbr.BlobRef, sbr.Size)
+	}
+
+	var send []int // indexes in hs of the blobs to upload
+	for _, i := range need {
+		if _, ok := stat.HaveMap[hs[i].BlobRef.String()]; ok {
+			res[i].Skipped = true
+			continue
+		}
+		send = append(send, i)
+	}
+	for len(send) > 0 {
+		// As many as fit in one upload, but at least one.
+		n, size := 1, hs[send[0]].Size
+		for n < len(send) && size+hs[send[n]].Size <= stat.maxUploadSize {
+			size += hs[send[n]].Size
+			n++
+		}
+		if err := c.uploadParts(stat.uploadUrl, hs, send[:n]); err != nil {
+			return nil, err
+		}
+		send = send[n:]
+	}
+	return res, nil
+}
+
+// uploadParts uploads the blobs of hs at indexes idx in one
+// multipart request to uploadURL, as returned by a stat request.
+func (c *Client) uploadParts(uploadURL string, hs []*UploadHandle, idx []int) error {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, i := range idx {
+		h := hs[i]
+		part, err := mw.CreateFormFile(h.BlobRef.String(), h.BlobRef.String())
+		if err != nil {
+			return err
+		}
+		if n, err := io.Copy(part, h.Contents); err != nil {
+			return fmt.Errorf("client: reading %v: %v", h.BlobRef, err)
+		} else if n != h.Size {
+			return fmt.Errorf("client: %v is %d bytes; handle says %d", h.BlobRef, n, h.Size)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	if debugUploads {
+		log.Printf("Uploading %d blobs (%d bytes)", len(idx), body.Len())
+	}
+	req := c.newRequest("POST", uploadURL, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := c.doReqGated(req)
+	if err != nil {
+		return transientError{fmt.Errorf("upload http error: %v", err)}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return &HTTPError{StatusCode: resp.StatusCode, Msg: fmt.Sprintf("invalid http response %d in upload response", resp.StatusCode)}
+	}
+
+	var ures struct {
+		ErrorText string
+		Received  []struct {
+			BlobRef string
+			Size    int64
+		}
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 5<<20)).Decode(&ures); err != nil {
+		return fmt.Errorf("json parse from upload error: %v", err)
+	}
+	if ures.ErrorText != "" {
+		c.log.Printf("Blob server reports error: %s", ures.ErrorText)
+	}
+	got := make(map[string]int64, len(ures.Received))
+	for _, r := range ures.Received {
+		got[r.BlobRef] = r.Size
+	}
+	for _, i := range idx {
+		h := hs[i]
+		size, ok := got[h.BlobRef.String()]
+		if !ok {
+			return fmt.Errorf("Server didn't receive blob %v.", h.BlobRef)
+		}
+		if size != h.Size {
+			return fmt.Errorf("Server got blob %v, but reports wrong length (%v; we sent %d)", h.BlobRef, size, h.Size)
+		}
+		c.statsMutex.Lock()
+		c.stats.Uploads.Blobs++
+		c.stats.Uploads.Bytes += size
+		c.statsMutex.Unlock()
+		c.haveCache.NoteBlobExists(h.BlobRef, size)
+	}
+	return nil
+}
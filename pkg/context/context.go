@@ -0,0 +1,110 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package context lets the caller of a long-running operation cancel
+// it, or bound how long it may take.
+package context
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// A Context is passed to an operation to tell it when to give up.
+type Context interface {
+	// Done returns a channel closed once the operation should
+	// stop, or nil if it never needs to.
+	Done() <-chan struct{}
+
+	// Err returns why Done was closed: Canceled or
+	// DeadlineExceeded. It returns nil while Done is open.
+	Err() error
+}
+
+var (
+	// Canceled is the error of a Context whose CancelFunc was called.
+	Canceled = errors.New("context canceled")
+
+	// DeadlineExceeded is the error of a Context whose timeout passed.
+	DeadlineExceeded = errors.New("context deadline exceeded")
+)
+
+// A CancelFunc cancels its Context. Calls after the first do nothing.
+type CancelFunc func()
+
+type background struct{}
+
+func (background) Done() <-chan struct{} { return nil }
+func (background) Err() error            { return nil }
+
+// Background returns a Context which is never done.
+func Background() Context {
+	return background{}
+}
+
+type cancelCtx struct {
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+func (c *cancelCtx) Done() <-chan struct{} { return c.done }
+
+func (c *cancelCtx) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+func (c *cancelCtx) cancel(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+}
+
+// WithCancel returns a Context which is done once parent is, or once
+// the returned CancelFunc is called. The CancelFunc should be called
+// once the operation is over, to release its resources.
+func WithCancel(parent Context) (Context, CancelFunc) {
+	c := &cancelCtx{done: make(chan struct{})}
+	if pdone := parent.Done(); pdone != nil {
+		go func() {
+			select {
+			case <-pdone:
+				c.cancel(parent.Err())
+			case <-c.done:
+			}
+		}()
+	}
+	return c, func() { c.cancel(Canceled) }
+}
+
+// WithTimeout is like WithCancel, but the Context is also done, with
+// DeadlineExceeded, once d has passed.
+func WithTimeout(parent Context, d time.Duration) (Context, CancelFunc) {
+	ctx, cancel := WithCancel(parent)
+	c := ctx.(*cancelCtx)
+	t := time.AfterFunc(d, func() { c.cancel(DeadlineExceeded) })
+	return c, func() {
+		t.Stop()
+		cancel()
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package context
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackground(t *testing.T) {
+	ctx := Background()
+	if ctx.Done() != nil || ctx.Err() != nil {
+		t.Errorf("Background is done: %v", ctx.Err())
+	}
+}
+
+func TestWithCancel(t *testing.T) {
+	parent, cancelParent := WithCancel(Background())
+	ctx, cancel := WithCancel(parent)
+	defer cancel()
+	if err := ctx.Err(); err != nil {
+		t.Fatalf("Err before cancel = %v", err)
+	}
+	cancelParent()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("child not done after its parent was canceled")
+	}
+	if err := ctx.Err(); err != Canceled {
+		t.Errorf("Err = %v; want %v", err, Canceled)
+	}
+	cancel() // no effect once done
+	if err := ctx.Err(); err != Canceled {
+		t.Errorf("Err after a second cancel = %v; want %v", err, Canceled)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	ctx, cancel := WithTimeout(Background(), 10*time.Millisecond)
+	defer cancel()
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("not done after its timeout")
+	}
+	if err := ctx.Err(); err != DeadlineExceeded {
+		t.Errorf("Err = %v; want %v", err, DeadlineExceeded)
+	}
+
+	ctx, cancel = WithTimeout(Background(), time.Hour)
+	cancel()
+	if err := ctx.Err(); err != Canceled {
+		t.Errorf("Err after cancel = %v; want %v", err, Canceled)
+	}
+}
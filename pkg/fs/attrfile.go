@@ -0,0 +1,208 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// attrFileSuffix is appended to the name of an entry of a mutable
+// directory to look up its attrFile, when CamliFileSystem.AttrFiles
+// is set. On its own, it names the directory's attrFile.
+const attrFileSuffix = ".camli-attr"
+
+// editableAttr reports whether attr may be set through an attrFile.
+// The attributes the file system itself is built from can't be, as
+// changing them behind its back would corrupt its view of the tree.
+func editableAttr(attr string) bool {
+	switch attr {
+	case "camliContent", "camliSymlinkTarget", mtimeAttr, uidAttr, gidAttr, modeAttr:
+		return false
+	}
+	return !strings.HasPrefix(attr, "camliPath:") && !strings.HasPrefix(attr, xattrPrefix)
+}
+
+// attrFile implements fuse.Node and is a synthetic file giving
+// access to a permanode's attributes from the shell: reading it
+// lists them as "key=value" lines, and writing such lines sets
+// them, when the file is closed. An empty value deletes the
+// attribute.
+type attrFile struct {
+	fs        *CamliFileSystem
+	permanode *blobref.BlobRef
+	name      string // for logging
+}
+
+// attrFileOf returns the attrFile for name in n, which must end in
+// attrFileSuffix, or nil if there's no such entry. n.mu must be held.
+func (n *mutDir) attrFileOf(name string) *attrFile {
+	base := strings.TrimSuffix(name, attrFileSuffix)
+	f := &attrFile{fs: n.fs, name: filepath.Join(n.fullPath(), name)}
+	switch c := n.children[base].(type) {
+	case *mutDir:
+		f.permanode = c.permanode
+	case *mutFile:
+		f.permanode = c.permanode
+	default:
+		if base != "" {
+			return nil
+		}
+		f.permanode = n.permanode
+	}
+	return f
+}
+
+func (f *attrFile) Attr() fuse.Attr {
+	var mode os.FileMode = 0600
+	if f.fs.readOnly() {
+		mode = 0400
+	}
+	return fuse.Attr{
+		Mode: mode,
+		Uid:  uint32(os.Getuid()),
+		Gid:  uint32(os.Getgid()),
+	}
+}
+
+func (f *attrFile) Open(req *fuse.OpenRequest, res *fuse.OpenResponse, intr fuse.Intr) (fuse.Handle, fuse.Error) {
+	if f.fs.readOnly() && req.Flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return nil, fuse.EPERM
+	}
+	return &attrFileHandle{f: f}, nil
+}
+
+// Setattr accepts the truncation done when the shell opens the file
+// with ">", there being nothing to truncate.
+func (f *attrFile) Setattr(req *fuse.SetattrRequest, res *fuse.SetattrResponse, intr fuse.Intr) fuse.Error {
+	if f.fs.readOnly() {
+		return fuse.EPERM
+	}
+	res.AttrValid = f.fs.attrValid()
+	res.Attr = f.Attr()
+	return nil
+}
+
+// attrFileHandle is an open attrFile. It collects what's written to
+// it until it's flushed.
+type attrFileHandle struct {
+	f *attrFile
+
+	mu  sync.Mutex
+	buf bytes.Buffer // written, not yet applied
+}
+
+// ReadAll lists the current attributes of the permanode, sorted.
+func (h *attrFileHandle) ReadAll(intr fuse.Intr) ([]byte, fuse.Error) {
+	h.f.fs.uploadClaims()
+	res, err := h.f.fs.describe(&search.DescribeRequest{
+		BlobRef: h.f.permanode,
+		Depth:   1,
+	})
+	if err != nil {
+		h.f.fs.errorf("attrFile.ReadAll(%q): %v", h.f.name, err)
+		return nil, fuse.EIO
+	}
+	db := res.Meta[h.f.permanode.String()]
+	if db == nil || db.Permanode == nil {
+		h.f.fs.warnf("attrFile.ReadAll(%q): permanode %v not described", h.f.name, h.f.permanode)
+		return nil, fuse.EIO
+	}
+	var keys []string
+	for k := range db.Permanode.Attr {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, k := range keys {
+		for _, v := range db.Permanode.Attr[k] {
+			fmt.Fprintf(&buf, "%s=%s\n", k, v)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Write appends to the lines to apply. Offsets are ignored: the
+// file is a command channel, not storage.
+func (h *attrFileHandle) Write(req *fuse.WriteRequest, res *fuse.WriteResponse, intr fuse.Intr) fuse.Error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Write(req.Data)
+	res.Size = len(req.Data)
+	return nil
+}
+
+// Flush applies the lines written since the last flush. Nothing is
+// applied if any line is malformed (EINVAL) or names an attribute
+// that isn't editable (EPERM).
+func (h *attrFileHandle) Flush(req *fuse.FlushRequest, intr fuse.Intr) fuse.Error {
+	h.mu.Lock()
+	data := h.buf.String()
+	h.buf.Reset()
+	h.mu.Unlock()
+	if data == "" {
+		return nil
+	}
+
+	var claims []*schema.Builder
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			h.f.fs.warnf("attrFile(%q): malformed line %q", h.f.name, line)
+			return fuse.Errno(syscall.EINVAL)
+		}
+		key, value := strings.TrimSpace(line[:i]), line[i+1:]
+		if key == "" {
+			h.f.fs.warnf("attrFile(%q): malformed line %q", h.f.name, line)
+			return fuse.Errno(syscall.EINVAL)
+		}
+		if !editableAttr(key) {
+			h.f.fs.warnf("attrFile(%q): attribute %q isn't editable", h.f.name, key)
+			return fuse.EPERM
+		}
+		if value == "" {
+			claims = append(claims, schema.NewDelAttributeClaim(h.f.permanode, key))
+		} else {
+			claims = append(claims, schema.NewSetAttributeClaim(h.f.permanode, key, value))
+		}
+	}
+	for _, claim := range claims {
+		if err := h.f.fs.uploadClaim(claim); err != nil {
+			h.f.fs.errorf("attrFile(%q): %v", h.f.name, err)
+			return h.f.fs.uploadError(err)
+		}
+	}
+	return nil
+}
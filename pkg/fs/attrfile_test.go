@@ -0,0 +1,126 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// openAttrFile looks up name, which must be an attrFile, in dir
+// and opens it.
+func openAttrFile(t *testing.T, dir *mutDir, name string) *attrFileHandle {
+	n, err := dir.Lookup(name, nil)
+	if err != nil {
+		t.Fatalf("Lookup(%q): %v", name, err)
+	}
+	h, err := n.(*attrFile).Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", name, err)
+	}
+	return h.(*attrFileHandle)
+}
+
+func writeAttrFile(t *testing.T, h *attrFileHandle, data string) fuse.Error {
+	if err := h.Write(&fuse.WriteRequest{Data: []byte(data)}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return h.Flush(&fuse.FlushRequest{}, nil)
+}
+
+func TestAttrFile(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	newFileWithContent(t, dir, "file", "contents")
+	if _, err := dir.Lookup("file"+attrFileSuffix, nil); err != fuse.ENOENT {
+		t.Fatalf("Lookup of attr file with AttrFiles unset = %v; want ENOENT", err)
+	}
+	fs.AttrFiles = true
+	if _, err := dir.Lookup("nofile"+attrFileSuffix, nil); err != fuse.ENOENT {
+		t.Fatalf("Lookup of attr file of a missing entry = %v; want ENOENT", err)
+	}
+
+	h := openAttrFile(t, dir, "file"+attrFileSuffix)
+	if err := writeAttrFile(t, h, "tag=red\ntitle=My file\n"); err != nil {
+		t.Fatalf("setting attributes: %v", err)
+	}
+	data, err := h.ReadAll(nil)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	got := string(data)
+	for _, want := range []string{"tag=red\n", "title=My file\n", "camliContent="} {
+		if !strings.Contains(got, want) {
+			t.Errorf("attributes = %q; want a line %q", got, want)
+		}
+	}
+
+	if err := writeAttrFile(t, h, "tag=\n"); err != nil {
+		t.Fatalf("deleting an attribute: %v", err)
+	}
+	if data, _ := h.ReadAll(nil); strings.Contains(string(data), "tag=") {
+		t.Errorf("attributes after deleting tag = %q", data)
+	}
+
+	// The directory's own attributes.
+	dh := openAttrFile(t, dir, attrFileSuffix)
+	if err := writeAttrFile(t, dh, "title=Root\n"); err != nil {
+		t.Fatalf("setting the directory's attributes: %v", err)
+	}
+	if data, _ := dh.ReadAll(nil); !strings.Contains(string(data), "title=Root\n") {
+		t.Errorf("directory attributes = %q; want its title", data)
+	}
+}
+
+func TestAttrFileRejects(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	newFileWithContent(t, dir, "file", "contents")
+	fs.AttrFiles = true
+	h := openAttrFile(t, dir, "file"+attrFileSuffix)
+
+	tests := []struct {
+		data string
+		want fuse.Error
+	}{
+		{"camliContent=sha1-0000000000000000000000000000000000000000\n", fuse.EPERM},
+		{"camliPath:evil=sha1-0000000000000000000000000000000000000000\n", fuse.EPERM},
+		{mtimeAttr + "=2001-02-03T04:05:06Z\n", fuse.EPERM},
+		{"no equals sign\n", fuse.Errno(syscall.EINVAL)},
+		{"=value\n", fuse.Errno(syscall.EINVAL)},
+		// One bad line keeps the good ones from being applied too.
+		{"tag=red\ncamliContent=x\n", fuse.EPERM},
+	}
+	for _, tt := range tests {
+		before := fc.signedCount()
+		if err := writeAttrFile(t, h, tt.data); err != tt.want {
+			t.Errorf("writing %q = %v; want %v", tt.data, err, tt.want)
+		}
+		if n := fc.signedCount() - before; n != 0 {
+			t.Errorf("writing %q signed %d claims; want 0", tt.data, n)
+		}
+	}
+
+	fs.ReadOnly = true
+	n, _ := dir.Lookup("file"+attrFileSuffix, nil)
+	if _, err := n.(*attrFile).Open(&fuse.OpenRequest{Flags: syscall.O_WRONLY}, &fuse.OpenResponse{}, nil); err != fuse.EPERM {
+		t.Errorf("writable Open on a read-only mount = %v; want EPERM", err)
+	}
+}
@@ -0,0 +1,115 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/types"
+)
+
+// chunkCache is a blobref.SeekFetcher keeping the blobs most recently
+// fetched through it in memory, up to a total size. Files read
+// through the file system fetch their schema and chunk blobs through
+// it, so re-reading a file doesn't go back to the blob server.
+// Blobs being immutable, entries never go stale.
+type chunkCache struct {
+	fetcher  blobref.SeekFetcher
+	maxBytes int64
+
+	mu    sync.Mutex
+	ll    *list.List               // of *chunkEntry, most recent first
+	m     map[string]*list.Element // blobref string -> element in ll
+	bytes int64                    // total size of the cached blobs
+}
+
+type chunkEntry struct {
+	br   string
+	data []byte
+}
+
+func newChunkCache(fetcher blobref.SeekFetcher, maxBytes int64) *chunkCache {
+	return &chunkCache{
+		fetcher:  fetcher,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		m:        make(map[string]*list.Element),
+	}
+}
+
+func (c *chunkCache) Fetch(br *blobref.BlobRef) (types.ReadSeekCloser, int64, error) {
+	if data, ok := c.get(br.String()); ok {
+		chunkCacheHit.Incr()
+		return readSeekNopCloser{bytes.NewReader(data)}, int64(len(data)), nil
+	}
+	chunkCacheMiss.Incr()
+	rsc, size, err := c.fetcher.Fetch(br)
+	if err != nil || size > c.maxBytes {
+		return rsc, size, err
+	}
+	defer rsc.Close()
+	data, err := ioutil.ReadAll(rsc)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.add(br.String(), data)
+	return readSeekNopCloser{bytes.NewReader(data)}, int64(len(data)), nil
+}
+
+func (c *chunkCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*chunkEntry).data, true
+}
+
+// add caches data as the blob key, evicting the least recently used
+// blobs as needed to stay within maxBytes.
+func (c *chunkCache) add(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.m[key]; ok {
+		// Fetched concurrently by another reader.
+		return
+	}
+	c.m[key] = c.ll.PushFront(&chunkEntry{key, data})
+	c.bytes += int64(len(data))
+	for c.bytes > c.maxBytes {
+		e := c.ll.Back()
+		ce := e.Value.(*chunkEntry)
+		c.ll.Remove(e)
+		delete(c.m, ce.br)
+		c.bytes -= int64(len(ce.data))
+	}
+}
+
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error { return nil }
@@ -0,0 +1,155 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/test"
+	"camlistore.org/pkg/types"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// countingFetcher counts the fetches made through it.
+type countingFetcher struct {
+	blobref.SeekFetcher
+
+	mu    sync.Mutex
+	n     int
+	delay time.Duration // added to each fetch, as a server's latency
+}
+
+func (f *countingFetcher) Fetch(br *blobref.BlobRef) (types.ReadSeekCloser, int64, error) {
+	f.mu.Lock()
+	f.n++
+	delay := f.delay
+	f.mu.Unlock()
+	time.Sleep(delay)
+	return f.SeekFetcher.Fetch(br)
+}
+
+func (f *countingFetcher) fetches() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.n
+}
+
+// newCountingFS returns a file system with a chunk cache of
+// cacheBytes (if positive), whose fetches are counted, and a file in
+// it of size bytes.
+func newCountingFS(t testing.TB, cacheBytes int64, size int) (*countingFetcher, *mutFile) {
+	fs, _, dir := newFakeFS(t)
+	cf := &countingFetcher{SeekFetcher: fs.fetcher}
+	fs.fetcher = cf
+	fs.ChunkCacheBytes = cacheBytes
+	contents := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(contents)
+	return cf, newFileWithContent(t, dir, "file", string(contents))
+}
+
+// readFile reads all of mf through a read-only handle.
+func readFile(t testing.TB, mf *mutFile) []byte {
+	h, err := mf.Open(&fuse.OpenRequest{}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	nr := h.(*nodeReader)
+	defer nr.Release(&fuse.ReleaseRequest{}, nil)
+	var data []byte
+	for off := int64(0); off < nr.fr.Size(); {
+		res := &fuse.ReadResponse{}
+		if err := nr.Read(&fuse.ReadRequest{Offset: off, Size: 64 << 10}, res, nil); err != nil {
+			t.Fatalf("Read at %d: %v", off, err)
+		}
+		data = append(data, res.Data...)
+		off += int64(len(res.Data))
+	}
+	return data
+}
+
+func TestChunkCache(t *testing.T) {
+	cf, mf := newCountingFS(t, 8<<20, 1<<20)
+	first := readFile(t, mf)
+	n := cf.fetches()
+	if n == 0 {
+		t.Fatal("first read fetched nothing")
+	}
+	if again := readFile(t, mf); string(again) != string(first) {
+		t.Fatalf("re-read got %d different bytes", len(again))
+	}
+	if n2 := cf.fetches(); n2 != n {
+		t.Errorf("re-read with the chunk cache fetched %d more blobs; want 0", n2-n)
+	}
+}
+
+func TestChunkCacheEvicts(t *testing.T) {
+	src := new(test.Fetcher)
+	var blobs []*test.Blob
+	for _, s := range []string{"aaaa", "bbbb", "cccc"} {
+		tb := &test.Blob{s}
+		src.AddBlob(tb)
+		blobs = append(blobs, tb)
+	}
+	cf := &countingFetcher{SeekFetcher: src}
+	c := newChunkCache(cf, 8)
+	fetch := func(tb *test.Blob) {
+		rsc, _, err := c.Fetch(tb.BlobRef())
+		if err != nil {
+			t.Fatalf("Fetch(%v): %v", tb.BlobRef(), err)
+		}
+		rsc.Close()
+	}
+	fetch(blobs[0])
+	fetch(blobs[1])
+	fetch(blobs[0]) // now the most recently used
+	fetch(blobs[2]) // evicts blobs[1]
+	if c.bytes != 8 || c.ll.Len() != 2 {
+		t.Errorf("cache holds %d blobs of %d bytes; want 2 of 8", c.ll.Len(), c.bytes)
+	}
+	n := cf.fetches()
+	fetch(blobs[0])
+	if cf.fetches() != n {
+		t.Errorf("recently used blob was evicted")
+	}
+	fetch(blobs[1])
+	if cf.fetches() != n+1 {
+		t.Errorf("least recently used blob wasn't evicted")
+	}
+}
+
+func benchmarkReRead(b *testing.B, cacheBytes int64) {
+	cf, mf := newCountingFS(b, cacheBytes, 1<<20)
+	readFile(b, mf)
+	n := cf.fetches()
+	b.SetBytes(1 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		readFile(b, mf)
+	}
+	b.StopTimer()
+	b.Logf("%d re-reads: %.1f fetches per read", b.N, float64(cf.fetches()-n)/float64(b.N))
+}
+
+func BenchmarkReReadUncached(b *testing.B) { benchmarkReRead(b, 0) }
+func BenchmarkReReadCached(b *testing.B)   { benchmarkReRead(b, 8<<20) }
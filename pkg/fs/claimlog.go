@@ -0,0 +1,209 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+// A claim log is a write-ahead log of the claims a mount uploads, so
+// that those a crash keeps from reaching the server, e.g. the
+// camliContent claim of a file whose contents were just stored, are
+// uploaded when it's mounted again rather than lost, leaving the
+// contents unreferenced.
+//
+// Each claim is appended to the log, unsigned, before it's uploaded,
+// and marked done once the server has it. Claims uploaded directly
+// are marked done if their upload fails too, as the operation
+// making them fails; claims queued per ClaimBatchWindow whose batch
+// fails are left pending, as their operations succeeded. The log is
+// emptied whenever no claim is pending.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+)
+
+// claimLog is the open claim log of a CamliFileSystem.
+type claimLog struct {
+	mu      sync.Mutex
+	f       *os.File // opened for appending
+	next    int64    // id of the next claim logged
+	pending int      // claims logged and not done
+}
+
+// claimLogEntry is a line of a claim log: a claim to upload, or,
+// without one, the id of a claim that's done.
+type claimLogEntry struct {
+	ID    int64  `json:"id"`
+	Claim string `json:"claim,omitempty"` // unsigned JSON
+}
+
+// OpenClaimLog uploads the claims left pending in the claim log at
+// path by a mount that didn't finish uploading them, and then logs
+// the claims made by fs there. It's meant to be called once, before
+// fs is served. A log must not be used by two mounts at once.
+func (fs *CamliFileSystem) OpenClaimLog(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	claims, err := readClaimLog(f)
+	if err == nil && len(claims) > 0 {
+		err = fs.replayClaims(claims)
+	}
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("fs: claim log %s: %v", path, err)
+	}
+	fs.claimLog = &claimLog{f: f, next: 1}
+	return nil
+}
+
+// readClaimLog returns the claims pending in the log f, in the order
+// they were logged. A last line cut short by a crash is ignored.
+func readClaimLog(f *os.File) ([]schema.AnyBlob, error) {
+	pending := make(map[int64]string)
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		var e claimLogEntry
+		if json.Unmarshal(line, &e) == nil {
+			if e.Claim == "" {
+				delete(pending, e.ID)
+			} else {
+				pending[e.ID] = e.Claim
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var ids []int64
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	sort.Sort(int64Slice(ids))
+	var claims []schema.AnyBlob
+	for _, id := range ids {
+		s := pending[id]
+		b, err := schema.BlobFromReader(blobref.SHA1FromString(s), strings.NewReader(s))
+		if err != nil {
+			return nil, fmt.Errorf("bad claim %d: %v", id, err)
+		}
+		claims = append(claims, b)
+	}
+	return claims, nil
+}
+
+// replayClaims uploads claims, in order. Those uploaded already,
+// before their done entries were logged, are uploaded again; as
+// their claim dates are kept, that changes nothing.
+func (fs *CamliFileSystem) replayClaims(claims []schema.AnyBlob) error {
+	for len(claims) > 0 {
+		n := len(claims)
+		if n > maxClaimBatch {
+			n = maxClaimBatch
+		}
+		if _, err := fs.uploadClient().UploadAndSignBlobs(claims[:n]); err != nil {
+			return err
+		}
+		claimLogReplayed.Add(int64(n))
+		claims = claims[n:]
+	}
+	return nil
+}
+
+// logClaim logs claim as pending, and returns its id, or 0 if fs has no
+// claim log. The log is synced, so the claim survives a crash.
+func (fs *CamliFileSystem) logClaim(claim schema.AnyBlob) (int64, error) {
+	l := fs.claimLog
+	if l == nil {
+		return 0, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	id := l.next
+	if err := l.write(claimLogEntry{ID: id, Claim: claim.Blob().JSON()}); err != nil {
+		return 0, err
+	}
+	if err := l.f.Sync(); err != nil {
+		return 0, fmt.Errorf("fs: syncing claim log: %v", err)
+	}
+	l.next++
+	l.pending++
+	return id, nil
+}
+
+// claimsDone marks the logged claims ids as uploaded. Ids of 0, for
+// claims made without a claim log, are skipped. Failures are only
+// logged: the claims are then uploaded again by the next mount.
+func (fs *CamliFileSystem) claimsDone(ids ...int64) {
+	l := fs.claimLog
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range ids {
+		if id == 0 {
+			continue
+		}
+		if err := l.write(claimLogEntry{ID: id}); err != nil {
+			fs.errorf("%v", err)
+			return
+		}
+		l.pending--
+	}
+	if l.pending == 0 {
+		// Nothing to replay; don't let the log grow.
+		if err := l.f.Truncate(0); err != nil {
+			fs.warnf("fs: truncating claim log: %v", err)
+		}
+	}
+}
+
+// write appends e to the log. l.mu must be held.
+func (l *claimLog) write(e claimLogEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := l.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("fs: writing claim log: %v", err)
+	}
+	return nil
+}
+
+type int64Slice []int64
+
+func (s int64Slice) Len() int           { return len(s) }
+func (s int64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
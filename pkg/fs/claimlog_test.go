@@ -0,0 +1,113 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestClaimLogReplay(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "camli-claimlog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "claims")
+
+	fs, fc, dir := newFakeFS(t)
+	if err := fs.OpenClaimLog(path); err != nil {
+		t.Fatalf("OpenClaimLog: %v", err)
+	}
+	// Queued claims stand for those a crash keeps from being
+	// uploaded: the contents are stored, but not the claims
+	// linking them into the tree.
+	fs.ClaimBatchWindow = time.Hour
+	const contents = "some contents"
+	_, h, ferr := dir.Create(&fuse.CreateRequest{Name: "file", Flags: syscall.O_WRONLY | syscall.O_CREAT, Mode: 0644}, &fuse.CreateResponse{}, nil)
+	if ferr != nil {
+		t.Fatalf("Create: %v", ferr)
+	}
+	w := h.(*mutFileHandle)
+	if err := w.Write(&fuse.WriteRequest{Data: []byte(contents)}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	fs.claimLog.f.Close() // the crash
+
+	// Mounting again.
+	fs2 := newCamliFileSystem(fs.fetcher)
+	fs2.client = fc
+	lookup := func() (fuse.Node, fuse.Error) {
+		cold := &mutDir{fs: fs2, permanode: dir.permanode, name: "cold"}
+		return cold.Lookup("file", nil)
+	}
+	if _, err := lookup(); err != fuse.ENOENT {
+		t.Fatalf("before replaying, Lookup = %v; want ENOENT", err)
+	}
+	// A line cut short by the crash.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":100,"claim":"{\"camliVer`)
+	f.Close()
+	if err := fs2.OpenClaimLog(path); err != nil {
+		t.Fatalf("OpenClaimLog replaying: %v", err)
+	}
+	n, ferr := lookup()
+	if ferr != nil {
+		t.Fatalf("after replaying, Lookup: %v", ferr)
+	}
+	if got := storedContents(t, n.(*mutFile)); got != contents {
+		t.Errorf("after replaying, contents = %q; want %q", got, contents)
+	}
+	checkLogEmpty(t, path)
+
+	// Claims uploaded aren't replayed.
+	newFileWithContent(t, &mutDir{fs: fs2, permanode: dir.permanode, name: "root"}, "file2", "more")
+	checkLogEmpty(t, path)
+	signed := fc.signedCount()
+	fs3 := newCamliFileSystem(fs.fetcher)
+	fs3.client = fc
+	if err := fs3.OpenClaimLog(path); err != nil {
+		t.Fatalf("OpenClaimLog: %v", err)
+	}
+	if n := fc.signedCount() - signed; n != 0 {
+		t.Errorf("reopening a log with nothing pending signed %d claims", n)
+	}
+}
+
+func checkLogEmpty(t *testing.T, path string) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 0 {
+		t.Errorf("claim log is %d bytes; want it emptied", fi.Size())
+	}
+}
@@ -0,0 +1,139 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/schema"
+)
+
+const (
+	// maxClaimBatch is the most claims uploaded in one batch.
+	maxClaimBatch = 100
+
+	// maxQueuedClaims is the most claims waiting to be uploaded
+	// before queueing more waits for them.
+	maxQueuedClaims = 10 * maxClaimBatch
+)
+
+// claimQueue holds the claims waiting to be uploaded in batches,
+// per CamliFileSystem.ClaimBatchWindow.
+//
+// Claims are uploaded in the order they were queued. Their claim
+// dates are set when they're made, so the server orders them the
+// same whether they're uploaded in a batch or one at a time.
+type claimQueue struct {
+	uploadMu sync.Mutex // held while uploading, so batches go in order
+
+	mu      sync.Mutex
+	pending []schema.AnyBlob
+	logIDs  []int64     // pending's ids in the claim log; see claimlog.go
+	timer   *time.Timer // pending upload after ClaimBatchWindow, or nil
+	err     error       // first failed upload since the last flush
+}
+
+// uploadClaim signs and uploads claim, or, if ClaimBatchWindow is
+// set, queues it to be uploaded in the background with those made
+// soon after. A queued claim's failure is logged, and returned by
+// the next flushClaims.
+func (fs *CamliFileSystem) uploadClaim(claim schema.AnyBlob) error {
+	id, err := fs.logClaim(claim)
+	if err != nil {
+		return err
+	}
+	if fs.ClaimBatchWindow <= 0 {
+		_, err := fs.uploadClient().UploadAndSignBlob(claim)
+		fs.claimsDone(id)
+		return err
+	}
+	q := &fs.claims
+	q.mu.Lock()
+	q.pending = append(q.pending, claim)
+	q.logIDs = append(q.logIDs, id)
+	n := len(q.pending)
+	if n >= maxClaimBatch {
+		if q.timer != nil {
+			q.timer.Stop()
+			q.timer = nil
+		}
+	} else if q.timer == nil {
+		q.timer = time.AfterFunc(fs.ClaimBatchWindow, func() { fs.uploadClaims() })
+	}
+	q.mu.Unlock()
+	switch {
+	case n >= maxQueuedClaims:
+		// Uploads are falling behind; wait for them.
+		fs.uploadClaims()
+	case n >= maxClaimBatch:
+		go fs.uploadClaims()
+	}
+	return nil
+}
+
+// uploadClaims uploads the queued claims, after those being
+// uploaded already. Operations which read what claims set, such as
+// listing a directory, call it first, so they see the changes made
+// on this file system; errors are left for FlushClaims to return.
+func (fs *CamliFileSystem) uploadClaims() {
+	q := &fs.claims
+	q.uploadMu.Lock()
+	defer q.uploadMu.Unlock()
+	q.mu.Lock()
+	claims, ids := q.pending, q.logIDs
+	q.pending, q.logIDs = nil, nil
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	q.mu.Unlock()
+	for len(claims) > 0 {
+		n := len(claims)
+		if n > maxClaimBatch {
+			n = maxClaimBatch
+		}
+		claimBatchUpload.Incr()
+		if _, err := fs.uploadClient().UploadAndSignBlobs(claims[:n]); err != nil {
+			fs.errorf("fs: uploading %d queued claims: %v", n, err)
+			q.mu.Lock()
+			if q.err == nil {
+				q.err = err
+			}
+			q.mu.Unlock()
+		} else {
+			fs.claimsDone(ids[:n]...)
+		}
+		claims, ids = claims[n:], ids[n:]
+	}
+}
+
+// FlushClaims uploads the claims queued per ClaimBatchWindow, and
+// returns the first error uploading any queued claim since the
+// last flush. It's a no-op if ClaimBatchWindow isn't set. Fsync
+// flushes too, and so should unmounting.
+func (fs *CamliFileSystem) FlushClaims() error {
+	fs.uploadClaims()
+	q := &fs.claims
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	err := q.err
+	q.err = nil
+	return err
+}
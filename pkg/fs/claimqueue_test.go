@@ -0,0 +1,123 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestClaimBatching(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	fs.ClaimBatchWindow = time.Hour
+	const n = 20
+	signed := fc.signedCount()
+	for i := 0; i < n; i++ {
+		if _, err := dir.creat(fmt.Sprintf("file%d", i), fileType); err != nil {
+			t.Fatalf("creat: %v", err)
+		}
+	}
+	// Only the permanodes are uploaded right away.
+	if got := fc.signedCount() - signed; got != n {
+		t.Errorf("signed %d blobs before the window ended; want %d permanodes", got, n)
+	}
+	if err := dir.Remove(&fuse.RemoveRequest{Name: "file0"}, nil); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	// Listing from the same mount uploads the queued claims first.
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	ents, err := cold.ReadDir(nil)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(ents) != n-1 {
+		t.Errorf("ReadDir = %d entries; want %d", len(ents), n-1)
+	}
+	if _, err := cold.Lookup("file0", nil); err != fuse.ENOENT {
+		t.Errorf("Lookup of removed file = %v; want ENOENT", err)
+	}
+	fc.mu.Lock()
+	batches := fc.batches
+	fc.mu.Unlock()
+	if batches != 1 {
+		t.Errorf("claims uploaded in %d batches; want 1", batches)
+	}
+}
+
+func TestClaimBatchWindow(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	fs.ClaimBatchWindow = 10 * time.Millisecond
+	if _, err := dir.creat("file", fileType); err != nil {
+		t.Fatalf("creat: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fc.mu.Lock()
+		batches := fc.batches
+		fc.mu.Unlock()
+		if batches > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("queued claims not uploaded after 5s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestClaimQueueErrors(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	fs.ClaimBatchWindow = time.Hour
+	mf := newFileWithContent(t, dir, "file", "contents")
+
+	fc.failUploads(errors.New("server down"))
+	if err := mf.storeMtime(time.Now()); err != nil {
+		t.Fatalf("storeMtime with a queue = %v; want the failure left for later", err)
+	}
+	if err := dir.Fsync(&fuse.FsyncRequest{Dir: true}, nil); err != fuse.EIO {
+		t.Errorf("Fsync with a failed claim = %v; want EIO", err)
+	}
+	fc.failUploads(nil)
+	if err := dir.Fsync(&fuse.FsyncRequest{Dir: true}, nil); err != nil {
+		t.Errorf("Fsync after reporting the failure = %v; want nil", err)
+	}
+}
+
+// benchmarkUntar creates small files as fast as it can, as untarring
+// would, on a server taking a millisecond per upload request.
+func benchmarkUntar(b *testing.B, window time.Duration) {
+	fs, fc, dir := newFakeFS(b)
+	fs.ClaimBatchWindow = window
+	fc.uploadDelay = time.Millisecond
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newFileWithContent(b, dir, fmt.Sprintf("file%d", i), "contents")
+	}
+	if err := fs.FlushClaims(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkUntarUnbatched(b *testing.B) { benchmarkUntar(b, 0) }
+func BenchmarkUntarBatched(b *testing.B)   { benchmarkUntar(b, 10*time.Millisecond) }
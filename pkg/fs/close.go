@@ -0,0 +1,152 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"camlistore.org/pkg/context"
+)
+
+// openFiles tracks the shared temporary files of the files open for
+// writing, for Close to commit.
+type openFiles struct {
+	mu     sync.Mutex
+	closed bool // Close was called
+	files  map[*sharedBacking]*mutFile
+}
+
+func (o *openFiles) add(b *sharedBacking, n *mutFile) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.files == nil {
+		o.files = make(map[*sharedBacking]*mutFile)
+	}
+	o.files[b] = n
+}
+
+func (o *openFiles) remove(b *sharedBacking) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.files, b)
+}
+
+// readOnly reports whether changes are refused: ReadOnly is set, or
+// fs was closed.
+func (fs *CamliFileSystem) readOnly() bool {
+	if fs.ReadOnly {
+		return true
+	}
+	fs.open.mu.Lock()
+	defer fs.open.mu.Unlock()
+	return fs.open.closed
+}
+
+// Close commits the contents of the files still open for writing,
+// as their last handles' release would, uploads the queued claims,
+// and closes the claim log, so nothing written is lost if fs is
+// unmounted before the kernel releases every handle. From the time
+// it's called, changes are refused as with ReadOnly, and the handles
+// left open can't be read or written any more.
+//
+// If ctx is done first, Close returns ctx's error, and finishes in
+// the background. Closing fs again does nothing.
+func (fs *CamliFileSystem) Close(ctx context.Context) error {
+	fs.open.mu.Lock()
+	if fs.open.closed {
+		fs.open.mu.Unlock()
+		return nil
+	}
+	fs.open.closed = true
+	files := fs.open.files
+	fs.open.files = nil
+	fs.open.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fs.close(files)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close does the work of Close, returning the first error.
+func (fs *CamliFileSystem) close(files map[*sharedBacking]*mutFile) error {
+	var firstErr error
+	for b, n := range files {
+		if err := n.commitOnClose(b); err != nil {
+			fs.errorf("fs: Close: storing %q: %v", n.fullPath(), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if err := fs.FlushClaims(); err != nil {
+		fs.errorf("fs: Close: uploading queued claims: %v", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if l := fs.claimLog; l != nil {
+		l.mu.Lock()
+		err := l.f.Close()
+		l.mu.Unlock()
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("fs: closing claim log: %v", err)
+		}
+	}
+	return firstErr
+}
+
+// commitOnClose stores the contents of b, n's shared temporary file,
+// if they changed since they were last stored, and then closes and
+// removes it, or just removes n's silly name if it was removed while
+// open. The handles on b are then unusable;
+// releasing them does nothing more.
+func (n *mutFile) commitOnClose(b *sharedBacking) error {
+	b.wb.stop()
+	err := n.store(b)
+
+	n.mu.Lock()
+	sillyDir, silly := n.sillyDir, n.sillyName
+	if n.backing == b {
+		n.sillyDir = nil
+	} else {
+		sillyDir = nil
+	}
+	n.mu.Unlock()
+	if sillyDir != nil {
+		sillyDir.removeSilly(silly, n)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tmp != nil {
+		b.tmp.Close()
+		os.Remove(b.tmp.Name())
+		b.tmp = nil
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/context"
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestCloseCommitsOpenFiles(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	// Queued claims must be uploaded by Close too.
+	fs.ClaimBatchWindow = time.Hour
+	mf := newFileWithContent(t, dir, "file", "old contents")
+	h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	w := h.(*mutFileHandle)
+	if err := w.Write(&fuse.WriteRequest{Data: []byte("new")}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := fs.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got, want := storedContents(t, mf), "new contents"; got != want {
+		t.Errorf("stored contents after Close = %q; want %q", got, want)
+	}
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	n, ferr := cold.Lookup("file", nil)
+	if ferr != nil {
+		t.Fatalf("Lookup: %v", ferr)
+	}
+	if got, want := storedContents(t, n.(*mutFile)), "new contents"; got != want {
+		t.Errorf("contents seen by another client after Close = %q; want %q", got, want)
+	}
+
+	if err := w.Write(&fuse.WriteRequest{Data: []byte("late")}, &fuse.WriteResponse{}, nil); err != fuse.EPERM {
+		t.Errorf("Write after Close = %v; want EPERM", err)
+	}
+	if _, _, err := dir.Create(&fuse.CreateRequest{Name: "late", Flags: syscall.O_WRONLY | syscall.O_CREAT, Mode: 0644}, &fuse.CreateResponse{}, nil); err != fuse.EPERM {
+		t.Errorf("Create after Close = %v; want EPERM", err)
+	}
+	if err := w.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Errorf("Release after Close: %v", err)
+	}
+	if got, want := storedContents(t, mf), "new contents"; got != want {
+		t.Errorf("stored contents after Release = %q; want %q", got, want)
+	}
+	if err := fs.Close(context.Background()); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestCloseSkipsUnchangedFiles(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "contents")
+	h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	name := h.(*mutFileHandle).tmp.Name()
+	before, signed := fc.uploadCount(), fc.signedCount()
+	if err := fs.Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if n := fc.uploadCount() - before; n != 0 {
+		t.Errorf("Close uploaded %d blobs for an unmodified file; want 0", n)
+	}
+	if n := fc.signedCount() - signed; n != 0 {
+		t.Errorf("Close signed %d claims for an unmodified file; want 0", n)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("temp file still exists after Close: %v", err)
+	}
+}
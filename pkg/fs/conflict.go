@@ -0,0 +1,113 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+
+	"camlistore.org/pkg/schema"
+)
+
+// A directory's name normally links to one permanode, as its
+// camliPath:name attribute is only ever set. But another client, or
+// two racing ones, may add a value rather than set it, leaving the
+// name with several live links. The latest claimed, the last value,
+// is the one shown; with ShowConflicts set, the others are shown
+// too, most recent first, as name.conflict-1, name.conflict-2, and
+// so on, skipping names in use. Removing or renaming any of them,
+// name included, removes only its own link, so conflicts can be
+// repaired from the file system without losing the other links.
+
+// pathConflict is a child of a directory shown under a conflict
+// name: one of the links of its camliPath:name attribute that isn't
+// the one shown as name.
+type pathConflict struct {
+	childName, name string
+	target          string // the permanode linked
+}
+
+// conflictNames returns the names to show the losing links of each
+// of conflicts under, given the names already used by children.
+// Links of the same name are given in the order of the attribute's
+// values, so the most recent last.
+func conflictNames(conflicts []pathConflict, children map[string]mutFileOrDir) map[string]pathConflict {
+	names := make(map[string]pathConflict)
+	next := make(map[string]int) // name to the next number to try
+	for i := len(conflicts) - 1; i >= 0; i-- {
+		pc := conflicts[i]
+		for {
+			next[pc.name]++
+			pc.childName = fmt.Sprintf("%s.conflict-%d", pc.name, next[pc.name])
+			if _, ok := children[pc.childName]; !ok {
+				break
+			}
+		}
+		names[pc.childName] = pc
+	}
+	return names
+}
+
+// pathLinks returns the child permanode of name, given the values
+// of its camliPath attribute, and the conflicting links, if any.
+func (n *mutDir) pathLinks(name string, values []string) (target string, conflicts []pathConflict) {
+	target = values[len(values)-1]
+	if len(values) == 1 {
+		return target, nil
+	}
+	mutDirPathConflict.Incr()
+	n.fs.infof("mutDir.populate: %q in %v has %d links; showing the latest, %s", name, n.permanode, len(values), target)
+	for _, v := range values[:len(values)-1] {
+		conflicts = append(conflicts, pathConflict{name: name, target: v})
+	}
+	return target, conflicts
+}
+
+// hasConflicts reports whether n's child name has conflicting
+// links besides the one shown. n.mu must be held.
+func (n *mutDir) hasConflicts(name string) bool {
+	for _, pc := range n.conflicts {
+		if pc.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// unlinkClaims returns the claim unlinking target, n's child name,
+// and the claim undoing that. For a conflict name, or a name with
+// conflicts, only target's own link is removed, leaving the others;
+// undone, it's linked again as the latest.
+func (n *mutDir) unlinkClaims(name, target string) (unlink, relink *schema.Builder) {
+	n.mu.Lock()
+	pc, ok := n.conflicts[name]
+	conflicted := n.hasConflicts(name)
+	n.mu.Unlock()
+	if ok && pc.target == target {
+		return schema.NewDelAttributeValueClaim(n.permanode, "camliPath:"+pc.name, target),
+			schema.NewAddAttributeClaim(n.permanode, "camliPath:"+pc.name, target)
+	}
+	if conflicted {
+		// The latest of the other links is shown as name
+		// once n is populated again.
+		return schema.NewDelAttributeValueClaim(n.permanode, "camliPath:"+name, target),
+			schema.NewAddAttributeClaim(n.permanode, "camliPath:"+name, target)
+	}
+	return schema.NewDelAttributeClaim(n.permanode, "camliPath:"+name),
+		schema.NewSetAttributeClaim(n.permanode, "camliPath:"+name, target)
+}
@@ -0,0 +1,159 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestPathConflicts(t *testing.T) {
+	defer func(old bool) { TrackStats = old }(TrackStats)
+	TrackStats = true
+
+	fs, fc, dir := newFakeFS(t)
+	older := newFileWithContent(t, dir, "older", "older contents")
+	newer := newFileWithContent(t, dir, "newer", "newer contents")
+	newFileWithContent(t, dir, "doc.conflict-1", "in the way")
+
+	// As two clients racing to add, rather than set, a link.
+	date := time.Now().Add(-time.Minute)
+	for _, mf := range []*mutFile{older, newer} {
+		claim := schema.NewAddAttributeClaim(dir.permanode, "camliPath:doc", mf.permanode.String())
+		date = date.Add(time.Second)
+		claim.SetClaimDate(date)
+		if _, err := fc.UploadAndSignBlob(claim); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func(d *mutDir) []string {
+		ents, err := d.ReadDir(nil)
+		if err != nil {
+			t.Fatalf("ReadDir: %v", err)
+		}
+		var names []string
+		for _, ent := range ents {
+			names = append(names, ent.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	contents := func(d *mutDir, name string) string {
+		n, err := d.Lookup(name, nil)
+		if err != nil {
+			t.Fatalf("Lookup(%q): %v", name, err)
+		}
+		return storedContents(t, n.(*mutFile))
+	}
+
+	conflictsBefore := expvarInt(t, "mutdir-path-conflict")
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	want := []string{"doc", "doc.conflict-1", "newer", "older"}
+	if got := names(cold); !reflect.DeepEqual(got, want) {
+		t.Errorf("names = %q; want %q", got, want)
+	}
+	if got := contents(cold, "doc"); got != "newer contents" {
+		t.Errorf("doc has %q; want the latest link's contents", got)
+	}
+	if expvarInt(t, "mutdir-path-conflict") == conflictsBefore {
+		t.Errorf("conflict not counted")
+	}
+
+	fs.ShowConflicts = true
+	cold = &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	want = []string{"doc", "doc.conflict-1", "doc.conflict-2", "newer", "older"}
+	if got := names(cold); !reflect.DeepEqual(got, want) {
+		t.Errorf("names showing conflicts = %q; want %q", got, want)
+	}
+	if got := contents(cold, "doc"); got != "newer contents" {
+		t.Errorf("doc has %q; want the latest link's contents", got)
+	}
+	if got := contents(cold, "doc.conflict-2"); got != "older contents" {
+		t.Errorf("doc.conflict-2 has %q; want the older link's contents", got)
+	}
+
+	// Removing the conflict only unlinks it, leaving doc alone.
+	if err := cold.Remove(&fuse.RemoveRequest{Name: "doc.conflict-2"}, nil); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	res, err := fc.Describe(&search.DescribeRequest{BlobRef: dir.permanode, Depth: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := res.Meta[dir.permanode.String()].Permanode.Attr["camliPath:doc"], []string{newer.permanode.String()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("camliPath:doc after removing the conflict = %q; want %q", got, want)
+	}
+	cold = &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	want = []string{"doc", "doc.conflict-1", "newer", "older"}
+	if got := names(cold); !reflect.DeepEqual(got, want) {
+		t.Errorf("names after removing the conflict = %q; want %q", got, want)
+	}
+	if got := contents(cold, "doc"); got != "newer contents" {
+		t.Errorf("doc after removing the conflict has %q; want the latest link's contents", got)
+	}
+}
+
+func TestRemoveConflictedName(t *testing.T) {
+	for _, show := range []bool{false, true} {
+		fs, fc, dir := newFakeFS(t)
+		fs.ShowConflicts = show
+		older := newFileWithContent(t, dir, "older", "older contents")
+		newer := newFileWithContent(t, dir, "newer", "newer contents")
+		date := time.Now().Add(-time.Minute)
+		for _, mf := range []*mutFile{older, newer} {
+			claim := schema.NewAddAttributeClaim(dir.permanode, "camliPath:doc", mf.permanode.String())
+			date = date.Add(time.Second)
+			claim.SetClaimDate(date)
+			if _, err := fc.UploadAndSignBlob(claim); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Removing the name shown unlinks only the latest link.
+		cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+		if _, err := cold.Lookup("doc", nil); err != nil {
+			t.Fatalf("show=%v: Lookup(doc): %v", show, err)
+		}
+		if err := cold.Remove(&fuse.RemoveRequest{Name: "doc"}, nil); err != nil {
+			t.Fatalf("show=%v: Remove: %v", show, err)
+		}
+		res, err := fc.Describe(&search.DescribeRequest{BlobRef: dir.permanode, Depth: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := res.Meta[dir.permanode.String()].Permanode.Attr["camliPath:doc"], []string{older.permanode.String()}; !reflect.DeepEqual(got, want) {
+			t.Errorf("show=%v: camliPath:doc after removing doc = %q; want %q", show, got, want)
+		}
+		cold = &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+		n, ferr := cold.Lookup("doc", nil)
+		if ferr != nil {
+			t.Fatalf("show=%v: Lookup(doc) after removing it: %v", show, ferr)
+		}
+		if got := storedContents(t, n.(*mutFile)); got != "older contents" {
+			t.Errorf("show=%v: doc after removing it has %q; want the older link's contents", show, got)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+// Copying a file within the mount, as cp(1) does, reads all of its
+// contents and writes them to a new file. The fuse package has no
+// copy_file_range, so the bytes still pass through the kernel, but
+// they needn't be chunked and uploaded again: the contents read in
+// full are remembered by digest, and a file written with the same
+// bytes is pointed at the contents already stored when released.
+// It's only done with DetectCopies set, as it costs every handle the
+// hashing.
+//
+// Only files read and written in order from their start are
+// recognized, which is what copying programs do; reads through a
+// handle whose first read isn't at offset zero aren't hashed. A
+// copy shares the original's file schema blob, and so its recorded
+// file name.
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"sync"
+
+	"camlistore.org/pkg/blobref"
+)
+
+// maxHeldBytes bounds the bytes a seqHash holds back waiting for
+// earlier ones, e.g. from readahead served out of order, before
+// giving up on hashing the file.
+const maxHeldBytes = 4 << 20
+
+// seqHash hashes the bytes of a file as they are read or written,
+// as long as they come in order from offset zero. Bytes a little
+// ahead are held back until those before them arrive; bytes before
+// those already hashed, e.g. a rewrite, end the hashing.
+type seqHash struct {
+	mu     sync.Mutex
+	h      hash.Hash        // nil until the first bytes
+	n      int64            // bytes hashed
+	held   map[int64][]byte // bytes ahead of n, by offset
+	nheld  int
+	broken bool
+}
+
+// add hashes p, found at off, and returns the number of bytes hashed
+// in order so far, or -1 if the bytes didn't come in order.
+func (s *seqHash) add(off int64, p []byte) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.broken:
+		return -1
+	case off < s.n:
+		s.stopLocked()
+		return -1
+	case off > s.n:
+		if s.nheld+len(p) > maxHeldBytes {
+			s.stopLocked()
+			return -1
+		}
+		if s.held == nil {
+			s.held = make(map[int64][]byte)
+		}
+		if _, dup := s.held[off]; dup {
+			s.stopLocked()
+			return -1
+		}
+		s.held[off] = append([]byte(nil), p...)
+		s.nheld += len(p)
+		return s.n
+	}
+	if s.h == nil {
+		s.h = sha1.New()
+	}
+	s.h.Write(p)
+	s.n += int64(len(p))
+	for {
+		next, ok := s.held[s.n]
+		if !ok {
+			break
+		}
+		delete(s.held, s.n)
+		s.nheld -= len(next)
+		s.h.Write(next)
+		s.n += int64(len(next))
+	}
+	return s.n
+}
+
+// stop gives up hashing, e.g. as the bytes hashed were changed.
+func (s *seqHash) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopLocked()
+}
+
+// stopLocked is stop for callers holding s.mu.
+func (s *seqHash) stopLocked() {
+	s.broken = true
+	s.h = nil
+	s.held = nil
+	s.nheld = 0
+}
+
+// reset starts hashing over, e.g. after the file was truncated.
+func (s *seqHash) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopLocked()
+	s.broken = false
+	s.n = 0
+}
+
+// key returns the key of the size bytes hashed by s in
+// fs.readContents, or "" if s hasn't hashed exactly that many bytes,
+// in order.
+func (s *seqHash) key(size int64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.broken || s.n != size || len(s.held) > 0 {
+		return ""
+	}
+	if s.h == nil {
+		// Empty files aren't worth sharing.
+		return ""
+	}
+	return fmt.Sprintf("sha1-%x/%d", s.h.Sum(nil), size)
+}
+
+// readContent records that the bytes of content, p at off, were read
+// through a handle hashing them with s. Once all size bytes have
+// been, content is remembered as copyable.
+func (fs *CamliFileSystem) readContent(s *seqHash, content *blobref.BlobRef, size, off int64, p []byte) {
+	if s.add(off, p) != size {
+		return
+	}
+	if key := s.key(size); key != "" {
+		fs.readContents.Add(key, content)
+	}
+}
+
+// copiedContent returns the stored content with the size bytes hashed
+// by s, if they were read in full recently, or nil.
+func (fs *CamliFileSystem) copiedContent(s *seqHash, size int64) *blobref.BlobRef {
+	key := s.key(size)
+	if key == "" {
+		return nil
+	}
+	if v, ok := fs.readContents.Get(key); ok {
+		return v.(*blobref.BlobRef)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"math/rand"
+	"syscall"
+	"testing"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// copyFile copies src to a new file name in dir as cp(1) would,
+// through a read-only handle, modifying the bytes written with
+// change, and returns the copy once released. Reads come in pairs
+// served out of order, as with readahead.
+func copyFile(t *testing.T, dir *mutDir, src *mutFile, name string, change func([]byte)) *mutFile {
+	rh, err := src.Open(&fuse.OpenRequest{Flags: syscall.O_RDONLY}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", src.name, err)
+	}
+	r := rh.(*nodeReader)
+	defer r.Release(&fuse.ReleaseRequest{}, nil)
+	node, wh, err := dir.Create(&fuse.CreateRequest{Name: name, Flags: syscall.O_WRONLY | syscall.O_CREAT | syscall.O_EXCL, Mode: 0644}, &fuse.CreateResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Create(%q): %v", name, err)
+	}
+	w := wh.(*mutFileHandle)
+
+	const chunk = 16 << 10
+	read := func(off int64) []byte {
+		var res fuse.ReadResponse
+		if err := r.Read(&fuse.ReadRequest{Offset: off, Size: chunk}, &res, nil); err != nil {
+			t.Fatalf("Read at %d: %v", off, err)
+		}
+		return res.Data
+	}
+	for off := int64(0); ; off += 2 * chunk {
+		second := read(off + chunk)
+		first := read(off)
+		if len(first) == 0 {
+			break
+		}
+		for i, p := range [][]byte{first, second} {
+			if len(p) == 0 {
+				continue
+			}
+			p = append([]byte(nil), p...)
+			change(p)
+			if err := w.Write(&fuse.WriteRequest{Offset: off + int64(i)*chunk, Data: p}, &fuse.WriteResponse{}, nil); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+		}
+	}
+	if err := w.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release(%q): %v", name, err)
+	}
+	return node.(*mutFile)
+}
+
+func TestCopyReusesContent(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	fs.DetectCopies = true
+	contents := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(contents)
+	src := newFileWithContent(t, dir, "src", string(contents))
+
+	// unsigned returns the number of blobs uploaded other than
+	// claims and permanodes: file schemas and chunks.
+	unsigned := func() int { return fc.uploadCount() - fc.signedCount() }
+
+	before := unsigned()
+	cp := copyFile(t, dir, src, "copy", func([]byte) {})
+	if n := unsigned() - before; n != 0 {
+		t.Errorf("copying uploaded %d file schema and chunk blobs; want none", n)
+	}
+	if !cp.content.Equal(src.content) {
+		t.Errorf("copy's content = %v; want the original's %v", cp.content, src.content)
+	}
+	if got := storedContents(t, cp); got != string(contents) {
+		t.Errorf("copy's stored contents differ from the original's")
+	}
+	if a := cp.Attr(); a.Size != uint64(len(contents)) {
+		t.Errorf("copy's size = %d; want %d", a.Size, len(contents))
+	}
+
+	// A copy with different bytes is stored as usual.
+	before = unsigned()
+	changed := copyFile(t, dir, src, "changed", func(p []byte) { p[0]++ })
+	if unsigned() == before {
+		t.Error("storing a file differing from the one read uploaded nothing")
+	}
+	if changed.content.Equal(src.content) {
+		t.Error("a file differing from the one read got its content")
+	}
+}
+
+func TestCopiesNotDetectedByDefault(t *testing.T) {
+	_, _, dir := newFakeFS(t)
+	src := newFileWithContent(t, dir, "src", "contents")
+	rh, err := src.Open(&fuse.OpenRequest{Flags: syscall.O_RDONLY}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rh.(*nodeReader).Release(&fuse.ReleaseRequest{}, nil)
+	if rh.(*nodeReader).copied != nil {
+		t.Error("read-only handle hashes its reads without DetectCopies")
+	}
+
+	if cp := copyFile(t, dir, src, "copy", func([]byte) {}); cp.content.Equal(src.content) {
+		t.Error("copy got the original's content without DetectCopies")
+	}
+}
+
+func TestSeqHash(t *testing.T) {
+	var s seqHash
+	s.add(0, []byte("ab"))
+	s.add(4, []byte("ef"))
+	if n := s.add(2, []byte("cd")); n != 6 {
+		t.Fatalf("after out of order adds, hashed %d bytes; want 6", n)
+	}
+	var in seqHash
+	in.add(0, []byte("abcdef"))
+	if a, b := s.key(6), in.key(6); a == "" || a != b {
+		t.Errorf("keys of the same bytes added out of order and in order = %q, %q; want equal", a, b)
+	}
+	if k := s.key(5); k != "" {
+		t.Errorf("key for the wrong size = %q; want none", k)
+	}
+	if n := s.add(1, []byte("x")); n != -1 || s.key(6) != "" {
+		t.Errorf("after rewriting hashed bytes, add = %d, key = %q; want -1 and none", n, s.key(6))
+	}
+	s.reset()
+	s.add(0, []byte("abcdef"))
+	if k := s.key(6); k != in.key(6) {
+		t.Errorf("key after reset = %q; want %q", k, in.key(6))
+	}
+}
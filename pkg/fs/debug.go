@@ -20,9 +20,11 @@ package fs
 
 import (
 	"bytes"
+	"expvar"
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	"camlistore.org/pkg/types"
 
@@ -30,6 +32,8 @@ import (
 )
 
 // If TrackStats is true, statistics are kept on operations.
+// They're readable from the ".camli_fs_stats" directory in the root,
+// and are published with expvar as "camli.fs.<name>".
 var TrackStats bool
 
 func init() {
@@ -37,12 +41,63 @@ func init() {
 }
 
 var (
-	mutFileOpen      = newStat("mutfile-open")
-	mutFileOpenError = newStat("mutfile-open-error")
-	mutFileOpenRO    = newStat("mutfile-open-ro")
-	mutFileOpenRW    = newStat("mutfile-open-rw")
+	mutFileOpen           = newStat("mutfile-open")
+	mutFileOpenError      = newStat("mutfile-open-error")
+	mutFileOpenRO         = newStat("mutfile-open-ro")
+	mutFileOpenRW         = newStat("mutfile-open-rw")
+	mutFileOpenWait       = newStat("mutfile-open-wait")
+	fileRead              = newStat("file-read")
+	fileReadBytes         = newStat("file-read-bytes")
+	fileReadAhead         = newStat("file-read-ahead")
+	fileWrite             = newStat("file-write")
+	fileWriteBytes        = newStat("file-write-bytes")
+	mutDirPopulate        = newStat("mutdir-populate")
+	mutDirPopulateFresh   = newStat("mutdir-populate-fresh")
+	mutDirDescribeMissing = newStat("mutdir-describe-missing")
+	mutDirContentMissing  = newStat("mutdir-content-missing")
+	mutDirUnresolved      = newStat("mutdir-unresolved")
+	mutDirPathConflict    = newStat("mutdir-path-conflict")
+	mutFileWriteBehind    = newStat("mutfile-write-behind")
+	chunkCacheHit         = newStat("chunk-cache-hit")
+	chunkCacheMiss        = newStat("chunk-cache-miss")
+	claimBatchUpload      = newStat("claim-batch-upload")
+	claimLogReplayed      = newStat("claim-log-replayed")
+	mutFileCopied         = newStat("mutfile-copied")
+	describeCount         = newStat("describe")
+	describeMicros        = newStat("describe-usec")
 )
 
+// describeLatency counts the describe requests by how long they
+// took, each stat those taking up to its max but longer than the
+// previous one's; the last stat, with no max, counts the rest.
+var describeLatency = []struct {
+	max time.Duration
+	s   *stat
+}{
+	{time.Millisecond, newStat("describe-latency-1ms")},
+	{10 * time.Millisecond, newStat("describe-latency-10ms")},
+	{100 * time.Millisecond, newStat("describe-latency-100ms")},
+	{time.Second, newStat("describe-latency-1s")},
+	{10 * time.Second, newStat("describe-latency-10s")},
+	{0, newStat("describe-latency-inf")},
+}
+
+// recordDescribe counts a describe request that took d.
+func recordDescribe(d time.Duration) {
+	describeCount.Incr()
+	describeMicros.Add(int64(d / time.Microsecond))
+	for _, b := range describeLatency {
+		if d <= b.max || b.max == 0 {
+			b.s.Incr()
+			return
+		}
+	}
+}
+
+// expvarPrefix is prepended to stat names to form their expvar
+// names.
+const expvarPrefix = "camli.fs."
+
 var statByName = map[string]*stat{}
 
 func newStat(name string) *stat {
@@ -51,6 +106,9 @@ func newStat(name string) *stat {
 	}
 	s := &stat{name: name}
 	statByName[name] = s
+	expvar.Publish(expvarPrefix+name, expvar.Func(func() interface{} {
+		return s.n.Get()
+	}))
 	return s
 }
 
@@ -62,8 +120,12 @@ type stat struct {
 }
 
 func (s *stat) Incr() {
+	s.Add(1)
+}
+
+func (s *stat) Add(delta int64) {
 	if TrackStats {
-		s.n.Add(1)
+		s.n.Add(delta)
 	}
 }
 
@@ -0,0 +1,140 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"expvar"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func expvarInt(t *testing.T, name string) int64 {
+	v := expvar.Get(expvarPrefix + name)
+	if v == nil {
+		t.Fatalf("expvar %s%s not published", expvarPrefix, name)
+	}
+	n, err := strconv.ParseInt(v.String(), 10, 64)
+	if err != nil {
+		t.Fatalf("expvar %s%s = %q: %v", expvarPrefix, name, v.String(), err)
+	}
+	return n
+}
+
+func TestStatsExpvar(t *testing.T) {
+	defer func(old bool) { TrackStats = old }(TrackStats)
+	TrackStats = true
+
+	fs, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "contents")
+
+	before := make(map[string]int64)
+	for name := range statByName {
+		before[name] = expvarInt(t, name)
+	}
+
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	if _, err := cold.ReadDir(nil); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fh := h.(*mutFileHandle)
+	if err := fh.Write(&fuse.WriteRequest{Offset: 8, Data: []byte("+more")}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := fh.Read(&fuse.ReadRequest{Size: 100}, &fuse.ReadResponse{}, nil); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if err := fh.Release(nil, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	want := map[string]int64{
+		"mutdir-populate":  1,
+		"mutfile-open":     1,
+		"mutfile-open-rw":  1,
+		"file-write":       1,
+		"file-write-bytes": int64(len("+more")),
+		"file-read":        1,
+		"file-read-bytes":  int64(len("contents+more")),
+	}
+	for name, delta := range want {
+		if got := expvarInt(t, name) - before[name]; got != delta {
+			t.Errorf("%s advanced by %d; want %d", name, got, delta)
+		}
+	}
+}
+
+func TestDescribeStats(t *testing.T) {
+	defer func(old bool) { TrackStats = old }(TrackStats)
+	TrackStats = true
+
+	fs, fc, dir := newFakeFS(t)
+	newFileWithContent(t, dir, "file", "contents")
+	fc.mu.Lock()
+	fc.describeDelay = 2 * time.Millisecond
+	fc.mu.Unlock()
+
+	before := make(map[string]int64)
+	for name := range statByName {
+		before[name] = expvarInt(t, name)
+	}
+	delta := func(name string) int64 {
+		return expvarInt(t, name) - before[name]
+	}
+
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			repopulate(t, cold)
+		} else if _, err := cold.ReadDir(nil); err != nil {
+			t.Fatalf("ReadDir: %v", err)
+		}
+	}
+
+	if n := delta("mutdir-populate"); n != 2 {
+		t.Errorf("mutdir-populate advanced by %d; want 2, the first listing and the forced one", n)
+	}
+	if n := delta("mutdir-populate-fresh"); n < 1 {
+		t.Errorf("mutdir-populate-fresh advanced by %d; want at least 1, the second listing", n)
+	}
+	n := delta("describe")
+	if n < 2 {
+		t.Fatalf("describe advanced by %d; want at least 2", n)
+	}
+	if us := delta("describe-usec"); us < n*2000 {
+		t.Errorf("describe-usec advanced by %d; want at least %d, for %d describes of 2ms", us, n*2000, n)
+	}
+	var inBuckets int64
+	for _, b := range describeLatency {
+		inBuckets += delta(b.s.name)
+	}
+	if inBuckets != n {
+		t.Errorf("latency buckets advanced by %d in all; want %d, one per describe", inBuckets, n)
+	}
+	if n := delta("describe-latency-1ms"); n != 0 {
+		t.Errorf("describe-latency-1ms advanced by %d; want 0, for describes of 2ms", n)
+	}
+}
@@ -0,0 +1,90 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"io"
+	"io/ioutil"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/schema"
+)
+
+// dryRunClient is the camliClient of a CamliFileSystem with DryRun
+// set. It logs the blobs and claims it's given, and reports them
+// uploaded, rather than uploading them. Everything else goes to the
+// real client.
+type dryRunClient struct {
+	camliClient
+	fs *CamliFileSystem
+}
+
+func (c dryRunClient) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	n, err := io.Copy(ioutil.Discard, source)
+	if err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	c.fs.debugf("fs: dry run: not uploading blob %v (%d bytes)", br, n)
+	return blobref.SizedBlobRef{BlobRef: br, Size: n}, nil
+}
+
+func (c dryRunClient) UploadAndSignBlob(b schema.AnyBlob) (*client.PutResult, error) {
+	// Unsigned, so its blobref isn't that of the claim that would
+	// be uploaded, but it's as good to refer to it locally.
+	json := b.Blob().JSON()
+	c.fs.infof("fs: dry run: not signing and uploading %s", json)
+	return &client.PutResult{BlobRef: blobref.SHA1FromString(json), Size: int64(len(json))}, nil
+}
+
+func (c dryRunClient) UploadAndSignBlobs(bs []schema.AnyBlob) ([]*client.PutResult, error) {
+	prs := make([]*client.PutResult, len(bs))
+	for i, b := range bs {
+		prs[i], _ = c.UploadAndSignBlob(b)
+	}
+	return prs, nil
+}
+
+func (c dryRunClient) UploadMany(hs []*client.UploadHandle) ([]*client.PutResult, error) {
+	prs := make([]*client.PutResult, len(hs))
+	for i, h := range hs {
+		sb, err := c.ReceiveBlob(h.BlobRef, h.Contents)
+		if err != nil {
+			return nil, err
+		}
+		prs[i] = &client.PutResult{BlobRef: sb.BlobRef, Size: sb.Size}
+	}
+	return prs, nil
+}
+
+func (c dryRunClient) UploadNewPermanode() (*client.PutResult, error) {
+	return c.UploadAndSignBlob(schema.NewUnsignedPermanode())
+}
+
+// uploadClient returns the client to store blobs and claims with:
+// fs's client, or a dryRunClient on it if DryRun is set.
+func (fs *CamliFileSystem) uploadClient() camliClient {
+	fs.uploadClientOnce.Do(func() {
+		fs.uploadCl = fs.client
+		if fs.DryRun {
+			fs.uploadCl = dryRunClient{fs.client, fs}
+		}
+	})
+	return fs.uploadCl
+}
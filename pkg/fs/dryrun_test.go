@@ -0,0 +1,74 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestDryRun(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	fs.DryRun = true
+	uploads, signed := fc.uploadCount(), fc.signedCount()
+
+	_, h, err := dir.Create(&fuse.CreateRequest{Name: "file", Flags: syscall.O_RDWR | syscall.O_CREAT, Mode: 0644}, &fuse.CreateResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	w := h.(*mutFileHandle)
+	if err := w.Write(&fuse.WriteRequest{Data: []byte("contents")}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := dir.Mkdir(&fuse.MkdirRequest{Name: "dir", Mode: 0755}, nil); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	if _, err := dir.Symlink(&fuse.SymlinkRequest{NewName: "link", Target: "file"}, nil); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	if err := dir.Rename(&fuse.RenameRequest{OldName: "file", NewName: "renamed"}, dir, nil); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if err := dir.Remove(&fuse.RemoveRequest{Name: "link"}, nil); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if err := fs.FlushClaims(); err != nil {
+		t.Fatalf("FlushClaims: %v", err)
+	}
+
+	if got := fc.uploadCount(); got != uploads {
+		t.Errorf("%d blobs uploaded in dry run mode", got-uploads)
+	}
+	if got := fc.signedCount(); got != signed {
+		t.Errorf("%d blobs signed in dry run mode", got-signed)
+	}
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	ents, ferr := cold.ReadDir(nil)
+	if ferr != nil {
+		t.Fatalf("ReadDir: %v", ferr)
+	}
+	if len(ents) != 0 {
+		t.Errorf("server has %v after dry run; want nothing", ents)
+	}
+}
@@ -0,0 +1,389 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/index/indextest"
+	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
+	"camlistore.org/pkg/test"
+)
+
+// fakeClient is a camliClient backed by an in-memory index and
+// search handler, signing claims with the test key.
+type fakeClient struct {
+	id *indextest.IndexDeps
+	sh *search.Handler
+
+	mu        sync.Mutex
+	describes []*search.DescribeRequest
+	uploadErr error // if non-nil, returned by all uploads
+	noSigner  bool  // if set, signing fails as without a key
+	uploads   int   // blobs received
+	signed    int   // claims and permanodes signed
+	batches   int   // UploadAndSignBlobs and UploadMany calls
+
+	// describeDelay, if non-zero, is added to each Describe, as
+	// if the search server were remote.
+	describeDelay time.Duration
+
+	// uploadDelay, if non-zero, is added to each upload request,
+	// which UploadAndSignBlobs makes one of for all its blobs.
+	uploadDelay time.Duration
+
+	// stall, if non-nil, blocks Describe and ReceiveBlob until
+	// it's closed, as if the server hung.
+	stall chan struct{}
+
+	// undescribed holds the blobrefs left out of Describe
+	// responses, as though the index lagged behind.
+	undescribed map[string]bool
+
+	// lagging, if true, makes received blobs be stored but only
+	// indexed once catchUp is called; see lagIndex.
+	lagging  bool
+	catchUps []func() error
+
+	// failClaim, if non-nil, is called with each claim to sign;
+	// the upload fails with the error it returns, if not nil.
+	failClaim func(schema.AnyBlob) error
+
+	// total and free are reported by StorageCapacity; a zero
+	// total means unknown.
+	total, free int64
+}
+
+func newFakeClient(t testing.TB) *fakeClient {
+	id := indextest.NewIndexDeps(index.NewMemoryIndex())
+	id.Fataler = t
+	return &fakeClient{
+		id: id,
+		sh: search.NewHandler(id.Index, id.SignerBlobRef),
+	}
+}
+
+// newFakeFS returns a file system using a new fakeClient, and a
+// mutable directory in it.
+func newFakeFS(t testing.TB) (*CamliFileSystem, *fakeClient, *mutDir) {
+	fc := newFakeClient(t)
+	fs := newCamliFileSystem(fc.id.BlobSource)
+	fs.client = fc
+	pr, err := fc.UploadNewPermanode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := &mutDir{fs: fs, permanode: pr.BlobRef, name: "root"}
+	return fs, fc, dir
+}
+
+// stallServer makes the client's Describes and uploads block until
+// the returned function is called.
+func (c *fakeClient) stallServer() (resume func()) {
+	stall := make(chan struct{})
+	c.mu.Lock()
+	c.stall = stall
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		c.stall = nil
+		c.mu.Unlock()
+		close(stall)
+	}
+}
+
+// setDescribed makes Describe leave br out of its responses, or
+// include it again.
+func (c *fakeClient) setDescribed(br *blobref.BlobRef, described bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.undescribed == nil {
+		c.undescribed = make(map[string]bool)
+	}
+	if described {
+		delete(c.undescribed, br.String())
+	} else {
+		c.undescribed[br.String()] = true
+	}
+}
+
+// describeRequests returns the Describe requests made so far.
+func (c *fakeClient) describeRequests() []*search.DescribeRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*search.DescribeRequest(nil), c.describes...)
+}
+
+// failUploads makes all later uploads fail with err, or succeed
+// again if err is nil.
+func (c *fakeClient) failUploads(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.uploadErr = err
+}
+
+// setCapacity sets the storage capacity reported by c.
+func (c *fakeClient) setCapacity(total, free int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total, c.free = total, free
+}
+
+func (c *fakeClient) StorageCapacity() (total, free int64, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total, c.free, nil
+}
+
+// uploadCount returns the number of blobs uploaded so far.
+func (c *fakeClient) uploadCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.uploads
+}
+
+// signedCount returns the number of blobs signed so far.
+func (c *fakeClient) signedCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.signed
+}
+
+func (c *fakeClient) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	c.mu.Lock()
+	delay := c.uploadDelay
+	c.mu.Unlock()
+	time.Sleep(delay)
+	return c.receiveBlob(br, source)
+}
+
+func (c *fakeClient) receiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	c.mu.Lock()
+	uploadErr := c.uploadErr
+	c.uploads++
+	stall := c.stall
+	c.mu.Unlock()
+	if stall != nil {
+		<-stall
+	}
+	if uploadErr != nil {
+		return blobref.SizedBlobRef{}, uploadErr
+	}
+	slurp, err := ioutil.ReadAll(source)
+	if err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	sb, err := c.id.BlobSource.ReceiveBlob(br, bytes.NewReader(slurp))
+	if err != nil {
+		return sb, err
+	}
+	index := func() error {
+		_, err := c.id.Index.ReceiveBlob(br, bytes.NewReader(slurp))
+		return err
+	}
+	c.mu.Lock()
+	if c.lagging {
+		c.catchUps = append(c.catchUps, index)
+		index = nil
+	}
+	c.mu.Unlock()
+	if index != nil {
+		if err := index(); err != nil {
+			return sb, err
+		}
+	}
+	return sb, nil
+}
+
+// lagIndex makes the blobs received from now on stored, but not seen
+// by Describe and other searches until catchUp is called, as with a
+// server whose index lags behind.
+func (c *fakeClient) lagIndex() (catchUp func()) {
+	c.mu.Lock()
+	c.lagging = true
+	c.mu.Unlock()
+	return func() {
+		c.mu.Lock()
+		c.lagging = false
+		fns := c.catchUps
+		c.catchUps = nil
+		c.mu.Unlock()
+		for _, fn := range fns {
+			if err := fn(); err != nil {
+				c.id.Fatalf("indexing a lagging blob: %v", err)
+			}
+		}
+	}
+}
+
+func (c *fakeClient) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, wait time.Duration) error {
+	return c.id.BlobSource.StatBlobs(dest, blobs, wait)
+}
+
+func (c *fakeClient) Describe(req *search.DescribeRequest) (*search.DescribeResponse, error) {
+	c.mu.Lock()
+	c.describes = append(c.describes, req)
+	delay := c.describeDelay
+	stall := c.stall
+	c.mu.Unlock()
+	time.Sleep(delay)
+	if stall != nil {
+		<-stall
+	}
+	dr := c.sh.NewDescribeRequest()
+	dr.Attrs = req.Attrs
+	brs := req.BlobRefs
+	if len(brs) == 0 {
+		brs = []*blobref.BlobRef{req.BlobRef}
+	}
+	depth := req.Depth
+	if depth == 0 {
+		depth = 4
+	}
+	for _, br := range brs {
+		dr.Describe(br, depth)
+	}
+	m, err := dr.Result()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	for br := range c.undescribed {
+		delete(m, br)
+	}
+	c.mu.Unlock()
+	return &search.DescribeResponse{Meta: m}, nil
+}
+
+func (c *fakeClient) GetRecentPermanodes(req *search.RecentRequest) (*search.RecentResponse, error) {
+	return c.sh.GetRecentPermanodes(req)
+}
+
+func (c *fakeClient) GetPermanodesWithAttr(req *search.WithAttrRequest) (*search.WithAttrResponse, error) {
+	return c.sh.GetPermanodesWithAttr(req)
+}
+
+func (c *fakeClient) GetClaims(req *search.ClaimsRequest) (*search.ClaimsResponse, error) {
+	return c.sh.GetClaims(req)
+}
+
+func (c *fakeClient) GetSignerPaths(req *search.SignerPathsRequest) (*search.SignerPathsResponse, error) {
+	return c.sh.GetSignerPaths(req)
+}
+
+func (c *fakeClient) SignerPublicKeyBlobref() *blobref.BlobRef {
+	return c.id.SignerBlobRef
+}
+
+func (c *fakeClient) UploadAndSignBlob(b schema.AnyBlob) (*client.PutResult, error) {
+	tb, err := c.signBlob(b)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := c.ReceiveBlob(tb.BlobRef(), tb.Reader())
+	if err != nil {
+		return nil, err
+	}
+	return &client.PutResult{BlobRef: sb.BlobRef, Size: sb.Size}, nil
+}
+
+func (c *fakeClient) UploadAndSignBlobs(bs []schema.AnyBlob) ([]*client.PutResult, error) {
+	c.mu.Lock()
+	c.batches++
+	delay := c.uploadDelay
+	c.mu.Unlock()
+	tbs := make([]*test.Blob, len(bs))
+	for i, b := range bs {
+		tb, err := c.signBlob(b)
+		if err != nil {
+			return nil, err
+		}
+		tbs[i] = tb
+	}
+	time.Sleep(delay)
+	prs := make([]*client.PutResult, len(bs))
+	for i, tb := range tbs {
+		sb, err := c.receiveBlob(tb.BlobRef(), tb.Reader())
+		if err != nil {
+			return nil, err
+		}
+		prs[i] = &client.PutResult{BlobRef: sb.BlobRef, Size: sb.Size}
+	}
+	return prs, nil
+}
+
+func (c *fakeClient) UploadMany(hs []*client.UploadHandle) ([]*client.PutResult, error) {
+	c.mu.Lock()
+	c.batches++
+	delay := c.uploadDelay
+	c.mu.Unlock()
+	time.Sleep(delay)
+	prs := make([]*client.PutResult, len(hs))
+	for i, h := range hs {
+		sb, err := c.receiveBlob(h.BlobRef, h.Contents)
+		if err != nil {
+			return nil, err
+		}
+		prs[i] = &client.PutResult{BlobRef: sb.BlobRef, Size: sb.Size}
+	}
+	return prs, nil
+}
+
+// signBlob signs b as a claim or permanode would be.
+func (c *fakeClient) signBlob(b schema.AnyBlob) (*test.Blob, error) {
+	c.mu.Lock()
+	noSigner, failClaim := c.noSigner, c.failClaim
+	if !noSigner {
+		c.signed++
+	}
+	c.mu.Unlock()
+	if noSigner {
+		return nil, &client.SigningError{errors.New("no signing key configured")}
+	}
+	if failClaim != nil {
+		if err := failClaim(b); err != nil {
+			return nil, err
+		}
+	}
+	unsigned := b.Blob().Builder().SetSigner(c.id.SignerBlobRef).Blob().JSON()
+	signed, err := (&jsonsign.SignRequest{
+		UnsignedJSON:  unsigned,
+		Fetcher:       c.id.PublicKeyFetcher,
+		EntityFetcher: c.id.EntityFetcher,
+	}).Sign()
+	if err != nil {
+		return nil, err
+	}
+	return &test.Blob{Contents: signed}, nil
+}
+
+func (c *fakeClient) UploadNewPermanode() (*client.PutResult, error) {
+	return c.UploadAndSignBlob(schema.NewUnsignedPermanode())
+}
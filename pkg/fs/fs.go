@@ -21,18 +21,22 @@ limitations under the License.
 package fs
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"sync"
 	"syscall"
 	"time"
 
 	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/client"
 	"camlistore.org/pkg/lru"
 	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
 
 	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
 )
@@ -41,9 +45,95 @@ var serverStart = time.Now()
 
 var errNotDir = fuse.Errno(syscall.ENOTDIR)
 
+// errInterrupted is returned by interruptible when the request
+// waiting for an operation is interrupted.
+var errInterrupted = errors.New("fs: interrupted")
+
+// interruptible runs fn and returns its error, unless intr is closed
+// first, in which case it returns errInterrupted right away. The
+// client can't abort a request in flight, so fn still runs to
+// completion in the background; only the wait for it is cut short,
+// so a process stuck on a hung server can be killed.
+func interruptible(intr fuse.Intr, fn func() error) error {
+	if intr == nil {
+		return fn()
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fn()
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-intr:
+		return errInterrupted
+	}
+}
+
+// uploadError maps an error from storing blobs to the error returned
+// to the kernel: out-of-space and quota errors become ENOSPC,
+// permission errors EPERM, interruptions EINTR, failures to sign
+// claims EACCES if SigningEACCES is set, and anything else EIO.
+// Both local errors, from the disk cache, and the server's HTTP
+// errors are mapped.
+func (fs *CamliFileSystem) uploadError(err error) fuse.Error {
+	if err == errInterrupted {
+		return fuse.EINTR
+	}
+	switch e := err.(type) {
+	case *client.SigningError:
+		fs.signingErrorOnce.Do(func() {
+			fs.warnf("fs: signing key unavailable, so nothing can be changed: %v", e.Err)
+		})
+		if fs.SigningEACCES {
+			return fuse.EACCES
+		}
+		return fuse.EIO
+	case *client.HTTPError:
+		switch e.StatusCode {
+		case client.StatusInsufficientStorage:
+			return fuse.ENOSPC
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fuse.EPERM
+		}
+		return fuse.EIO
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	switch err {
+	case syscall.ENOSPC, syscall.EDQUOT:
+		return fuse.ENOSPC
+	case syscall.EPERM, syscall.EACCES:
+		return fuse.EPERM
+	}
+	return fuse.EIO
+}
+
+// camliClient is the subset of *client.Client used by the file
+// system. Tests substitute a fake.
+type camliClient interface {
+	blobserver.StatReceiver
+	Describe(*search.DescribeRequest) (*search.DescribeResponse, error)
+	GetRecentPermanodes(*search.RecentRequest) (*search.RecentResponse, error)
+	GetPermanodesWithAttr(*search.WithAttrRequest) (*search.WithAttrResponse, error)
+	GetClaims(*search.ClaimsRequest) (*search.ClaimsResponse, error)
+	GetSignerPaths(*search.SignerPathsRequest) (*search.SignerPathsResponse, error)
+	SignerPublicKeyBlobref() *blobref.BlobRef
+	UploadAndSignBlob(schema.AnyBlob) (*client.PutResult, error)
+	UploadAndSignBlobs([]schema.AnyBlob) ([]*client.PutResult, error)
+	UploadMany([]*client.UploadHandle) ([]*client.PutResult, error)
+	UploadNewPermanode() (*client.PutResult, error)
+}
+
+var _ camliClient = (*client.Client)(nil)
+
 type CamliFileSystem struct {
 	fetcher blobref.SeekFetcher
-	client  *client.Client // or nil, if not doing search queries
+	client  camliClient // or nil, if not doing search queries
 	root    fuse.Node
 
 	// IgnoreOwners, if true, collapses all file ownership to the
@@ -51,19 +141,248 @@ type CamliFileSystem struct {
 	// permissions to 0600/0700.
 	IgnoreOwners bool
 
+	// DefaultFileMode and DefaultDirMode, if non-zero, are the
+	// permissions recorded for files and directories created
+	// through the mount, as if chmod-ed right after, e.g. 0640 and
+	// 02750 (setgid) for a tree shared with a group. Otherwise new
+	// nodes have none recorded, and report 0600 and 0700 until
+	// chmod-ed. Only the bits a chmod records are used; see
+	// ParseMode.
+	DefaultFileMode os.FileMode
+	DefaultDirMode  os.FileMode
+
+	// LazySizes, if true, makes mutable directories list their
+	// children with a shallow describe that doesn't include the
+	// files' contents, and look up each file's size the first
+	// time its attributes are needed. This makes listing huge
+	// directories cheaper when most entries are never stat-ed.
+	LazySizes bool
+
+	// PopulateDepth is the depth of the describe request used to
+	// list a mutable directory. Zero means DefaultPopulateDepth.
+	// Depth 2 reaches the child permanodes and 3 their contents
+	// too; deeper only adds payload. Children missing from a
+	// shallower response are described in a follow-up request.
+	// LazySizes caps it at 2.
+	PopulateDepth int
+
+	// SharedWrites, if true, makes read-only handles of a
+	// mutable file share the temporary file of its writable
+	// handles, so writes are seen by readers before they're
+	// released. Otherwise readers see the contents last stored.
+	// Writable handles of the same file always share one
+	// temporary file, so concurrent writers don't lose each
+	// other's writes.
+	SharedWrites bool
+
+	// WriteBehindBytes and WriteBehindInterval, if positive, make
+	// a file being written store its contents so far in the
+	// background, once that many bytes were written since they
+	// were last stored, or that long after an unstored write. The
+	// file's camliContent then points at the partial contents, so
+	// a crash mid-copy loses at most about that much. Releasing
+	// the file still stores the rest. Chunks already stored aren't
+	// uploaded again.
+	WriteBehindBytes    int64
+	WriteBehindInterval time.Duration
+
+	// TempDir is the directory holding the temporary files of
+	// mutable files open for writing, which can be as large as
+	// the files themselves. Empty means the OS default (see
+	// os.TempDir), often a small tmpfs.
+	TempDir string
+
+	// MaxOpenWrites, if positive, is the most files that may be
+	// open for writing at once, each holding a temporary file.
+	// Opening another one for writing then blocks until one of
+	// them is released, or the request is interrupted, so that
+	// copying in a large tree with many parallel writers doesn't
+	// run out of file descriptors or temporary space.
+	MaxOpenWrites int
+
+	// ReadOnly, if true, makes all operations that would change
+	// the file system (or write claims) fail with EPERM, as they
+	// do once fs is closed; see Close.
+	ReadOnly bool
+
+	// DryRun, if true, makes changes succeed without changing
+	// anything on the server: the claims and blobs they would
+	// upload are logged instead, to see what an application does
+	// to the file system. Changes may show locally for a while,
+	// but the contents of files written can't be read back.
+	DryRun bool
+
+	// LogLevel is the least severe level of the messages logged.
+	// The zero value, LogDebug, logs a line for most operations;
+	// LogInfo and above only log what's out of the ordinary.
+	// Malformed permanode attributes are logged at any level.
+	LogLevel LogLevel
+
+	// CheckSpace, if true, makes storing a file's contents first
+	// check that the blob storage has room for them, failing with
+	// ENOSPC up front rather than after uploading part of the
+	// file. The client asks the server for its storage's capacity,
+	// as does Statfs; the check is skipped if that's unknown.
+	CheckSpace bool
+
+	// Versions, if true, gives each regular file "name" in a
+	// mutable directory a hidden, read-only sibling directory
+	// "name.versions" (see versionsSuffix), holding every content
+	// the file has had, named by the time it was set. Versions
+	// can also be looked up by how many changes ago they were,
+	// as name.versions/~1 for the previous contents.
+	Versions bool
+
+	// AttrFiles, if true, gives each entry "name" of a mutable
+	// directory a hidden sibling file "name.camli-attr" (see
+	// attrFileSuffix), and the directory itself one named
+	// ".camli-attr", listing the attributes of the entry's
+	// permanode when read and setting those written to it as
+	// "key=value" lines.
+	AttrFiles bool
+
+	// RecursiveRemove, if true, makes removing a mutable directory
+	// also delete the camliPath links of everything below it,
+	// instead of only unlinking the directory itself and leaving
+	// its subtree linked but unreachable. Directories in the
+	// subtree which are also linked from elsewhere are kept whole.
+	RecursiveRemove bool
+
+	// RenameMovesContent, if true, makes renaming a file over
+	// another, as editors do to save, give the replaced file's
+	// permanode the renamed one's content instead of linking the
+	// renamed one's permanode in its place. The name then keeps
+	// its permanode and inode number, and the attributes of the
+	// replaced file, and the renamed file's permanode is left
+	// unlinked. Files open for writing are renamed as usual. The
+	// kernel may use the renamed node for the name until its entry
+	// for it expires, and it looks the name up again.
+	RenameMovesContent bool
+
+	// DetectCopies, if true, makes a file written with the bytes
+	// of a mutable file just read in full, as cp(1) does, point at
+	// the contents already stored rather than upload them again.
+	// It hashes the bytes read and written through every handle,
+	// holding up to 4 MB of them per handle when they come out of
+	// order. See copy.go.
+	DetectCopies bool
+
+	// SigningEACCES, if true, makes operations fail with EACCES
+	// rather than EIO when the claims they need can't be signed
+	// because the client has no signing key (see
+	// client.SigningError), so it shows as a credentials problem.
+	SigningEACCES bool
+
+	// StatContents, if true, makes listing a mutable directory
+	// check that the blob server has the content blobs of its
+	// files, with one stat request, and leave out the files whose
+	// content is missing, e.g. not replicated yet, rather than
+	// list files that can't be read.
+	StatContents bool
+
+	// ShowConflicts, if true, shows the links a directory's name
+	// has besides the latest, left by clients adding rather than
+	// setting them, as name.conflict-1 and so on, rather than
+	// hiding them. See conflict.go.
+	ShowConflicts bool
+
+	// ChunkCacheBytes, if positive, is how many bytes of the
+	// blobs read for file contents to keep in memory, least
+	// recently used first out, so re-reading a file doesn't
+	// fetch them again. See chunkCache.
+	ChunkCacheBytes int64
+
+	// ClaimBatchWindow, if positive, makes the claims recording
+	// most changes, such as creating, removing or writing files,
+	// upload in the background, batched with the others made
+	// within that long, rather than one request at a time before
+	// the operation returns. Operations then don't report failures
+	// to upload them; FlushClaims and Fsync do. Changes are seen
+	// by other clients once uploaded. See claimQueue.
+	ClaimBatchWindow time.Duration
+
+	// ReadAheadBytes, if positive, makes a handle read
+	// sequentially fetch that many bytes of the file past those
+	// read in the background, several blocks at once, rather than
+	// each only once the kernel asks for it. It speeds up reading
+	// large files from a server far away, at the cost of fetching
+	// some unneeded bytes when reading stops early.
+	ReadAheadBytes int64
+
+	// AttrValid is how long the kernel may cache the attributes of
+	// mutable files and directories before asking for them again.
+	// Zero means DefaultAttrValid. Longer spares stat-heavy
+	// programs the round trips, but changes made by other clients
+	// take up to that long to show.
+	AttrValid time.Duration
+
+	// UploadBytesPerSecond and DownloadBytesPerSecond, if
+	// positive, limit how fast the contents of files are read to
+	// be stored, and how fast their blobs are fetched to be read,
+	// across all the files of the mount, so that copying a large
+	// tree in or out doesn't saturate the link. Blobs served from
+	// the chunk cache aren't limited.
+	UploadBytesPerSecond   int64
+	DownloadBytesPerSecond int64
+
+	// Chunking, if non-nil, is how the contents of files written
+	// are cut into blobs, e.g. smaller chunks for a tree of many
+	// similar small files, or fixed ones for large media. Nil is
+	// the schema package's default chunking.
+	Chunking *schema.ChunkOptions
+
+	signingErrorOnce sync.Once // logs the first signing error
+
+	readFetcherOnce sync.Once
+	readFetch       blobref.SeekFetcher // see readFetcher
+	chunkCache      *chunkCache         // or nil
+
+	uploadClientOnce sync.Once
+	uploadCl         camliClient // see uploadClient
+
+	uploadLimitOnce sync.Once
+	uploadLimit     *rateLimiter // or nil; see uploadReader
+
+	locks    lockTable  // see lock.go
+	inodes   inodeTable // see inode.go
+	claims   claimQueue // see claimqueue.go
+	claimLog *claimLog  // or nil; see claimlog.go
+	open     openFiles  // see close.go
+
+	writeSlots writeSlots // see openlimit.go
+
 	blobToSchema *lru.Cache // ~map[blobstring]*schema.Blob
 	nameToBlob   *lru.Cache // ~map[string]*blobref.BlobRef
 	nameToAttr   *lru.Cache // ~map[string]*fuse.Attr
+	readContents *lru.Cache // ~map[digest/size]*blobref.BlobRef; see copy.go
 }
 
 var _ fuse.FS = (*CamliFileSystem)(nil)
 
+// DefaultPopulateDepth is the describe depth used to list mutable
+// directories when CamliFileSystem.PopulateDepth is zero.
+const DefaultPopulateDepth = 3
+
+// DefaultAttrValid is how long the kernel may cache attributes when
+// CamliFileSystem.AttrValid is zero.
+const DefaultAttrValid = 1 * time.Minute
+
+// attrValid returns how long the kernel may cache the attributes
+// returned by Getattr and Setattr.
+func (fs *CamliFileSystem) attrValid() time.Duration {
+	if fs.AttrValid > 0 {
+		return fs.AttrValid
+	}
+	return DefaultAttrValid
+}
+
 func newCamliFileSystem(fetcher blobref.SeekFetcher) *CamliFileSystem {
 	return &CamliFileSystem{
 		fetcher:      fetcher,
 		blobToSchema: lru.New(1024), // arbitrary; TODO: tunable/smarter?
 		nameToBlob:   lru.New(1024), // arbitrary: TODO: tunable/smarter?
 		nameToAttr:   lru.New(1024), // arbitrary: TODO: tunable/smarter?
+		readContents: lru.New(64),   // only the most recent reads are copied
 	}
 }
 
@@ -97,6 +416,49 @@ func NewRootedCamliFileSystem(fetcher blobref.SeekFetcher, root *blobref.BlobRef
 	return fs, nil
 }
 
+// NewPermanodeCamliFileSystem returns a CamliFileSystem with the
+// mutable directory of the permanode root as its base. The root is
+// described first, so that a root the search server doesn't know
+// fails here, rather than the first listing with EIO.
+func NewPermanodeCamliFileSystem(client *client.Client, fetcher blobref.SeekFetcher, root *blobref.BlobRef) (*CamliFileSystem, error) {
+	if client == nil || fetcher == nil {
+		panic("nil argument")
+	}
+	fs := newCamliFileSystem(fetcher)
+	fs.client = client
+	if err := fs.setPermanodeRoot(root); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// describe sends req to the search server, timing it for the
+// describe stats.
+func (fs *CamliFileSystem) describe(req *search.DescribeRequest) (*search.DescribeResponse, error) {
+	start := time.Now()
+	res, err := fs.client.Describe(req)
+	recordDescribe(time.Since(start))
+	return res, err
+}
+
+// setPermanodeRoot makes the directory of root fs's base, once a
+// describe shows root is a permanode.
+func (fs *CamliFileSystem) setPermanodeRoot(root *blobref.BlobRef) error {
+	res, err := fs.describe(&search.DescribeRequest{BlobRef: root, Depth: 1})
+	if err != nil {
+		return fmt.Errorf("fs: describing root %v: %v", root, err)
+	}
+	db := res.Meta[root.String()]
+	switch {
+	case db == nil || db.CamliType == "" && db.Permanode == nil:
+		return fmt.Errorf("fs: root %v not found by the search server", root)
+	case db.Permanode == nil:
+		return fmt.Errorf("fs: root %v is a %q blob, not a permanode", root, db.CamliType)
+	}
+	fs.root = &mutDir{fs: fs, permanode: root, name: "/"}
+	return nil
+}
+
 // node implements fuse.Node with a read-only Camli "file" or
 // "directory" blob.
 type node struct {
@@ -118,7 +480,7 @@ func (n *node) Attr() (attr fuse.Attr) {
 	_, err := n.schema()
 	if err != nil {
 		// Hm, can't return it. Just log it I guess.
-		log.Printf("error fetching schema superset for %v: %v", n.blobref, err)
+		n.fs.errorf("error fetching schema superset for %v: %v", n.blobref, err)
 	}
 	return n.attr
 }
@@ -172,31 +534,47 @@ func (n *node) schema() (*schema.Blob, error) {
 }
 
 func (n *node) Open(req *fuse.OpenRequest, res *fuse.OpenResponse, intr fuse.Intr) (fuse.Handle, fuse.Error) {
-	log.Printf("CAMLI Open on %v: %#v", n.blobref, req)
+	n.fs.debugf("CAMLI Open on %v: %#v", n.blobref, req)
 	ss, err := n.schema()
 	if err != nil {
-		log.Printf("open of %v: %v", n.blobref, err)
+		n.fs.errorf("open of %v: %v", n.blobref, err)
 		return nil, fuse.EIO
 	}
 	if ss.Type() == "directory" {
 		return n, nil
 	}
-	fr, err := ss.NewFileReader(n.fs.fetcher)
+	fr, err := ss.NewFileReader(n.fs.readFetcher())
 	if err != nil {
 		// Will only happen if ss.Type != "file" or "bytes"
-		log.Printf("NewFileReader(%s) = %v", n.blobref, err)
+		n.fs.errorf("NewFileReader(%s) = %v", n.blobref, err)
 		return nil, fuse.EIO
 	}
-	return &nodeReader{n: n, fr: fr}, nil
+	return newNodeReader(n, fr), nil
 }
 
 type nodeReader struct {
 	n  *node
 	fr *schema.FileReader
+
+	// copied, if non-nil, hashes the bytes read, to recognize
+	// copies of a mutable file's content with DetectCopies; see
+	// copy.go.
+	copied *seqHash
+
+	ra *readAhead // or nil; see readahead.go
+}
+
+// newNodeReader returns a handle reading n's contents with fr.
+func newNodeReader(n *node, fr *schema.FileReader) *nodeReader {
+	nr := &nodeReader{n: n, fr: fr}
+	if max := n.fs.ReadAheadBytes; max > 0 {
+		nr.ra = newReadAhead(fr, max)
+	}
+	return nr
 }
 
 func (nr *nodeReader) Read(req *fuse.ReadRequest, res *fuse.ReadResponse, intr fuse.Intr) fuse.Error {
-	log.Printf("CAMLI nodeReader READ on %v: %#v", nr.n.blobref, req)
+	nr.n.fs.debugf("CAMLI nodeReader READ on %v: %#v", nr.n.blobref, req)
 	if req.Offset >= nr.fr.Size() {
 		return nil
 	}
@@ -205,26 +583,43 @@ func (nr *nodeReader) Read(req *fuse.ReadRequest, res *fuse.ReadResponse, intr f
 		size -= int((int64(size) + req.Offset) - nr.fr.Size())
 	}
 	buf := make([]byte, size)
+	if nr.ra != nil {
+		if n, ok := nr.ra.read(buf, req.Offset); ok {
+			res.Data = buf[:n]
+			nr.readDone(req, res)
+			return nil
+		}
+	}
 	n, err := nr.fr.ReadAt(buf, req.Offset)
 	if err == io.EOF {
 		err = nil
 	}
 	if err != nil {
-		log.Printf("camli read on %v at %d: %v", nr.n.blobref, req.Offset, err)
+		nr.n.fs.errorf("camli read on %v at %d: %v", nr.n.blobref, req.Offset, err)
 		return fuse.EIO
 	}
 	res.Data = buf[:n]
+	nr.readDone(req, res)
 	return nil
 }
 
+// readDone accounts for the read of res.Data.
+func (nr *nodeReader) readDone(req *fuse.ReadRequest, res *fuse.ReadResponse) {
+	if nr.copied != nil {
+		nr.n.fs.readContent(nr.copied, nr.n.blobref, nr.fr.Size(), req.Offset, res.Data)
+	}
+	fileRead.Incr()
+	fileReadBytes.Add(int64(len(res.Data)))
+}
+
 func (nr *nodeReader) Release(req *fuse.ReleaseRequest, intr fuse.Intr) fuse.Error {
-	log.Printf("CAMLI nodeReader RELEASE on %v", nr.n.blobref)
+	nr.n.fs.debugf("CAMLI nodeReader RELEASE on %v", nr.n.blobref)
 	nr.fr.Close()
 	return nil
 }
 
 func (n *node) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
-	log.Printf("CAMLI ReadDir on %v", n.blobref)
+	n.fs.debugf("CAMLI ReadDir on %v", n.blobref)
 	n.dmu.Lock()
 	defer n.dmu.Unlock()
 	if n.dirents != nil {
@@ -233,17 +628,17 @@ func (n *node) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
 
 	ss, err := n.schema()
 	if err != nil {
-		log.Printf("camli.ReadDir error on %v: %v", n.blobref, err)
+		n.fs.errorf("camli.ReadDir error on %v: %v", n.blobref, err)
 		return nil, fuse.EIO
 	}
 	dr, err := schema.NewDirReader(n.fs.fetcher, ss.BlobRef())
 	if err != nil {
-		log.Printf("camli.ReadDir error on %v: %v", n.blobref, err)
+		n.fs.errorf("camli.ReadDir error on %v: %v", n.blobref, err)
 		return nil, fuse.EIO
 	}
 	schemaEnts, err := dr.Readdir(-1)
 	if err != nil {
-		log.Printf("camli.ReadDir error on %v: %v", n.blobref, err)
+		n.fs.errorf("camli.ReadDir error on %v: %v", n.blobref, err)
 		return nil, fuse.EIO
 	}
 	n.dirents = make([]fuse.Dirent, 0)
@@ -291,7 +686,7 @@ func (n *node) populateAttr() error {
 	case "symlink":
 		n.attr.Mode |= 0400
 	default:
-		log.Printf("unknown attr ss.Type %q in populateAttr", meta.Type())
+		n.fs.warnf("unknown attr ss.Type %q in populateAttr", meta.Type())
 	}
 	return nil
 }
@@ -300,15 +695,86 @@ func (fs *CamliFileSystem) Root() (fuse.Node, fuse.Error) {
 	return fs.root, nil
 }
 
+// Init asks the kernel to forward POSIX lock requests, so they're
+// kept in fs.locks.
+func (fs *CamliFileSystem) Init(req *fuse.InitRequest, res *fuse.InitResponse, intr fuse.Intr) fuse.Error {
+	res.Flags |= req.Flags & fuse.InitPosixLocks
+	return nil
+}
+
+// statfsBlockSize is the block size reported to statfs(2).
+const statfsBlockSize = 1024
+
 func (fs *CamliFileSystem) Statfs(req *fuse.StatfsRequest, res *fuse.StatfsResponse, intr fuse.Intr) fuse.Error {
-	// Make some stuff up, just to see if it makes "lsof" happy.
+	// Blob storage has no fixed size, so make up something large
+	// enough that programs checking for free space will proceed,
+	// unless the blob source can tell us what it really has.
 	res.Blocks = 1 << 35
 	res.Bfree = 1 << 34
 	res.Bavail = 1 << 34
+	if cr := fs.capacityReporter(); cr != nil {
+		total, free, err := cr.StorageCapacity()
+		if err == nil && total > 0 {
+			res.Blocks = uint64(total) / statfsBlockSize
+			res.Bfree = uint64(free) / statfsBlockSize
+			res.Bavail = res.Bfree
+		} else if err != nil {
+			fs.warnf("fs.Statfs: StorageCapacity: %v", err)
+		}
+	}
+	// There's no limit on the number of files either.
 	res.Files = 1 << 29
 	res.Ffree = 1 << 28
 	res.Namelen = 2048
-	res.Bsize = 1024
+	res.Bsize = statfsBlockSize
+	res.Frsize = statfsBlockSize
+	return nil
+}
+
+// readFetcher returns the fetcher to read file contents through:
+// the chunk cache, if ChunkCacheBytes is set, over the plain fetcher,
+// limited to DownloadBytesPerSecond if set.
+func (fs *CamliFileSystem) readFetcher() blobref.SeekFetcher {
+	fs.readFetcherOnce.Do(func() {
+		fs.readFetch = fs.fetcher
+		if fs.DownloadBytesPerSecond > 0 {
+			fs.readFetch = &throttledFetcher{fs.fetcher, newRateLimiter(fs.DownloadBytesPerSecond)}
+		}
+		if fs.ChunkCacheBytes > 0 {
+			fs.chunkCache = newChunkCache(fs.readFetch, fs.ChunkCacheBytes)
+			fs.readFetch = fs.chunkCache
+		}
+	})
+	return fs.readFetch
+}
+
+// capacityReporter returns the client, or else the fetcher, if it
+// reports the blob storage's capacity, or nil.
+func (fs *CamliFileSystem) capacityReporter() blobserver.CapacityReporter {
+	if cr, ok := fs.client.(blobserver.CapacityReporter); ok {
+		return cr
+	}
+	if cr, ok := fs.fetcher.(blobserver.CapacityReporter); ok {
+		return cr
+	}
+	return nil
+}
+
+// checkSpace returns syscall.ENOSPC if the blob storage reports less
+// than size bytes free. An unknown capacity isn't an error.
+func (fs *CamliFileSystem) checkSpace(size int64) error {
+	cr := fs.capacityReporter()
+	if cr == nil {
+		return nil
+	}
+	total, free, err := cr.StorageCapacity()
+	if err != nil {
+		fs.warnf("fs.checkSpace: StorageCapacity: %v", err)
+		return nil
+	}
+	if total > 0 && free < size {
+		return syscall.ENOSPC
+	}
 	return nil
 }
 
@@ -328,11 +794,11 @@ func (fs *CamliFileSystem) fetchSchemaMeta(br *blobref.BlobRef) (*schema.Blob, e
 	defer rsc.Close()
 	blob, err := schema.BlobFromReader(br, rsc)
 	if err != nil {
-		log.Printf("Error parsing %s as schema blob: %v", br, err)
+		fs.errorf("Error parsing %s as schema blob: %v", br, err)
 		return nil, os.ErrInvalid
 	}
 	if blob.Type() == "" {
-		log.Printf("blob %s is JSON but lacks camliType", br)
+		fs.warnf("blob %s is JSON but lacks camliType", br)
 		return nil, os.ErrInvalid
 	}
 	fs.blobToSchema.Add(blobStr, blob)
@@ -347,6 +347,34 @@ func TestDifferentWriteTypes(t *testing.T) {
 	})
 }
 
+func TestFsync(t *testing.T) {
+	condSkip(t)
+	inEmptyMutDir(t, func(env *mountEnv, rootDir string) {
+		filename := filepath.Join(rootDir, "synced")
+		f, err := os.Create(filename)
+		if err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		defer f.Close()
+		const want = "durable contents"
+		if _, err := f.Write([]byte(want)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := f.Sync(); err != nil {
+			t.Fatalf("Sync: %v", err)
+		}
+
+		// Read it via another handle while the first is still open.
+		slurp, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(slurp); got != want {
+			t.Errorf("after fsync, contents = %q; want %q", got, want)
+		}
+	})
+}
+
 func statStr(name string) string {
 	fi, err := os.Stat(name)
 	if os.IsNotExist(err) {
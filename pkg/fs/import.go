@@ -0,0 +1,331 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/readerutil"
+	"camlistore.org/pkg/schema"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// importBatchBytes is about how many bytes of file contents Import
+// holds in memory before uploading them. It's a variable for tests.
+var importBatchBytes int64 = 16 << 20
+
+// Import creates the files of tree, keyed by their slash-separated
+// paths, in the mutable directory at dirPath, relative to the root
+// of fs, as restoring a backup would, with a few requests for all of
+// them rather than several per file. The directories on the paths
+// are created as needed; a path with a nil reader is made an empty
+// directory.
+//
+// The files' contents are uploaded together, up to
+// importBatchBytes at a time, then the permanodes of all the files
+// and directories, then the claims linking them, those linking the
+// tree into dirPath last, so that it only shows once complete. The
+// top-level names of tree must not exist in dirPath.
+func (fs *CamliFileSystem) Import(dirPath string, tree map[string]io.Reader) error {
+	if fs.readOnly() {
+		return &os.PathError{Op: "import", Path: dirPath, Err: syscall.EPERM}
+	}
+	dir, err := fs.lookupMutDir(dirPath)
+	if err != nil {
+		return err
+	}
+	nodes, err := importNodes(tree)
+	if err != nil {
+		return err
+	}
+	for _, in := range nodes {
+		if in.parent != nil {
+			continue
+		}
+		switch _, ferr := dir.Lookup(in.name, nil); {
+		case ferr == nil:
+			return &os.PathError{Op: "import", Path: path.Join(dirPath, in.name), Err: syscall.EEXIST}
+		case ferr != fuse.ENOENT:
+			return fmt.Errorf("fs: import: looking up %q: %v", path.Join(dirPath, in.name), ferr)
+		}
+	}
+
+	batch := &importBatch{fs: fs, seen: make(map[string]bool)}
+	for _, in := range nodes {
+		if in.dir {
+			continue
+		}
+		r := readerutil.CountingReader{Reader: fs.uploadReader(in.contents), N: &in.size}
+		if in.content, err = schema.WriteFileFromReaderChunked(batch, in.name, r, fs.Chunking); err != nil {
+			return fmt.Errorf("fs: import: storing %q: %v", in.path, err)
+		}
+	}
+	if err := batch.flush(); err != nil {
+		return err
+	}
+
+	pns := make([]schema.AnyBlob, len(nodes))
+	for i := range nodes {
+		pns[i] = schema.NewUnsignedPermanode()
+	}
+	prs, err := fs.uploadAndSignBatches(pns)
+	if err != nil {
+		return fmt.Errorf("fs: import: uploading permanodes: %v", err)
+	}
+	for i, in := range nodes {
+		in.permanode = prs[i].BlobRef
+	}
+
+	var claims, links []schema.AnyBlob
+	for _, in := range nodes {
+		if !in.dir {
+			claims = append(claims, schema.NewSetAttributeClaim(in.permanode, "camliContent", in.content.String()))
+		}
+		if in.parent != nil {
+			claims = append(claims, schema.NewSetAttributeClaim(in.parent.permanode, "camliPath:"+in.name, in.permanode.String()))
+		} else {
+			links = append(links, schema.NewSetAttributeClaim(dir.permanode, "camliPath:"+in.name, in.permanode.String()))
+		}
+	}
+	if err := fs.uploadImportClaims(claims); err != nil {
+		return fmt.Errorf("fs: import: uploading claims: %v", err)
+	}
+	if err := fs.uploadImportClaims(links); err != nil {
+		return fmt.Errorf("fs: import: linking into %q: %v", dirPath, err)
+	}
+
+	dir.mu.Lock()
+	if dir.children == nil {
+		dir.children = make(map[string]mutFileOrDir)
+	}
+	for _, in := range nodes {
+		if in.parent != nil {
+			continue
+		}
+		var child mutFileOrDir
+		if in.dir {
+			child = &mutDir{fs: fs, permanode: in.permanode, parent: dir, name: in.name, xattrs: map[string][]byte{}}
+		} else {
+			child = &mutFile{fs: fs, permanode: in.permanode, parent: dir, name: in.name, content: in.content, size: in.size, xattrs: map[string][]byte{}}
+		}
+		dir.children[in.name] = child
+		dir.unbury(in.name)
+	}
+	dir.childGen++
+	dir.mu.Unlock()
+	dir.touch(time.Now())
+	return nil
+}
+
+// importNode is a file or directory created by Import.
+type importNode struct {
+	path     string
+	name     string
+	parent   *importNode // or nil, if at the top of the tree
+	dir      bool
+	contents io.Reader // if a file
+
+	content   *blobref.BlobRef // once stored, if a file
+	size      int64
+	permanode *blobref.BlobRef // once uploaded
+}
+
+// importNodes returns the nodes of tree and of the directories on
+// its paths, parents first.
+func importNodes(tree map[string]io.Reader) ([]*importNode, error) {
+	byPath := make(map[string]*importNode)
+	var add func(p string, contents io.Reader) (*importNode, error)
+	add = func(p string, contents io.Reader) (*importNode, error) {
+		isDir := contents == nil
+		if in, ok := byPath[p]; ok {
+			if !in.dir || !isDir {
+				return nil, &os.PathError{Op: "import", Path: p, Err: syscall.ENOTDIR}
+			}
+			return in, nil
+		}
+		in := &importNode{path: p, name: path.Base(p), dir: isDir, contents: contents}
+		if parent := path.Dir(p); parent != "." {
+			var err error
+			if in.parent, err = add(parent, nil); err != nil {
+				return nil, err
+			}
+		}
+		byPath[p] = in
+		return in, nil
+	}
+	for p, contents := range tree {
+		clean := path.Clean(p)
+		if clean != p || p == "." || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return nil, &os.PathError{Op: "import", Path: p, Err: syscall.EINVAL}
+		}
+		if _, err := add(p, contents); err != nil {
+			return nil, err
+		}
+	}
+	var paths []string
+	for p := range byPath {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths) // parents sort before their children
+	nodes := make([]*importNode, len(paths))
+	for i, p := range paths {
+		nodes[i] = byPath[p]
+	}
+	return nodes, nil
+}
+
+// lookupMutDir returns the mutable directory at the slash-separated
+// path p, relative to the root of fs.
+func (fs *CamliFileSystem) lookupMutDir(p string) (*mutDir, error) {
+	n := fs.root
+	for _, name := range strings.Split(p, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		l, ok := n.(interface {
+			Lookup(string, fuse.Intr) (fuse.Node, fuse.Error)
+		})
+		if !ok {
+			return nil, &os.PathError{Op: "import", Path: p, Err: syscall.ENOTDIR}
+		}
+		var ferr fuse.Error
+		if n, ferr = l.Lookup(name, nil); ferr != nil {
+			return nil, fmt.Errorf("fs: looking up %q in %q: %v", name, p, ferr)
+		}
+	}
+	dir, ok := n.(*mutDir)
+	if !ok {
+		return nil, &os.PathError{Op: "import", Path: p, Err: syscall.ENOTDIR}
+	}
+	return dir, nil
+}
+
+// uploadAndSignBatches signs and uploads bs, in batches of up to
+// maxClaimBatch blobs. The results are in the order of bs.
+func (fs *CamliFileSystem) uploadAndSignBatches(bs []schema.AnyBlob) ([]*client.PutResult, error) {
+	var prs []*client.PutResult
+	for len(bs) > 0 {
+		n := len(bs)
+		if n > maxClaimBatch {
+			n = maxClaimBatch
+		}
+		res, err := fs.uploadClient().UploadAndSignBlobs(bs[:n])
+		if err != nil {
+			return nil, err
+		}
+		prs = append(prs, res...)
+		bs = bs[n:]
+	}
+	return prs, nil
+}
+
+// uploadImportClaims uploads Import's claims, logging them first to
+// the claim log, like uploadClaim, so a failed upload is retried by
+// the next mount.
+func (fs *CamliFileSystem) uploadImportClaims(claims []schema.AnyBlob) error {
+	ids := make([]int64, len(claims))
+	for i, claim := range claims {
+		id, err := fs.logClaim(claim)
+		if err != nil {
+			return err
+		}
+		ids[i] = id
+	}
+	if _, err := fs.uploadAndSignBatches(claims); err != nil {
+		return err
+	}
+	fs.claimsDone(ids...)
+	return nil
+}
+
+// importBatch is a blobserver.StatReceiver holding the blobs it
+// receives in memory, for Import to upload them together with
+// flush. It flushes itself once it holds importBatchBytes.
+// schema.WriteFileFromReaderChunked calls ReceiveBlob from several
+// goroutines at once.
+type importBatch struct {
+	fs *CamliFileSystem
+
+	flushMu sync.Mutex // held while uploading, so flushes run one at a time
+
+	mu    sync.Mutex // guards the following
+	hs    []*client.UploadHandle
+	seen  map[string]bool // blobrefs in hs
+	bytes int64           // sum of hs's sizes
+}
+
+func (b *importBatch) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.SizedBlobRef, error) {
+	slurp, err := ioutil.ReadAll(source)
+	if err != nil {
+		return blobref.SizedBlobRef{}, err
+	}
+	sb := blobref.SizedBlobRef{BlobRef: br, Size: int64(len(slurp))}
+	b.mu.Lock()
+	if b.seen[br.String()] {
+		b.mu.Unlock()
+		return sb, nil
+	}
+	b.seen[br.String()] = true
+	b.hs = append(b.hs, &client.UploadHandle{BlobRef: br, Size: sb.Size, Contents: bytes.NewReader(slurp)})
+	b.bytes += sb.Size
+	full := b.bytes >= importBatchBytes
+	b.mu.Unlock()
+	if full {
+		if err := b.flush(); err != nil {
+			return blobref.SizedBlobRef{}, err
+		}
+	}
+	return sb, nil
+}
+
+// StatBlobs reports nothing: the server's blobs are skipped by
+// flush's upload.
+func (b *importBatch) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs []*blobref.BlobRef, wait time.Duration) error {
+	return nil
+}
+
+// flush uploads the blobs received so far.
+func (b *importBatch) flush() error {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	hs := b.hs
+	b.hs, b.seen, b.bytes = nil, make(map[string]bool), 0
+	b.mu.Unlock()
+	if len(hs) == 0 {
+		return nil
+	}
+	if _, err := b.fs.uploadClient().UploadMany(hs); err != nil {
+		return fmt.Errorf("fs: import: uploading contents: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestImport(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	fs.root = dir
+	if _, err := dir.creat("restore", dirType); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a.txt":            "hello",
+		"sub/b.txt":        "world",
+		"sub/deep/c.txt":   "!",
+		"sub/deep/dup.txt": "hello",
+	}
+	tree := map[string]io.Reader{"empty": nil}
+	for p, contents := range files {
+		tree[p] = strings.NewReader(contents)
+	}
+	batches := fc.batches
+	if err := fs.Import("restore", tree); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	// Contents, permanodes, claims, and the top-level links.
+	if n := fc.batches - batches; n != 4 {
+		t.Errorf("Import made %d batch requests; want 4", n)
+	}
+
+	// As if remounted: a fresh node for the same permanode.
+	cold, err := fs.lookupMutDir("restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cold = &mutDir{fs: fs, permanode: cold.permanode, name: "cold"}
+	lookup := func(p string) fuse.Node {
+		var n fuse.Node = cold
+		for _, name := range strings.Split(p, "/") {
+			var ferr fuse.Error
+			if n, ferr = n.(*mutDir).Lookup(name, nil); ferr != nil {
+				t.Fatalf("Lookup(%q) of %q: %v", name, p, ferr)
+			}
+		}
+		return n
+	}
+	for p, contents := range files {
+		mf, ok := lookup(p).(*mutFile)
+		if !ok {
+			t.Errorf("%q isn't a file", p)
+			continue
+		}
+		if got := storedContents(t, mf); got != contents {
+			t.Errorf("%q contents = %q; want %q", p, got, contents)
+		}
+	}
+	empty, ok := lookup("empty").(*mutDir)
+	if !ok {
+		t.Fatal(`"empty" isn't a directory`)
+	}
+	if ents, err := empty.ReadDir(nil); err != nil || len(ents) != 0 {
+		t.Errorf("ReadDir of empty = %v, %v; want no entries", ents, err)
+	}
+	if ents, err := cold.ReadDir(nil); err != nil || len(ents) != 3 {
+		t.Errorf("ReadDir of the import = %v, %v; want a.txt, empty and sub", ents, err)
+	}
+
+	// The mount's node sees them without a populate.
+	restore, _ := fs.lookupMutDir("restore")
+	if _, err := restore.Lookup("a.txt", nil); err != nil {
+		t.Errorf("Lookup of an imported file: %v", err)
+	}
+}
+
+func TestImportLargeFile(t *testing.T) {
+	defer func(old int64) { importBatchBytes = old }(importBatchBytes)
+	importBatchBytes = 64 << 10
+	fs, fc, dir := newFakeFS(t)
+	fs.root = dir
+	contents := make([]byte, 1<<20)
+	rand.Read(contents)
+	batches := fc.batches
+	if err := fs.Import("", map[string]io.Reader{"big": bytes.NewReader(contents)}); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	// Besides the permanodes, claims and links, the contents are
+	// uploaded in several batches, not held until the file's end.
+	if n := fc.batches - batches - 3; n < 2 {
+		t.Errorf("Import uploaded the contents in %d batches; want several", n)
+	}
+	n, err := dir.Lookup("big", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := storedContents(t, n.(*mutFile)); got != string(contents) {
+		t.Errorf("imported contents differ: got %d bytes; want %d", len(got), len(contents))
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	fs.root = dir
+	newFileWithContent(t, dir, "exists", "contents")
+	tests := []struct {
+		tree  map[string]io.Reader
+		check func(error) bool
+	}{
+		{map[string]io.Reader{"exists/x": strings.NewReader("x")}, os.IsExist},
+		{map[string]io.Reader{"x": strings.NewReader("x"), "x/y": strings.NewReader("y")}, nil},
+		{map[string]io.Reader{"../x": strings.NewReader("x")}, nil},
+		{map[string]io.Reader{"/x": strings.NewReader("x")}, nil},
+		{map[string]io.Reader{"x//y": strings.NewReader("x")}, nil},
+	}
+	for _, tt := range tests {
+		err := fs.Import("", tt.tree)
+		if err == nil || tt.check != nil && !tt.check(err) {
+			t.Errorf("Import(%v) = %v", tt.tree, err)
+		}
+	}
+	if _, err := dir.Lookup("x", nil); err != fuse.ENOENT {
+		t.Errorf("after failed imports, Lookup(x) = %v; want ENOENT", err)
+	}
+	fs.ReadOnly = true
+	if err := fs.Import("", map[string]io.Reader{"ro": nil}); !os.IsPermission(err) {
+		t.Errorf("Import on a read-only mount = %v; want EPERM", err)
+	}
+}
@@ -0,0 +1,151 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"sync"
+
+	"camlistore.org/pkg/blobref"
+)
+
+// InodeFor returns the inode number of the node of br: the first 64
+// bits of its digest, so it's the same in every mount. It's never
+// zero, which the fuse package takes as unset.
+//
+// Blobrefs whose digests share their first 64 bits, e.g. of
+// different hash types, get the same number; within a mount,
+// CamliFileSystem gives all but the first seen another one (see
+// inodeTable).
+func InodeFor(br *blobref.BlobRef) uint64 {
+	if ino := br.AsUint64(); ino != 0 {
+		return ino
+	}
+	return 1
+}
+
+// inodeTable assigns the inode numbers of the nodes of a mount, so
+// that no two live blobrefs get the same one: the first blobref seen
+// of an InodeFor number gets it, and those colliding with it the
+// next free one of a sequence derived from it. Numbers are counted
+// references, taken by nodes once and dropped when the kernel
+// forgets them, so the table only holds the mount's live nodes.
+type inodeTable struct {
+	mu    sync.Mutex
+	ino   map[string]uint64 // blobref string -> inode, once collided
+	owner map[uint64]*inodeOwner
+}
+
+// inodeOwner is the blobref holding an inode number.
+type inodeOwner struct {
+	key  string // blobref string
+	refs int
+}
+
+// inodeStride is added to an inode number taken by another blobref
+// to find a free one. It's odd, so all numbers are eventually tried,
+// and large, so the ones tried aren't InodeFor numbers of blobrefs
+// close to the first.
+const inodeStride = 0x9e3779b97f4a7c15
+
+// inode returns the inode number of the nodes of br within fs, and
+// takes a reference on it, dropped by releaseInode. Nodes call it
+// once, through their inodeNum methods, rather than on each Attr.
+func (fs *CamliFileSystem) inode(br *blobref.BlobRef) uint64 {
+	t := &fs.inodes
+	key := br.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.owner == nil {
+		t.owner = make(map[uint64]*inodeOwner)
+		t.ino = make(map[string]uint64)
+	}
+	if ino, ok := t.ino[key]; ok {
+		t.owner[ino].refs++
+		return ino
+	}
+	ino := InodeFor(br)
+	for {
+		o, taken := t.owner[ino]
+		if !taken {
+			t.owner[ino] = &inodeOwner{key: key, refs: 1}
+			break
+		}
+		if o.key == key {
+			o.refs++
+			return ino
+		}
+		ino += inodeStride
+		if ino == 0 {
+			ino += inodeStride
+		}
+	}
+	if ino != InodeFor(br) {
+		// Only remapped blobrefs need a lookup by key: the
+		// others find themselves as their number's owner.
+		t.ino[key] = ino
+	}
+	return ino
+}
+
+// releaseInode drops a reference taken by inode on ino, freeing the
+// number once none are left.
+func (fs *CamliFileSystem) releaseInode(ino uint64) {
+	t := &fs.inodes
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	o, ok := t.owner[ino]
+	if !ok {
+		return
+	}
+	if o.refs--; o.refs > 0 {
+		return
+	}
+	delete(t.owner, ino)
+	delete(t.ino, o.key)
+}
+
+// nodeInode is a node's inode number, taken from the mount's
+// inodeTable when first asked for and released when the kernel
+// forgets the node.
+type nodeInode struct {
+	mu  sync.Mutex
+	ino uint64 // or 0, if not taken
+}
+
+// get returns the inode number of the node of br, taking it first
+// if needed.
+func (n *nodeInode) get(fs *CamliFileSystem, br *blobref.BlobRef) uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ino == 0 {
+		n.ino = fs.inode(br)
+	}
+	return n.ino
+}
+
+// forget releases the node's inode number; the next get takes it
+// again.
+func (n *nodeInode) forget(fs *CamliFileSystem) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ino != 0 {
+		fs.releaseInode(n.ino)
+		n.ino = 0
+	}
+}
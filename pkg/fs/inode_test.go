@@ -0,0 +1,120 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+)
+
+func TestInodeFor(t *testing.T) {
+	br := blobref.SHA1FromString("foo")
+	if a, b := InodeFor(br), InodeFor(blobref.MustParse(br.String())); a != b {
+		t.Errorf("InodeFor of the same blobref = %x, then %x", a, b)
+	}
+	zero := blobref.MustParse("sha1-0000000000000000000000000000000000000000")
+	if ino := InodeFor(zero); ino == 0 {
+		t.Error("InodeFor returned zero")
+	}
+}
+
+func TestInodesUnique(t *testing.T) {
+	fs, _, _ := newFakeFS(t)
+	seen := make(map[uint64]*blobref.BlobRef)
+	check := func(br *blobref.BlobRef) {
+		ino := fs.inode(br)
+		if ino == 0 {
+			t.Fatalf("inode of %v is zero", br)
+		}
+		if other, ok := seen[ino]; ok && !other.Equal(br) {
+			t.Fatalf("%v and %v share inode %x", other, br, ino)
+		}
+		seen[ino] = br
+		if again := fs.inode(br); again != ino {
+			t.Fatalf("inode of %v = %x, then %x", br, ino, again)
+		}
+	}
+
+	var brs []*blobref.BlobRef
+	for i := 0; i < 10000; i++ {
+		brs = append(brs, blobref.SHA1FromString(fmt.Sprint(i)))
+	}
+	// Blobrefs colliding with those: the same leading digits
+	// under other hash types, and one that collides with an
+	// inode a collision was moved to.
+	for i, br := range brs[:100] {
+		prefix := br.Digest()[:16]
+		brs = append(brs,
+			blobref.MustParse(fmt.Sprintf("sha256-%s%048x", prefix, i)),
+			blobref.MustParse(fmt.Sprintf("md5-%s%016x", prefix, i)))
+	}
+	check(brs[0])
+	moved := fs.inode(brs[10000]) // collides with brs[0]
+	brs = append(brs, blobref.MustParse(fmt.Sprintf("sha1-%016x%024x", moved, 0)))
+	for _, br := range brs {
+		check(br)
+	}
+	// And again, in another order.
+	for i := len(brs) - 1; i >= 0; i-- {
+		check(brs[i])
+	}
+	if len(seen) != len(brs) {
+		t.Errorf("%d inodes for %d blobrefs", len(seen), len(brs))
+	}
+	if ino := fs.inode(brs[0]); ino != InodeFor(brs[0]) {
+		t.Errorf("first blobref of its inode was moved, to %x", ino)
+	}
+
+	// Nodes report them.
+	dir := &mutDir{fs: fs, permanode: brs[10000], name: "d"}
+	if a := dir.Attr(); a.Inode != moved {
+		t.Errorf("directory's inode = %x; want %x", a.Inode, moved)
+	}
+}
+
+func TestInodeForget(t *testing.T) {
+	fs, _, _ := newFakeFS(t)
+	a := blobref.SHA1FromString("a")
+	b := blobref.MustParse(fmt.Sprintf("sha256-%s%048x", a.Digest()[:16], 0))
+	da := &mutDir{fs: fs, permanode: a, name: "a"}
+	fb := &mutFile{fs: fs, permanode: b, name: "b"}
+	if ia, ib := da.Attr().Inode, fb.Attr().Inode; ia == ib {
+		t.Fatalf("%v and %v share inode %x", a, b, ia)
+	}
+	if n := len(fs.inodes.owner); n != 2 {
+		t.Errorf("%d inodes taken; want 2", n)
+	}
+
+	// Once a's node is forgotten, b's still holds its number.
+	da.Forget()
+	ib := fb.Attr().Inode
+	if ino := fs.inode(b); ino != ib {
+		t.Errorf("inode of %v = %x after a was forgotten; want %x", b, ino, ib)
+	}
+	fs.releaseInode(ib)
+	fb.Forget()
+	if n, m := len(fs.inodes.owner), len(fs.inodes.ino); n != 0 || m != 0 {
+		t.Errorf("after forgetting all nodes, %d inodes and %d remappings are kept", n, m)
+	}
+	if ino := da.Attr().Inode; ino != InodeFor(a) {
+		t.Errorf("inode of %v, taken again = %x; want %x", a, ino, InodeFor(a))
+	}
+}
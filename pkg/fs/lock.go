@@ -0,0 +1,190 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"sync"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// A lockTable holds the POSIX byte-range locks taken through one
+// mount, keyed by file (its permanode, or blobref for immutable
+// files). Locks aren't shared with other mounts or clients.
+type lockTable struct {
+	mu      sync.Mutex
+	locks   map[string][]heldLock
+	changed chan struct{} // closed, and replaced, when locks are released
+}
+
+// A heldLock is a lock on the bytes start through end, inclusive.
+type heldLock struct {
+	owner      uint64
+	pid        uint32
+	typ        fuse.LockType
+	start, end uint64
+}
+
+func (l heldLock) overlaps(start, end uint64) bool {
+	return l.start <= end && start <= l.end
+}
+
+// conflict returns a lock on key that keeps owner from taking l,
+// if any. t.mu must be held.
+func (t *lockTable) conflict(key string, owner uint64, l fuse.FileLock) (heldLock, bool) {
+	for _, hl := range t.locks[key] {
+		if hl.owner == owner || !hl.overlaps(l.Start, l.End) {
+			continue
+		}
+		if hl.typ == fuse.LockWrite || l.Type == fuse.LockWrite {
+			return hl, true
+		}
+	}
+	return heldLock{}, false
+}
+
+// set replaces owner's locks on key in l's range by l, splitting
+// the ones that only partly overlap it. t.mu must be held.
+func (t *lockTable) set(key string, owner uint64, l fuse.FileLock) {
+	var kept []heldLock
+	released := false
+	for _, hl := range t.locks[key] {
+		if hl.owner != owner || !hl.overlaps(l.Start, l.End) {
+			kept = append(kept, hl)
+			continue
+		}
+		if hl.start < l.Start {
+			left := hl
+			left.end = l.Start - 1
+			kept = append(kept, left)
+		}
+		if hl.end > l.End {
+			right := hl
+			right.start = l.End + 1
+			kept = append(kept, right)
+		}
+		released = true
+	}
+	if l.Type != fuse.LockUnlock {
+		kept = append(kept, heldLock{owner: owner, pid: l.Pid, typ: l.Type, start: l.Start, end: l.End})
+	}
+	if len(kept) == 0 {
+		delete(t.locks, key)
+	} else {
+		if t.locks == nil {
+			t.locks = make(map[string][]heldLock)
+		}
+		t.locks[key] = kept
+	}
+	// Downgrading a write lock to a read lock may also let
+	// waiters in, so wake them for any change to owner's locks.
+	if released && t.changed != nil {
+		close(t.changed)
+		t.changed = nil
+	}
+}
+
+// getlk reports in res a lock conflicting with l, or an unlocked
+// range if there is none.
+func (t *lockTable) getlk(key string, owner uint64, l fuse.FileLock, res *fuse.GetlkResponse) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	hl, ok := t.conflict(key, owner, l)
+	if !ok {
+		res.Lock = fuse.FileLock{Start: l.Start, End: l.End, Type: fuse.LockUnlock}
+		return
+	}
+	res.Lock = fuse.FileLock{Start: hl.start, End: hl.end, Type: hl.typ, Pid: hl.pid}
+}
+
+// setlk takes or releases the lock l for owner. If another owner's
+// lock is in the way, it fails with EAGAIN, or if wait is set,
+// waits for it to go away or for intr to be closed.
+func (t *lockTable) setlk(key string, owner uint64, l fuse.FileLock, wait bool, intr fuse.Intr) fuse.Error {
+	for {
+		t.mu.Lock()
+		if l.Type == fuse.LockUnlock {
+			t.set(key, owner, l)
+			t.mu.Unlock()
+			return nil
+		}
+		if _, ok := t.conflict(key, owner, l); !ok {
+			t.set(key, owner, l)
+			t.mu.Unlock()
+			return nil
+		}
+		if !wait {
+			t.mu.Unlock()
+			return fuse.EAGAIN
+		}
+		if t.changed == nil {
+			t.changed = make(chan struct{})
+		}
+		changed := t.changed
+		t.mu.Unlock()
+		select {
+		case <-changed:
+		case <-intr:
+			return fuse.EINTR
+		}
+	}
+}
+
+// releaseOwner drops all of owner's locks on key, as when it
+// closes the file.
+func (t *lockTable) releaseOwner(key string, owner uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.set(key, owner, fuse.FileLock{Start: 0, End: ^uint64(0), Type: fuse.LockUnlock})
+}
+
+// lockKey returns the key of f's locks in the file system's
+// lockTable.
+func (f *mutFile) lockKey() string {
+	return f.permanode.String()
+}
+
+// Getlk implements F_GETLK for the file.
+func (h *mutFileHandle) Getlk(req *fuse.GetlkRequest, res *fuse.GetlkResponse, intr fuse.Intr) fuse.Error {
+	h.f.fs.locks.getlk(h.f.lockKey(), req.Owner, req.Lock, res)
+	return nil
+}
+
+// Setlk implements F_SETLK and F_SETLKW for the file.
+func (h *mutFileHandle) Setlk(req *fuse.SetlkRequest, intr fuse.Intr) fuse.Error {
+	return h.f.fs.locks.setlk(h.f.lockKey(), req.Owner, req.Lock, req.Wait, intr)
+}
+
+// Getlk implements F_GETLK for the immutable file.
+func (nr *nodeReader) Getlk(req *fuse.GetlkRequest, res *fuse.GetlkResponse, intr fuse.Intr) fuse.Error {
+	nr.n.fs.locks.getlk(nr.n.blobref.String(), req.Owner, req.Lock, res)
+	return nil
+}
+
+// Setlk implements F_SETLK and F_SETLKW for the immutable file.
+func (nr *nodeReader) Setlk(req *fuse.SetlkRequest, intr fuse.Intr) fuse.Error {
+	return nr.n.fs.locks.setlk(nr.n.blobref.String(), req.Owner, req.Lock, req.Wait, intr)
+}
+
+// Flush releases the locks of the closing process, as POSIX says
+// closing any descriptor of a file does.
+func (nr *nodeReader) Flush(req *fuse.FlushRequest, intr fuse.Intr) fuse.Error {
+	nr.n.fs.locks.releaseOwner(nr.n.blobref.String(), req.LockOwner)
+	return nil
+}
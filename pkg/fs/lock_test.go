@@ -0,0 +1,137 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"math"
+	"syscall"
+	"testing"
+	"time"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// toEOF is the lock end the kernel sends for "to the end of the file".
+const toEOF = math.MaxInt64
+
+func TestLocks(t *testing.T) {
+	_, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "db", "contents")
+	open := func() *mutFileHandle {
+		h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return h.(*mutFileHandle)
+	}
+	h1, h2 := open(), open()
+	const owner1, owner2 = 1, 2
+	setlk := func(h *mutFileHandle, owner uint64, typ fuse.LockType, start, end uint64) fuse.Error {
+		return h.Setlk(&fuse.SetlkRequest{
+			Owner: owner,
+			Lock:  fuse.FileLock{Start: start, End: end, Type: typ, Pid: uint32(owner)},
+		}, nil)
+	}
+	getlk := func(h *mutFileHandle, owner uint64, typ fuse.LockType, start, end uint64) fuse.FileLock {
+		var res fuse.GetlkResponse
+		err := h.Getlk(&fuse.GetlkRequest{
+			Owner: owner,
+			Lock:  fuse.FileLock{Start: start, End: end, Type: typ},
+		}, &res, nil)
+		if err != nil {
+			t.Fatalf("Getlk: %v", err)
+		}
+		return res.Lock
+	}
+
+	// Shared locks don't conflict; an exclusive one does.
+	if err := setlk(h1, owner1, fuse.LockRead, 0, toEOF); err != nil {
+		t.Fatalf("first read lock: %v", err)
+	}
+	if err := setlk(h2, owner2, fuse.LockRead, 0, 99); err != nil {
+		t.Fatalf("second read lock: %v", err)
+	}
+	if err := setlk(h2, owner2, fuse.LockWrite, 50, 60); err != fuse.EAGAIN {
+		t.Errorf("write lock over another's read lock = %v; want EAGAIN", err)
+	}
+	if l := getlk(h2, owner2, fuse.LockWrite, 50, 60); l.Type != fuse.LockRead || l.Pid != owner1 {
+		t.Errorf("Getlk = %v; want owner1's read lock", l)
+	}
+
+	// Unlocking the middle of owner1's lock makes room there only.
+	if err := setlk(h1, owner1, fuse.LockUnlock, 40, 69); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	if err := setlk(h2, owner2, fuse.LockWrite, 50, 60); err != nil {
+		t.Errorf("write lock in the unlocked range: %v", err)
+	}
+	if err := setlk(h2, owner2, fuse.LockWrite, 60, 70); err != fuse.EAGAIN {
+		t.Errorf("write lock overlapping owner1's remaining lock = %v; want EAGAIN", err)
+	}
+	if l := getlk(h1, owner1, fuse.LockRead, 0, 10); l.Type != fuse.LockUnlock {
+		t.Errorf("Getlk for a compatible read lock = %v; want unlocked", l)
+	}
+
+	// A waiting lock is granted once the conflicting ones are
+	// released, here by owner2 closing the file.
+	granted := make(chan fuse.Error, 1)
+	go func() {
+		granted <- h1.Setlk(&fuse.SetlkRequest{
+			Owner: owner1,
+			Lock:  fuse.FileLock{Start: 0, End: toEOF, Type: fuse.LockWrite},
+			Wait:  true,
+		}, nil)
+	}()
+	select {
+	case err := <-granted:
+		t.Fatalf("waiting write lock returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := h2.Flush(&fuse.FlushRequest{LockOwner: owner2}, nil); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	select {
+	case err := <-granted:
+		if err != nil {
+			t.Fatalf("waiting write lock: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting write lock not granted after the conflicting locks were released")
+	}
+
+	// An interrupted wait gives up.
+	intr := make(fuse.Intr)
+	go func() {
+		granted <- h2.Setlk(&fuse.SetlkRequest{
+			Owner: owner2,
+			Lock:  fuse.FileLock{Start: 0, End: 0, Type: fuse.LockRead},
+			Wait:  true,
+		}, intr)
+	}()
+	close(intr)
+	if err := <-granted; err != fuse.EINTR {
+		t.Errorf("interrupted wait = %v; want EINTR", err)
+	}
+
+	for _, h := range []*mutFileHandle{h1, h2} {
+		if err := h.Release(nil, nil); err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+	}
+}
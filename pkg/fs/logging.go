@@ -0,0 +1,87 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// A LogLevel is the severity of a message logged by the file system.
+type LogLevel int
+
+const (
+	// LogDebug messages trace the operations the kernel asks for,
+	// e.g. a line per lookup, read or write.
+	LogDebug LogLevel = iota
+	// LogInfo messages report notable changes, such as a name's
+	// conflicting links, or a file removed while open.
+	LogInfo
+	// LogWarn messages report problems worked around, such as
+	// malformed permanodes or blobs missing from the server.
+	LogWarn
+	// LogError messages report failed operations.
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < 0 || int(l) >= len(logLevelNames) {
+		return fmt.Sprintf("LogLevel(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel returns the LogLevel named s: "debug", "info", "warn"
+// or "error".
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("fs: unknown log level %q", s)
+}
+
+// logf logs a message of the given level, unless it's below fs's
+// LogLevel.
+func (fs *CamliFileSystem) logf(level LogLevel, format string, args ...interface{}) {
+	if level < fs.LogLevel {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func (fs *CamliFileSystem) debugf(format string, args ...interface{}) {
+	fs.logf(LogDebug, format, args...)
+}
+
+func (fs *CamliFileSystem) infof(format string, args ...interface{}) {
+	fs.logf(LogInfo, format, args...)
+}
+
+func (fs *CamliFileSystem) warnf(format string, args ...interface{}) {
+	fs.logf(LogWarn, format, args...)
+}
+
+func (fs *CamliFileSystem) errorf(format string, args ...interface{}) {
+	fs.logf(LogError, format, args...)
+}
@@ -0,0 +1,81 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLog returns the output of the standard logger until the
+// returned function is called.
+func captureLog() (stop func() string) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	return func() string {
+		log.SetOutput(os.Stderr)
+		return buf.String()
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	newFileWithContent(t, dir, "file", "contents")
+	cold := func() *mutDir {
+		return &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	}
+	lookup := func() {
+		n, err := cold().Lookup("file", nil)
+		if err != nil {
+			t.Fatalf("Lookup: %v", err)
+		}
+		if got := string(readFile(t, n.(*mutFile))); got != "contents" {
+			t.Fatalf("read %q; want %q", got, "contents")
+		}
+	}
+
+	fs.LogLevel = LogInfo
+	stop := captureLog()
+	lookup()
+	if out := stop(); out != "" {
+		t.Errorf("lookup and read at level info logged:\n%s", out)
+	}
+
+	fs.LogLevel = LogDebug
+	stop = captureLog()
+	lookup()
+	if out := stop(); !strings.Contains(out, `Lookup("file")`) {
+		t.Errorf("lookup at level debug logged %q; want the lookup traced", out)
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, l := range []LogLevel{LogDebug, LogInfo, LogWarn, LogError} {
+		got, err := ParseLogLevel(strings.ToUpper(l.String()))
+		if err != nil || got != l {
+			t.Errorf("ParseLogLevel(%q) = %v, %v; want %v", strings.ToUpper(l.String()), got, err, l)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("ParseLogLevel(\"verbose\") succeeded")
+	}
+}
@@ -0,0 +1,145 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// modeAttr is the permanode attribute holding a mutable node's
+// permissions, as set by chmod: the 12 low bits of its Unix mode, in
+// octal, so the setuid, setgid and sticky bits (04000, 02000 and
+// 01000) are kept along with the rwx ones.
+const modeAttr = "camliFileMode"
+
+// perm is the permissions recorded for a mutable node. If none are,
+// the default ones are reported.
+type perm struct {
+	mode os.FileMode // os.ModePerm, os.ModeSetuid, os.ModeSetgid and os.ModeSticky bits
+	set  bool
+}
+
+// permFromAttrs returns the permissions stored in a permanode's
+// attributes.
+func permFromAttrs(attrs url.Values) perm {
+	v := attrs.Get(modeAttr)
+	if v == "" {
+		return perm{}
+	}
+	bits, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || bits&^07777 != 0 {
+		log.Printf("fs: bad %s attribute %q", modeAttr, v)
+		return perm{}
+	}
+	return perm{mode: permMode(uint32(bits)), set: true}
+}
+
+// permMode returns the os.FileMode permission bits of the low 12
+// bits of a Unix mode.
+func permMode(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	if bits&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// unixPerm is the inverse of permMode.
+func unixPerm(mode os.FileMode) uint32 {
+	bits := uint32(mode & os.ModePerm)
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// permBits are the bits of an os.FileMode that a perm records.
+const permBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// bits returns the permission bits to report for the node: def if
+// none are recorded or fs.IgnoreOwners is set.
+func (p perm) bits(fs *CamliFileSystem, def os.FileMode) os.FileMode {
+	if !p.set || fs.IgnoreOwners {
+		return def
+	}
+	return p.mode
+}
+
+// ParseMode parses permissions in octal, as chmod takes them, e.g.
+// "0640" or "2750", for DefaultFileMode and DefaultDirMode.
+func ParseMode(s string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || bits&^07777 != 0 {
+		return 0, fmt.Errorf("fs: bad mode %q; want octal permissions, e.g. 0644", s)
+	}
+	return permMode(uint32(bits)), nil
+}
+
+// storeMode records the permissions changed by req on permanode.
+func storeMode(fs *CamliFileSystem, permanode *blobref.BlobRef, req *fuse.SetattrRequest) error {
+	return storePerm(fs, permanode, req.Mode)
+}
+
+// storePerm records mode's permission bits on permanode.
+func storePerm(fs *CamliFileSystem, permanode *blobref.BlobRef, mode os.FileMode) error {
+	v := fmt.Sprintf("%04o", unixPerm(mode))
+	return fs.uploadClaim(schema.NewSetAttributeClaim(permanode, modeAttr, v))
+}
+
+// defaultPerm returns the permissions to record for a new node of
+// type typ: DefaultDirMode or DefaultFileMode, if set.
+func (fs *CamliFileSystem) defaultPerm(typ nodeType) perm {
+	var mode os.FileMode
+	switch typ {
+	case dirType:
+		mode = fs.DefaultDirMode
+	case fileType:
+		mode = fs.DefaultFileMode
+	}
+	mode &= permBits
+	return perm{mode: mode, set: mode != 0}
+}
+
+// apply updates p with the permissions changed by req.
+func (p *perm) apply(req *fuse.SetattrRequest) {
+	if req.Valid.Mode() {
+		p.mode, p.set = req.Mode&permBits, true
+	}
+}
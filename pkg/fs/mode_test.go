@@ -0,0 +1,187 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestModeRoundTrip(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	newFileWithContent(t, dir, "setuid", "#!/bin/sh")
+	for _, name := range []string{"tmp", "setgid"} {
+		if _, err := dir.creat(name, dirType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newFileWithContent(t, dir, "untouched", "contents")
+
+	tests := []struct {
+		name string
+		mode os.FileMode // as set by chmod, or 0
+		want os.FileMode
+	}{
+		{"setuid", os.ModeSetuid | 0755, os.ModeSetuid | 0755},
+		{"tmp", os.ModeSticky | 0777, os.ModeDir | os.ModeSticky | 0777},
+		{"setgid", os.ModeSetgid | os.ModeSticky | 0750, os.ModeDir | os.ModeSetgid | os.ModeSticky | 0750},
+		{"untouched", 0, 0600},
+	}
+	for _, tt := range tests {
+		if tt.mode == 0 {
+			continue
+		}
+		n, err := dir.Lookup(tt.name, nil)
+		if err != nil {
+			t.Fatalf("Lookup(%q): %v", tt.name, err)
+		}
+		var res fuse.SetattrResponse
+		req := &fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: tt.mode}
+		if err := n.(interface {
+			Setattr(*fuse.SetattrRequest, *fuse.SetattrResponse, fuse.Intr) fuse.Error
+		}).Setattr(req, &res, nil); err != nil {
+			t.Fatalf("Setattr(%q): %v", tt.name, err)
+		}
+		if res.Attr.Mode != tt.want {
+			t.Errorf("Setattr(%q) attr mode = %v; want %v", tt.name, res.Attr.Mode, tt.want)
+		}
+	}
+
+	// As if remounted: a fresh node for the same permanode.
+	check := func(ignoreOwners bool) {
+		fs.IgnoreOwners = ignoreOwners
+		cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+		for _, tt := range tests {
+			n, err := cold.Lookup(tt.name, nil)
+			if err != nil {
+				t.Fatalf("Lookup(%q): %v", tt.name, err)
+			}
+			want := tt.want
+			if ignoreOwners {
+				want = want&os.ModeDir | 0600
+				if want&os.ModeDir != 0 {
+					want |= 0700
+				}
+			}
+			if a := n.Attr(); a.Mode != want {
+				t.Errorf("IgnoreOwners=%v: %s mode = %v; want %v", ignoreOwners, tt.name, a.Mode, want)
+			}
+		}
+	}
+	check(false)
+	check(true)
+}
+
+func TestUnixPerm(t *testing.T) {
+	for bits := uint32(0); bits <= 07777; bits++ {
+		if got := unixPerm(permMode(bits)); got != bits {
+			t.Fatalf("unixPerm(permMode(%04o)) = %04o", bits, got)
+		}
+	}
+	if got := unixPerm(os.ModeDir | os.ModeSticky | 0755); got != 01755 {
+		t.Errorf("unixPerm of a sticky directory = %04o; want 1755", got)
+	}
+}
+
+func TestDefaultModes(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	fs.DefaultFileMode = 0640
+	fs.DefaultDirMode = os.ModeSetgid | 0750
+
+	file, h, err := dir.Create(&fuse.CreateRequest{Name: "file", Flags: syscall.O_WRONLY | syscall.O_CREAT, Mode: 0644}, &fuse.CreateResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := h.(*mutFileHandle).Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := dir.Mkdir(&fuse.MkdirRequest{Name: "dir", Mode: os.ModeDir | 0755}, nil); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+	node, err := dir.Mknod(&fuse.MknodRequest{Name: "node", Mode: 0644}, nil)
+	if err != nil {
+		t.Fatalf("Mknod: %v", err)
+	}
+	if _, err := dir.Symlink(&fuse.SymlinkRequest{NewName: "link", Target: "file"}, nil); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	for _, n := range []fuse.Node{file, node} {
+		if a := n.Attr(); a.Mode != 0640 {
+			t.Errorf("created file mode = %v; want %v", a.Mode, os.FileMode(0640))
+		}
+	}
+
+	// The modes are recorded, as if remounted without the defaults.
+	fs.DefaultFileMode, fs.DefaultDirMode = 0, 0
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	for _, tt := range []struct {
+		name string
+		want os.FileMode
+	}{
+		{"file", 0640},
+		{"dir", os.ModeDir | os.ModeSetgid | 0750},
+		{"link", os.ModeSymlink | 0600},
+	} {
+		n, err := cold.Lookup(tt.name, nil)
+		if err != nil {
+			t.Fatalf("Lookup(%q): %v", tt.name, err)
+		}
+		if a := n.Attr(); a.Mode != tt.want {
+			t.Errorf("%s mode = %v; want %v", tt.name, a.Mode, tt.want)
+		}
+	}
+
+	// Without defaults, creating records no mode: one claim less.
+	creatSigned := func(name string) int {
+		signed := fc.signedCount()
+		if _, err := dir.creat(name, fileType); err != nil {
+			t.Fatal(err)
+		}
+		return fc.signedCount() - signed
+	}
+	plain := creatSigned("plain")
+	fs.DefaultFileMode = 0640
+	if withMode := creatSigned("with-mode"); withMode != plain+1 {
+		t.Errorf("creat signed %d blobs with a default mode, %d without; want one more claim with", withMode, plain)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want os.FileMode
+		ok   bool
+	}{
+		{"0644", 0644, true},
+		{"640", 0640, true},
+		{"2750", os.ModeSetgid | 0750, true},
+		{"1777", os.ModeSticky | 0777, true},
+		{"10000", 0, false},
+		{"0689", 0, false},
+		{"rw", 0, false},
+	} {
+		got, err := ParseMode(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseMode(%q) = %v, %v; want %v, ok %v", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"time"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// contentMovable reports whether a rename of src over dst can move
+// src's content to dst, per RenameMovesContent: both are regular
+// files, src has stored content, and neither is open for writing,
+// as its contents would be stored later.
+func contentMovable(src, dst mutFileOrDir) (*mutFile, *mutFile, bool) {
+	sf, ok := src.(*mutFile)
+	if !ok {
+		return nil, nil, false
+	}
+	df, ok := dst.(*mutFile)
+	if !ok {
+		return nil, nil, false
+	}
+	for _, f := range []*mutFile{sf, df} {
+		f.mu.Lock()
+		busy := f.symLink || f.backing != nil
+		f.mu.Unlock()
+		if busy {
+			return nil, nil, false
+		}
+	}
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf, df, sf.content != nil
+}
+
+// moveContent renames src, named oldName in n, over dst, named
+// newName in n2, by pointing dst's permanode at src's content and
+// modification time, and then unlinking oldName. dst's name thus
+// keeps its permanode, and inode.
+//
+// If unlinking oldName fails, dst already has the new content, and
+// oldName is left with it too.
+func (n *mutDir) moveContent(oldName string, src *mutFile, n2 *mutDir, newName string, dst *mutFile, now time.Time) fuse.Error {
+	src.resolveSize()
+	src.mu.Lock()
+	content, size := src.content, src.size
+	mtime := src.modTimeLocked()
+	src.mu.Unlock()
+	if err := dst.setContent(content, size); err != nil {
+		n.fs.errorf("*mutDir.Rename of %q over %q: setting content: %v", oldName, newName, err)
+		return n.fs.uploadError(err)
+	}
+	if err := dst.storeMtime(mtime); err != nil {
+		n.fs.errorf("*mutDir.Rename of %q over %q: setting mtime: %v", oldName, newName, err)
+		return n.fs.uploadError(err)
+	}
+	claim, _ := n.unlinkClaims(oldName, src.permanodeString())
+	claim.SetClaimDate(now)
+	if err := n.fs.uploadClaim(claim); err != nil {
+		n.fs.errorf("*mutDir.Rename of %q over %q: unlinking %q: %v", oldName, newName, oldName, err)
+		return n.fs.uploadError(err)
+	}
+	n.fs.debugf("*mutDir.Rename moved the content of %q to %q (%s)", oldName, newName, dst.permanodeString())
+
+	n.mu.Lock()
+	if cur := n.children[oldName]; cur != nil && samePermanode(cur, src) {
+		delete(n.children, oldName)
+		delete(n.conflicts, oldName)
+		n.childGen++
+		n.bury(oldName, src)
+	}
+	n.mu.Unlock()
+	n.touch(now)
+	if n2 != n {
+		n2.touch(now)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestRenameMovesContent(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	fs.RenameMovesContent = true
+	doc := newFileWithContent(t, dir, "doc", "old contents")
+	ino := doc.Attr().Inode
+
+	// An editor's save: write a temporary file, rename it over.
+	newFileWithContent(t, dir, "doc.tmp", "new contents")
+	if err := dir.Rename(&fuse.RenameRequest{OldName: "doc.tmp", NewName: "doc"}, dir, nil); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	for _, d := range []*mutDir{dir, cold} {
+		n, err := d.Lookup("doc", nil)
+		if err != nil {
+			t.Fatalf("%s: Lookup: %v", d.name, err)
+		}
+		mf := n.(*mutFile)
+		if got := mf.Attr().Inode; got != ino {
+			t.Errorf("%s: inode after save = %x; want %x, as before", d.name, got, ino)
+		}
+		if got, want := storedContents(t, mf), "new contents"; got != want {
+			t.Errorf("%s: contents after save = %q; want %q", d.name, got, want)
+		}
+		if _, err := d.Lookup("doc.tmp", nil); err != fuse.ENOENT {
+			t.Errorf("%s: Lookup of the renamed name = %v; want ENOENT", d.name, err)
+		}
+	}
+
+	// A file open for writing is renamed as usual.
+	tmp := newFileWithContent(t, dir, "doc.tmp", "newer contents")
+	h, err := doc.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer h.(*mutFileHandle).Release(&fuse.ReleaseRequest{}, nil)
+	if err := dir.Rename(&fuse.RenameRequest{OldName: "doc.tmp", NewName: "doc"}, dir, nil); err != nil {
+		t.Fatalf("Rename over an open file: %v", err)
+	}
+	cold = &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	n, err := cold.Lookup("doc", nil)
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if got := n.(*mutFile).permanode; !got.Equal(tmp.permanode) {
+		t.Errorf("doc after rename over an open file = %v; want the renamed file, %v", got, tmp.permanode)
+	}
+}
@@ -20,16 +20,20 @@ package fs
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/readerutil"
 	"camlistore.org/pkg/schema"
 	"camlistore.org/pkg/search"
@@ -55,10 +59,28 @@ type mutDir struct {
 	permanode *blobref.BlobRef
 	parent    *mutDir // or nil, if the root within its roots.go root.
 	name      string  // ent name (base name within parent)
-
-	mu       sync.Mutex
-	lastPop  time.Time
-	children map[string]mutFileOrDir
+	ino       nodeInode
+
+	mu        sync.Mutex
+	lastPop   time.Time
+	populated bool          // once a populate listed children
+	firstPop  chan struct{} // closed when the first populate is done; see populate
+	children  map[string]mutFileOrDir
+	childGen  int               // bumped on each change made to children here
+	xattrs    map[string][]byte // nil until known; see xattr.go
+	mtime     time.Time         // if zero, use created
+	created   time.Time         // first claim's date; if zero, use serverStart
+	owner     owner             // see owner.go
+	perm      perm              // see mode.go
+
+	// conflicts holds the losing links of the children's names,
+	// by the conflict names they're shown under if ShowConflicts
+	// is set; see conflict.go.
+	conflicts map[string]pathConflict
+
+	// tombstones holds the children removed here that describes
+	// may still list; see tombstone.go.
+	tombstones map[string]tombstone
 }
 
 // for debugging
@@ -70,125 +92,535 @@ func (n *mutDir) fullPath() string {
 }
 
 func (n *mutDir) Attr() fuse.Attr {
+	n.mu.Lock()
+	created := orServerStart(n.created)
+	mtime := n.mtime
+	uid, gid := n.owner.ids(n.fs)
+	perm := n.perm
+	n.mu.Unlock()
+	if mtime.IsZero() {
+		mtime = created
+	}
 	return fuse.Attr{
-		Inode: n.permanode.AsUint64(),
-		Mode:  os.ModeDir | 0700,
-		Uid:   uint32(os.Getuid()),
-		Gid:   uint32(os.Getgid()),
+		Inode:  n.ino.get(n.fs, n.permanode),
+		Mode:   os.ModeDir | perm.bits(n.fs, 0700),
+		Uid:    uid,
+		Gid:    gid,
+		Mtime:  mtime,
+		Atime:  mtime,
+		Ctime:  mtime,
+		Crtime: created,
+	}
+}
+
+// Forget releases n's inode number, once the kernel has no use for
+// it.
+func (n *mutDir) Forget() {
+	n.ino.forget(n.fs)
+}
+
+// Getattr is Attr, for the kernel to cache as long as the file
+// system's AttrValid.
+func (n *mutDir) Getattr(req *fuse.GetattrRequest, res *fuse.GetattrResponse, intr fuse.Intr) fuse.Error {
+	res.AttrValid = n.fs.attrValid()
+	res.Attr = n.Attr()
+	return nil
+}
+
+// orServerStart returns t, or serverStart if t is zero: the times
+// of nodes nothing is known about, e.g. permanodes described without
+// their claims' dates.
+func orServerStart(t time.Time) time.Time {
+	if t.IsZero() {
+		return serverStart
+	}
+	return t
+}
+
+// mtimeAttr is the permanode attribute holding a mutable
+// directory's or file's modification time, in RFC 3339 format.
+const mtimeAttr = "unixMtime"
+
+// mtimeFromAttrs returns the modification time stored in a
+// directory or file permanode's attributes, or the zero time.
+func mtimeFromAttrs(attrs url.Values) time.Time {
+	v := attrs.Get(mtimeAttr)
+	if v == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		log.Printf("fs: bad %s attribute %q: %v", mtimeAttr, v, err)
+		return time.Time{}
+	}
+	return t
+}
+
+// touch sets n's modification time to t, after one of its entries
+// changed.
+func (n *mutDir) touch(t time.Time) {
+	n.mu.Lock()
+	n.mtime = t
+	n.mu.Unlock()
+	claim := schema.NewSetAttributeClaim(n.permanode, mtimeAttr, schema.RFC3339FromTime(t))
+	claim.SetClaimDate(t)
+	if err := n.fs.uploadClaim(claim); err != nil {
+		n.fs.warnf("mutDir.touch(%q): %v", n.fullPath(), err)
 	}
 }
 
+// Fsync uploads the queued claims, such as those linking the
+// entries created in n; see CamliFileSystem.ClaimBatchWindow.
+func (n *mutDir) Fsync(r *fuse.FsyncRequest, intr fuse.Intr) fuse.Error {
+	if err := n.fs.FlushClaims(); err != nil {
+		n.fs.errorf("mutDir.Fsync: %v", err)
+		return n.fs.uploadError(err)
+	}
+	return nil
+}
+
 // populate hits the blobstore to populate map of child nodes.
+//
+// n.mu isn't held while talking to the server, so lookups and
+// listings aren't held up by a slow one: they use the children
+// known so far, unless n was never populated, in which case they
+// wait for the populate in progress.
 func (n *mutDir) populate() error {
 	n.mu.Lock()
-	defer n.mu.Unlock()
-
 	// Only re-populate if we haven't done so recently.
 	now := time.Now()
 	if n.lastPop.Add(populateInterval).After(now) {
+		mutDirPopulateFresh.Incr()
+		wait := n.firstPop
+		n.mu.Unlock()
+		if wait != nil {
+			<-wait
+		}
 		return nil
 	}
 	n.lastPop = now
+	if !n.populated {
+		first := make(chan struct{})
+		n.firstPop = first
+		defer func() {
+			n.mu.Lock()
+			n.firstPop = nil
+			n.mu.Unlock()
+			close(first)
+		}()
+	}
+	gen := n.childGen
+	n.mu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		db, children, conflicts, err := n.describeChildren(now)
+		if db == nil || err != nil {
+			return err
+		}
+		n.mu.Lock()
+		n.xattrs = xattrsFromAttrs(db.Permanode.Attr)
+		n.mtime = mtimeFromAttrs(db.Permanode.Attr)
+		n.created = db.Permanode.FirstClaimDate
+		n.owner = ownerFromAttrs(db.Permanode.Attr)
+		n.perm = permFromAttrs(db.Permanode.Attr)
+		if n.childGen != gen {
+			// Changed here while we were describing it, so
+			// the response may predate the change; don't
+			// undo it, and look again.
+			gen = n.childGen
+			n.mu.Unlock()
+			if attempt < maxPopulateAttempts {
+				continue
+			}
+			n.mu.Lock()
+			n.lastPop = time.Time{}
+			n.mu.Unlock()
+			return nil
+		}
+		n.populated = true
+		if n.children == nil {
+			n.children = make(map[string]mutFileOrDir)
+		}
+		for name, c := range children {
+			if n.buried(name, c, now) {
+				continue
+			}
+			n.mergeChild(name, c)
+		}
+		n.conflicts = conflicts
+		n.pruneTombstones(children)
+		n.mu.Unlock()
+		return nil
+	}
+}
 
-	res, err := n.fs.client.Describe(&search.DescribeRequest{
+// mergeChild makes c, from a describe, n's child name. If the node
+// already there is of the same permanode and kind, it's updated from
+// c instead, so it keeps what a new node wouldn't have: a
+// directory's children, a file's open handles. n.mu must be held.
+func (n *mutDir) mergeChild(name string, c mutFileOrDir) {
+	switch old := n.children[name].(type) {
+	case *mutDir:
+		if c, ok := c.(*mutDir); ok && old.permanode.Equal(c.permanode) {
+			old.mu.Lock()
+			old.xattrs = c.xattrs
+			old.mtime = c.mtime
+			old.created = c.created
+			old.owner = c.owner
+			old.perm = c.perm
+			old.mu.Unlock()
+			return
+		}
+	case *mutFile:
+		if c, ok := c.(*mutFile); ok && !c.unresolved && old.permanode.Equal(c.permanode) && old.updateFrom(c) {
+			return
+		}
+	}
+	n.children[name] = c
+}
+
+// maxPopulateAttempts is how many times populate describes a
+// directory changed locally meanwhile before giving up until the
+// next populate.
+const maxPopulateAttempts = 3
+
+// populateAttrs are the permanode attributes populate needs, for
+// its describes not to return nor follow the others.
+var populateAttrs = []string{
+	"camliPath:*",
+	"camliContent",
+	"camliSymlinkTarget",
+	xattrPrefix + "*",
+	uidAttr,
+	gidAttr,
+	modeAttr,
+	mtimeAttr,
+}
+
+// describeChildren describes n and returns its description and the
+// children it lists, as of now, including those shown under conflict
+// names. A nil description with a nil error means the describe
+// failed, and was logged.
+func (n *mutDir) describeChildren(now time.Time) (*search.DescribedBlob, map[string]mutFileOrDir, map[string]pathConflict, error) {
+	mutDirPopulate.Incr()
+
+	// Depth 3 describes each child's content too, which is where
+	// file sizes come from. In LazySizes mode, stop at the child
+	// permanodes and let mutFile.Attr fetch sizes on demand.
+	depth := n.fs.PopulateDepth
+	if depth <= 0 {
+		depth = DefaultPopulateDepth
+	}
+	if n.fs.LazySizes && depth > 2 {
+		depth = 2
+	}
+	n.fs.uploadClaims()
+	res, err := n.fs.describe(&search.DescribeRequest{
 		BlobRef: n.permanode,
-		Depth:   3,
+		Depth:   depth,
+		Attrs:   populateAttrs,
 	})
 	if err != nil {
-		log.Println("mutDir.paths:", err)
-		return nil
+		n.fs.errorf("mutDir.paths: %v", err)
+		return nil, nil, nil, nil
 	}
 	db := res.Meta[n.permanode.String()]
 	if db == nil {
-		return errors.New("dir blobref not described")
+		return nil, nil, nil, errors.New("dir blobref not described")
 	}
-
-	// Find all child permanodes and stick them in n.children
-	if n.children == nil {
-		n.children = make(map[string]mutFileOrDir)
+	n.describeMissing(res.Meta, db)
+
+	// Find all child permanodes and stick them in children
+	children := make(map[string]mutFileOrDir)
+	var files []*mutFile
+	addChild := func(name, childRef string) {
+		childBr := blobref.Parse(childRef)
+		if childBr == nil {
+			n.fs.warnf("mutDir.populate: skipping %q: malformed child blobref %q", name, childRef)
+			return
+		}
+		c := n.newChild(name, childBr, res.Meta, now)
+		if c == nil {
+			return
+		}
+		children[name] = c
+		if mf, ok := c.(*mutFile); ok && mf.content != nil {
+			files = append(files, mf)
+		}
 	}
+	var pathConflicts []pathConflict
 	for k, v := range db.Permanode.Attr {
 		const p = "camliPath:"
 		if !strings.HasPrefix(k, p) || len(v) < 1 {
 			continue
 		}
 		name := k[len(p):]
-		childRef := v[0]
-		child := res.Meta[childRef]
-		if child == nil {
-			log.Printf("child not described: %v", childRef)
-			continue
-		}
-		if target := child.Permanode.Attr.Get("camliSymlinkTarget"); target != "" {
-			// This is a symlink.
-			n.children[name] = &mutFile{
-				fs:        n.fs,
-				permanode: blobref.Parse(childRef),
-				parent:    n,
-				name:      name,
-				symLink:   true,
-				target:    target,
+		childRef, pcs := n.pathLinks(name, v)
+		pathConflicts = append(pathConflicts, pcs...)
+		addChild(name, childRef)
+	}
+	// The conflicts are kept even if not shown, so removing a
+	// name only removes the link shown.
+	var conflicts map[string]pathConflict
+	if len(pathConflicts) > 0 {
+		conflicts = conflictNames(pathConflicts, children)
+		if n.fs.ShowConflicts {
+			for name, pc := range conflicts {
+				addChild(name, pc.target)
 			}
-			continue
 		}
-		if contentRef := child.Permanode.Attr.Get("camliContent"); contentRef != "" {
-			// This is a file.
-			content := res.Meta[contentRef]
-			if content == nil {
-				log.Printf("child content not described: %v", childRef)
-				continue
-			}
-			if content.CamliType != "file" {
-				log.Printf("child not a file: %v", childRef)
-				continue
-			}
-			n.children[name] = &mutFile{
-				fs:        n.fs,
-				permanode: blobref.Parse(childRef),
-				parent:    n,
-				name:      name,
-				content:   blobref.Parse(contentRef),
-				size:      content.File.Size,
-			}
-			continue
+	}
+	if n.fs.StatContents && len(files) > 0 {
+		dropMissingContents(n.fs, children, files)
+	}
+	return db, children, conflicts, nil
+}
+
+// newChild returns the node of n's child permanode br, linked as
+// name, from its description in meta, or nil if it can't be listed.
+// A child that meta lacks is returned as an unresolved placeholder
+// (see mutFile.unresolved), so it still shows, and one whose
+// content meta lacks gets its size looked up when needed.
+func (n *mutDir) newChild(name string, br *blobref.BlobRef, meta search.MetaMap, now time.Time) mutFileOrDir {
+	child := meta[br.String()]
+	if child == nil || child.Permanode == nil {
+		n.fs.warnf("mutDir.populate: child %q not described: %v", name, br)
+		mutDirUnresolved.Incr()
+		return &mutFile{
+			fs:         n.fs,
+			permanode:  br,
+			parent:     n,
+			name:       name,
+			unresolved: true,
+		}
+	}
+	attr := child.Permanode.Attr
+	if target := attr.Get("camliSymlinkTarget"); target != "" {
+		// This is a symlink.
+		return &mutFile{
+			fs:         n.fs,
+			permanode:  br,
+			parent:     n,
+			name:       name,
+			symLink:    true,
+			target:     target,
+			targetTime: now,
+			created:    child.Permanode.FirstClaimDate,
+			xattrs:     xattrsFromAttrs(attr),
+			owner:      ownerFromAttrs(attr),
 		}
-		// This is a directory.
-		n.children[name] = &mutDir{
+	}
+	if contentRef := attr.Get("camliContent"); contentRef != "" {
+		// This is a file.
+		contentBr := blobref.Parse(contentRef)
+		if contentBr == nil {
+			n.fs.warnf("mutDir.populate: skipping %q: malformed content blobref %q", name, contentRef)
+			return nil
+		}
+		content := meta[contentRef]
+		if content != nil && content.CamliType != "file" {
+			n.fs.warnf("child not a file: %v", br)
+			return nil
+		}
+		mf := &mutFile{
 			fs:        n.fs,
-			permanode: blobref.Parse(childRef),
+			permanode: br,
 			parent:    n,
 			name:      name,
+			content:   contentBr,
+			xattrs:    xattrsFromAttrs(attr),
+			owner:     ownerFromAttrs(attr),
+			perm:      permFromAttrs(attr),
+			mtime:     mtimeFromAttrs(attr),
+			created:   child.Permanode.FirstClaimDate,
+		}
+		if content != nil {
+			mf.size = content.File.Size
+		} else {
+			mf.needSize = true
+		}
+		return mf
+	}
+	// This is a directory.
+	return &mutDir{
+		fs:        n.fs,
+		permanode: br,
+		parent:    n,
+		name:      name,
+		xattrs:    xattrsFromAttrs(attr),
+		mtime:     mtimeFromAttrs(attr),
+		created:   child.Permanode.FirstClaimDate,
+		owner:     ownerFromAttrs(attr),
+		perm:      permFromAttrs(attr),
+	}
+}
+
+// resolve describes again the child permanode that populate left
+// unresolved as name, and, if it's now described, replaces the
+// placeholder mf with it. It returns the node for name.
+func (n *mutDir) resolve(name string, mf *mutFile) mutFileOrDir {
+	depth := 2
+	if n.fs.LazySizes {
+		depth = 1
+	}
+	meta := make(search.MetaMap)
+	n.describeInto(meta, []*blobref.BlobRef{mf.permanode}, depth)
+	c := n.newChild(name, mf.permanode, meta, time.Now())
+	if c2, ok := c.(*mutFile); c == nil || ok && c2.unresolved {
+		return mf
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if cur := n.children[name]; cur != mf {
+		// Changed meanwhile.
+		return cur
+	}
+	n.children[name] = c
+	return c
+}
+
+// dropMissingContents removes from children those of files whose
+// content blob the blob server doesn't have, as they couldn't be
+// read. If the stat fails, they're all kept.
+func dropMissingContents(fs *CamliFileSystem, children map[string]mutFileOrDir, files []*mutFile) {
+	refs := make([]*blobref.BlobRef, len(files))
+	for i, mf := range files {
+		refs[i] = mf.content
+	}
+	have, err := blobserver.StatBlobSizes(fs.client, refs)
+	if err != nil {
+		fs.warnf("mutDir.populate: stat of contents: %v", err)
+		return
+	}
+	for _, mf := range files {
+		if _, ok := have[mf.content.String()]; ok {
+			continue
+		}
+		mutDirContentMissing.Incr()
+		fs.warnf("mutDir.populate: skipping %q: content %v missing", mf.name, mf.content)
+		if children[mf.name] == mf {
+			delete(children, mf.name)
+		}
+	}
+}
+
+// populateIntr is populate, given up on with errInterrupted if
+// intr is closed before it's done. The populate still completes in
+// the background, so its results aren't lost.
+func (n *mutDir) populateIntr(intr fuse.Intr) error {
+	return interruptible(intr, n.populate)
+}
+
+// populateError maps an error from populating a directory to the
+// error returned to the kernel.
+func populateError(err error) fuse.Error {
+	if err == errInterrupted {
+		return fuse.EINTR
+	}
+	return fuse.EIO
+}
+
+// describeMissing adds to meta the child permanodes of db, and
+// unless in LazySizes mode their contents, that a shallow populate
+// describe didn't reach, with one follow-up describe for each level.
+func (n *mutDir) describeMissing(meta search.MetaMap, db *search.DescribedBlob) {
+	var linked []string
+	for k, v := range db.Permanode.Attr {
+		if !strings.HasPrefix(k, "camliPath:") || len(v) < 1 {
+			continue
+		}
+		if n.fs.ShowConflicts {
+			linked = append(linked, v...)
+		} else {
+			linked = append(linked, v[len(v)-1])
+		}
+	}
+	var children []*blobref.BlobRef
+	for _, ref := range linked {
+		if br := blobref.Parse(ref); br != nil && meta[ref] == nil {
+			children = append(children, br)
+		}
+	}
+	depth := 2
+	if n.fs.LazySizes {
+		depth = 1
+	}
+	n.describeInto(meta, children, depth)
+	if n.fs.LazySizes {
+		return
+	}
+
+	var contents []*blobref.BlobRef
+	for _, ref := range linked {
+		child := meta[ref]
+		if child == nil || child.Permanode == nil {
+			continue
+		}
+		contentRef := child.Permanode.Attr.Get("camliContent")
+		if br := blobref.Parse(contentRef); br != nil && meta[contentRef] == nil {
+			contents = append(contents, br)
+		}
+	}
+	n.describeInto(meta, contents, 1)
+}
+
+// describeInto describes brs to the given depth, adding the
+// results to meta.
+func (n *mutDir) describeInto(meta search.MetaMap, brs []*blobref.BlobRef, depth int) {
+	if len(brs) == 0 {
+		return
+	}
+	mutDirDescribeMissing.Incr()
+	res, err := n.fs.describe(&search.DescribeRequest{
+		BlobRefs: brs,
+		Depth:    depth,
+		Attrs:    populateAttrs,
+	})
+	if err != nil {
+		n.fs.errorf("mutDir.populate(%q): describing %d missing blobs: %v", n.fullPath(), len(brs), err)
+		return
+	}
+	for k, v := range res.Meta {
+		if meta[k] == nil {
+			meta[k] = v
 		}
 	}
-	return nil
 }
 
 func (n *mutDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
-	if err := n.populate(); err != nil {
-		log.Println("populate:", err)
-		return nil, fuse.EIO
+	if err := n.populateIntr(intr); err != nil {
+		n.fs.errorf("populate: %v", err)
+		return nil, populateError(err)
 	}
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	var ents []fuse.Dirent
 	for name, childNode := range n.children {
 		var ino uint64
+		var typ fuse.DirentType
 		switch v := childNode.(type) {
 		case *mutDir:
-			ino = v.permanode.AsUint64()
+			ino = v.ino.get(n.fs, v.permanode)
+			typ = fuse.DT_Dir
 		case *mutFile:
-			ino = v.permanode.AsUint64()
+			ino = v.ino.get(n.fs, v.permanode)
+			typ = fuse.DT_File
+			v.mu.Lock()
+			if v.symLink {
+				typ = fuse.DT_Link
+			}
+			v.mu.Unlock()
 		default:
-			log.Printf("mutDir.ReadDir: unknown child type %T", childNode)
+			n.fs.warnf("mutDir.ReadDir: skipping %q: unknown child type %T", name, childNode)
+			continue
 		}
 
-		// TODO: figure out what Dirent.Type means.
-		// fuse.go says "Type uint32 // ?"
 		dirent := fuse.Dirent{
 			Name:  name,
 			Inode: ino,
+			Type:  typ,
 		}
-		log.Printf("mutDir(%q) appending inode %x, %+v", n.fullPath(), dirent.Inode, dirent)
+		n.fs.debugf("mutDir(%q) appending inode %x, %+v", n.fullPath(), dirent.Inode, dirent)
 		ents = append(ents, dirent)
 	}
 	return ents, nil
@@ -196,17 +628,45 @@ func (n *mutDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
 
 func (n *mutDir) Lookup(name string, intr fuse.Intr) (ret fuse.Node, err fuse.Error) {
 	defer func() {
-		log.Printf("mutDir(%q).Lookup(%q) = %#v, %v", n.fullPath(), name, ret, err)
+		n.fs.debugf("mutDir(%q).Lookup(%q) = %#v, %v", n.fullPath(), name, ret, err)
 	}()
-	if err := n.populate(); err != nil {
-		log.Println("populate:", err)
-		return nil, fuse.EIO
+	if err := n.populateIntr(intr); err != nil {
+		n.fs.errorf("populate: %v", err)
+		return nil, populateError(err)
 	}
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	if n2 := n.children[name]; n2 != nil {
+	n2 := n.children[name]
+	if mf, ok := n2.(*mutFile); ok && mf.unresolved {
+		n.mu.Unlock()
+		n2 = n.resolve(name, mf)
+		n.mu.Lock()
+	}
+	if mf, ok := n2.(*mutFile); ok && n.fs.LazySizes {
+		// The listing didn't describe the content, so check
+		// it's a file, as populate does otherwise. The kernel
+		// asks for the size right after anyway.
+		n.mu.Unlock()
+		err := mf.resolveSize()
+		n.mu.Lock()
+		if err == errContentNotFile {
+			n.fs.warnf("child not a file: %v", mf.permanode)
+			return nil, fuse.ENOENT
+		}
+	}
+	if n2 != nil {
 		return n2, nil
 	}
+	if n.fs.Versions && strings.HasSuffix(name, versionsSuffix) {
+		if mf, ok := n.children[strings.TrimSuffix(name, versionsSuffix)].(*mutFile); ok && !mf.isSymlink() {
+			return &versionsDir{fs: n.fs, file: mf}, nil
+		}
+	}
+	if n.fs.AttrFiles && strings.HasSuffix(name, attrFileSuffix) {
+		if f := n.attrFileOf(name); f != nil {
+			return f, nil
+		}
+	}
 	return nil, fuse.ENOENT
 }
 
@@ -220,14 +680,29 @@ func (n *mutDir) Lookup(name string, intr fuse.Intr) (ret fuse.Node, err fuse.Er
 // 2013/07/21 05:26:35 <- &{Create [ID=0x3 Node=0x8 Uid=61652 Gid=5000 Pid=13115] "x" fl=514 mode=-rw-r--r-- fuse.Intr}
 // 2013/07/21 05:26:36 -> 0x3 Create {LookupResponse:{Node:23 Generation:0 EntryValid:1m0s AttrValid:1m0s Attr:{Inode:15976986887557313215 Size:0 Blocks:0 Atime:2013-07-21 05:23:51.537251251 +1200 NZST Mtime:2013-07-21 05:23:51.537251251 +1200 NZST Ctime:2013-07-21 05:23:51.537251251 +1200 NZST Crtime:2013-07-21 05:23:51.537251251 +1200 NZST Mode:-rw------- Nlink:1 Uid:61652 Gid:5000 Rdev:0 Flags:0}} OpenResponse:{Handle:1 Flags:OpenDirectIO}}
 func (n *mutDir) Create(req *fuse.CreateRequest, res *fuse.CreateResponse, intr fuse.Intr) (fuse.Node, fuse.Handle, fuse.Error) {
+	if n.fs.readOnly() {
+		return nil, nil, fuse.EPERM
+	}
+	// The kernel usually looks a name up before creating it, but
+	// its view of n can be stale, or another client may have
+	// created the name since.
+	switch existing, err := n.Lookup(req.Name, intr); {
+	case err == fuse.ENOENT:
+	case err != nil:
+		return nil, nil, err
+	case req.Flags&syscall.O_EXCL != 0:
+		return nil, nil, fuse.Errno(syscall.EEXIST)
+	default:
+		return n.openExisting(existing, req, res, intr)
+	}
 	child, err := n.creat(req.Name, fileType)
 	if err != nil {
-		log.Printf("mutDir.Create(%q): %v", req.Name, err)
-		return nil, nil, fuse.EIO
+		n.fs.errorf("mutDir.Create(%q): %v", req.Name, err)
+		return nil, nil, n.fs.uploadError(err)
 	}
 
 	// Create and return a file handle.
-	h, ferr := child.(*mutFile).newHandle(nil)
+	h, ferr := child.(*mutFile).newHandle(nil, req.Flags, intr)
 	if ferr != nil {
 		return nil, nil, ferr
 	}
@@ -240,51 +715,116 @@ func (n *mutDir) Create(req *fuse.CreateRequest, res *fuse.CreateResponse, intr
 	return child, h, nil
 }
 
+// openExisting opens node, which Create found already in n, as open(2)
+// without O_EXCL would, rather than shadowing it with a new permanode.
+func (n *mutDir) openExisting(node fuse.Node, req *fuse.CreateRequest, res *fuse.CreateResponse, intr fuse.Intr) (fuse.Node, fuse.Handle, fuse.Error) {
+	mf, ok := node.(*mutFile)
+	if !ok {
+		if _, ok := node.(*mutDir); ok {
+			return nil, nil, fuse.Errno(syscall.EISDIR)
+		}
+		// The generated files, e.g. versions directories.
+		return nil, nil, fuse.EPERM
+	}
+	oreq := &fuse.OpenRequest{Header: req.Header, Flags: req.Flags &^ syscall.O_CREAT, Mode: req.Mode}
+	h, err := mf.Open(oreq, &res.OpenResponse, intr)
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.Flags&syscall.O_TRUNC != 0 {
+		// Having answered Create, the kernel won't truncate
+		// the file itself.
+		wh, ok := h.(*mutFileHandle)
+		if !ok {
+			return nil, nil, fuse.EIO
+		}
+		if err := wh.Truncate(0, intr); err != nil {
+			return nil, nil, err
+		}
+	}
+	return mf, h, nil
+}
+
 func (n *mutDir) Mkdir(req *fuse.MkdirRequest, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	if n.fs.readOnly() {
+		return nil, fuse.EPERM
+	}
 	child, err := n.creat(req.Name, dirType)
 	if err != nil {
-		log.Printf("mutDir.Mkdir(%q): %v", req.Name, err)
-		return nil, fuse.EIO
+		n.fs.errorf("mutDir.Mkdir(%q): %v", req.Name, err)
+		return nil, n.fs.uploadError(err)
 	}
 	return child, nil
 }
 
-// &fuse.SymlinkRequest{Header:fuse.Header{Conn:(*fuse.Conn)(0xc210047180), ID:0x4, Node:0x8, Uid:0xf0d4, Gid:0x1388, Pid:0x7e88}, NewName:"some-link", Target:"../../some-target"}
-func (n *mutDir) Symlink(req *fuse.SymlinkRequest, intr fuse.Intr) (fuse.Node, fuse.Error) {
-	node, err := n.creat(req.NewName, symlinkType)
+// Mknod creates regular files, which mknod(2) can also make. Device
+// nodes, FIFOs and sockets have no representation in permanodes, so
+// they're refused with EPERM, as on file systems without them.
+func (n *mutDir) Mknod(req *fuse.MknodRequest, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	if n.fs.readOnly() {
+		return nil, fuse.EPERM
+	}
+	if req.Mode&os.ModeType != 0 {
+		n.fs.warnf("mutDir.Mknod(%q): unsupported file type in mode %v", req.Name, req.Mode)
+		return nil, fuse.EPERM
+	}
+	child, err := n.creat(req.Name, fileType)
 	if err != nil {
-		log.Printf("mutDir.Symlink(%q): %v", req.NewName, err)
-		return nil, fuse.EIO
+		n.fs.errorf("mutDir.Mknod(%q): %v", req.Name, err)
+		return nil, n.fs.uploadError(err)
 	}
-	mf := node.(*mutFile)
-	mf.symLink = true
-	mf.target = req.Target
+	return child, nil
+}
 
-	claim := schema.NewSetAttributeClaim(mf.permanode, "camliSymlinkTarget", req.Target)
-	_, err = n.fs.client.UploadAndSignBlob(claim)
+// &fuse.SymlinkRequest{Header:fuse.Header{Conn:(*fuse.Conn)(0xc210047180), ID:0x4, Node:0x8, Uid:0xf0d4, Gid:0x1388, Pid:0x7e88}, NewName:"some-link", Target:"../../some-target"}
+func (n *mutDir) Symlink(req *fuse.SymlinkRequest, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	if n.fs.readOnly() {
+		return nil, fuse.EPERM
+	}
+	// Set the target before linking the permanode into n, so
+	// no listing ever sees it without one, as a directory.
+	pr, err := n.fs.uploadClient().UploadNewPermanode()
 	if err != nil {
-		log.Printf("mutDir.Symlink(%q) upload error: %v", req.NewName, err)
-		return nil, fuse.EIO
+		n.fs.errorf("mutDir.Symlink(%q): %v", req.NewName, err)
+		return nil, n.fs.uploadError(err)
 	}
-
-	return node, nil
+	claim := schema.NewSetAttributeClaim(pr.BlobRef, "camliSymlinkTarget", req.Target)
+	if err := n.fs.uploadClaim(claim); err != nil {
+		n.fs.errorf("mutDir.Symlink(%q) upload error: %v", req.NewName, err)
+		return nil, n.fs.uploadError(err)
+	}
+	mf := &mutFile{
+		fs:         n.fs,
+		permanode:  pr.BlobRef,
+		parent:     n,
+		name:       req.NewName,
+		symLink:    true,
+		target:     req.Target,
+		targetTime: time.Now(),
+		xattrs:     map[string][]byte{},
+	}
+	if err := n.link(req.NewName, pr.BlobRef, mf); err != nil {
+		n.fs.errorf("mutDir.Symlink(%q): %v", req.NewName, err)
+		return nil, n.fs.uploadError(err)
+	}
+	return mf, nil
 }
 
 func (n *mutDir) creat(name string, typ nodeType) (fuse.Node, error) {
 	// Create a Permanode for the file/directory.
-	pr, err := n.fs.client.UploadNewPermanode()
+	pr, err := n.fs.uploadClient().UploadNewPermanode()
 	if err != nil {
 		return nil, err
 	}
-
-	// Add a camliPath:name attribute to the directory permanode.
-	claim := schema.NewSetAttributeClaim(n.permanode, "camliPath:"+name, pr.BlobRef.String())
-	_, err = n.fs.client.UploadAndSignBlob(claim)
-	if err != nil {
-		return nil, err
+	// Record the default permissions, if any, before linking the
+	// permanode into n, so no listing sees it without them.
+	perm := n.fs.defaultPerm(typ)
+	if perm.set {
+		if err := storePerm(n.fs, pr.BlobRef, perm.mode); err != nil {
+			return nil, err
+		}
 	}
 
-	// Add a child node to this node.
 	var child mutFileOrDir
 	switch typ {
 	case dirType:
@@ -293,6 +833,8 @@ func (n *mutDir) creat(name string, typ nodeType) (fuse.Node, error) {
 			permanode: pr.BlobRef,
 			parent:    n,
 			name:      name,
+			xattrs:    map[string][]byte{},
+			perm:      perm,
 		}
 	case fileType, symlinkType:
 		child = &mutFile{
@@ -300,52 +842,197 @@ func (n *mutDir) creat(name string, typ nodeType) (fuse.Node, error) {
 			permanode: pr.BlobRef,
 			parent:    n,
 			name:      name,
+			xattrs:    map[string][]byte{},
+			perm:      perm,
 		}
 	default:
 		panic("bogus creat type")
 	}
+	if err := n.link(name, pr.BlobRef, child); err != nil {
+		return nil, err
+	}
+	return child, nil
+}
+
+// link adds child, whose permanode is pn, to n as name: in n's
+// permanode, with a camliPath:name attribute, and in n.children.
+func (n *mutDir) link(name string, pn *blobref.BlobRef, child mutFileOrDir) error {
+	claim := schema.NewSetAttributeClaim(n.permanode, "camliPath:"+name, pn.String())
+	if err := n.fs.uploadClaim(claim); err != nil {
+		return err
+	}
 	n.mu.Lock()
 	if n.children == nil {
 		n.children = make(map[string]mutFileOrDir)
 	}
 	n.children[name] = child
+	n.childGen++
+	n.unbury(name)
 	n.mu.Unlock()
 
-	return child, nil
+	n.touch(time.Now())
+	return nil
 }
 
 func (n *mutDir) Remove(req *fuse.RemoveRequest, intr fuse.Intr) fuse.Error {
+	if n.fs.readOnly() {
+		return fuse.EPERM
+	}
+	if n.fs.RecursiveRemove {
+		n.mu.Lock()
+		sub, ok := n.children[req.Name].(*mutDir)
+		n.mu.Unlock()
+		if ok {
+			if err := sub.unlinkAll(n, req.Name, map[string]bool{n.permanode.String(): true}); err != nil {
+				n.fs.errorf("mutDir.Remove(%q): %v", req.Name, err)
+				return n.fs.uploadError(err)
+			}
+		}
+	}
+	n.mu.Lock()
+	mf, ok := n.children[req.Name].(*mutFile)
+	n.mu.Unlock()
+	if ok {
+		removed, err := n.removeOpen(req.Name, mf)
+		if err != nil {
+			n.fs.errorf("mutDir.Remove: %v", err)
+			return n.fs.uploadError(err)
+		}
+		if removed {
+			n.touch(time.Now())
+			return nil
+		}
+	}
 	// Remove the camliPath:name attribute from the directory permanode.
-	claim := schema.NewDelAttributeClaim(n.permanode, "camliPath:"+req.Name)
-	_, err := n.fs.client.UploadAndSignBlob(claim)
-	if err != nil {
-		log.Println("mutDir.Create:", err)
-		return fuse.EIO
+	n.mu.Lock()
+	c := n.children[req.Name]
+	n.mu.Unlock()
+	var claim *schema.Builder
+	if c != nil {
+		claim, _ = n.unlinkClaims(req.Name, c.permanodeString())
+	} else {
+		claim = schema.NewDelAttributeClaim(n.permanode, "camliPath:"+req.Name)
+	}
+	if err := n.fs.uploadClaim(claim); err != nil {
+		n.fs.errorf("mutDir.Remove: %v", err)
+		return n.fs.uploadError(err)
 	}
 	// Remove child from map.
 	n.mu.Lock()
-	if n.children != nil {
-		delete(n.children, req.Name)
+	n.bury(req.Name, n.children[req.Name])
+	delete(n.children, req.Name)
+	delete(n.conflicts, req.Name)
+	n.childGen++
+	n.mu.Unlock()
+	n.touch(time.Now())
+	return nil
+}
+
+// unlinkAll deletes the camliPath links of the whole tree below n,
+// parent's child name, deepest first, so an interrupted removal
+// leaves the tree partly emptied rather than partly detached. A
+// directory also linked from elsewhere is left whole, as removing
+// it here mustn't empty it there. seen holds the permanodes of the
+// directories already on the way down, to stop at cycles.
+func (n *mutDir) unlinkAll(parent *mutDir, name string, seen map[string]bool) error {
+	if seen[n.permanode.String()] {
+		return nil
+	}
+	seen[n.permanode.String()] = true
+	switch shared, err := n.linkedElsewhere(parent.permanode, name); {
+	case err != nil:
+		return err
+	case shared:
+		return nil
+	}
+	if err := n.populate(); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	children := make(map[string]mutFileOrDir, len(n.children))
+	for name, c := range n.children {
+		children[name] = c
 	}
 	n.mu.Unlock()
+	for name, c := range children {
+		if sub, ok := c.(*mutDir); ok {
+			if err := sub.unlinkAll(n, name, seen); err != nil {
+				return err
+			}
+		}
+		claim, _ := n.unlinkClaims(name, c.permanodeString())
+		if err := n.fs.uploadClaim(claim); err != nil {
+			return err
+		}
+		n.mu.Lock()
+		delete(n.children, name)
+		delete(n.conflicts, name)
+		n.childGen++
+		n.bury(name, c)
+		n.mu.Unlock()
+	}
 	return nil
 }
 
+// linkedElsewhere reports whether n's permanode is linked by a
+// camliPath attribute other than parent's camliPath:name.
+func (n *mutDir) linkedElsewhere(parent *blobref.BlobRef, name string) (bool, error) {
+	res, err := n.fs.client.GetSignerPaths(&search.SignerPathsRequest{
+		Signer: n.fs.client.SignerPublicKeyBlobref(),
+		Target: n.permanode,
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, p := range res.Paths {
+		if p.BaseRef.String() == parent.String() && p.Suffix == name {
+			continue
+		}
+		// The index keeps paths whose attribute was deleted
+		// without a value, so check the base still links n.
+		db := res.Meta[p.BaseRef.String()]
+		if db == nil || db.Permanode == nil {
+			continue
+		}
+		for _, v := range db.Permanode.Attr["camliPath:"+p.Suffix] {
+			if v == n.permanode.String() {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
 // &RenameRequest{Header:fuse.Header{Conn:(*fuse.Conn)(0xc210048180), ID:0x2, Node:0x8, Uid:0xf0d4, Gid:0x1388, Pid:0x5edb}, NewDir:0x8, OldName:"1", NewName:"2"}
 func (n *mutDir) Rename(req *fuse.RenameRequest, newDir fuse.Node, intr fuse.Intr) fuse.Error {
+	if n.fs.readOnly() {
+		return fuse.EPERM
+	}
 	n2, ok := newDir.(*mutDir)
 	if !ok {
-		log.Printf("*mutDir newDir node isn't a *mutDir; is a %T; can't handle. returning EIO.", newDir)
+		n.fs.errorf("*mutDir newDir node isn't a *mutDir; is a %T; can't handle. returning EIO.", newDir)
 		return fuse.EIO
 	}
 
-	// TODO: do these populates in parallel:
-	if err := n.populate(); err != nil {
-		log.Printf("*mutDir.Rename src dir populate = %v", err)
+	// Populate both dirs in parallel. Each populate only takes
+	// its own dir's lock, so they can't deadlock.
+	var wg sync.WaitGroup
+	var srcErr, dstErr error
+	if n2 != n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dstErr = n2.populate()
+		}()
+	}
+	srcErr = n.populate()
+	wg.Wait()
+	if srcErr != nil {
+		n.fs.errorf("*mutDir.Rename src dir populate = %v", srcErr)
 		return fuse.EIO
 	}
-	if err := n2.populate(); err != nil {
-		log.Printf("*mutDir.Rename dst dir populate = %v", err)
+	if dstErr != nil {
+		n.fs.errorf("*mutDir.Rename dst dir populate = %v", dstErr)
 		return fuse.EIO
 	}
 
@@ -353,28 +1040,90 @@ func (n *mutDir) Rename(req *fuse.RenameRequest, newDir fuse.Node, intr fuse.Int
 	target, ok := n.children[req.OldName]
 	n.mu.Unlock()
 	if !ok {
-		log.Printf("*mutDir.Rename src name %q isn't known", req.OldName)
+		n.fs.debugf("*mutDir.Rename src name %q isn't known", req.OldName)
 		return fuse.ENOENT
 	}
 
+	// Renaming over an existing name replaces it, like rename(2).
+	n2.mu.Lock()
+	clobbered := n2.children[req.NewName]
+	n2.mu.Unlock()
+	if clobbered != nil {
+		if samePermanode(clobbered, target) {
+			// Two links to the same file; as with
+			// rename(2), nothing to do.
+			return nil
+		}
+		if err := checkReplace(target, clobbered); err != nil {
+			n.fs.debugf("*mutDir.Rename can't replace %q: %v", req.NewName, err)
+			return err
+		}
+	}
+
 	now := time.Now()
 
-	// Add a camliPath:name attribute to the dest permanode before unlinking it from
-	// the source.
+	if clobbered != nil && n.fs.RenameMovesContent {
+		if src, dst, ok := contentMovable(target, clobbered); ok {
+			return n.moveContent(req.OldName, src, n2, req.NewName, dst, now)
+		}
+	}
+
+	// Link the target into the dest permanode and unlink it from
+	// the source concurrently, as the index has no claim changing
+	// both at once. If only one of them makes it, it's undone, so
+	// the target doesn't end up linked twice, or not at all.
 	claim := schema.NewSetAttributeClaim(n2.permanode, "camliPath:"+req.NewName, target.permanodeString())
 	claim.SetClaimDate(now)
-	_, err := n.fs.client.UploadAndSignBlob(claim)
+	delClaim, relink := n.unlinkClaims(req.OldName, target.permanodeString())
+	delClaim.SetClaimDate(now)
+	// Logged together, so a crash in between completes the
+	// rename when the claim log is replayed.
+	linkID, err := n.fs.logClaim(claim)
 	if err != nil {
-		log.Printf("Upload rename link error: %v", err)
-		return fuse.EIO
+		return n.fs.uploadError(err)
 	}
-
-	delClaim := schema.NewDelAttributeClaim(n.permanode, "camliPath:"+req.OldName)
-	delClaim.SetClaimDate(now)
-	_, err = n.fs.client.UploadAndSignBlob(delClaim)
+	unlinkID, err := n.fs.logClaim(delClaim)
 	if err != nil {
-		log.Printf("Upload rename src unlink error: %v", err)
-		return fuse.EIO
+		n.fs.claimsDone(linkID)
+		return n.fs.uploadError(err)
+	}
+	var linkErr, unlinkErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, linkErr = n.fs.uploadClient().UploadAndSignBlob(claim)
+	}()
+	_, unlinkErr = n.fs.uploadClient().UploadAndSignBlob(delClaim)
+	wg.Wait()
+	n.fs.claimsDone(linkID, unlinkID)
+	if linkErr != nil || unlinkErr != nil {
+		// Claims of the same date apply in no set order, so
+		// the undo is dated after them.
+		var undo *schema.Builder
+		switch {
+		case linkErr != nil && unlinkErr != nil:
+			// Neither made it; nothing to undo.
+		case unlinkErr != nil:
+			if clobbered != nil {
+				undo = schema.NewSetAttributeClaim(n2.permanode, "camliPath:"+req.NewName, clobbered.permanodeString())
+			} else {
+				undo = schema.NewDelAttributeClaim(n2.permanode, "camliPath:"+req.NewName)
+			}
+		default:
+			undo = relink
+		}
+		if undo != nil {
+			undo.SetClaimDate(now.Add(time.Millisecond))
+			if _, err := n.fs.uploadClient().UploadAndSignBlob(undo); err != nil {
+				n.fs.errorf("*mutDir.Rename of %q to %q half done, and undoing it failed: %v", req.OldName, req.NewName, err)
+			}
+		}
+		err := linkErr
+		if err == nil {
+			err = unlinkErr
+		}
+		n.fs.errorf("Upload rename claims error: link: %v; unlink: %v", linkErr, unlinkErr)
+		return n.fs.uploadError(err)
 	}
 
 	// TODO(bradfitz): this locking would be racy, if the kernel
@@ -382,15 +1131,66 @@ func (n *mutDir) Rename(req *fuse.RenameRequest, newDir fuse.Node, intr fuse.Int
 	// kernel for now. Later we can verify and remove this
 	// comment.
 	n.mu.Lock()
-	if n.children[req.OldName] != target {
-		panic("Race.")
+	if cur := n.children[req.OldName]; cur == nil || !samePermanode(cur, target) {
+		// A populate may have put a new node of the same
+		// permanode in target's place, which is no race. Anything
+		// else changed the directory since the lookup above. The
+		// claims are uploaded, so the rename did happen; have both
+		// directories fetched again rather than guess at their
+		// children.
+		n.lastPop = time.Time{}
+		n.mu.Unlock()
+		n2.mu.Lock()
+		n2.lastPop = time.Time{}
+		n2.mu.Unlock()
+		n.fs.infof("*mutDir.Rename: %q changed during its rename to %q; repopulating", req.OldName, req.NewName)
+		return nil
 	}
 	delete(n.children, req.OldName)
+	delete(n.conflicts, req.OldName)
+	n.childGen++
+	n.bury(req.OldName, target)
 	n.mu.Unlock()
 	n2.mu.Lock()
+	if clobbered != nil {
+		// The camliPath claim above replaced its link.
+		n.fs.infof("*mutDir.Rename unlinked %q (%s), replaced by %s", req.NewName, clobbered.permanodeString(), target.permanodeString())
+	}
 	n2.children[req.NewName] = target
+	n2.childGen++
+	n2.unbury(req.NewName)
 	n2.mu.Unlock()
 
+	n.touch(now)
+	if n2 != n {
+		n2.touch(now)
+	}
+	return nil
+}
+
+// checkReplace returns the error rename(2) gives when old can't be
+// replaced by target: directories can only replace empty directories,
+// and files only files.
+func checkReplace(target, old mutFileOrDir) fuse.Error {
+	oldDir, ok := old.(*mutDir)
+	if !ok {
+		if _, ok := target.(*mutDir); ok {
+			return errNotDir
+		}
+		return nil
+	}
+	if _, ok := target.(*mutDir); !ok {
+		return fuse.Errno(syscall.EISDIR)
+	}
+	if err := oldDir.populate(); err != nil {
+		oldDir.fs.errorf("*mutDir.Rename dst populate = %v", err)
+		return fuse.EIO
+	}
+	oldDir.mu.Lock()
+	defer oldDir.mu.Unlock()
+	if len(oldDir.children) > 0 {
+		return fuse.Errno(syscall.ENOTEMPTY)
+	}
 	return nil
 }
 
@@ -400,13 +1200,40 @@ type mutFile struct {
 	permanode *blobref.BlobRef
 	parent    *mutDir
 	name      string // ent name (base name within parent)
+	ino       nodeInode
 
 	mu           sync.Mutex       // protects all following fields
 	symLink      bool             // if true, is a symlink
 	target       string           // if a symlink
+	targetTime   time.Time        // when target was last read or written
 	content      *blobref.BlobRef // if a regular file
+	contentMeta  *schema.Blob     // content's file schema, or nil until opened
 	size         int64
-	mtime, atime time.Time // if zero, use serverStart
+	needSize     bool           // size not yet looked up (LazySizes)
+	mtime, atime time.Time      // if zero, use created
+	created      time.Time      // first claim's date; if zero, use serverStart
+	backing      *sharedBacking // open handles' temp file, or nil
+	xattrs       map[string][]byte
+	owner        owner // see owner.go
+	perm         perm  // see mode.go; unused for symlinks
+
+	// unresolved is set, when n is made, if its permanode
+	// wasn't described; n is then a placeholder, which can't be
+	// opened or changed, until its parent's Lookup resolves it.
+	unresolved bool
+
+	// unlinked is set once n was removed while open; its
+	// contents are no longer stored. sillyDir links n as
+	// sillyName until its last handle is released; see silly.go.
+	unlinked  bool
+	sillyDir  *mutDir
+	sillyName string
+}
+
+func (n *mutFile) isSymlink() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.symLink
 }
 
 // for debugging
@@ -418,73 +1245,259 @@ func (n *mutFile) fullPath() string {
 }
 
 func (n *mutFile) Attr() fuse.Attr {
-	// TODO: don't grab n.mu three+ times in here.
-	var mode os.FileMode = 0600 // writable
+	// Done first, as it may describe the content without n.mu.
+	n.resolveSize()
 
 	n.mu.Lock()
-	size := n.size
+	defer n.mu.Unlock()
+	mode := n.perm.bits(n.fs, 0600) // writable by default
+	switch {
+	case n.unresolved:
+		mode = 0
+	case n.symLink:
+		mode = os.ModeSymlink | 0600
+	}
 	var blocks uint64
-	if size > 0 {
-		blocks = uint64(size)/512 + 1
+	if n.size > 0 {
+		blocks = uint64(n.size)/512 + 1
 	}
-	inode := n.permanode.AsUint64()
-	if n.symLink {
-		mode |= os.ModeSymlink
+	uid, gid := n.owner.ids(n.fs)
+	created := orServerStart(n.created)
+	mtime := n.modTimeLocked()
+	atime := n.atime
+	if atime.IsZero() {
+		atime = mtime
 	}
-	n.mu.Unlock()
-
 	return fuse.Attr{
-		Inode:  inode,
+		Inode:  n.ino.get(n.fs, n.permanode),
 		Mode:   mode,
-		Uid:    uint32(os.Getuid()),
-		Gid:    uint32(os.Getgid()),
-		Size:   uint64(size),
+		Uid:    uid,
+		Gid:    gid,
+		Size:   uint64(n.size),
 		Blocks: blocks,
-		Mtime:  n.modTime(),
-		Atime:  n.accessTime(),
-		Ctime:  serverStart,
-		Crtime: serverStart,
+		Mtime:  mtime,
+		Atime:  atime,
+		Ctime:  created,
+		Crtime: created,
+	}
+}
+
+// Forget releases n's inode number, once the kernel has no use for
+// it.
+func (n *mutFile) Forget() {
+	n.ino.forget(n.fs)
+}
+
+// Getattr is Attr, for the kernel to cache as long as the file
+// system's AttrValid.
+func (n *mutFile) Getattr(req *fuse.GetattrRequest, res *fuse.GetattrResponse, intr fuse.Intr) fuse.Error {
+	res.AttrValid = n.fs.attrValid()
+	res.Attr = n.Attr()
+	return nil
+}
+
+// updateFrom copies into n what a describe found out about it, as
+// c, unless it's not of the same kind. A file open for writing keeps
+// its contents, being newer. It reports whether n was updated.
+func (n *mutFile) updateFrom(c *mutFile) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.unresolved || n.symLink != c.symLink {
+		return false
+	}
+	if n.symLink {
+		n.target, n.targetTime = c.target, c.targetTime
+	} else if n.backing == nil && !n.content.Equal(c.content) {
+		n.content = c.content
+		n.contentMeta = nil
+		n.size, n.needSize = c.size, c.needSize
 	}
+	n.xattrs = c.xattrs
+	n.owner = c.owner
+	n.perm = c.perm
+	n.mtime = c.mtime
+	n.created = c.created
+	return true
 }
 
-func (n *mutFile) accessTime() time.Time {
+// resolveSize looks up the size of n's content, if populate didn't
+// already (see CamliFileSystem.LazySizes). The error is
+// errContentNotFile if the content turns out not to be a file, which
+// populate only checks when it describes contents.
+func (n *mutFile) resolveSize() error {
+	n.mu.Lock()
+	content := n.content
+	need := n.needSize
+	n.mu.Unlock()
+	if !need {
+		return nil
+	}
+	size, err := n.contentSize(content)
+	if err != nil {
+		n.fs.warnf("mutFile.resolveSize(%q): %v", n.fullPath(), err)
+		return err
+	}
 	n.mu.Lock()
-	if !n.atime.IsZero() {
-		defer n.mu.Unlock()
-		return n.atime
+	defer n.mu.Unlock()
+	if n.needSize && n.content.Equal(content) {
+		n.size = size
+		n.needSize = false
 	}
+	return nil
+}
+
+// errContentNotFile is returned by contentSize for a content blob
+// described as something other than a file schema.
+var errContentNotFile = errors.New("fs: content isn't a file")
+
+// verifySize re-describes n's content and, if the file schema's size
+// disagrees with the size n has cached (e.g. after a partial write),
+// corrects it. It returns the size n had before and whether it was
+// corrected. Open calls it when the content it's about to read has a
+// different size than n reports.
+func (n *mutFile) verifySize() (oldSize int64, repaired bool, err error) {
+	n.mu.Lock()
+	content := n.content
 	n.mu.Unlock()
-	return n.modTime()
+	if content == nil {
+		return 0, false, fmt.Errorf("%q has no content", n.fullPath())
+	}
+	size, err := n.contentSize(content)
+	if err != nil {
+		return 0, false, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.content.Equal(content) {
+		return n.size, false, fmt.Errorf("content of %q changed during verify", n.fullPath())
+	}
+	oldSize = n.size
+	if n.size != size || n.needSize {
+		repaired = n.size != size
+		n.size = size
+		n.needSize = false
+	}
+	if repaired {
+		n.fs.warnf("mutFile.verifySize(%q): corrected size %d to %d for content %v", n.fullPath(), oldSize, size, content)
+	}
+	return oldSize, repaired, nil
+}
+
+// sizeDisagrees reports whether n's cached size differs from
+// schemaSize, the size of its content's file schema, while there are
+// no unstored writes that could explain the difference.
+func (n *mutFile) sizeDisagrees(schemaSize int64) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.content != nil && n.backing == nil && !n.needSize && n.size != schemaSize
+}
+
+// contentSize returns the size of the file schema blob content, as
+// described by the search server.
+func (n *mutFile) contentSize(content *blobref.BlobRef) (int64, error) {
+	res, err := n.fs.describe(&search.DescribeRequest{
+		BlobRef: content,
+		Depth:   1,
+	})
+	if err != nil {
+		return 0, err
+	}
+	db := res.Meta[content.String()]
+	if db != nil && db.CamliType != "" && db.CamliType != "file" {
+		return 0, errContentNotFile
+	}
+	if db == nil || db.File == nil {
+		return 0, fmt.Errorf("content %v not described as a file", content)
+	}
+	return db.File.Size, nil
 }
 
 func (n *mutFile) modTime() time.Time {
 	n.mu.Lock()
 	defer n.mu.Unlock()
+	return n.modTimeLocked()
+}
+
+// modTimeLocked is modTime for callers holding n.mu.
+func (n *mutFile) modTimeLocked() time.Time {
 	if !n.mtime.IsZero() {
 		return n.mtime
 	}
-	return serverStart
+	return orServerStart(n.created)
 }
 
 func (n *mutFile) setContent(br *blobref.BlobRef, size int64) error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	n.content = br
+	n.contentMeta = nil
 	n.size = size
+	n.needSize = false
 	claim := schema.NewSetAttributeClaim(n.permanode, "camliContent", br.String())
-	_, err := n.fs.client.UploadAndSignBlob(claim)
-	return err
+	return n.fs.uploadClaim(claim)
+}
+
+// storeMtime sets n's modification time to t, and records it in
+// n's permanode.
+func (n *mutFile) storeMtime(t time.Time) error {
+	claim := schema.NewSetAttributeClaim(n.permanode, mtimeAttr, schema.RFC3339FromTime(t))
+	if err := n.fs.uploadClaim(claim); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.mtime = t
+	n.mu.Unlock()
+	return nil
+}
+
+// sameContent reports whether br is already n's content. If so, it
+// also sets n's size, which writes may have left out of date.
+func (n *mutFile) sameContent(br *blobref.BlobRef, size int64) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !br.Equal(n.content) {
+		return false
+	}
+	n.size = size
+	n.needSize = false
+	return true
 }
 
 func (n *mutFile) setSizeAtLeast(size int64) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	log.Printf("mutFile.setSizeAtLeast(%d). old size = %d", size, n.size)
+	n.fs.debugf("mutFile.setSizeAtLeast(%d). old size = %d", size, n.size)
 	if size > n.size {
 		n.size = size
 	}
 }
 
+// newFileReader returns a reader of n's content. The content's file
+// schema blob is kept on n once fetched, so opening n again only
+// fetches the chunks read. A file without content yet, e.g. created
+// but not released, reads as empty.
+func (n *mutFile) newFileReader() (*schema.FileReader, error) {
+	n.mu.Lock()
+	content, meta := n.content, n.contentMeta
+	n.mu.Unlock()
+	if content == nil {
+		return schema.NewFileMap(n.name).Blob().NewFileReader(n.fs.readFetcher())
+	}
+	if meta == nil {
+		var err error
+		meta, err = n.fs.fetchSchemaMeta(content)
+		if err != nil {
+			return nil, err
+		}
+		n.mu.Lock()
+		if n.content.Equal(content) {
+			n.contentMeta = meta
+		}
+		n.mu.Unlock()
+	}
+	return meta.NewFileReader(n.fs.readFetcher())
+}
+
 // Empirically:
 //  open for read:   req.Flags == 0
 //  open for append: req.Flags == 1
@@ -497,60 +1510,163 @@ func (n *mutFile) setSizeAtLeast(size int64) {
 func (n *mutFile) Open(req *fuse.OpenRequest, res *fuse.OpenResponse, intr fuse.Intr) (fuse.Handle, fuse.Error) {
 	mutFileOpen.Incr()
 
-	log.Printf("mutFile.Open: %v: content: %v dir=%v flags=%v mode=%v", n.permanode, n.content, req.Dir, req.Flags, req.Mode)
-	r, err := schema.NewFileReader(n.fs.fetcher, n.content)
+	n.fs.debugf("mutFile.Open: %v: content: %v dir=%v flags=%v mode=%v", n.permanode, n.content, req.Dir, req.Flags, req.Mode)
+	if n.unresolved {
+		n.fs.errorf("mutFile.Open(%q): permanode %v not described", n.fullPath(), n.permanode)
+		return nil, fuse.EIO
+	}
+	if n.fs.readOnly() && req.Flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		// Releasing a writable handle would store its contents.
+		return nil, fuse.EPERM
+	}
+	if h := n.joinBacking(req.Flags); h != nil {
+		res.Flags &= ^fuse.OpenDirectIO
+		n.fs.debugf("mutFile.Open returning filehandle on shared backing")
+		return h, nil
+	}
+	r, err := n.newFileReader()
 	if err != nil {
 		mutFileOpenError.Incr()
-		log.Printf("mutFile.Open: %v", err)
+		n.fs.errorf("mutFile.Open: %v", err)
 		return nil, fuse.EIO
 	}
+	if n.sizeDisagrees(r.Size()) {
+		if _, _, err := n.verifySize(); err != nil {
+			n.fs.warnf("mutFile.Open(%q): %v", n.fullPath(), err)
+		}
+	}
 
 	// Turn off the OpenDirectIO bit (on by default in rsc fuse server.go),
 	// else append operations don't work for some reason.
 	res.Flags &= ^fuse.OpenDirectIO
 
 	// Read-only.
-	if req.Flags == 0 {
+	if req.Flags&syscall.O_ACCMODE == syscall.O_RDONLY {
 		mutFileOpenRO.Incr()
-		log.Printf("mutFile.Open returning read-only file")
+		n.fs.debugf("mutFile.Open returning read-only file")
 		n := &node{
 			fs:      n.fs,
 			blobref: n.content,
 		}
-		return &nodeReader{n: n, fr: r}, nil
+		nr := newNodeReader(n, r)
+		if n.fs.DetectCopies {
+			nr.copied = new(seqHash)
+		}
+		return nr, nil
 	}
 
 	mutFileOpenRW.Incr()
-	log.Printf("mutFile.Open returning read-write filehandle")
+	n.fs.debugf("mutFile.Open returning read-write filehandle")
+
+	// Writes only ever grow the size, so it must be known first.
+	n.resolveSize()
 
 	defer r.Close()
-	return n.newHandle(r)
+	return n.newHandle(r, req.Flags, intr)
 }
 
+// Fsync is only called by the fuse package when there's no open
+// mutFileHandle for the request (see mutFileHandle.Fsync), in which
+// case there's nothing pending to write but queued claims.
 func (n *mutFile) Fsync(r *fuse.FsyncRequest, intr fuse.Intr) fuse.Error {
-	// TODO(adg): in the fuse package, plumb through fsync to mutFileHandle
-	// in the same way we did Truncate.
-	log.Printf("mutFile.Fsync: TODO")
+	if err := n.fs.FlushClaims(); err != nil {
+		n.fs.errorf("mutFile.Fsync: %v", err)
+		return n.fs.uploadError(err)
+	}
 	return nil
 }
 
+// Readlink returns the symlink's target. A target older than
+// populateInterval is looked up again first, in case another client
+// changed it; the kernel may hold on to this node for much longer
+// than its parent's listing.
 func (n *mutFile) Readlink(req *fuse.ReadlinkRequest, intr fuse.Intr) (string, fuse.Error) {
 	n.mu.Lock()
-	defer n.mu.Unlock()
 	if !n.symLink {
-		log.Printf("mutFile.Readlink on node that's not a symlink?")
+		n.mu.Unlock()
+		n.fs.warnf("mutFile.Readlink on node that's not a symlink?")
 		return "", fuse.EIO
 	}
+	stale := n.targetTime.Add(populateInterval).Before(time.Now())
+	n.mu.Unlock()
+	if stale {
+		n.refreshTarget()
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
 	return n.target, nil
 }
 
+// refreshTarget re-describes the symlink's permanode and updates
+// its cached target. On failure the old target is kept.
+func (n *mutFile) refreshTarget() {
+	now := time.Now()
+	n.fs.uploadClaims()
+	res, err := n.fs.describe(&search.DescribeRequest{
+		BlobRef: n.permanode,
+		Depth:   1,
+	})
+	if err != nil {
+		n.fs.warnf("mutFile.refreshTarget(%q): %v", n.fullPath(), err)
+		return
+	}
+	db := res.Meta[n.permanode.String()]
+	if db == nil || db.Permanode == nil {
+		n.fs.warnf("mutFile.refreshTarget(%q): permanode not described", n.fullPath())
+		return
+	}
+	target := db.Permanode.Attr.Get("camliSymlinkTarget")
+	if target == "" {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// Don't clobber a target set while we were asking.
+	if n.targetTime.Before(now) {
+		n.target = target
+		n.targetTime = now
+	}
+}
+
 func (n *mutFile) Setattr(req *fuse.SetattrRequest, res *fuse.SetattrResponse, intr fuse.Intr) fuse.Error {
-	log.Printf("mutFile.Setattr on %q: %#v", n.fullPath(), req)
+	if n.fs.readOnly() {
+		return fuse.EPERM
+	}
+	if n.unresolved {
+		// It might not even be a file.
+		return fuse.EIO
+	}
+	n.fs.debugf("mutFile.Setattr on %q: %#v", n.fullPath(), req)
 	// 2013/07/17 19:43:41 mutFile.Setattr on "foo": &fuse.SetattrRequest{Header:fuse.Header{Conn:(*fuse.Conn)(0xc210047180), ID:0x3, Node:0x3d, Uid:0xf0d4, Gid:0x1388, Pid:0x75e8}, Valid:0x30, Handle:0x0, Size:0x0, Atime:time.Time{sec:63509651021, nsec:0x4aec6b8, loc:(*time.Location)(0x47f7600)}, Mtime:time.Time{sec:63509651021, nsec:0x4aec6b8, loc:(*time.Location)(0x47f7600)}, Mode:0x4000000, Uid:0x0, Gid:0x0, Bkuptime:time.Time{sec:62135596800, nsec:0x0, loc:(*time.Location)(0x47f7600)}, Chgtime:time.Time{sec:62135596800, nsec:0x0, loc:(*time.Location)(0x47f7600)}, Crtime:time.Time{sec:0, nsec:0x0, loc:(*time.Location)(nil)}, Flags:0x0}
 
-	n.mu.Lock()
+	if req.Valid.Uid() || req.Valid.Gid() {
+		if err := storeOwner(n.fs, n.permanode, req); err != nil {
+			n.fs.errorf("mutFile.Setattr(%q): %v", n.fullPath(), err)
+			return n.fs.uploadError(err)
+		}
+	}
+	if req.Valid.Mode() && !n.isSymlink() {
+		if err := storeMode(n.fs, n.permanode, req); err != nil {
+			n.fs.errorf("mutFile.Setattr(%q): %v", n.fullPath(), err)
+			return n.fs.uploadError(err)
+		}
+	}
 	if req.Valid&fuse.SetattrMtime != 0 {
-		n.mtime = req.Mtime
+		if err := n.storeMtime(req.Mtime); err != nil {
+			n.fs.errorf("mutFile.Setattr(%q): %v", n.fullPath(), err)
+			return n.fs.uploadError(err)
+		}
+	}
+
+	n.mu.Lock()
+	n.owner.apply(req)
+	if !n.symLink {
+		n.perm.apply(req)
+	}
+	if req.Valid&fuse.SetattrMtime != 0 && n.backing != nil {
+		// As with cp -p: don't let storing the new contents
+		// overwrite the time just set.
+		n.backing.keepMtime = true
 	}
 	if req.Valid&fuse.SetattrAtime != 0 {
 		n.atime = req.Atime
@@ -558,44 +1674,171 @@ func (n *mutFile) Setattr(req *fuse.SetattrRequest, res *fuse.SetattrResponse, i
 	if req.Valid&fuse.SetattrSize != 0 {
 		// TODO(bradfitz): truncate?
 		n.size = int64(req.Size)
+		n.needSize = false
 	}
 	n.mu.Unlock()
 
-	res.AttrValid = 1 * time.Minute
+	res.AttrValid = n.fs.attrValid()
 	res.Attr = n.Attr()
 	return nil
 }
 
-func (n *mutFile) newHandle(body io.Reader) (fuse.Handle, fuse.Error) {
-	tmp, err := ioutil.TempFile("", "camli-")
+// newHandle returns a writable handle on n, on a new temporary file
+// holding body, unless another handle opened its shared backing file
+// meanwhile. It waits for a write slot first; see MaxOpenWrites.
+func (n *mutFile) newHandle(body io.Reader, flags uint32, intr fuse.Intr) (fuse.Handle, fuse.Error) {
+	if err := n.fs.acquireWriteSlot(intr); err != nil {
+		return nil, fuse.EINTR
+	}
+	tmp, err := ioutil.TempFile(n.fs.TempDir, "camli-")
 	if err == nil && body != nil {
 		_, err = io.Copy(tmp, body)
 	}
 	if err != nil {
-		log.Printf("mutFile.newHandle: %v", err)
+		n.fs.errorf("mutFile.newHandle: %v", err)
 		if tmp != nil {
 			tmp.Close()
 			os.Remove(tmp.Name())
 		}
+		n.fs.releaseWriteSlot()
 		return nil, fuse.EIO
 	}
-	return &mutFileHandle{f: n, tmp: tmp}, nil
+	h := &mutFileHandle{
+		f:          n,
+		appendOnly: flags&syscall.O_APPEND != 0,
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.backing != nil {
+		// Another handle was opened meanwhile; use its file.
+		tmp.Close()
+		os.Remove(tmp.Name())
+		n.fs.releaseWriteSlot()
+	} else {
+		// Only files written from empty can be copies. A new
+		// file is stored even if nothing is written to it.
+		n.backing = &sharedBacking{
+			tmp:     tmp,
+			copied:  seqHash{broken: body != nil || !n.fs.DetectCopies},
+			changed: body == nil,
+		}
+		n.fs.open.add(n.backing, n)
+	}
+	n.backing.refs++
+	h.tmp = n.backing.tmp
+	h.shared = n.backing
+	return h, nil
+}
+
+// A sharedBacking is the temporary file shared by all open writable
+// handles of a mutFile, and by its read-only handles too when
+// CamliFileSystem.SharedWrites is set. Sharing it means concurrent
+// writers see each other's writes, and whichever releases last
+// stores them all, instead of one silently discarding the other's.
+type sharedBacking struct {
+	mu   sync.Mutex // serializes appends and flushes
+	tmp  *os.File   // nil once closed; guarded by mu
+	refs int        // number of open handles; guarded by the mutFile's mu
+
+	// keepMtime is set once the file's modification time was set
+	// explicitly while open, so stores don't bump it to the
+	// current time. Guarded by the mutFile's mu.
+	keepMtime bool
+
+	// changed is set by writes and truncations, and cleared when a
+	// store begins, so flushing an unmodified file uploads nothing.
+	// Guarded by the mutFile's mu.
+	changed bool
+
+	wb     writeBehind // see writebehind.go
+	copied seqHash     // the bytes written; see copy.go
+}
+
+// joinBacking returns a new handle on n's shared backing file, if n
+// has one. It returns nil if n has no open writable handles, or if
+// the open is read-only and SharedWrites isn't set, in which case
+// the reader sees only stored contents.
+func (n *mutFile) joinBacking(flags uint32) *mutFileHandle {
+	readOnly := flags&syscall.O_ACCMODE == syscall.O_RDONLY
+	if !n.fs.SharedWrites && readOnly {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.backing == nil {
+		return nil
+	}
+	n.backing.refs++
+	return &mutFileHandle{
+		f:          n,
+		tmp:        n.backing.tmp,
+		shared:     n.backing,
+		readOnly:   readOnly,
+		appendOnly: flags&syscall.O_APPEND != 0,
+	}
+}
+
+// releaseBacking closes and removes h's temporary file, unless
+// other handles still share it.
+func (n *mutFile) releaseBacking(h *mutFileHandle) {
+	n.mu.Lock()
+	h.shared.refs--
+	last := h.shared.refs == 0
+	if last && n.backing == h.shared {
+		n.backing = nil
+	}
+	var sillyDir *mutDir
+	if last && n.backing == nil {
+		sillyDir = n.sillyDir
+		n.sillyDir = nil
+	}
+	silly := n.sillyName
+	n.mu.Unlock()
+	if !last {
+		return
+	}
+	n.fs.open.remove(h.shared)
+	if sillyDir != nil {
+		sillyDir.removeSilly(silly, n)
+	}
+	// Not under n.mu: a write-behind store may hold h.shared.mu
+	// while it sets n's content.
+	h.shared.wb.stop()
+	mu := h.tmpMu()
+	mu.Lock()
+	defer mu.Unlock()
+	h.shared.tmp = nil
+	h.tmp.Close()
+	os.Remove(h.tmp.Name())
+	n.fs.releaseWriteSlot()
 }
 
 // mutFileHandle represents an open mutable file.
 // It stores the file contents in a temporary file, and
 // delegates reads and writes directly to the temporary file.
-// When the handle is released, it writes the contents of the
-// temporary file to the blobstore, and instructs the parent
+// When the handle is flushed or released, it writes the contents
+// of the temporary file to the blobstore, and instructs the parent
 // mutFile to update the file permanode.
 type mutFileHandle struct {
 	f   *mutFile
 	tmp *os.File
+
+	// appendOnly is whether the file was opened with O_APPEND,
+	// in which case every write goes at the end of tmp.
+	appendOnly bool
+
+	shared   *sharedBacking // owner of tmp
+	readOnly bool           // opened read-only (SharedWrites)
+}
+
+// tmpMu returns the mutex serializing appends and flushes on h.tmp.
+func (h *mutFileHandle) tmpMu() *sync.Mutex {
+	return &h.shared.mu
 }
 
 func (h *mutFileHandle) Read(req *fuse.ReadRequest, res *fuse.ReadResponse, intr fuse.Intr) fuse.Error {
 	if h.tmp == nil {
-		log.Printf("Read called on camli mutFileHandle without a tempfile set")
+		h.f.fs.errorf("Read called on camli mutFileHandle without a tempfile set")
 		return fuse.EIO
 	}
 
@@ -605,76 +1848,293 @@ func (h *mutFileHandle) Read(req *fuse.ReadRequest, res *fuse.ReadResponse, intr
 		err = nil
 	}
 	if err != nil {
-		log.Printf("mutFileHandle.Read: %v", err)
+		h.f.fs.errorf("mutFileHandle.Read: %v", err)
 		return fuse.EIO
 	}
 	res.Data = buf[:n]
+	fileRead.Incr()
+	fileReadBytes.Add(int64(n))
 	return nil
 }
 
 func (h *mutFileHandle) Write(req *fuse.WriteRequest, res *fuse.WriteResponse, intr fuse.Intr) fuse.Error {
+	if h.f.fs.readOnly() {
+		return fuse.EPERM
+	}
 	if h.tmp == nil {
-		log.Printf("Write called on camli mutFileHandle without a tempfile set")
+		h.f.fs.errorf("Write called on camli mutFileHandle without a tempfile set")
 		return fuse.EIO
 	}
 
-	n, err := h.tmp.WriteAt(req.Data, req.Offset)
-	log.Printf("mutFileHandle.Write(%q, at %d, flags %v, %q) = %d, %v", h.f.fullPath(), req.Offset, req.Flags, req.Data, n, err)
+	off := req.Offset
+	if h.appendOnly {
+		// Don't trust the kernel's offset: with several
+		// writers it may already be stale.
+		mu := h.tmpMu()
+		mu.Lock()
+		defer mu.Unlock()
+		fi, err := h.tmp.Stat()
+		if err != nil {
+			h.f.fs.errorf("mutFileHandle.Write: %v", err)
+			return fuse.EIO
+		}
+		off = fi.Size()
+	}
+
+	n, err := h.tmp.WriteAt(req.Data, off)
+	h.f.fs.debugf("mutFileHandle.Write(%q, at %d, flags %v, %q) = %d, %v", h.f.fullPath(), off, req.Flags, req.Data, n, err)
 	if err != nil {
-		log.Println("mutFileHandle.Write:", err)
+		h.f.fs.errorf("mutFileHandle.Write: %v", err)
 		return fuse.EIO
 	}
 	res.Size = n
-	h.f.setSizeAtLeast(req.Offset + int64(n))
+	h.shared.copied.add(off, req.Data[:n])
+	h.f.setSizeAtLeast(off + int64(n))
+	h.f.markChanged(h.shared)
+	h.f.wrote(h.shared, n)
+	fileWrite.Incr()
+	fileWriteBytes.Add(int64(n))
 	return nil
 }
 
 func (h *mutFileHandle) Release(req *fuse.ReleaseRequest, intr fuse.Intr) fuse.Error {
 	if h.tmp == nil {
-		log.Printf("Release called on camli mutFileHandle without a tempfile set")
+		h.f.fs.errorf("Release called on camli mutFileHandle without a tempfile set")
 		return fuse.EIO
 	}
-	log.Printf("mutFileHandle release.")
-	_, err := h.tmp.Seek(0, 0)
+	h.f.fs.debugf("mutFileHandle release.")
+	// If interrupted, the upload and release carry on without
+	// the closing process waiting for them.
+	err := interruptible(intr, func() error {
+		if !h.readOnly {
+			if err := h.flush(); err != nil {
+				return err
+			}
+		}
+		h.f.releaseBacking(h)
+		h.tmp = nil
+		return nil
+	})
 	if err != nil {
-		log.Println("mutFileHandle.Release:", err)
+		h.f.fs.errorf("mutFileHandle.Release: %v", err)
+		return h.f.fs.uploadError(err)
+	}
+	return nil
+}
+
+// Fsync writes the current contents of the temporary file to the
+// blobstore and points the file's permanode at it, returning once
+// the new content is stored.
+func (h *mutFileHandle) Fsync(r *fuse.FsyncRequest, intr fuse.Intr) fuse.Error {
+	if h.tmp == nil {
+		h.f.fs.errorf("Fsync called on camli mutFileHandle without a tempfile set")
 		return fuse.EIO
 	}
-	var n int64
-	br, err := schema.WriteFileFromReader(h.f.fs.client, h.f.name, readerutil.CountingReader{Reader: h.tmp, N: &n})
-	if err != nil {
-		log.Println("mutFileHandle.Release:", err)
+	if err := h.flush(); err != nil {
+		h.f.fs.errorf("mutFileHandle.Fsync: %v", err)
+		return h.f.fs.uploadError(err)
+	}
+	if err := h.f.fs.FlushClaims(); err != nil {
+		h.f.fs.errorf("mutFileHandle.Fsync: %v", err)
+		return h.f.fs.uploadError(err)
+	}
+	return nil
+}
+
+// Flush is called on each close(2) of a file descriptor referring to
+// h, which may happen several times when the descriptor was dup'd.
+// Like Fsync, it commits the current contents if they were modified,
+// so they're stored by the time close returns; unlike Release, it
+// keeps the temporary file for further use of the handle. It also
+// releases the closing process's locks on the file, as POSIX
+// requires.
+func (h *mutFileHandle) Flush(r *fuse.FlushRequest, intr fuse.Intr) fuse.Error {
+	h.f.fs.locks.releaseOwner(h.f.lockKey(), r.LockOwner)
+	if h.tmp == nil {
+		h.f.fs.errorf("Flush called on camli mutFileHandle without a tempfile set")
 		return fuse.EIO
 	}
-	h.f.setContent(br, n)
+	if h.readOnly {
+		return nil
+	}
+	if err := h.flush(); err != nil {
+		h.f.fs.errorf("mutFileHandle.Flush: %v", err)
+		return h.f.fs.uploadError(err)
+	}
+	return nil
+}
 
-	h.tmp.Close()
-	os.Remove(h.tmp.Name())
-	h.tmp = nil
+// flush uploads the contents of the temporary file and updates the
+// content of the parent mutFile, if they changed since the last
+// store.
+func (h *mutFileHandle) flush() error {
+	return h.f.store(h.shared)
+}
 
-	return nil
+// markChanged records that b, n's shared temporary file, was
+// modified and needs storing.
+func (n *mutFile) markChanged(b *sharedBacking) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	b.changed = true
+}
+
+// store uploads the contents of the shared temporary file b and
+// makes them n's content, unless they weren't modified since the
+// last store.
+func (n *mutFile) store(b *sharedBacking) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tmp == nil {
+		// Released meanwhile, having stored everything.
+		return nil
+	}
+	n.mu.Lock()
+	unlinked := n.unlinked
+	changed := b.changed
+	b.changed = false
+	n.mu.Unlock()
+	if unlinked {
+		// Removed while open; the contents go with the last
+		// handle, as with unlink(2).
+		return nil
+	}
+	if !changed {
+		return nil
+	}
+	err := n.storeBacking(b)
+	if err != nil {
+		// Try again on the next flush.
+		n.markChanged(b)
+	}
+	return err
+}
+
+// storeBacking does the work of store, with b.mu held.
+func (n *mutFile) storeBacking(b *sharedBacking) error {
+	fi, err := b.tmp.Stat()
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	br := n.fs.copiedContent(&b.copied, size)
+	if br != nil {
+		mutFileCopied.Incr()
+		n.fs.debugf("mutFile.store(%q): copy of content %v", n.fullPath(), br)
+	} else {
+		if n.fs.CheckSpace {
+			// Chunks already stored are deduplicated, so
+			// this may refuse a file that would fit;
+			// better than leaving half of one behind.
+			if err := n.fs.checkSpace(size); err != nil {
+				return err
+			}
+		}
+		if _, err := b.tmp.Seek(0, 0); err != nil {
+			return err
+		}
+		size = 0
+		br, err = schema.WriteFileFromReaderChunked(n.fs.uploadClient(), n.name, n.fs.uploadReader(readerutil.CountingReader{Reader: b.tmp, N: &size}), n.fs.Chunking)
+		if err != nil {
+			return err
+		}
+	}
+	if n.sameContent(br, size) {
+		// e.g. an editor saving an unmodified file. A new
+		// camliContent claim would only churn the index.
+		n.fs.debugf("mutFile.store(%q): content unchanged", n.fullPath())
+		return nil
+	}
+	if err := n.setContent(br, size); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	keep := b.keepMtime
+	n.mu.Unlock()
+	if keep {
+		return nil
+	}
+	return n.storeMtime(time.Now())
 }
 
 func (h *mutFileHandle) Truncate(size uint64, intr fuse.Intr) fuse.Error {
 	if h.tmp == nil {
-		log.Printf("Truncate called on camli mutFileHandle without a tempfile set")
+		h.f.fs.errorf("Truncate called on camli mutFileHandle without a tempfile set")
 		return fuse.EIO
 	}
 
-	log.Printf("mutFileHandle.Truncate(%q) to size %d", h.f.fullPath(), size)
+	h.f.fs.debugf("mutFileHandle.Truncate(%q) to size %d", h.f.fullPath(), size)
 	if err := h.tmp.Truncate(int64(size)); err != nil {
-		log.Println("mutFileHandle.Truncate:", err)
+		h.f.fs.errorf("mutFileHandle.Truncate: %v", err)
 		return fuse.EIO
 	}
+	h.f.markChanged(h.shared)
+	if size == 0 && h.f.fs.DetectCopies {
+		// e.g. opened with O_TRUNC, so maybe about to be
+		// overwritten with a copy.
+		h.shared.copied.reset()
+	} else {
+		h.shared.copied.stop()
+	}
+	return nil
+}
+
+// Fallocate reserves a range of the file, as preallocating
+// downloaders and databases ask. The temporary file is grown to
+// cover it, sparsely, unless req.Mode keeps the size; the space is
+// only taken in the blobstore once written. Punching holes isn't
+// supported.
+func (h *mutFileHandle) Fallocate(req *fuse.FallocateRequest, intr fuse.Intr) fuse.Error {
+	if h.f.fs.readOnly() {
+		return fuse.EPERM
+	}
+	if h.tmp == nil || h.readOnly {
+		h.f.fs.errorf("Fallocate called on camli mutFileHandle without a writable tempfile")
+		return fuse.Errno(syscall.EBADF)
+	}
+	if req.Mode&^fuse.FallocateKeepSize != 0 {
+		return fuse.Errno(syscall.EOPNOTSUPP)
+	}
+	if req.Mode&fuse.FallocateKeepSize != 0 {
+		return nil
+	}
+	end := int64(req.Offset + req.Length)
+	mu := h.tmpMu()
+	mu.Lock()
+	defer mu.Unlock()
+	fi, err := h.tmp.Stat()
+	if err != nil {
+		h.f.fs.errorf("mutFileHandle.Fallocate: %v", err)
+		return fuse.EIO
+	}
+	if end <= fi.Size() {
+		return nil
+	}
+	h.f.fs.debugf("mutFileHandle.Fallocate(%q) to size %d", h.f.fullPath(), end)
+	if err := h.tmp.Truncate(end); err != nil {
+		h.f.fs.errorf("mutFileHandle.Fallocate: %v", err)
+		return fuse.EIO
+	}
+	h.f.setSizeAtLeast(end)
+	h.f.markChanged(h.shared)
 	return nil
 }
 
 // mutFileOrDir is a *mutFile or *mutDir
 type mutFileOrDir interface {
 	fuse.Node
+	permanodeRef() *blobref.BlobRef
 	permanodeString() string
 }
 
+func (n *mutFile) permanodeRef() *blobref.BlobRef {
+	return n.permanode
+}
+
+func (n *mutDir) permanodeRef() *blobref.BlobRef {
+	return n.permanode
+}
+
 func (n *mutFile) permanodeString() string {
 	return n.permanode.String()
 }
@@ -682,3 +2142,9 @@ func (n *mutFile) permanodeString() string {
 func (n *mutDir) permanodeString() string {
 	return n.permanode.String()
 }
+
+// samePermanode reports whether a and b are nodes of the same
+// permanode.
+func samePermanode(a, b mutFileOrDir) bool {
+	return a.permanodeRef().Equal(b.permanodeRef())
+}
@@ -0,0 +1,2124 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/client"
+	"camlistore.org/pkg/lru"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// newFileWithContent creates name in dir, with the given contents.
+func newFileWithContent(t testing.TB, dir *mutDir, name, contents string) *mutFile {
+	node, err := dir.creat(name, fileType)
+	if err != nil {
+		t.Fatalf("creat(%q): %v", name, err)
+	}
+	mf := node.(*mutFile)
+	br, err := schema.WriteFileFromReader(dir.fs.client, name, strings.NewReader(contents))
+	if err != nil {
+		t.Fatalf("WriteFileFromReader: %v", err)
+	}
+	if err := mf.setContent(br, int64(len(contents))); err != nil {
+		t.Fatalf("setContent: %v", err)
+	}
+	return mf
+}
+
+func TestLazySizes(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	const contents = "some file contents"
+	newFileWithContent(t, dir, "file", contents)
+
+	// A fresh node for the same permanode, as if just mounted.
+	fs.LazySizes = true
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	nreq := len(fc.describeRequests())
+	if _, err := cold.ReadDir(nil); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	reqs := fc.describeRequests()[nreq:]
+	if len(reqs) != 1 {
+		t.Fatalf("ReadDir made %d describes; want 1", len(reqs))
+	}
+	if reqs[0].Depth != 2 {
+		t.Fatalf("ReadDir describe depth = %d; want 2", reqs[0].Depth)
+	}
+	cold.mu.Lock()
+	mf := cold.children["file"].(*mutFile)
+	cold.mu.Unlock()
+	if !mf.needSize {
+		t.Fatalf("size already known after a shallow describe")
+	}
+
+	// Lookup checks the content is a file, so the size comes
+	// with it.
+	if _, err := cold.Lookup("file", nil); err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if got := mf.Attr().Size; got != uint64(len(contents)) {
+		t.Errorf("Attr size = %d; want %d", got, len(contents))
+	}
+	reqs = fc.describeRequests()[nreq+1:]
+	if len(reqs) != 1 || !reqs[0].BlobRef.Equal(mf.content) {
+		t.Errorf("size lookup describes = %v; want one of the content %v", reqs, mf.content)
+	}
+
+	// Resolved once only.
+	mf.Attr()
+	if n := len(fc.describeRequests()); n != nreq+2 {
+		t.Errorf("%d describes after second Attr; want %d", n, nreq+2)
+	}
+}
+
+func TestLazySizesNotFile(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	child, err := fc.UploadNewPermanode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := fc.UploadNewPermanode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A camliContent that isn't a file schema.
+	if _, err := fc.UploadAndSignBlob(schema.NewSetAttributeClaim(child.BlobRef, "camliContent", other.BlobRef.String())); err != nil {
+		t.Fatal(err)
+	}
+	if err := dir.link("odd", child.BlobRef, &mutFile{fs: fs, permanode: child.BlobRef, parent: dir, name: "odd"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lazy := range []bool{false, true} {
+		fs.LazySizes = lazy
+		cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+		if n, err := cold.Lookup("odd", nil); err != fuse.ENOENT {
+			t.Errorf("lazy=%v: Lookup of a permanode with non-file content = %v, %v; want ENOENT", lazy, n, err)
+		}
+	}
+}
+
+func TestVerifySize(t *testing.T) {
+	_, _, dir := newFakeFS(t)
+	const contents = "some file contents"
+	mf := newFileWithContent(t, dir, "file", contents)
+
+	// As if a partial write had grown the cached size.
+	mf.setSizeAtLeast(100)
+	if got := mf.Attr().Size; got != 100 {
+		t.Fatalf("seeded Attr size = %d; want 100", got)
+	}
+
+	// Opening the file reads its content's schema and notices.
+	h, ferr := mf.Open(&fuse.OpenRequest{}, &fuse.OpenResponse{}, nil)
+	if ferr != nil {
+		t.Fatalf("Open: %v", ferr)
+	}
+	h.(*nodeReader).Release(&fuse.ReleaseRequest{}, nil)
+	if got := mf.Attr().Size; got != uint64(len(contents)) {
+		t.Errorf("Attr size after Open = %d; want %d", got, len(contents))
+	}
+
+	old, repaired, err := mf.verifySize()
+	if err != nil || repaired || old != int64(len(contents)) {
+		t.Errorf("verifySize after Open = %d, %v, %v; want %d, false, nil", old, repaired, err, len(contents))
+	}
+}
+
+func TestUploadErrors(t *testing.T) {
+	quota := &os.PathError{Op: "write", Path: "/blobs/sha1-xxx", Err: syscall.EDQUOT}
+	tests := []struct {
+		err  error
+		want fuse.Error
+	}{
+		{quota, fuse.ENOSPC},
+		{&os.PathError{Op: "write", Path: "/blobs", Err: syscall.ENOSPC}, fuse.ENOSPC},
+		{&os.PathError{Op: "open", Path: "/blobs", Err: syscall.EACCES}, fuse.EPERM},
+		{errors.New("server said no"), fuse.EIO},
+		{&client.HTTPError{StatusCode: client.StatusInsufficientStorage}, fuse.ENOSPC},
+		{&client.HTTPError{StatusCode: http.StatusForbidden}, fuse.EPERM},
+		{&client.HTTPError{StatusCode: http.StatusUnauthorized}, fuse.EPERM},
+		{&client.HTTPError{StatusCode: http.StatusInternalServerError}, fuse.EIO},
+	}
+	for i, tt := range tests {
+		_, fc, dir := newFakeFS(t)
+		fc.failUploads(tt.err)
+		_, err := dir.Mkdir(&fuse.MkdirRequest{Name: "dir"}, nil)
+		if err != tt.want {
+			t.Errorf("%d. Mkdir error = %v; want %v", i, err, tt.want)
+		}
+	}
+
+	// A write that only fails when the handle is released.
+	_, fc, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "contents")
+	h, err := mf.newHandle(strings.NewReader("contents"), syscall.O_RDWR, nil)
+	if err != nil {
+		t.Fatalf("newHandle: %v", err)
+	}
+	fh := h.(*mutFileHandle)
+	defer os.Remove(fh.tmp.Name())
+	if err := fh.Write(&fuse.WriteRequest{Offset: 8, Data: []byte(" and more")}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	fc.failUploads(quota)
+	if err := fh.Release(nil, nil); err != fuse.ENOSPC {
+		t.Errorf("Release error = %v; want ENOSPC", err)
+	}
+}
+
+func TestAppendWrites(t *testing.T) {
+	_, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "log", "start\n")
+	h, ferr := mf.newHandle(strings.NewReader("start\n"), syscall.O_WRONLY|syscall.O_APPEND, nil)
+	if ferr != nil {
+		t.Fatalf("newHandle: %v", ferr)
+	}
+	fh := h.(*mutFileHandle)
+	defer os.Remove(fh.tmp.Name())
+
+	// Concurrent appenders that all got the same, soon stale,
+	// offset from the kernel.
+	const writers, lines = 4, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				req := &fuse.WriteRequest{
+					Offset: int64(len("start\n")),
+					Data:   []byte(fmt.Sprintf("writer %d line %d\n", w, i)),
+				}
+				if err := fh.Write(req, &fuse.WriteResponse{}, nil); err != nil {
+					t.Errorf("Write: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	slurp, err := ioutil.ReadFile(fh.tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSuffix(string(slurp), "\n"), "\n")
+	if len(got) != 1+writers*lines || got[0] != "start" {
+		t.Fatalf("got %d lines, first %q; want %d, first %q", len(got), got[0], 1+writers*lines, "start")
+	}
+	seen := make(map[string]bool)
+	for _, line := range got[1:] {
+		seen[line] = true
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < lines; i++ {
+			if line := fmt.Sprintf("writer %d line %d", w, i); !seen[line] {
+				t.Errorf("missing line %q", line)
+			}
+		}
+	}
+	if size := mf.Attr().Size; size != uint64(len(slurp)) {
+		t.Errorf("file size = %d; want %d", size, len(slurp))
+	}
+}
+
+func TestSharedWrites(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	fs.SharedWrites = true
+	mf := newFileWithContent(t, dir, "file", "hello")
+
+	wh, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open for writing: %v", err)
+	}
+	rh, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDONLY}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open for reading: %v", err)
+	}
+	w, r := wh.(*mutFileHandle), rh.(*mutFileHandle)
+	if w.tmp != r.tmp {
+		t.Fatalf("handles don't share a backing file")
+	}
+
+	wreq := &fuse.WriteRequest{Offset: 5, Data: []byte(", world")}
+	if err := w.Write(wreq, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	var res fuse.ReadResponse
+	if err := r.Read(&fuse.ReadRequest{Size: 100}, &res, nil); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got, want := string(res.Data), "hello, world"; got != want {
+		t.Errorf("read through second handle = %q; want %q", got, want)
+	}
+
+	name := w.tmp.Name()
+	if err := r.Release(nil, nil); err != nil {
+		t.Fatalf("Release reader: %v", err)
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Fatalf("backing file gone while a handle is open: %v", err)
+	}
+	if err := w.Release(nil, nil); err != nil {
+		t.Fatalf("Release writer: %v", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("backing file still exists after last Release: %v", err)
+	}
+	if mf.backing != nil {
+		t.Errorf("backing still set after last Release")
+	}
+	if size := mf.Attr().Size; size != uint64(len("hello, world")) {
+		t.Errorf("size after Release = %d; want %d", size, len("hello, world"))
+	}
+}
+
+func TestRenameOverExisting(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	src := newFileWithContent(t, dir, "a", "new contents")
+	old := newFileWithContent(t, dir, "b", "old contents")
+
+	rename := func(from, to string) fuse.Error {
+		return dir.Rename(&fuse.RenameRequest{OldName: from, NewName: to}, dir, nil)
+	}
+	if err := rename("a", "b"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if b, ok := dir.children["b"]; len(dir.children) != 1 || !ok || b.permanodeString() != src.permanode.String() {
+		t.Errorf("children after Rename = %v; want only b, the renamed file", dir.children)
+	}
+
+	// The old file is unreachable from a fresh tree.
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	ents, err := cold.ReadDir(nil)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(ents) != 1 || ents[0].Name != "b" {
+		t.Errorf("ReadDir = %+v; want only b", ents)
+	}
+	node, err := cold.Lookup("b", nil)
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	if got := node.(*mutFile); !got.permanode.Equal(src.permanode) || !got.content.Equal(src.content) {
+		t.Errorf("b = %v with content %v; want %v with %v", got.permanode, got.content, src.permanode, src.content)
+	}
+	res, derr := fc.Describe(&search.DescribeRequest{BlobRef: dir.permanode, Depth: 1})
+	if derr != nil {
+		t.Fatal(derr)
+	}
+	for k, v := range res.Meta[dir.permanode.String()].Permanode.Attr {
+		for _, ref := range v {
+			if ref == old.permanode.String() {
+				t.Errorf("dir attribute %s still links the replaced file", k)
+			}
+		}
+	}
+
+	// Replacing across types, or a non-empty directory, fails.
+	full, cerr := dir.creat("full", dirType)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	if _, cerr := full.(*mutDir).creat("x", fileType); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if _, cerr := dir.creat("empty", dirType); cerr != nil {
+		t.Fatal(cerr)
+	}
+	tests := []struct {
+		from, to string
+		want     fuse.Error
+	}{
+		{"b", "full", fuse.Errno(syscall.EISDIR)},
+		{"full", "b", fuse.Errno(syscall.ENOTDIR)},
+		{"empty", "full", fuse.Errno(syscall.ENOTEMPTY)},
+		{"b", "b", nil},
+		{"full", "empty", nil},
+	}
+	for _, tt := range tests {
+		if err := rename(tt.from, tt.to); err != tt.want {
+			t.Errorf("Rename(%q, %q) = %v; want %v", tt.from, tt.to, err, tt.want)
+		}
+	}
+}
+
+// TestRenameOverColdDir checks the rename(2) rules on nodes fresh
+// from a mount, whose destinations are only known once populated.
+func TestRenameOverColdDir(t *testing.T) {
+	fs, _, root := newFakeFS(t)
+	mkdir := func(d *mutDir, name string) *mutDir {
+		c, err := d.creat(name, dirType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.(*mutDir)
+	}
+	src, dst := mkdir(root, "src"), mkdir(root, "dst")
+	newFileWithContent(t, src, "f", "contents")
+	mkdir(src, "d")
+	newFileWithContent(t, dst, "file", "contents")
+	newFileWithContent(t, mkdir(dst, "full"), "x", "contents")
+	mkdir(dst, "empty")
+
+	cold := func(d *mutDir) *mutDir {
+		return &mutDir{fs: fs, permanode: d.permanode, name: d.name}
+	}
+	tests := []struct {
+		from, to string
+		want     fuse.Error
+	}{
+		{"f", "full", fuse.Errno(syscall.EISDIR)},
+		{"d", "file", fuse.Errno(syscall.ENOTDIR)},
+		{"d", "full", fuse.Errno(syscall.ENOTEMPTY)},
+		{"d", "empty", nil},
+	}
+	for _, tt := range tests {
+		err := cold(src).Rename(&fuse.RenameRequest{OldName: tt.from, NewName: tt.to}, cold(dst), nil)
+		if err != tt.want {
+			t.Errorf("Rename(%q, %q) = %v; want %v", tt.from, tt.to, err, tt.want)
+		}
+	}
+
+	// The refused renames changed nothing.
+	d := cold(dst)
+	if n, err := d.Lookup("file", nil); err != nil {
+		t.Errorf("Lookup(file): %v", err)
+	} else if _, ok := n.(*mutFile); !ok {
+		t.Errorf("file is a %T after refused renames", n)
+	}
+	full, err := d.Lookup("full", nil)
+	if err != nil {
+		t.Fatalf("Lookup(full): %v", err)
+	}
+	if ents, err := full.(*mutDir).ReadDir(nil); err != nil || len(ents) != 1 {
+		t.Errorf("full lists %v, %v after refused renames; want only x", ents, err)
+	}
+	if _, err := cold(src).Lookup("f", nil); err != nil {
+		t.Errorf("Lookup(f) in src after refused rename: %v", err)
+	}
+}
+
+func TestRenameRollback(t *testing.T) {
+	failing := errors.New("upload failed")
+	tests := []struct {
+		name     string
+		fail     string // claim type and attribute failing to upload
+		clobber  bool   // whether the new name exists
+		wantDest bool   // whether dst links b after the failed rename
+	}{
+		{"unlink", "del-attribute camliPath:a", false, false},
+		{"unlink over existing", "del-attribute camliPath:a", true, true},
+		{"link", "set-attribute camliPath:b", false, false},
+	}
+	for _, tt := range tests {
+		fs, fc, root := newFakeFS(t)
+		mkdir := func(name string) *mutDir {
+			d, err := root.creat(name, dirType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return d.(*mutDir)
+		}
+		src, dst := mkdir("src"), mkdir("dst")
+		a := newFileWithContent(t, src, "a", "contents")
+		var old *mutFile
+		if tt.clobber {
+			old = newFileWithContent(t, dst, "b", "old contents")
+		}
+		fc.mu.Lock()
+		fc.failClaim = func(b schema.AnyBlob) error {
+			var claim struct{ ClaimType, Attribute string }
+			json.Unmarshal([]byte(b.Blob().JSON()), &claim)
+			if claim.ClaimType+" "+claim.Attribute == tt.fail {
+				return failing
+			}
+			return nil
+		}
+		fc.mu.Unlock()
+
+		err := src.Rename(&fuse.RenameRequest{OldName: "a", NewName: "b"}, dst, nil)
+		if err != fuse.EIO {
+			t.Errorf("%s: Rename = %v; want EIO", tt.name, err)
+		}
+		fc.mu.Lock()
+		fc.failClaim = nil
+		fc.mu.Unlock()
+
+		if _, ok := src.children["a"]; !ok {
+			t.Errorf("%s: src lost a after the failed rename", tt.name)
+		}
+		// The claims are what a fresh mount sees.
+		cold := func(d *mutDir) map[string]string {
+			fresh := &mutDir{fs: fs, permanode: d.permanode, name: "cold"}
+			ents, err := fresh.ReadDir(nil)
+			if err != nil {
+				t.Fatalf("%s: ReadDir: %v", tt.name, err)
+			}
+			m := make(map[string]string)
+			for _, ent := range ents {
+				m[ent.Name] = fresh.children[ent.Name].permanodeString()
+			}
+			return m
+		}
+		if got := cold(src); got["a"] != a.permanode.String() || len(got) != 1 {
+			t.Errorf("%s: src links %v; want only a", tt.name, got)
+		}
+		got := cold(dst)
+		b, ok := got["b"]
+		if ok != tt.wantDest || len(got) > 1 || (ok && b != old.permanode.String()) {
+			t.Errorf("%s: dst links %v; want b linked = %v, to the old file", tt.name, got, tt.wantDest)
+		}
+	}
+}
+
+// TestRenameRaced checks that a rename whose claims were uploaded
+// succeeds even if the directory changed under it after its lookup.
+func TestRenameRaced(t *testing.T) {
+	_, fc, dir := newFakeFS(t)
+	newFileWithContent(t, dir, "a", "contents")
+	fc.mu.Lock()
+	fc.failClaim = func(schema.AnyBlob) error {
+		dir.mu.Lock()
+		delete(dir.children, "a")
+		dir.mu.Unlock()
+		return nil
+	}
+	fc.mu.Unlock()
+	err := dir.Rename(&fuse.RenameRequest{OldName: "a", NewName: "b"}, dir, nil)
+	fc.mu.Lock()
+	fc.failClaim = nil
+	fc.mu.Unlock()
+	if err != nil {
+		t.Fatalf("Rename = %v; want success, as its claims made it", err)
+	}
+
+	// The directory is fetched again, so the next lookup finds
+	// the new name.
+	if _, err := dir.Lookup("b", nil); err != nil {
+		t.Errorf("Lookup(b) after the raced rename = %v", err)
+	}
+	if _, err := dir.Lookup("a", nil); err != fuse.ENOENT {
+		t.Errorf("Lookup(a) after the raced rename = %v; want ENOENT", err)
+	}
+}
+
+func TestDirMtime(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	if got := dir.Attr().Mtime; !got.Equal(serverStart) {
+		t.Errorf("new dir mtime = %v; want serverStart %v", got, serverStart)
+	}
+
+	// Each change must bump the mtime, and persist it.
+	last := dir.Attr().Mtime
+	check := func(what string, n *mutDir) {
+		time.Sleep(time.Millisecond) // for coarse clocks
+		got := n.Attr().Mtime
+		if !got.After(last) {
+			t.Errorf("mtime after %s = %v; want after %v", what, got, last)
+		}
+		last = got
+
+		cold := &mutDir{fs: fs, permanode: n.permanode, name: "cold"}
+		if err := cold.populate(); err != nil {
+			t.Fatalf("populate: %v", err)
+		}
+		if persisted := cold.Attr().Mtime; !persisted.Equal(got) {
+			t.Errorf("persisted mtime after %s = %v; want %v", what, persisted, got)
+		}
+	}
+	sub, err := dir.creat("sub", dirType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := sub.(*mutDir)
+	check("creat", dir)
+	newFileWithContent(t, dir, "file", "contents")
+	check("create file", dir)
+	if err := dir.Rename(&fuse.RenameRequest{OldName: "file", NewName: "moved"}, other, nil); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	check("rename source", dir)
+	if got := other.Attr().Mtime; !got.Equal(last) {
+		t.Errorf("rename destination mtime = %v; want %v", got, last)
+	}
+	if err := other.Remove(&fuse.RemoveRequest{Name: "moved"}, nil); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	check("remove", other)
+
+	// Subdirectories get their mtime from their parent's describe.
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	node, ferr := cold.Lookup("sub", nil)
+	if ferr != nil {
+		t.Fatalf("Lookup: %v", ferr)
+	}
+	if got := node.(*mutDir).Attr().Mtime; !got.Equal(last) {
+		t.Errorf("looked up subdir mtime = %v; want %v", got, last)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "contents")
+	h, ferr := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if ferr != nil {
+		t.Fatalf("Open: %v", ferr)
+	}
+	wh := h.(*mutFileHandle)
+	defer os.Remove(wh.tmp.Name())
+
+	fs.ReadOnly = true
+	nup := fc.uploadCount()
+	ops := []struct {
+		name string
+		f    func() fuse.Error
+	}{
+		{"Create", func() fuse.Error {
+			_, _, err := dir.Create(&fuse.CreateRequest{Name: "new"}, &fuse.CreateResponse{}, nil)
+			return err
+		}},
+		{"Mkdir", func() fuse.Error {
+			_, err := dir.Mkdir(&fuse.MkdirRequest{Name: "new"}, nil)
+			return err
+		}},
+		{"Symlink", func() fuse.Error {
+			_, err := dir.Symlink(&fuse.SymlinkRequest{NewName: "new", Target: "file"}, nil)
+			return err
+		}},
+		{"Remove", func() fuse.Error {
+			return dir.Remove(&fuse.RemoveRequest{Name: "file"}, nil)
+		}},
+		{"Rename", func() fuse.Error {
+			return dir.Rename(&fuse.RenameRequest{OldName: "file", NewName: "new"}, dir, nil)
+		}},
+		{"Setattr", func() fuse.Error {
+			return mf.Setattr(&fuse.SetattrRequest{Valid: fuse.SetattrSize}, &fuse.SetattrResponse{}, nil)
+		}},
+		{"Setxattr", func() fuse.Error {
+			return mf.Setxattr(&fuse.SetxattrRequest{Name: "user.x", Xattr: []byte("x")}, nil)
+		}},
+		{"Open for writing", func() fuse.Error {
+			_, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_WRONLY}, &fuse.OpenResponse{}, nil)
+			return err
+		}},
+		{"Write", func() fuse.Error {
+			return wh.Write(&fuse.WriteRequest{Data: []byte("x")}, &fuse.WriteResponse{}, nil)
+		}},
+	}
+	for _, op := range ops {
+		if err := op.f(); err != fuse.EPERM {
+			t.Errorf("%s = %v; want EPERM", op.name, err)
+		}
+	}
+	if n := fc.uploadCount() - nup; n != 0 {
+		t.Errorf("%d blobs uploaded in read-only mode", n)
+	}
+
+	// Reading still works.
+	if _, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDONLY}, &fuse.OpenResponse{}, nil); err != nil {
+		t.Errorf("Open for reading: %v", err)
+	}
+}
+
+func TestNoopRewrite(t *testing.T) {
+	_, fc, dir := newFakeFS(t)
+	const contents = "unchanged contents"
+	mf := newFileWithContent(t, dir, "file", contents)
+	content := mf.content
+
+	rewrite := func(data string) {
+		h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		fh := h.(*mutFileHandle)
+		if err := fh.Write(&fuse.WriteRequest{Data: []byte(data)}, &fuse.WriteResponse{}, nil); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if err := fh.Release(nil, nil); err != nil {
+			t.Fatalf("Release: %v", err)
+		}
+	}
+
+	before := fc.signedCount()
+	rewrite(contents)
+	if n := fc.signedCount() - before; n != 0 {
+		t.Errorf("%d claims signed on a no-op rewrite; want 0", n)
+	}
+	if !mf.content.Equal(content) {
+		t.Errorf("content changed to %v on a no-op rewrite", mf.content)
+	}
+
+	before = fc.signedCount()
+	rewrite("changed contents!!")
+	// One for the content, one for the modification time.
+	if n := fc.signedCount() - before; n != 2 {
+		t.Errorf("%d claims signed on a real rewrite; want 2", n)
+	}
+	if mf.content.Equal(content) {
+		t.Errorf("content unchanged after a real rewrite")
+	}
+}
+
+// BenchmarkRenameAcrossDirs measures a move between two
+// directories whose contents must be re-fetched from a search
+// server with some latency.
+func BenchmarkRenameAcrossDirs(b *testing.B) {
+	_, fc, a := newFakeFS(b)
+	bnode, err := a.creat("b", dirType)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bdir := bnode.(*mutDir)
+	if _, err := a.creat("file", fileType); err != nil {
+		b.Fatal(err)
+	}
+	fc.describeDelay = 10 * time.Millisecond
+
+	b.ResetTimer()
+	from, to := a, bdir
+	for i := 0; i < b.N; i++ {
+		// Force both dirs to be populated again.
+		a.lastPop, bdir.lastPop = time.Time{}, time.Time{}
+		if err := from.Rename(&fuse.RenameRequest{OldName: "file", NewName: "file"}, to, nil); err != nil {
+			b.Fatalf("Rename: %v", err)
+		}
+		from, to = to, from
+	}
+}
+
+func TestReadlinkRefresh(t *testing.T) {
+	_, fc, dir := newFakeFS(t)
+	node, err := dir.Symlink(&fuse.SymlinkRequest{NewName: "link", Target: "old-target"}, nil)
+	if err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	mf := node.(*mutFile)
+	readlink := func() string {
+		target, err := mf.Readlink(&fuse.ReadlinkRequest{}, nil)
+		if err != nil {
+			t.Fatalf("Readlink: %v", err)
+		}
+		return target
+	}
+
+	// Another client changes the target.
+	claim := schema.NewSetAttributeClaim(mf.permanode, "camliSymlinkTarget", "new-target")
+	claim.SetClaimDate(time.Now().Add(time.Second))
+	if _, err := fc.UploadAndSignBlob(claim); err != nil {
+		t.Fatal(err)
+	}
+
+	before := len(fc.describeRequests())
+	if got := readlink(); got != "old-target" {
+		t.Errorf("fresh Readlink = %q; want cached %q", got, "old-target")
+	}
+	if n := len(fc.describeRequests()) - before; n != 0 {
+		t.Errorf("fresh Readlink made %d describe requests; want 0", n)
+	}
+
+	mf.mu.Lock()
+	mf.targetTime = time.Now().Add(-populateInterval - time.Second)
+	mf.mu.Unlock()
+	if got := readlink(); got != "new-target" {
+		t.Errorf("stale Readlink = %q; want %q", got, "new-target")
+	}
+	before = len(fc.describeRequests())
+	if got := readlink(); got != "new-target" {
+		t.Errorf("second Readlink = %q; want %q", got, "new-target")
+	}
+	if n := len(fc.describeRequests()) - before; n != 0 {
+		t.Errorf("Readlink after refresh made %d describe requests; want 0", n)
+	}
+}
+
+// storedContents returns the contents of mf's file schema blob
+// in the blobstore.
+func storedContents(t *testing.T, mf *mutFile) string {
+	mf.mu.Lock()
+	content := mf.content
+	mf.mu.Unlock()
+	fr, err := schema.NewFileReader(mf.fs.fetcher, content)
+	if err != nil {
+		t.Fatalf("NewFileReader(%v): %v", content, err)
+	}
+	defer fr.Close()
+	slurp, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatalf("reading %v: %v", content, err)
+	}
+	return string(slurp)
+}
+
+func TestFlushKeepsHandle(t *testing.T) {
+	_, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "hello")
+	h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fh := h.(*mutFileHandle)
+	write := func(off int64, data string) {
+		if err := fh.Write(&fuse.WriteRequest{Offset: off, Data: []byte(data)}, &fuse.WriteResponse{}, nil); err != nil {
+			t.Fatalf("Write(%q): %v", data, err)
+		}
+	}
+
+	write(5, ", world")
+	if got := storedContents(t, mf); got != "hello" {
+		t.Errorf("stored before Flush = %q; want %q", got, "hello")
+	}
+	if err := fh.Flush(&fuse.FlushRequest{}, nil); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got := storedContents(t, mf); got != "hello, world" {
+		t.Errorf("stored after Flush = %q; want %q", got, "hello, world")
+	}
+
+	// The handle is still usable, e.g. through a dup'd descriptor.
+	write(12, "!")
+	var res fuse.ReadResponse
+	if err := fh.Read(&fuse.ReadRequest{Size: 100}, &res, nil); err != nil {
+		t.Fatalf("Read after Flush: %v", err)
+	}
+	if got := string(res.Data); got != "hello, world!" {
+		t.Errorf("read after Flush = %q; want %q", got, "hello, world!")
+	}
+	if err := fh.Flush(&fuse.FlushRequest{}, nil); err != nil {
+		t.Fatalf("second Flush: %v", err)
+	}
+	if got := storedContents(t, mf); got != "hello, world!" {
+		t.Errorf("stored after second Flush = %q; want %q", got, "hello, world!")
+	}
+
+	name := fh.tmp.Name()
+	if err := fh.Release(nil, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("temp file still exists after Release: %v", err)
+	}
+	if err := fh.Flush(&fuse.FlushRequest{}, nil); err == nil {
+		t.Errorf("Flush after Release succeeded")
+	}
+}
+
+func TestFlushUnchanged(t *testing.T) {
+	_, fc, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "hello")
+	h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fh := h.(*mutFileHandle)
+	before, signed := fc.uploadCount(), fc.signedCount()
+	for i := 0; i < 3; i++ {
+		if err := fh.Flush(&fuse.FlushRequest{}, nil); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+	if err := fh.Release(nil, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if n := fc.uploadCount() - before; n != 0 {
+		t.Errorf("flushing an unmodified file uploaded %d blobs; want 0", n)
+	}
+	if n := fc.signedCount() - signed; n != 0 {
+		t.Errorf("flushing an unmodified file signed %d claims; want 0", n)
+	}
+
+	// Truncating counts as a change.
+	h, err = mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("second Open: %v", err)
+	}
+	fh = h.(*mutFileHandle)
+	if err := fh.Truncate(2, nil); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+	if err := fh.Flush(&fuse.FlushRequest{}, nil); err != nil {
+		t.Fatalf("Flush after Truncate: %v", err)
+	}
+	if got := storedContents(t, mf); got != "he" {
+		t.Errorf("stored after Truncate = %q; want %q", got, "he")
+	}
+	before = fc.uploadCount()
+	if err := fh.Release(nil, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if n := fc.uploadCount() - before; n != 0 {
+		t.Errorf("Release after Flush uploaded %d blobs; want 0", n)
+	}
+}
+
+func TestFlushReadOnlyShared(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	fs.SharedWrites = true
+	mf := newFileWithContent(t, dir, "file", "hello")
+	wh, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open for writing: %v", err)
+	}
+	rh, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDONLY}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open for reading: %v", err)
+	}
+	w, r := wh.(*mutFileHandle), rh.(*mutFileHandle)
+	defer w.Release(nil, nil)
+	defer r.Release(nil, nil)
+
+	if err := w.Write(&fuse.WriteRequest{Offset: 5, Data: []byte("!")}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	before := fc.uploadCount()
+	if err := r.Flush(&fuse.FlushRequest{}, nil); err != nil {
+		t.Fatalf("Flush of reader: %v", err)
+	}
+	if n := fc.uploadCount() - before; n != 0 {
+		t.Errorf("Flush of read-only handle uploaded %d blobs; want 0", n)
+	}
+	if err := w.Flush(&fuse.FlushRequest{}, nil); err != nil {
+		t.Fatalf("Flush of writer: %v", err)
+	}
+	if got := storedContents(t, mf); got != "hello!" {
+		t.Errorf("stored after writer's Flush = %q; want %q", got, "hello!")
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	_, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "aaaa bbbb")
+	open := func(flags uint32) fuse.Handle {
+		h, err := mf.Open(&fuse.OpenRequest{Flags: flags}, &fuse.OpenResponse{}, nil)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		return h
+	}
+	h1 := open(syscall.O_RDWR).(*mutFileHandle)
+	h2 := open(syscall.O_WRONLY).(*mutFileHandle)
+	if h1.tmp != h2.tmp {
+		t.Fatalf("writable handles don't share a temp file")
+	}
+	for _, flags := range []uint32{syscall.O_RDONLY, syscall.O_RDONLY | syscall.O_NONBLOCK} {
+		ro := open(flags)
+		if _, ok := ro.(*mutFileHandle); ok {
+			t.Fatalf("read-only open (flags %#x) shares the writers' temp file without SharedWrites", flags)
+		}
+		ro.(*nodeReader).Release(nil, nil)
+	}
+
+	write := func(h *mutFileHandle, off int64, data string) {
+		if err := h.Write(&fuse.WriteRequest{Offset: off, Data: []byte(data)}, &fuse.WriteResponse{}, nil); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	write(h1, 0, "AAAA")
+	write(h2, 5, "BBBB")
+
+	// The first release stores both handles' writes, so
+	// neither writer's release can drop the other's.
+	if err := h2.Release(nil, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := storedContents(t, mf); got != "AAAA BBBB" {
+		t.Errorf("stored after first Release = %q; want %q", got, "AAAA BBBB")
+	}
+	write(h1, 9, "!")
+	if err := h1.Release(nil, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := storedContents(t, mf); got != "AAAA BBBB!" {
+		t.Errorf("stored after last Release = %q; want %q", got, "AAAA BBBB!")
+	}
+	if mf.backing != nil {
+		t.Errorf("backing still set after last Release")
+	}
+}
+
+func TestCheckSpace(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "")
+	contents := strings.Repeat("x", 10<<10)
+	release := func() fuse.Error {
+		h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		fh := h.(*mutFileHandle)
+		if err := fh.Write(&fuse.WriteRequest{Data: []byte(contents)}, &fuse.WriteResponse{}, nil); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		return fh.Release(nil, nil)
+	}
+
+	fs.CheckSpace = true
+	fc.setCapacity(1<<20, 1<<10)
+	before := fc.uploadCount()
+	if err := release(); err != fuse.ENOSPC {
+		t.Errorf("Release with too little space = %v; want ENOSPC", err)
+	}
+	if n := fc.uploadCount() - before; n != 0 {
+		t.Errorf("%d blobs uploaded before running out of space; want 0", n)
+	}
+	if got := storedContents(t, mf); got != "" {
+		t.Errorf("stored contents = %q after ENOSPC; want unchanged", got)
+	}
+
+	// Unknown capacity isn't checked.
+	fc.setCapacity(0, 0)
+	if err := release(); err != nil {
+		t.Errorf("Release with unknown capacity: %v", err)
+	}
+
+	fc.setCapacity(1<<20, 1<<20)
+	if err := release(); err != nil {
+		t.Errorf("Release with enough space: %v", err)
+	}
+
+	fs.CheckSpace = false
+	fc.setCapacity(1<<20, 1<<10)
+	if err := release(); err != nil {
+		t.Errorf("Release without CheckSpace: %v", err)
+	}
+	if got := storedContents(t, mf); got != contents {
+		t.Errorf("stored %d bytes; want %d", len(got), len(contents))
+	}
+}
+
+func TestPopulateMalformedRefs(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	newFileWithContent(t, dir, "good", "contents")
+
+	// Another client links a truncated child ref, and a child
+	// whose content ref isn't hex.
+	pr, err := fc.UploadNewPermanode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := []schema.AnyBlob{
+		schema.NewSetAttributeClaim(dir.permanode, "camliPath:truncated", pr.BlobRef.String()[:20]),
+		schema.NewSetAttributeClaim(pr.BlobRef, "camliContent", "sha1-"+strings.Repeat("z", 40)),
+		schema.NewSetAttributeClaim(dir.permanode, "camliPath:nothex", pr.BlobRef.String()),
+	}
+	for _, cl := range claims {
+		if _, err := fc.UploadAndSignBlob(cl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs.LazySizes = true
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	if err := cold.populate(); err != nil {
+		t.Fatalf("populate: %v", err)
+	}
+	cold.mu.Lock()
+	defer cold.mu.Unlock()
+	if _, ok := cold.children["good"]; !ok {
+		t.Errorf("well-formed child missing")
+	}
+	for _, name := range []string{"truncated", "nothex"} {
+		if c, ok := cold.children[name]; ok {
+			t.Errorf("child %q with a malformed ref was added: %#v", name, c)
+		}
+	}
+}
+
+func TestPopulateDepth(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	const contents = "some file contents"
+	newFileWithContent(t, dir, "file", contents)
+	if _, err := dir.creat("sub", dirType); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.Symlink(&fuse.SymlinkRequest{NewName: "link", Target: "target"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		depth     int
+		describes int // including follow-ups for what was missing
+	}{
+		{0, 1},
+		{1, 2},
+		{2, 2},
+		{3, 1},
+		{4, 1},
+	}
+	for _, tt := range tests {
+		fs.PopulateDepth = tt.depth
+		cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+		nreq := len(fc.describeRequests())
+		if err := cold.populate(); err != nil {
+			t.Fatalf("depth %d: populate: %v", tt.depth, err)
+		}
+		reqs := fc.describeRequests()[nreq:]
+		if len(reqs) != tt.describes {
+			t.Errorf("depth %d: %d describe requests; want %d", tt.depth, len(reqs), tt.describes)
+		}
+		want := tt.depth
+		if want == 0 {
+			want = DefaultPopulateDepth
+		}
+		if len(reqs) > 0 && reqs[0].Depth != want {
+			t.Errorf("depth %d: first describe has depth %d; want %d", tt.depth, reqs[0].Depth, want)
+		}
+
+		cold.mu.Lock()
+		if len(cold.children) != 3 {
+			t.Errorf("depth %d: %d children; want 3", tt.depth, len(cold.children))
+		}
+		if mf, ok := cold.children["file"].(*mutFile); !ok || mf.size != int64(len(contents)) {
+			t.Errorf("depth %d: file = %#v; want size %d", tt.depth, cold.children["file"], len(contents))
+		}
+		if mf, ok := cold.children["link"].(*mutFile); !ok || mf.target != "target" {
+			t.Errorf("depth %d: link = %#v; want target %q", tt.depth, cold.children["link"], "target")
+		}
+		if _, ok := cold.children["sub"].(*mutDir); !ok {
+			t.Errorf("depth %d: sub = %#v; want a directory", tt.depth, cold.children["sub"])
+		}
+		cold.mu.Unlock()
+	}
+}
+
+func TestInterruptPopulate(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	newFileWithContent(t, dir, "file", "contents")
+
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	resume := fc.stallServer()
+	intr := make(fuse.Intr)
+	time.AfterFunc(10*time.Millisecond, func() { close(intr) })
+	if _, err := cold.Lookup("file", intr); err != fuse.EINTR {
+		t.Fatalf("Lookup on a hung server = %v; want EINTR", err)
+	}
+	resume()
+	if _, err := cold.Lookup("file", nil); err != nil {
+		t.Fatalf("Lookup after resuming = %v", err)
+	}
+}
+
+func TestLookupDuringSlowPopulate(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	newFileWithContent(t, dir, "file", "contents")
+
+	// The first populate of a directory is waited for.
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	resume := fc.stallServer()
+	found := make(chan fuse.Error, 1)
+	go func() {
+		_, err := cold.Lookup("file", nil)
+		found <- err
+	}()
+	select {
+	case err := <-found:
+		t.Fatalf("Lookup before the first populate finished = %v; want it to wait", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	resume()
+	if err := <-found; err != nil {
+		t.Fatalf("Lookup after the first populate = %v", err)
+	}
+
+	// Later ones aren't: lookups use the children known so far.
+	cold.mu.Lock()
+	cold.lastPop = time.Time{}
+	cold.mu.Unlock()
+	resume = fc.stallServer()
+	defer func() { resume() }()
+	described := len(fc.describeRequests())
+	refreshed := make(chan error, 1)
+	go func() { refreshed <- cold.populate() }()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fc.describeRequests()) == described {
+		if time.Now().After(deadline) {
+			t.Fatal("populate never sent its describe")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		_, err := cold.Lookup("file", nil)
+		found <- err
+	}()
+	select {
+	case err := <-found:
+		if err != nil {
+			t.Fatalf("Lookup during a slow populate = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lookup blocked on a slow populate")
+	}
+	resume()
+	resume = func() {}
+	if err := <-refreshed; err != nil {
+		t.Fatalf("populate = %v", err)
+	}
+}
+
+func TestInterruptRelease(t *testing.T) {
+	_, fc, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "hello")
+	h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fh := h.(*mutFileHandle)
+	if err := fh.Write(&fuse.WriteRequest{Offset: 5, Data: []byte(", world")}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	resume := fc.stallServer()
+	intr := make(fuse.Intr)
+	time.AfterFunc(10*time.Millisecond, func() { close(intr) })
+	if err := fh.Release(&fuse.ReleaseRequest{}, intr); err != fuse.EINTR {
+		t.Fatalf("Release on a hung server = %v; want EINTR", err)
+	}
+	resume()
+
+	// The upload finishes in the background.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mf.mu.Lock()
+		released := mf.backing == nil
+		mf.mu.Unlock()
+		if released && storedContents(t, mf) == "hello, world" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("contents after interrupted Release = %q; want %q", storedContents(t, mf), "hello, world")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// coldModTime returns the modification time of the file name in
+// dir as a fresh mount would see it.
+func coldModTime(t *testing.T, dir *mutDir, name string) time.Time {
+	cold := &mutDir{fs: dir.fs, permanode: dir.permanode, name: "cold"}
+	n, err := cold.Lookup(name, nil)
+	if err != nil {
+		t.Fatalf("Lookup(%q): %v", name, err)
+	}
+	return n.(*mutFile).modTime()
+}
+
+func TestClaimDateTimes(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	before := time.Now()
+	newFileWithContent(t, dir, "file", "contents")
+
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	if err := cold.populate(); err != nil {
+		t.Fatalf("populate: %v", err)
+	}
+	a := cold.children["file"].(*mutFile).Attr()
+	if a.Crtime.Before(before) || a.Crtime.After(time.Now()) {
+		t.Errorf("file creation time = %v; want its first claim's date, after %v", a.Crtime, before)
+	}
+	if !a.Mtime.Equal(a.Crtime) {
+		t.Errorf("file mtime = %v; want its creation time %v, having none set", a.Mtime, a.Crtime)
+	}
+	if a := cold.Attr(); a.Crtime.Before(before) {
+		t.Errorf("dir creation time = %v; want its first claim's date, after %v", a.Crtime, before)
+	}
+}
+
+func TestOpenCachesContentSchema(t *testing.T) {
+	cf, mf := newCountingFS(t, 0, 100)
+	first := string(readFile(t, mf))
+	n1 := cf.fetches()
+	if mf.contentMeta == nil {
+		t.Fatal("content schema not kept after open")
+	}
+
+	// Without the file system's schema cache, re-opening only
+	// fetches the chunks.
+	mf.fs.blobToSchema = lru.New(1024)
+	if got := string(readFile(t, mf)); got != first {
+		t.Fatalf("re-read = %q; want %q", got, first)
+	}
+	if n2 := cf.fetches() - n1; n2 != n1-1 {
+		t.Errorf("re-read made %d fetches; want %d, all but the file schema's", n2, n1-1)
+	}
+
+	// New content drops the kept schema.
+	br, err := schema.WriteFileFromReader(mf.fs.client, "file", strings.NewReader("new contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mf.setContent(br, int64(len("new contents"))); err != nil {
+		t.Fatal(err)
+	}
+	if mf.contentMeta != nil {
+		t.Error("content schema kept after content change")
+	}
+	if got := string(readFile(t, mf)); got != "new contents" {
+		t.Errorf("read after content change = %q; want %q", got, "new contents")
+	}
+}
+
+func TestOpenWithoutContent(t *testing.T) {
+	_, _, dir := newFakeFS(t)
+	_, h, err := dir.Create(&fuse.CreateRequest{Name: "new", Flags: syscall.O_WRONLY | syscall.O_CREAT, Mode: 0644}, &fuse.CreateResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer h.(*mutFileHandle).Release(&fuse.ReleaseRequest{}, nil)
+	n, err := dir.Lookup("new", nil)
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	mf := n.(*mutFile)
+	if mf.content != nil {
+		t.Fatalf("content of a file created but not released = %v; want none", mf.content)
+	}
+
+	rh, err := mf.Open(&fuse.OpenRequest{}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open for reading: %v", err)
+	}
+	nr := rh.(*nodeReader)
+	defer nr.Release(&fuse.ReleaseRequest{}, nil)
+	res := &fuse.ReadResponse{}
+	if err := nr.Read(&fuse.ReadRequest{Size: 4096}, res, nil); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(res.Data) != 0 {
+		t.Errorf("Read = %q; want nothing", res.Data)
+	}
+}
+
+func TestStatContents(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	newFileWithContent(t, dir, "present", "here")
+	gone := newFileWithContent(t, dir, "absent", "not replicated")
+	// The index knows the content, but the blob server lost it.
+	if err := fc.id.BlobSource.RemoveBlobs([]*blobref.BlobRef{gone.content}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stat := range []bool{false, true} {
+		fs.StatContents = stat
+		cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+		ents, err := cold.ReadDir(nil)
+		if err != nil {
+			t.Fatalf("ReadDir: %v", err)
+		}
+		var names []string
+		for _, ent := range ents {
+			names = append(names, ent.Name)
+		}
+		sort.Strings(names)
+		want := []string{"absent", "present"}
+		if stat {
+			want = []string{"present"}
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("StatContents = %v: ReadDir = %q; want %q", stat, names, want)
+		}
+	}
+}
+
+func TestMknod(t *testing.T) {
+	_, fc, dir := newFakeFS(t)
+	for _, mode := range []os.FileMode{
+		os.ModeDevice | os.ModeCharDevice | 0600,
+		os.ModeDevice | 0600,
+		os.ModeNamedPipe | 0600,
+		os.ModeSocket | 0600,
+	} {
+		signed := fc.signedCount()
+		if _, err := dir.Mknod(&fuse.MknodRequest{Name: "node", Mode: mode}, nil); err != fuse.EPERM {
+			t.Errorf("Mknod with mode %v = %v; want EPERM", mode, err)
+		}
+		if n := fc.signedCount() - signed; n != 0 {
+			t.Errorf("Mknod with mode %v signed %d claims; want 0", mode, n)
+		}
+	}
+
+	n, err := dir.Mknod(&fuse.MknodRequest{Name: "file", Mode: 0600}, nil)
+	if err != nil {
+		t.Fatalf("Mknod of a regular file: %v", err)
+	}
+	if _, ok := n.(*mutFile); !ok {
+		t.Fatalf("Mknod of a regular file made a %T", n)
+	}
+	if got := pathAttrs(t, fc, dir.permanode); !reflect.DeepEqual(got, []string{"camliPath:file"}) {
+		t.Errorf("links after Mknod = %q; want the file", got)
+	}
+}
+
+func TestReleaseSetsMtime(t *testing.T) {
+	_, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "hello")
+	h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fh := h.(*mutFileHandle)
+	before := time.Now()
+	if err := fh.Write(&fuse.WriteRequest{Offset: 5, Data: []byte(", world")}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := fh.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := mf.modTime(); got.Before(before) {
+		t.Errorf("mtime after Release = %v; want at least %v", got, before)
+	}
+	if got, want := coldModTime(t, dir, "file"), mf.modTime(); !got.Equal(want) {
+		t.Errorf("mtime after remount = %v; want %v", got, want)
+	}
+}
+
+func TestSetattrMtimeKeptOnRelease(t *testing.T) {
+	_, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "hello")
+	h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fh := h.(*mutFileHandle)
+	if err := fh.Write(&fuse.WriteRequest{Offset: 5, Data: []byte(", world")}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	want := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	req := &fuse.SetattrRequest{Valid: fuse.SetattrMtime, Mtime: want}
+	if err := mf.Setattr(req, &fuse.SetattrResponse{}, nil); err != nil {
+		t.Fatalf("Setattr: %v", err)
+	}
+	if err := fh.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := storedContents(t, mf); got != "hello, world" {
+		t.Errorf("contents = %q; want %q", got, "hello, world")
+	}
+	if got := mf.modTime(); !got.Equal(want) {
+		t.Errorf("mtime after Release = %v; want %v", got, want)
+	}
+	if got := coldModTime(t, dir, "file"); !got.Equal(want) {
+		t.Errorf("mtime after remount = %v; want %v", got, want)
+	}
+}
+
+func TestReadDirSymlink(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	newFileWithContent(t, dir, "file", "contents")
+	// A dangling symlink: its target needn't exist.
+	if _, err := dir.Symlink(&fuse.SymlinkRequest{NewName: "link", Target: "no/such/target"}, nil); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	for _, d := range []*mutDir{dir, {fs: fs, permanode: dir.permanode, name: "cold"}} {
+		ents, err := d.ReadDir(nil)
+		if err != nil {
+			t.Fatalf("%s: ReadDir: %v", d.name, err)
+		}
+		types := make(map[string]fuse.DirentType)
+		for _, ent := range ents {
+			types[ent.Name] = ent.Type
+			n, err := d.Lookup(ent.Name, nil)
+			if err != nil {
+				t.Fatalf("%s: Lookup(%q): %v", d.name, ent.Name, err)
+			}
+			if ino := n.Attr().Inode; ent.Inode != ino {
+				t.Errorf("%s: %q has inode %x in ReadDir, %x in Attr", d.name, ent.Name, ent.Inode, ino)
+			}
+		}
+		if types["link"] != fuse.DT_Link || types["file"] != fuse.DT_File || len(types) != 2 {
+			t.Errorf("%s: ReadDir types = %v; want link DT_Link and file DT_File", d.name, types)
+		}
+	}
+}
+
+func TestSigningErrorEACCES(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	fc.mu.Lock()
+	fc.noSigner = true
+	fc.mu.Unlock()
+
+	create := func() fuse.Error {
+		_, _, err := dir.Create(&fuse.CreateRequest{Name: "file", Flags: syscall.O_RDWR, Mode: 0644}, &fuse.CreateResponse{}, nil)
+		return err
+	}
+	if err := create(); err != fuse.EIO {
+		t.Errorf("Create without a signer = %v; want EIO", err)
+	}
+	fs.SigningEACCES = true
+	if err := create(); err != fuse.EACCES {
+		t.Errorf("Create without a signer, with SigningEACCES = %v; want EACCES", err)
+	}
+	if err := dir.Remove(&fuse.RemoveRequest{Name: "file"}, nil); err != fuse.EACCES {
+		t.Errorf("Remove without a signer, with SigningEACCES = %v; want EACCES", err)
+	}
+}
+
+// pathAttrs returns the camliPath attributes of the permanode pn.
+func pathAttrs(t *testing.T, fc *fakeClient, pn *blobref.BlobRef) []string {
+	res, err := fc.Describe(&search.DescribeRequest{BlobRef: pn, Depth: 1})
+	if err != nil {
+		t.Fatalf("Describe(%v): %v", pn, err)
+	}
+	var attrs []string
+	for k := range res.Meta[pn.String()].Permanode.Attr {
+		if strings.HasPrefix(k, "camliPath:") {
+			attrs = append(attrs, k)
+		}
+	}
+	sort.Strings(attrs)
+	return attrs
+}
+
+func TestRecursiveRemove(t *testing.T) {
+	for _, recursive := range []bool{false, true} {
+		fs, fc, dir := newFakeFS(t)
+		fs.RecursiveRemove = recursive
+		a, err := dir.creat("a", dirType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ad := a.(*mutDir)
+		b, err := ad.creat("b", dirType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bd := b.(*mutDir)
+		newFileWithContent(t, ad, "f1", "one")
+		newFileWithContent(t, bd, "f2", "two")
+
+		if err := dir.Remove(&fuse.RemoveRequest{Name: "a", Dir: true}, nil); err != nil {
+			t.Fatalf("recursive=%v: Remove: %v", recursive, err)
+		}
+		if got := pathAttrs(t, fc, dir.permanode); len(got) != 0 {
+			t.Errorf("recursive=%v: root still links %q", recursive, got)
+		}
+		gotA, gotB := pathAttrs(t, fc, ad.permanode), pathAttrs(t, fc, bd.permanode)
+		if recursive {
+			if len(gotA) != 0 || len(gotB) != 0 {
+				t.Errorf("recursive removal left links %q in a and %q in b", gotA, gotB)
+			}
+		} else {
+			if want := []string{"camliPath:b", "camliPath:f1"}; !reflect.DeepEqual(gotA, want) {
+				t.Errorf("plain removal: a's links = %q; want %q", gotA, want)
+			}
+			if want := []string{"camliPath:f2"}; !reflect.DeepEqual(gotB, want) {
+				t.Errorf("plain removal: b's links = %q; want %q", gotB, want)
+			}
+		}
+	}
+}
+
+func TestRecursiveRemoveShared(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	fs.RecursiveRemove = true
+	a, err := dir.creat("a", dirType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad := a.(*mutDir)
+	b, err := ad.creat("b", dirType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bd := b.(*mutDir)
+	newFileWithContent(t, bd, "f", "shared")
+	other, err := dir.creat("other", dirType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.(*mutDir).link("b", bd.permanode, bd); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dir.Remove(&fuse.RemoveRequest{Name: "a", Dir: true}, nil); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if got := pathAttrs(t, fc, ad.permanode); len(got) != 0 {
+		t.Errorf("a still links %q", got)
+	}
+	if got, want := pathAttrs(t, fc, bd.permanode), []string{"camliPath:f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("b, also linked from other, links %q; want %q", got, want)
+	}
+}
+
+func TestTempDir(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	tempDir, err := ioutil.TempDir("", "fs-test-tempdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	fs.TempDir = tempDir
+
+	mf := newFileWithContent(t, dir, "file", "contents")
+	h, ferr := mf.newHandle(strings.NewReader("contents"), syscall.O_RDWR, nil)
+	if ferr != nil {
+		t.Fatalf("newHandle: %v", ferr)
+	}
+	fh := h.(*mutFileHandle)
+	if got := filepath.Dir(fh.tmp.Name()); got != tempDir {
+		t.Errorf("temp file created in %s; want %s", got, tempDir)
+	}
+	if err := fh.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	fs.TempDir = filepath.Join(tempDir, "missing")
+	if _, ferr := mf.newHandle(nil, syscall.O_RDWR, nil); ferr != fuse.EIO {
+		t.Errorf("newHandle with a missing TempDir = %v; want EIO", ferr)
+	}
+}
+
+func TestPopulateTrimmedDescribe(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "contents")
+	if err := mf.Setxattr(&fuse.SetxattrRequest{Name: "user.k", Xattr: []byte("v")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.Mkdir(&fuse.MkdirRequest{Name: "sub"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dir.Symlink(&fuse.SymlinkRequest{NewName: "link", Target: "file"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Attributes the fs has no use for.
+	for _, claim := range []*schema.Builder{
+		schema.NewSetAttributeClaim(mf.permanode, "title", "a file"),
+		schema.NewAddAttributeClaim(dir.permanode, "camliMember", mf.permanode.String()),
+	} {
+		if _, err := fc.UploadAndSignBlob(claim); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res, derr := fc.Describe(&search.DescribeRequest{
+		BlobRef: dir.permanode,
+		Depth:   DefaultPopulateDepth,
+		Attrs:   populateAttrs,
+	})
+	if derr != nil {
+		t.Fatal(derr)
+	}
+	for br, db := range res.Meta {
+		if db.Permanode == nil {
+			continue
+		}
+		for _, attr := range []string{"title", "camliMember"} {
+			if v := db.Permanode.Attr[attr]; v != nil {
+				t.Errorf("described %s has %s %q; want it left out", br, attr, v)
+			}
+		}
+	}
+
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	before := len(fc.describeRequests())
+	if _, err := cold.ReadDir(nil); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	reqs := fc.describeRequests()[before:]
+	if len(reqs) == 0 || !reflect.DeepEqual(reqs[0].Attrs, populateAttrs) {
+		t.Fatalf("populate describes = %v; want them limited to %q", reqs, populateAttrs)
+	}
+
+	node, err := cold.Lookup("file", nil)
+	if err != nil {
+		t.Fatalf("Lookup(file): %v", err)
+	}
+	file := node.(*mutFile)
+	if a := file.Attr(); a.Size != uint64(len("contents")) {
+		t.Errorf("file size = %d; want %d", a.Size, len("contents"))
+	}
+	var xres fuse.GetxattrResponse
+	if err := file.Getxattr(&fuse.GetxattrRequest{Name: "user.k"}, &xres, nil); err != nil || string(xres.Xattr) != "v" {
+		t.Errorf("file xattr = %q, %v; want %q", xres.Xattr, err, "v")
+	}
+	if node, err := cold.Lookup("sub", nil); err != nil {
+		t.Errorf("Lookup(sub): %v", err)
+	} else if _, ok := node.(*mutDir); !ok {
+		t.Errorf("sub is a %T; want a directory", node)
+	}
+	node, err = cold.Lookup("link", nil)
+	if err != nil {
+		t.Fatalf("Lookup(link): %v", err)
+	}
+	if target, err := node.(*mutFile).Readlink(&fuse.ReadlinkRequest{}, nil); err != nil || target != "file" {
+		t.Errorf("Readlink = %q, %v; want %q", target, err, "file")
+	}
+}
+
+func TestPopulateUndescribedChildren(t *testing.T) {
+	fs, fc, dir := newFakeFS(t)
+	lagging := newFileWithContent(t, dir, "lagging", "not indexed yet")
+	content := newFileWithContent(t, dir, "content", "contents")
+
+	// The index knows the links, but not yet the first file's
+	// permanode, nor the second's content.
+	fc.setDescribed(lagging.permanode, false)
+	fc.setDescribed(content.content, false)
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	ents, err := cold.ReadDir(nil)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var names []string
+	for _, ent := range ents {
+		names = append(names, ent.Name)
+	}
+	sort.Strings(names)
+	if want := []string{"content", "lagging"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("ReadDir = %q; want %q", names, want)
+	}
+
+	node, err := cold.Lookup("lagging", nil)
+	if err != nil {
+		t.Fatalf("Lookup of an undescribed child: %v", err)
+	}
+	placeholder := node.(*mutFile)
+	if a := placeholder.Attr(); a.Mode != 0 || a.Size != 0 {
+		t.Errorf("placeholder mode, size = %v, %d; want no permissions, 0 bytes", a.Mode, a.Size)
+	}
+	if _, err := placeholder.Open(&fuse.OpenRequest{}, &fuse.OpenResponse{}, nil); err != fuse.EIO {
+		t.Errorf("Open of a placeholder = %v; want EIO", err)
+	}
+
+	// Once the index catches up, looking the child up again
+	// resolves it.
+	fc.setDescribed(lagging.permanode, true)
+	fc.setDescribed(content.content, true)
+	node, err = cold.Lookup("lagging", nil)
+	if err != nil {
+		t.Fatalf("Lookup after the index caught up: %v", err)
+	}
+	if mf := node.(*mutFile); mf.unresolved {
+		t.Error("Lookup after the index caught up returned the placeholder")
+	} else if got := storedContents(t, mf); got != "not indexed yet" {
+		t.Errorf("resolved contents = %q; want %q", got, "not indexed yet")
+	}
+	node, err = cold.Lookup("content", nil)
+	if err != nil {
+		t.Fatalf("Lookup(content): %v", err)
+	}
+	if a := node.(*mutFile).Attr(); a.Size != uint64(len("contents")) {
+		t.Errorf("size of a file whose content wasn't described = %d; want %d", a.Size, len("contents"))
+	}
+}
+
+func TestCreateExclusive(t *testing.T) {
+	_, fc, dir := newFakeFS(t)
+	newFileWithContent(t, dir, "file", "original")
+
+	nup := fc.uploadCount()
+	req := &fuse.CreateRequest{Name: "file", Flags: syscall.O_RDWR | syscall.O_CREAT | syscall.O_EXCL, Mode: 0644}
+	if _, _, err := dir.Create(req, &fuse.CreateResponse{}, nil); err != fuse.Errno(syscall.EEXIST) {
+		t.Fatalf("exclusive Create of an existing file = %v; want EEXIST", err)
+	}
+	if n := fc.uploadCount() - nup; n != 0 {
+		t.Errorf("exclusive Create of an existing file uploaded %d blobs; want none", n)
+	}
+
+	// Also when the name was added by another client since n
+	// was populated.
+	other := newFileWithContent(t, &mutDir{fs: dir.fs, permanode: dir.permanode, name: "other"}, "elsewhere", "x")
+	dir.mu.Lock()
+	delete(dir.children, "elsewhere")
+	dir.lastPop = time.Time{}
+	dir.mu.Unlock()
+	req.Name = "elsewhere"
+	if _, _, err := dir.Create(req, &fuse.CreateResponse{}, nil); err != fuse.Errno(syscall.EEXIST) {
+		t.Errorf("exclusive Create of a file added by another client = %v; want EEXIST", err)
+	}
+	if mf, ok := dir.children["elsewhere"].(*mutFile); !ok || mf.permanode.String() != other.permanode.String() {
+		t.Errorf("after refused Create, elsewhere = %#v; want the other client's permanode %v", dir.children["elsewhere"], other.permanode)
+	}
+}
+
+func TestCreateExisting(t *testing.T) {
+	_, fc, dir := newFakeFS(t)
+	orig := newFileWithContent(t, dir, "file", "original")
+
+	create := func(flags uint32) (*mutFile, *mutFileHandle) {
+		node, h, err := dir.Create(&fuse.CreateRequest{Name: "file", Flags: flags, Mode: 0644}, &fuse.CreateResponse{}, nil)
+		if err != nil {
+			t.Fatalf("Create of an existing file with flags %#x: %v", flags, err)
+		}
+		return node.(*mutFile), h.(*mutFileHandle)
+	}
+	mf, h := create(syscall.O_RDWR | syscall.O_CREAT)
+	if mf.permanode.String() != orig.permanode.String() {
+		t.Errorf("Create of an existing file returned node for %v; want the existing %v", mf.permanode, orig.permanode)
+	}
+	if err := h.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := storedContents(t, mf); got != "original" {
+		t.Errorf("contents after Create without O_TRUNC = %q; want %q", got, "original")
+	}
+
+	mf, h = create(syscall.O_RDWR | syscall.O_CREAT | syscall.O_TRUNC)
+	if err := h.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := storedContents(t, mf); got != "" {
+		t.Errorf("contents after Create with O_TRUNC = %q; want empty", got)
+	}
+	res, err := fc.Describe(&search.DescribeRequest{BlobRef: dir.permanode, Depth: 1})
+	if err != nil {
+		t.Fatalf("Describe: %v", err)
+	}
+	if got := res.Meta[dir.permanode.String()].Permanode.Attr["camliPath:file"]; !reflect.DeepEqual(got, []string{orig.permanode.String()}) {
+		t.Errorf("camliPath:file = %q; want the original %v", got, orig.permanode)
+	}
+}
+
+func TestAttrValid(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "contents")
+	nodes := []interface {
+		fuse.Node
+		Getattr(*fuse.GetattrRequest, *fuse.GetattrResponse, fuse.Intr) fuse.Error
+		Setattr(*fuse.SetattrRequest, *fuse.SetattrResponse, fuse.Intr) fuse.Error
+	}{mf, dir}
+	for _, valid := range []time.Duration{0, 5 * time.Second} {
+		fs.AttrValid = valid
+		want := valid
+		if want == 0 {
+			want = DefaultAttrValid
+		}
+		for _, n := range nodes {
+			var res fuse.GetattrResponse
+			if err := n.Getattr(&fuse.GetattrRequest{}, &res, nil); err != nil {
+				t.Fatalf("%T.Getattr: %v", n, err)
+			}
+			if res.AttrValid != want {
+				t.Errorf("with AttrValid %v, %T.Getattr's AttrValid = %v; want %v", valid, n, res.AttrValid, want)
+			}
+			if res.Attr != n.Attr() {
+				t.Errorf("%T.Getattr's Attr = %+v; want %+v", n, res.Attr, n.Attr())
+			}
+			var sres fuse.SetattrResponse
+			if err := n.Setattr(&fuse.SetattrRequest{}, &sres, nil); err != nil {
+				t.Fatalf("%T.Setattr: %v", n, err)
+			}
+			if sres.AttrValid != want {
+				t.Errorf("with AttrValid %v, %T.Setattr's AttrValid = %v; want %v", valid, n, sres.AttrValid, want)
+			}
+		}
+	}
+	if a := mf.Attr(); a.Size != uint64(len("contents")) || a.Mode != 0600 || !a.Atime.Equal(a.Mtime) {
+		t.Errorf("file Attr = %+v; want size %d, mode 0600, and atime the mtime", a, len("contents"))
+	}
+}
+
+func TestPopulateKeepsNodes(t *testing.T) {
+	_, _, dir := newFakeFS(t)
+	node, err := dir.creat("sub", dirType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := node.(*mutDir)
+	newFileWithContent(t, sub, "inner", "x")
+	mf := newFileWithContent(t, dir, "file", "old")
+	_, h, ferr := dir.Create(&fuse.CreateRequest{Name: "file", Flags: syscall.O_RDWR}, &fuse.CreateResponse{}, nil)
+	if ferr != nil {
+		t.Fatalf("opening file: %v", ferr)
+	}
+
+	// Another client changes the file's content meanwhile.
+	other := newFileWithContent(t, &mutDir{fs: dir.fs, permanode: dir.permanode, name: "other"}, "file2", "new")
+	claim := schema.NewSetAttributeClaim(mf.permanode, "camliContent", other.content.String())
+	if _, err := dir.fs.client.UploadAndSignBlob(claim); err != nil {
+		t.Fatal(err)
+	}
+
+	dir.mu.Lock()
+	dir.lastPop = time.Time{}
+	dir.mu.Unlock()
+	if err := dir.populate(); err != nil {
+		t.Fatalf("populate: %v", err)
+	}
+	dir.mu.Lock()
+	gotSub, gotFile := dir.children["sub"], dir.children["file"]
+	dir.mu.Unlock()
+	if gotSub != sub {
+		t.Error("populate replaced the node of a directory it already had")
+	}
+	sub.mu.Lock()
+	_, ok := sub.children["inner"]
+	sub.mu.Unlock()
+	if !ok {
+		t.Error("subdirectory lost its children")
+	}
+	if gotFile != mf {
+		t.Error("populate replaced the node of an open file")
+	}
+	if got := storedContents(t, mf); got != "old" {
+		t.Errorf("open file's content = %q; want its own, %q, until released", got, "old")
+	}
+	if err := h.(*mutFileHandle).Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once closed, a populate brings in others' changes.
+	dir.mu.Lock()
+	dir.lastPop = time.Time{}
+	dir.mu.Unlock()
+	if err := dir.populate(); err != nil {
+		t.Fatalf("populate: %v", err)
+	}
+	if got := storedContents(t, mf); got != "new" {
+		t.Errorf("closed file's content after populate = %q; want %q", got, "new")
+	}
+}
+
+func TestPermanodeRoot(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "contents")
+
+	bogus := blobref.SHA1FromString("no such blob")
+	tests := []struct {
+		root    *blobref.BlobRef
+		wantErr string
+	}{
+		{bogus, "not found"},
+		{mf.content, "not a permanode"},
+		{dir.permanode, ""},
+	}
+	for _, tt := range tests {
+		fs.root = nil
+		err := fs.setPermanodeRoot(tt.root)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("root %v: %v", tt.root, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("root %v: error = %v; want one saying %q", tt.root, err, tt.wantErr)
+		}
+		if fs.root != nil {
+			t.Errorf("root %v was set despite the error", tt.root)
+		}
+	}
+
+	root, _ := fs.Root()
+	if _, err := root.(*mutDir).Lookup("file", nil); err != nil {
+		t.Errorf("Lookup in the permanode root: %v", err)
+	}
+}
+
+func TestFallocate(t *testing.T) {
+	_, _, dir := newFakeFS(t)
+	node, h, err := dir.Create(&fuse.CreateRequest{Name: "download", Flags: syscall.O_WRONLY | syscall.O_CREAT, Mode: 0644}, &fuse.CreateResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	mf, w := node.(*mutFile), h.(*mutFileHandle)
+	const size = 1 << 20
+	fallocate := func(off, length uint64, mode uint32) fuse.Error {
+		return w.Fallocate(&fuse.FallocateRequest{Offset: off, Length: length, Mode: mode}, nil)
+	}
+	if err := fallocate(0, size, 0); err != nil {
+		t.Fatalf("Fallocate: %v", err)
+	}
+	if got := mf.Attr().Size; got != size {
+		t.Errorf("size after Fallocate = %d; want %d", got, size)
+	}
+	if err := fallocate(0, 2*size, fuse.FallocateKeepSize); err != nil {
+		t.Errorf("Fallocate keeping the size: %v", err)
+	}
+	if err := fallocate(0, size/2, 0); err != nil {
+		t.Errorf("Fallocate within the file: %v", err)
+	}
+	if err := fallocate(0, size, fuse.FallocateKeepSize|fuse.FallocatePunchHole); err != fuse.Errno(syscall.EOPNOTSUPP) {
+		t.Errorf("punching a hole = %v; want EOPNOTSUPP", err)
+	}
+	if got := mf.Attr().Size; got != size {
+		t.Errorf("size after Fallocates not growing the file = %d; want %d", got, size)
+	}
+
+	// Out of order, as a downloader fetching pieces would.
+	pieces := map[int64]string{size - 5: "tail!", size / 2: "middle", 0: "head"}
+	for off, data := range pieces {
+		if err := w.Write(&fuse.WriteRequest{Offset: off, Data: []byte(data)}, &fuse.WriteResponse{}, nil); err != nil {
+			t.Fatalf("Write at %d: %v", off, err)
+		}
+	}
+	if err := w.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	want := make([]byte, size)
+	for off, data := range pieces {
+		copy(want[off:], data)
+	}
+	if got := storedContents(t, mf); got != string(want) {
+		t.Errorf("stored %d bytes, not the %d written sparsely", len(got), size)
+	}
+	if got := mf.Attr().Size; got != size {
+		t.Errorf("size after Release = %d; want %d", got, size)
+	}
+}
+
+// chunkOffsets returns the offsets of the chunks of mf's content,
+// sorted, followed by its size.
+func chunkOffsets(t *testing.T, mf *mutFile) []int {
+	mf.mu.Lock()
+	content, size := mf.content, mf.size
+	mf.mu.Unlock()
+	fr, err := schema.NewFileReader(mf.fs.fetcher, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+	c := make(chan int64)
+	go fr.GetChunkOffsets(c)
+	offs := []int{int(size)}
+	for off := range c {
+		offs = append(offs, int(off))
+	}
+	sort.Ints(offs)
+	return offs
+}
+
+func TestChunking(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	const max = 16 << 10
+	fs.Chunking = &schema.ChunkOptions{MaxSize: max}
+	node, h, err := dir.Create(&fuse.CreateRequest{Name: "file", Flags: syscall.O_WRONLY | syscall.O_CREAT, Mode: 0644}, &fuse.CreateResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	mf, w := node.(*mutFile), h.(*mutFileHandle)
+	data := make([]byte, 200<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := w.Write(&fuse.WriteRequest{Data: data}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := storedContents(t, mf); got != string(data) {
+		t.Fatalf("stored %d bytes, differing from the %d written", len(got), len(data))
+	}
+
+	offs := chunkOffsets(t, mf)
+	if len(offs) < len(data)/max+1 {
+		t.Errorf("file stored in %d chunks; want at least %d", len(offs)-1, len(data)/max)
+	}
+	for i := 1; i < len(offs); i++ {
+		if n := offs[i] - offs[i-1]; n > max {
+			t.Errorf("chunk at %d is %d bytes; want at most %d", offs[i-1], n, max)
+		}
+	}
+}
+
+// TestChunkingInsert checks that with content-defined chunking,
+// rewriting a file with a few bytes inserted near its start only
+// uploads the chunks around the insertion, where fixed-size chunks
+// would all shift and be uploaded again.
+func TestChunkingInsert(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	edited := append(append(append([]byte{}, data[:1000]...), "inserted"...), data[1000:]...)
+
+	tests := []struct {
+		opts       schema.ChunkOptions
+		maxChanged int  // chunks
+		allShift   bool // if set, most chunks must change instead
+	}{
+		{opts: schema.ChunkOptions{NoFirstChunk: true}, maxChanged: 2},
+		// The first 256 KB is cut every MaxSize bytes.
+		{opts: schema.ChunkOptions{}, maxChanged: 256/32 + 2},
+		{opts: schema.ChunkOptions{Fixed: true}, allShift: true},
+	}
+	for _, tt := range tests {
+		fs, fc, dir := newFakeFS(t)
+		opts := tt.opts
+		opts.MinSize, opts.MaxSize = 4<<10, 32<<10
+		fs.Chunking = &opts
+		write := func(data []byte) *mutFile {
+			node, h, err := dir.Create(&fuse.CreateRequest{Name: "file", Flags: syscall.O_WRONLY | syscall.O_CREAT | syscall.O_TRUNC, Mode: 0644}, &fuse.CreateResponse{}, nil)
+			if err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+			w := h.(*mutFileHandle)
+			if err := w.Write(&fuse.WriteRequest{Data: data}, &fuse.WriteResponse{}, nil); err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if err := w.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+				t.Fatalf("Release: %v", err)
+			}
+			return node.(*mutFile)
+		}
+		// chunks returns the set of chunks of data, stored in mf.
+		chunks := func(mf *mutFile, data []byte) map[string]bool {
+			set := map[string]bool{}
+			offs := chunkOffsets(t, mf)
+			for i := 1; i < len(offs); i++ {
+				set[string(data[offs[i-1]:offs[i]])] = true
+			}
+			return set
+		}
+		old := chunks(write(data), data)
+		uploads := fc.uploadCount()
+		mf := write(edited)
+		if got := storedContents(t, mf); got != string(edited) {
+			t.Fatalf("%+v: stored %d bytes, differing from the %d written", opts, len(got), len(edited))
+		}
+		changed := 0
+		for c := range chunks(mf, edited) {
+			if !old[c] {
+				changed++
+			}
+		}
+		// The uploads also count the file and bytes schema blobs
+		// and the claims setting the content and mtime.
+		reuploaded := fc.uploadCount() - uploads
+		t.Logf("%+v: %d of %d chunks changed, %d blobs uploaded", opts, changed, len(old), reuploaded)
+		if tt.allShift {
+			if changed < len(old)*3/4 {
+				t.Errorf("%+v: %d of %d chunks changed; want most, as they all shift", opts, changed, len(old))
+			}
+		} else if changed > tt.maxChanged || reuploaded > tt.maxChanged+len(old)/8 {
+			t.Errorf("%+v: %d of %d chunks changed, %d blobs uploaded; want at most %d chunks changed and a few schema blobs", opts, changed, len(old), reuploaded, tt.maxChanged)
+		}
+	}
+}
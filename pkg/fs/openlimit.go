@@ -0,0 +1,68 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"sync"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// writeSlots limits the number of temporary files held by the files
+// open for writing to CamliFileSystem.MaxOpenWrites. A slot is taken
+// when a file's first writable handle is opened, and given back when
+// its last handle is released; further handles share its temporary
+// file, and take none.
+type writeSlots struct {
+	once  sync.Once
+	slots chan struct{} // or nil if unlimited
+}
+
+// acquireWriteSlot blocks until a temporary file may be created, or
+// returns errInterrupted if intr is closed first.
+func (fs *CamliFileSystem) acquireWriteSlot(intr fuse.Intr) error {
+	fs.writeSlots.once.Do(func() {
+		if fs.MaxOpenWrites > 0 {
+			fs.writeSlots.slots = make(chan struct{}, fs.MaxOpenWrites)
+		}
+	})
+	slots := fs.writeSlots.slots
+	if slots == nil {
+		return nil
+	}
+	select {
+	case slots <- struct{}{}:
+		return nil
+	default:
+	}
+	mutFileOpenWait.Incr()
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-intr:
+		return errInterrupted
+	}
+}
+
+// releaseWriteSlot gives back a slot taken by acquireWriteSlot.
+func (fs *CamliFileSystem) releaseWriteSlot() {
+	if slots := fs.writeSlots.slots; slots != nil {
+		<-slots
+	}
+}
@@ -0,0 +1,100 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestMaxOpenWrites(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	fs.MaxOpenWrites = 2
+	mf := newFileWithContent(t, dir, "existing", "contents")
+
+	create := func(name string, intr fuse.Intr) (fuse.Handle, fuse.Error) {
+		_, h, err := dir.Create(&fuse.CreateRequest{Name: name, Flags: syscall.O_RDWR | syscall.O_CREAT, Mode: 0644}, &fuse.CreateResponse{}, intr)
+		return h, err
+	}
+	var open []fuse.Handle
+	for _, name := range []string{"a", "b"} {
+		h, err := create(name, nil)
+		if err != nil {
+			t.Fatalf("Create(%q): %v", name, err)
+		}
+		open = append(open, h)
+	}
+	// Another handle on an open file shares its temporary file.
+	_, h, err := dir.Create(&fuse.CreateRequest{Name: "a", Flags: syscall.O_RDWR, Mode: 0644}, &fuse.CreateResponse{}, nil)
+	if err != nil {
+		t.Fatalf("second open of a: %v", err)
+	}
+	open = append(open, h)
+
+	intr := make(chan struct{})
+	close(intr)
+	if _, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, intr); err != fuse.EINTR {
+		t.Errorf("interrupted Open with no slot free = %v; want EINTR", err)
+	}
+
+	done := make(chan fuse.Error, 1)
+	go func() {
+		h, err := create("c", nil)
+		if err == nil {
+			h.(*mutFileHandle).Release(&fuse.ReleaseRequest{}, nil)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("third Create didn't wait for a slot; returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Releasing one of a's two handles frees nothing.
+	if err := open[2].(*mutFileHandle).Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("third Create returned %v while a was still open", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := open[0].(*mutFileHandle).Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("third Create: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("third Create still waiting after a was released")
+	}
+	if err := open[1].(*mutFileHandle).Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := len(fs.writeSlots.slots); got != 0 {
+		t.Errorf("%d write slots still taken after all were released", got)
+	}
+}
@@ -0,0 +1,137 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// Permanode attributes holding a mutable node's owner, as decimal
+// numeric ids.
+const (
+	uidAttr = "camliUid"
+	gidAttr = "camliGid"
+)
+
+// owner is the ownership recorded for a mutable node. Ids that
+// aren't recorded are reported as those of the mounting user.
+type owner struct {
+	uid, gid       uint32
+	hasUid, hasGid bool
+}
+
+// ownerFromAttrs returns the ownership stored in a permanode's
+// attributes.
+func ownerFromAttrs(attrs url.Values) owner {
+	var o owner
+	o.uid, o.hasUid = idFromAttrs(attrs, uidAttr)
+	o.gid, o.hasGid = idFromAttrs(attrs, gidAttr)
+	return o
+}
+
+func idFromAttrs(attrs url.Values, attr string) (uint32, bool) {
+	v := attrs.Get(attr)
+	if v == "" {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		log.Printf("fs: bad %s attribute %q: %v", attr, v, err)
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+// ids returns the uid and gid to report for the node, which are
+// the mounting user's if fs.IgnoreOwners is set.
+func (o owner) ids(fs *CamliFileSystem) (uid, gid uint32) {
+	uid, gid = uint32(os.Getuid()), uint32(os.Getgid())
+	if fs.IgnoreOwners {
+		return
+	}
+	if o.hasUid {
+		uid = o.uid
+	}
+	if o.hasGid {
+		gid = o.gid
+	}
+	return
+}
+
+// storeOwner records the uid and gid changed by req on permanode.
+func storeOwner(fs *CamliFileSystem, permanode *blobref.BlobRef, req *fuse.SetattrRequest) error {
+	if req.Valid.Uid() {
+		claim := schema.NewSetAttributeClaim(permanode, uidAttr, strconv.FormatUint(uint64(req.Uid), 10))
+		if err := fs.uploadClaim(claim); err != nil {
+			return err
+		}
+	}
+	if req.Valid.Gid() {
+		claim := schema.NewSetAttributeClaim(permanode, gidAttr, strconv.FormatUint(uint64(req.Gid), 10))
+		if err := fs.uploadClaim(claim); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply updates o with the uid and gid changed by req.
+func (o *owner) apply(req *fuse.SetattrRequest) {
+	if req.Valid.Uid() {
+		o.uid, o.hasUid = req.Uid, true
+	}
+	if req.Valid.Gid() {
+		o.gid, o.hasGid = req.Gid, true
+	}
+}
+
+func (n *mutDir) Setattr(req *fuse.SetattrRequest, res *fuse.SetattrResponse, intr fuse.Intr) fuse.Error {
+	if n.fs.readOnly() {
+		return fuse.EPERM
+	}
+	if req.Valid.Uid() || req.Valid.Gid() {
+		if err := storeOwner(n.fs, n.permanode, req); err != nil {
+			n.fs.errorf("mutDir.Setattr(%q): %v", n.fullPath(), err)
+			return n.fs.uploadError(err)
+		}
+		n.mu.Lock()
+		n.owner.apply(req)
+		n.mu.Unlock()
+	}
+	if req.Valid.Mode() {
+		if err := storeMode(n.fs, n.permanode, req); err != nil {
+			n.fs.errorf("mutDir.Setattr(%q): %v", n.fullPath(), err)
+			return n.fs.uploadError(err)
+		}
+		n.mu.Lock()
+		n.perm.apply(req)
+		n.mu.Unlock()
+	}
+	res.AttrValid = n.fs.attrValid()
+	res.Attr = n.Attr()
+	return nil
+}
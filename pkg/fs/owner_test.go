@@ -0,0 +1,95 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"os"
+	"testing"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestOwnerRoundTrip(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "contents")
+	sub, err := dir.creat("sub", dirType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFileWithContent(t, dir, "untouched", "contents")
+
+	chown := func(n interface {
+		Setattr(*fuse.SetattrRequest, *fuse.SetattrResponse, fuse.Intr) fuse.Error
+	}, req *fuse.SetattrRequest) fuse.Attr {
+		var res fuse.SetattrResponse
+		if err := n.Setattr(req, &res, nil); err != nil {
+			t.Fatalf("Setattr: %v", err)
+		}
+		return res.Attr
+	}
+	if a := chown(mf, &fuse.SetattrRequest{Valid: fuse.SetattrUid | fuse.SetattrGid, Uid: 1234, Gid: 5678}); a.Uid != 1234 || a.Gid != 5678 {
+		t.Errorf("file Setattr attr uid/gid = %d/%d; want 1234/5678", a.Uid, a.Gid)
+	}
+	if a := chown(sub.(*mutDir), &fuse.SetattrRequest{Valid: fuse.SetattrGid, Gid: 42}); a.Gid != 42 {
+		t.Errorf("dir Setattr attr gid = %d; want 42", a.Gid)
+	}
+
+	// As if remounted: a fresh node for the same permanode.
+	myUid, myGid := uint32(os.Getuid()), uint32(os.Getgid())
+	tests := []struct {
+		name     string
+		uid, gid uint32
+	}{
+		{"file", 1234, 5678},
+		{"sub", myUid, 42},
+		{"untouched", myUid, myGid},
+	}
+	check := func(ignoreOwners bool) {
+		fs.IgnoreOwners = ignoreOwners
+		cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+		for _, tt := range tests {
+			n, err := cold.Lookup(tt.name, nil)
+			if err != nil {
+				t.Fatalf("Lookup(%q): %v", tt.name, err)
+			}
+			uid, gid := tt.uid, tt.gid
+			if ignoreOwners {
+				uid, gid = myUid, myGid
+			}
+			if a := n.Attr(); a.Uid != uid || a.Gid != gid {
+				t.Errorf("IgnoreOwners=%v: %s uid/gid = %d/%d; want %d/%d", ignoreOwners, tt.name, a.Uid, a.Gid, uid, gid)
+			}
+		}
+	}
+	check(false)
+	check(true)
+}
+
+func TestSetattrOwnerReadOnly(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "contents")
+	fs.ReadOnly = true
+	req := &fuse.SetattrRequest{Valid: fuse.SetattrUid, Uid: 1}
+	if err := mf.Setattr(req, &fuse.SetattrResponse{}, nil); err != fuse.EPERM {
+		t.Errorf("file Setattr on a read-only mount = %v; want EPERM", err)
+	}
+	if err := dir.Setattr(req, &fuse.SetattrResponse{}, nil); err != fuse.EPERM {
+		t.Errorf("dir Setattr on a read-only mount = %v; want EPERM", err)
+	}
+}
@@ -0,0 +1,149 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"log"
+	"sync"
+
+	"camlistore.org/pkg/schema"
+)
+
+// readAheadBlock is the size of the blocks of a file a readAhead
+// fetches, each in its own request.
+const readAheadBlock = 128 << 10
+
+// readAhead fetches in the background, for a handle being read
+// sequentially, the blocks of the file just past those read, up to
+// CamliFileSystem.ReadAheadBytes ahead, so that they're fetched
+// concurrently instead of one at a time as the kernel asks for them.
+// Reads elsewhere in the file are served directly, and drop the
+// blocks fetched ahead.
+type readAhead struct {
+	fr  *schema.FileReader
+	max int64 // bytes to fetch past the last read
+
+	mu     sync.Mutex
+	next   int64              // offset just past the last read
+	blocks map[int64]*raBlock // by offset, a multiple of readAheadBlock
+}
+
+// raBlock is a block of a file being fetched by a readAhead.
+type raBlock struct {
+	done chan struct{} // closed once data and err are set
+	data []byte
+	err  error
+}
+
+func newReadAhead(fr *schema.FileReader, max int64) *readAhead {
+	return &readAhead{
+		fr:     fr,
+		max:    max,
+		blocks: make(map[int64]*raBlock),
+	}
+}
+
+// read copies into p the bytes at off, from the blocks fetched ahead,
+// and fetches those after them. It returns the number of bytes
+// copied, and false if p must be read directly instead, as the read
+// isn't sequential or fetching a block failed.
+func (ra *readAhead) read(p []byte, off int64) (int, bool) {
+	end := off + int64(len(p))
+	if size := ra.fr.Size(); end > size {
+		end = size
+	}
+	ra.mu.Lock()
+	_, ahead := ra.blocks[blockOff(off)]
+	if off != ra.next && !ahead {
+		// Not sequential, nor in what was fetched ahead: the
+		// blocks won't be used.
+		ra.next = end
+		ra.blocks = make(map[int64]*raBlock)
+		ra.mu.Unlock()
+		return 0, false
+	}
+	if end > ra.next {
+		ra.next = end
+	}
+	for boff := range ra.blocks {
+		if boff+readAheadBlock <= off {
+			delete(ra.blocks, boff)
+		}
+	}
+	for boff := blockOff(off); boff < ra.next+ra.max && boff < ra.fr.Size(); boff += readAheadBlock {
+		if ra.blocks[boff] == nil {
+			ra.blocks[boff] = ra.fetch(boff)
+		}
+	}
+	var need []*raBlock
+	for boff := blockOff(off); boff < end; boff += readAheadBlock {
+		need = append(need, ra.blocks[boff])
+	}
+	ra.mu.Unlock()
+
+	n := 0
+	for i, b := range need {
+		<-b.done
+		if b.err != nil {
+			log.Printf("read-ahead at %d: %v", off, b.err)
+			ra.forget(b)
+			return 0, false
+		}
+		if i == 0 {
+			n = copy(p, b.data[off%readAheadBlock:])
+		} else {
+			n += copy(p[n:], b.data)
+		}
+	}
+	return n, true
+}
+
+// fetch starts fetching the block at boff in the background.
+func (ra *readAhead) fetch(boff int64) *raBlock {
+	size := int64(readAheadBlock)
+	if rest := ra.fr.Size() - boff; rest < size {
+		size = rest
+	}
+	b := &raBlock{done: make(chan struct{})}
+	go func() {
+		defer close(b.done)
+		buf := make([]byte, size)
+		n, err := ra.fr.ReadAt(buf, boff)
+		b.data, b.err = buf[:n], err
+		fileReadAhead.Incr()
+	}()
+	return b
+}
+
+// forget drops b, which failed, so that it's fetched again if
+// needed.
+func (ra *readAhead) forget(b *raBlock) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	for boff, b2 := range ra.blocks {
+		if b2 == b {
+			delete(ra.blocks, boff)
+		}
+	}
+}
+
+// blockOff returns the offset of the block holding off.
+func blockOff(off int64) int64 {
+	return off - off%readAheadBlock
+}
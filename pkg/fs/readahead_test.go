@@ -0,0 +1,98 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestReadAhead(t *testing.T) {
+	const size = 1<<20 + 1234
+	_, mf := newCountingFS(t, 0, size)
+	want := readFile(t, mf)
+
+	mf.fs.ReadAheadBytes = 4 * readAheadBlock
+	if got := readFile(t, mf); !bytes.Equal(got, want) {
+		t.Fatalf("read with read-ahead got %d bytes differing from those read without", len(got))
+	}
+
+	h, err := mf.Open(&fuse.OpenRequest{}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	nr := h.(*nodeReader)
+	defer nr.Release(&fuse.ReleaseRequest{}, nil)
+	read := func(off int64, n int) {
+		var res fuse.ReadResponse
+		if err := nr.Read(&fuse.ReadRequest{Offset: off, Size: n}, &res, nil); err != nil {
+			t.Fatalf("Read at %d: %v", off, err)
+		}
+		if !bytes.Equal(res.Data, want[off:off+int64(len(res.Data))]) || len(res.Data) != n && off+int64(n) <= size {
+			t.Errorf("Read of %d bytes at %d got %d wrong bytes", n, off, len(res.Data))
+		}
+	}
+	blocks := func() int {
+		nr.ra.mu.Lock()
+		defer nr.ra.mu.Unlock()
+		return len(nr.ra.blocks)
+	}
+
+	read(0, 4096)
+	if n := blocks(); n != 5 {
+		t.Errorf("after the first read, %d blocks fetched; want the first and 4 ahead", n)
+	}
+	read(4096, 200<<10) // across blocks
+	if n := blocks(); n > 6 {
+		t.Errorf("after sequential reads, %d blocks held; want no more than 6", n)
+	}
+	read(3*readAheadBlock+10, 100) // ahead, but fetched already
+	if n := blocks(); n == 0 {
+		t.Error("a read in the blocks fetched ahead dropped them")
+	}
+
+	// A read elsewhere is served directly, and ends read-ahead
+	// until reads are sequential again.
+	read(10000, 5000)
+	if n := blocks(); n != 0 {
+		t.Errorf("after a random read, %d blocks held; want 0", n)
+	}
+	read(0, 100)
+	read(100, 100)
+	if n := blocks(); n == 0 {
+		t.Error("sequential reads after a random one fetched nothing ahead")
+	}
+}
+
+func benchmarkReadAhead(b *testing.B, readAhead int64) {
+	cf, mf := newCountingFS(b, 0, 4<<20)
+	cf.delay = time.Millisecond
+	mf.fs.ReadAheadBytes = readAhead
+	b.SetBytes(4 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		readFile(b, mf)
+	}
+}
+
+func BenchmarkReadNoReadAhead(b *testing.B) { benchmarkReadAhead(b, 0) }
+func BenchmarkReadAhead(b *testing.B)       { benchmarkReadAhead(b, 1<<20) }
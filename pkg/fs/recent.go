@@ -19,7 +19,6 @@ limitations under the License.
 package fs
 
 import (
-	"log"
 	"os"
 	"path"
 	"sync"
@@ -51,7 +50,7 @@ func (n *recentDir) Attr() fuse.Attr {
 }
 
 func (n *recentDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
-	log.Printf("fs.recent: ReadDir / searching")
+	n.fs.debugf("fs.recent: ReadDir / searching")
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
@@ -59,9 +58,10 @@ func (n *recentDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
 	n.modTime = make(map[string]time.Time)
 
 	req := &search.RecentRequest{N: 100}
+	n.fs.uploadClaims()
 	res, err := n.fs.client.GetRecentPermanodes(req)
 	if err != nil {
-		log.Printf("fs.recent: GetRecentPermanodes error in ReadDir: %v", err)
+		n.fs.errorf("fs.recent: GetRecentPermanodes error in ReadDir: %v", err)
 		return nil, fuse.EIO
 	}
 
@@ -100,12 +100,12 @@ func (n *recentDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
 		}
 		n.ents[name] = ccMeta
 		n.modTime[name] = modTime
-		log.Printf("fs.recent: name %q = %v (at %v -> %v)", name, ccMeta.BlobRef, ri.ModTime.Time(), modTime)
+		n.fs.debugf("fs.recent: name %q = %v (at %v -> %v)", name, ccMeta.BlobRef, ri.ModTime.Time(), modTime)
 		ents = append(ents, fuse.Dirent{
 			Name: name,
 		})
 	}
-	log.Printf("fs.recent returning %d entries", len(ents))
+	n.fs.debugf("fs.recent returning %d entries", len(ents))
 	return ents, nil
 }
 
@@ -120,7 +120,7 @@ func (n *recentDir) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error)
 		n.mu.Lock()
 	}
 	db := n.ents[name]
-	log.Printf("fs.recent: Lookup(%q) = %v", name, db)
+	n.fs.debugf("fs.recent: Lookup(%q) = %v", name, db)
 	if db == nil {
 		return nil, fuse.ENOENT
 	}
@@ -98,7 +98,7 @@ func (n *root) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
 	}
 
 	br := blobref.Parse(name)
-	log.Printf("Root lookup of %q = %v", name, br)
+	n.fs.debugf("Root lookup of %q = %v", name, br)
 	if br != nil {
 		return &node{fs: n.fs, blobref: br}, nil
 	}
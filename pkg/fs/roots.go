@@ -19,7 +19,7 @@ limitations under the License.
 package fs
 
 import (
-	"log"
+	"fmt"
 	"os"
 	"sync"
 	"time"
@@ -32,6 +32,12 @@ import (
 
 const refreshTime = 1 * time.Minute
 
+// rootsDir lists the permanodes with a camliRoot attribute, re-running
+// the search at most every refreshTime. There's no way to tell
+// watchers that the list changed: neither Linux nor OS X pass poll(2)
+// of a directory on to FUSE, and the entry invalidation notifications
+// need a newer protocol than the fuse package speaks. Programs that
+// want to see new roots have to read the directory again.
 type rootsDir struct {
 	fs *CamliFileSystem
 
@@ -62,7 +68,7 @@ func (n *rootsDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
 }
 
 func (n *rootsDir) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
-	log.Printf("fs.roots: Lookup(%q)", name)
+	n.fs.debugf("fs.roots: Lookup(%q)", name)
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	if err := n.condRefresh(); err != nil {
@@ -85,13 +91,26 @@ func (n *rootsDir) condRefresh() fuse.Error {
 	if n.lastQuery.After(time.Now().Add(-refreshTime)) {
 		return nil
 	}
-	log.Printf("fs.roots: querying")
+	n.fs.debugf("fs.roots: querying")
 
+	m, err := n.searchRoots()
+	if err != nil {
+		n.fs.errorf("fs.roots: %v", err)
+		return fuse.EIO
+	}
+	n.m = m
+	n.lastQuery = time.Now()
+	return nil
+}
+
+// searchRoots returns the permanodes with a camliRoot attribute,
+// keyed by their camliRoot name.
+func (n *rootsDir) searchRoots() (map[string]*blobref.BlobRef, error) {
 	req := &search.WithAttrRequest{N: 100, Attr: "camliRoot"}
+	n.fs.uploadClaims()
 	wres, err := n.fs.client.GetPermanodesWithAttr(req)
 	if err != nil {
-		log.Printf("fs.recent: GetRecentPermanodes error in ReadDir: %v", err)
-		return fuse.EIO
+		return nil, fmt.Errorf("GetPermanodesWithAttr: %v", err)
 	}
 
 	dr := &search.DescribeRequest{
@@ -100,43 +119,43 @@ func (n *rootsDir) condRefresh() fuse.Error {
 	for _, wi := range wres.WithAttr {
 		dr.BlobRefs = append(dr.BlobRefs, wi.Permanode)
 	}
-	dres, err := n.fs.client.Describe(dr)
+	dres, err := n.fs.describe(dr)
 	if err != nil {
-		log.Printf("Describe failure: %v", err)
-		return fuse.EIO
+		return nil, fmt.Errorf("Describe: %v", err)
 	}
 
-	n.m = make(map[string]*blobref.BlobRef)
-
+	m := make(map[string]*blobref.BlobRef)
 	for _, wi := range wres.WithAttr {
 		pn := wi.Permanode
 		db := dres.Meta[pn.String()]
 		if db != nil && db.Permanode != nil {
 			name := db.Permanode.Attr.Get("camliRoot")
 			if name != "" {
-				n.m[name] = pn
+				m[name] = pn
 			}
 		}
 	}
-	n.lastQuery = time.Now()
-	return nil
+	return m, nil
 }
 
 func (n *rootsDir) Mkdir(req *fuse.MkdirRequest, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	if n.fs.readOnly() {
+		return nil, fuse.EPERM
+	}
 	name := req.Name
 
 	// Create a Permanode for the root.
-	pr, err := n.fs.client.UploadNewPermanode()
+	pr, err := n.fs.uploadClient().UploadNewPermanode()
 	if err != nil {
-		log.Printf("rootsDir.Create(%q): %v", name, err)
+		n.fs.errorf("rootsDir.Create(%q): %v", name, err)
 		return nil, fuse.EIO
 	}
 
 	// Add a camliRoot attribute to the root permanode.
 	claim := schema.NewSetAttributeClaim(pr.BlobRef, "camliRoot", name)
-	_, err = n.fs.client.UploadAndSignBlob(claim)
+	_, err = n.fs.uploadClient().UploadAndSignBlob(claim)
 	if err != nil {
-		log.Printf("rootsDir.Create(%q): %v", name, err)
+		n.fs.errorf("rootsDir.Create(%q): %v", name, err)
 		return nil, fuse.EIO
 	}
 
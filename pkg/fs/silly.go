@@ -0,0 +1,130 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"strconv"
+	"time"
+
+	"camlistore.org/pkg/schema"
+)
+
+// sillyPrefix starts the names that files removed while open are
+// moved to, as NFS clients do, until their last handle is released.
+// Until then, their open handles keep working, as with unlink(2),
+// but their contents are no longer stored.
+const sillyPrefix = ".camli-silly-"
+
+// reserveSillyName returns an unused name for mf to be moved to, and
+// reserves it in n's children. n.mu must be held.
+func (n *mutDir) reserveSillyName(mf *mutFile) string {
+	if n.children == nil {
+		n.children = make(map[string]mutFileOrDir)
+	}
+	for i := 1; ; i++ {
+		name := sillyPrefix + strconv.Itoa(i)
+		if _, ok := n.children[name]; !ok {
+			n.children[name] = mf
+			n.childGen++
+			return name
+		}
+	}
+}
+
+// removeOpen removes mf, the child name of n, by moving it to a
+// silly name if it has open writable handles. It reports whether it
+// did; if not, mf wasn't open, and is to be removed as usual.
+func (n *mutDir) removeOpen(name string, mf *mutFile) (bool, error) {
+	mf.mu.Lock()
+	open := mf.backing != nil && !mf.unlinked
+	mf.mu.Unlock()
+	if !open {
+		return false, nil
+	}
+
+	n.mu.Lock()
+	silly := n.reserveSillyName(mf)
+	n.mu.Unlock()
+	unreserve := func() {
+		n.mu.Lock()
+		if n.children[silly] == mf {
+			delete(n.children, silly)
+			n.childGen++
+		}
+		n.mu.Unlock()
+	}
+
+	// Link the silly name before unlinking name, so a crash in
+	// between leaves the file linked twice rather than orphaned.
+	claim := schema.NewSetAttributeClaim(n.permanode, "camliPath:"+silly, mf.permanode.String())
+	if err := n.fs.uploadClaim(claim); err != nil {
+		unreserve()
+		return false, err
+	}
+	delClaim, _ := n.unlinkClaims(name, mf.permanode.String())
+	if err := n.fs.uploadClaim(delClaim); err != nil {
+		if err := n.fs.uploadClaim(schema.NewDelAttributeClaim(n.permanode, "camliPath:"+silly)); err != nil {
+			n.fs.errorf("mutDir.Remove(%q): unlinking %q after a failed remove: %v", name, silly, err)
+		}
+		unreserve()
+		return false, err
+	}
+
+	// The last handle may have been released during the uploads,
+	// before it could know to remove the silly name.
+	mf.mu.Lock()
+	open = mf.backing != nil && !mf.unlinked
+	if open {
+		mf.unlinked = true
+		mf.sillyDir, mf.sillyName = n, silly
+	}
+	mf.mu.Unlock()
+
+	n.mu.Lock()
+	if n.children[name] == mf {
+		delete(n.children, name)
+	}
+	n.childGen++
+	n.bury(name, mf)
+	n.mu.Unlock()
+	if !open {
+		n.removeSilly(silly, mf)
+		return true, nil
+	}
+	n.fs.infof("mutDir.Remove(%q): still open, moved to %q", name, silly)
+	return true, nil
+}
+
+// removeSilly removes the silly name of mf, once its last handle is
+// released.
+func (n *mutDir) removeSilly(silly string, mf *mutFile) {
+	claim := schema.NewDelAttributeClaim(n.permanode, "camliPath:"+silly)
+	if err := n.fs.uploadClaim(claim); err != nil {
+		n.fs.errorf("mutDir: removing %q: %v", silly, err)
+		return
+	}
+	n.mu.Lock()
+	if n.children[silly] == mf {
+		delete(n.children, silly)
+	}
+	n.childGen++
+	n.bury(silly, mf)
+	n.mu.Unlock()
+	n.touch(time.Now())
+}
@@ -0,0 +1,94 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestRemoveOpenFile(t *testing.T) {
+	_, fc, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "stored")
+	h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fh := h.(*mutFileHandle)
+	if err := fh.Write(&fuse.WriteRequest{Data: []byte("STORED, then written")}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := dir.Remove(&fuse.RemoveRequest{Name: "file"}, nil); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if got, want := pathAttrs(t, fc, dir.permanode), []string{"camliPath:" + sillyPrefix + "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("links while open = %q; want %q", got, want)
+	}
+	if _, err := dir.Lookup("file", nil); err != fuse.ENOENT {
+		t.Errorf("Lookup of removed file = %v; want ENOENT", err)
+	}
+
+	// The open handle still reads what was written.
+	res := &fuse.ReadResponse{}
+	if err := fh.Read(&fuse.ReadRequest{Size: 100}, res, nil); err != nil {
+		t.Fatalf("Read after Remove: %v", err)
+	}
+	if got := string(res.Data); got != "STORED, then written" {
+		t.Errorf("Read after Remove = %q; want the written contents", got)
+	}
+
+	signed := fc.signedCount()
+	if err := fh.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := pathAttrs(t, fc, dir.permanode); len(got) != 0 {
+		t.Errorf("links after the last Release = %q; want none", got)
+	}
+	if got := storedContents(t, mf); got != "stored" {
+		t.Errorf("stored contents after Release = %q; want them untouched", got)
+	}
+	// Unlinking the silly name and touching the directory.
+	if n := fc.signedCount() - signed; n != 2 {
+		t.Errorf("Release signed %d claims; want 2", n)
+	}
+
+	// A file that isn't open is just unlinked.
+	newFileWithContent(t, dir, "closed", "contents")
+	dir.mu.Lock()
+	gen := dir.childGen
+	dir.mu.Unlock()
+	if err := dir.Remove(&fuse.RemoveRequest{Name: "closed"}, nil); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	dir.mu.Lock()
+	if n := dir.childGen - gen; n != 1 {
+		t.Errorf("removing a closed file changed the directory %d times; want 1", n)
+	}
+	for name := range dir.children {
+		t.Errorf("child %q left after removing a closed file", name)
+	}
+	dir.mu.Unlock()
+	if got := pathAttrs(t, fc, dir.permanode); len(got) != 0 {
+		t.Errorf("links after removing a closed file = %q; want none", got)
+	}
+}
@@ -0,0 +1,67 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+	"testing"
+
+	"camlistore.org/pkg/blobref"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+type capacityFetcher struct {
+	blobref.SeekFetcher
+	total, free int64
+	err         error
+}
+
+func (f capacityFetcher) StorageCapacity() (total, free int64, err error) {
+	return f.total, f.free, f.err
+}
+
+func TestStatfs(t *testing.T) {
+	tests := []struct {
+		fetcher      blobref.SeekFetcher
+		blocks, free uint64
+	}{
+		{capacityFetcher{total: 10 << 20, free: 4 << 20}, 10 << 10, 4 << 10},
+		{capacityFetcher{err: errors.New("boom")}, 1 << 35, 1 << 34},
+		{capacityFetcher{}, 1 << 35, 1 << 34},
+		{nil, 1 << 35, 1 << 34},
+	}
+	for i, tt := range tests {
+		fs := newCamliFileSystem(tt.fetcher)
+		var res fuse.StatfsResponse
+		if err := fs.Statfs(nil, &res, nil); err != nil {
+			t.Fatalf("%d. Statfs: %v", i, err)
+		}
+		if res.Blocks != tt.blocks || res.Bfree != tt.free || res.Bavail != tt.free {
+			t.Errorf("%d. blocks, free, avail = %d, %d, %d; want %d, %d, %d",
+				i, res.Blocks, res.Bfree, res.Bavail, tt.blocks, tt.free, tt.free)
+		}
+		if res.Bsize == 0 || res.Frsize != res.Bsize {
+			t.Errorf("%d. Bsize, Frsize = %d, %d; want equal and non-zero", i, res.Bsize, res.Frsize)
+		}
+		if res.Files == 0 || res.Ffree == 0 {
+			t.Errorf("%d. Files, Ffree = %d, %d; want non-zero", i, res.Files, res.Ffree)
+		}
+	}
+}
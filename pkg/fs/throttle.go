@@ -0,0 +1,117 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/types"
+)
+
+// rateLimiter is a token bucket limiting the bytes per second passed
+// through it, shared by all the readers of a direction of a mount.
+// Up to a second's worth of bytes can pass at once after a pause.
+type rateLimiter struct {
+	rate float64 // bytes per second
+
+	mu     sync.Mutex
+	tokens float64 // bytes that can pass now; negative once reserved ahead
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n more bytes may pass. Callers are let through
+// in the order they called, each after the bytes of those before.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// throttledReader is an io.Reader limited by a rateLimiter.
+type throttledReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (tr throttledReader) Read(p []byte) (int, error) {
+	if max := int(tr.l.rate); max > 0 && len(p) > max {
+		// Don't let a large read take more than the burst.
+		p = p[:max]
+	}
+	n, err := tr.r.Read(p)
+	tr.l.wait(n)
+	return n, err
+}
+
+// throttledFetcher is a blobref.SeekFetcher whose blobs are read at
+// no more than its rateLimiter allows.
+type throttledFetcher struct {
+	blobref.SeekFetcher
+	l *rateLimiter
+}
+
+func (f *throttledFetcher) Fetch(br *blobref.BlobRef) (types.ReadSeekCloser, int64, error) {
+	rsc, size, err := f.SeekFetcher.Fetch(br)
+	if err != nil {
+		return rsc, size, err
+	}
+	return throttledReadSeekCloser{rsc, throttledReader{rsc, f.l}}, size, nil
+}
+
+type throttledReadSeekCloser struct {
+	types.ReadSeekCloser
+	tr throttledReader
+}
+
+func (t throttledReadSeekCloser) Read(p []byte) (int, error) { return t.tr.Read(p) }
+
+// uploadReader returns r, limited to UploadBytesPerSecond if set, to
+// read the contents of files being stored from.
+func (fs *CamliFileSystem) uploadReader(r io.Reader) io.Reader {
+	fs.uploadLimitOnce.Do(func() {
+		if fs.UploadBytesPerSecond > 0 {
+			fs.uploadLimit = newRateLimiter(fs.UploadBytesPerSecond)
+		}
+	})
+	if fs.uploadLimit == nil {
+		return r
+	}
+	return throttledReader{r, fs.uploadLimit}
+}
@@ -0,0 +1,85 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"math/rand"
+	"syscall"
+	"testing"
+	"time"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// checkRate fails t if n bytes passed in d, through a limit of rate
+// bytes per second with a second's worth of burst, exceed it.
+func checkRate(t *testing.T, what string, n int, d time.Duration, rate int64) {
+	min := time.Duration(float64(int64(n)-rate) / float64(rate) * float64(time.Second))
+	if d < min*95/100 {
+		t.Errorf("%s %d bytes at %d bytes/s in %v; want at least %v", what, n, rate, d, min)
+	}
+	t.Logf("%s %d bytes in %v: %.0f bytes/s past the burst", what, n, d, float64(int64(n)-rate)/d.Seconds())
+}
+
+func TestUploadRate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	const rate = 1 << 20
+	fs, _, dir := newFakeFS(t)
+	fs.UploadBytesPerSecond = rate
+	contents := make([]byte, 5*rate/2)
+	rand.New(rand.NewSource(1)).Read(contents)
+
+	node, h, err := dir.Create(&fuse.CreateRequest{Name: "file", Flags: syscall.O_WRONLY | syscall.O_CREAT, Mode: 0644}, &fuse.CreateResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	w := h.(*mutFileHandle)
+	if err := w.Write(&fuse.WriteRequest{Data: contents}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	start := time.Now()
+	if err := w.Release(&fuse.ReleaseRequest{}, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	checkRate(t, "uploaded", len(contents), time.Since(start), rate)
+	if got := storedContents(t, node.(*mutFile)); got != string(contents) {
+		t.Errorf("stored %d bytes differing from those written", len(got))
+	}
+}
+
+func TestDownloadRate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+	const rate = 1 << 20
+	_, mf := newCountingFS(t, 0, 5*rate/2)
+	mf.fs.DownloadBytesPerSecond = rate
+	want := make([]byte, 5*rate/2) // as newCountingFS writes
+	rand.New(rand.NewSource(1)).Read(want)
+
+	start := time.Now()
+	got := readFile(t, mf)
+	checkRate(t, "read", len(got), time.Since(start), rate)
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes differing from those written", len(got))
+	}
+}
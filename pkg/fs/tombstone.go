@@ -0,0 +1,88 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"time"
+
+	"camlistore.org/pkg/blobref"
+)
+
+// tombstoneTTL is how long a child removed from a mutable directory
+// is kept out of its listing while describes still show it, e.g.
+// from an index lagging behind the claim removing it.
+const tombstoneTTL = 1 * time.Minute
+
+// A tombstone records that a child was removed from a mutDir, so a
+// populate whose describe still lists it doesn't bring it back.
+// It's dropped once a describe no longer lists the child, a new
+// child is linked under its name, or it expires.
+type tombstone struct {
+	permanode *blobref.BlobRef // of the child removed
+	expires   time.Time
+}
+
+// bury leaves a tombstone for c, just removed from n as name.
+// n.mu must be held.
+func (n *mutDir) bury(name string, c mutFileOrDir) {
+	if c == nil {
+		return
+	}
+	if n.tombstones == nil {
+		n.tombstones = make(map[string]tombstone)
+	}
+	n.tombstones[name] = tombstone{
+		permanode: c.permanodeRef(),
+		expires:   time.Now().Add(tombstoneTTL),
+	}
+}
+
+// unbury drops the tombstone of name, as a child was linked under
+// it again. n.mu must be held.
+func (n *mutDir) unbury(name string) {
+	delete(n.tombstones, name)
+}
+
+// buried reports whether c, listed as n's child name by a describe
+// made at now, was removed since, and is to be left out. n.mu must be
+// held.
+func (n *mutDir) buried(name string, c mutFileOrDir, now time.Time) bool {
+	t, ok := n.tombstones[name]
+	if !ok {
+		return false
+	}
+	if now.After(t.expires) || !t.permanode.Equal(c.permanodeRef()) {
+		// Expired, or linked anew since, e.g. by another
+		// client.
+		delete(n.tombstones, name)
+		return false
+	}
+	return true
+}
+
+// pruneTombstones drops the tombstones of the names not in children,
+// as listed by a describe, which has caught up with their removal.
+// n.mu must be held.
+func (n *mutDir) pruneTombstones(children map[string]mutFileOrDir) {
+	for name := range n.tombstones {
+		if _, ok := children[name]; !ok {
+			delete(n.tombstones, name)
+		}
+	}
+}
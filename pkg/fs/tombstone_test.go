@@ -0,0 +1,113 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// repopulate makes dir describe its children again.
+func repopulate(t *testing.T, dir *mutDir) {
+	dir.mu.Lock()
+	dir.lastPop = time.Time{}
+	dir.mu.Unlock()
+	if err := dir.populate(); err != nil {
+		t.Fatalf("populate: %v", err)
+	}
+}
+
+func TestRemoveSurvivesLaggingIndex(t *testing.T) {
+	_, fc, dir := newFakeFS(t)
+	for _, name := range []string{"a", "b", "c"} {
+		newFileWithContent(t, dir, name, name)
+	}
+	repopulate(t, dir)
+
+	catchUp := fc.lagIndex()
+	fc.mu.Lock()
+	fc.describeDelay = 20 * time.Millisecond
+	fc.mu.Unlock()
+
+	// Remove while populates, whose describes don't see the
+	// removals yet, run.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			repopulate(t, dir)
+		}()
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := dir.Remove(&fuse.RemoveRequest{Name: name}, nil); err != nil {
+			t.Fatalf("Remove(%q): %v", name, err)
+		}
+	}
+	wg.Wait()
+	repopulate(t, dir)
+	for _, name := range []string{"a", "b"} {
+		if _, err := dir.Lookup(name, nil); err != fuse.ENOENT {
+			t.Errorf("Lookup(%q) after removing it = %v; want ENOENT", name, err)
+		}
+	}
+	if _, err := dir.Lookup("c", nil); err != nil {
+		t.Errorf("Lookup(c): %v", err)
+	}
+
+	// Linking a name again drops its tombstone.
+	newFileWithContent(t, dir, "b", "new b")
+	repopulate(t, dir)
+	if _, err := dir.Lookup("b", nil); err != nil {
+		t.Errorf("Lookup(b) after creating it again: %v", err)
+	}
+
+	// Once the index catches up, the tombstones go.
+	catchUp()
+	repopulate(t, dir)
+	dir.mu.Lock()
+	n := len(dir.tombstones)
+	dir.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d tombstones left after the index caught up; want 0", n)
+	}
+	if _, err := dir.Lookup("a", nil); err != fuse.ENOENT {
+		t.Errorf("Lookup(a) after the index caught up = %v; want ENOENT", err)
+	}
+}
+
+func TestTombstoneExpires(t *testing.T) {
+	_, fc, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "x")
+	fc.lagIndex()
+	if err := dir.Remove(&fuse.RemoveRequest{Name: "file"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	dir.mu.Lock()
+	if !dir.buried("file", mf, time.Now()) {
+		t.Error("removed file not buried")
+	}
+	if dir.buried("file", mf, time.Now().Add(2*tombstoneTTL)) {
+		t.Error("removed file still buried after its tombstone expired")
+	}
+	dir.mu.Unlock()
+}
@@ -0,0 +1,161 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/search"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// versionsSuffix is appended to a file's name to look up its
+// versionsDir, when CamliFileSystem.Versions is set.
+const versionsSuffix = ".versions"
+
+// versionLayout formats a version's name from the date of the claim
+// that set it. It sorts by date, and avoids characters file managers
+// dislike.
+const versionLayout = "2006-01-02T15.04.05.000000000Z"
+
+// agoPrefix starts the names looking up a version relative to the
+// current one: ~0 is the current contents, ~1 the previous ones, and
+// so on. They're not listed, and always look up the latest claims.
+const agoPrefix = "~"
+
+// versionsDir implements fuse.Node and is a read-only directory of
+// the past contents of a mutable file, taken from the camliContent
+// claims on its permanode.
+type versionsDir struct {
+	fs   *CamliFileSystem
+	file *mutFile
+
+	mu   sync.Mutex
+	ents map[string]*node // version name to its content; nil until read
+}
+
+func (n *versionsDir) Attr() fuse.Attr {
+	return fuse.Attr{
+		Mode: os.ModeDir | 0500,
+		Uid:  uint32(os.Getuid()),
+		Gid:  uint32(os.Getgid()),
+	}
+}
+
+// versions looks up the claims on n's file and returns its versions.
+func (n *versionsDir) versions() (map[string]*node, error) {
+	n.fs.uploadClaims()
+	res, err := n.fs.client.GetClaims(&search.ClaimsRequest{Permanode: n.file.permanode})
+	if err != nil {
+		return nil, err
+	}
+	ents := make(map[string]*node)
+	for _, cl := range res.Claims {
+		if cl.Type != string(schema.SetAttribute) || cl.Attr != "camliContent" {
+			continue
+		}
+		content := blobref.Parse(cl.Value)
+		if content == nil {
+			continue
+		}
+		date := time.Time(cl.Date).UTC()
+		name := date.Format(versionLayout)
+		for i := 2; ents[name] != nil; i++ {
+			name = fmt.Sprintf("%s-%d", date.Format(versionLayout), i)
+		}
+		ents[name] = &node{fs: n.fs, blobref: content, pnodeModTime: date}
+	}
+	return ents, nil
+}
+
+func (n *versionsDir) ReadDir(intr fuse.Intr) ([]fuse.Dirent, fuse.Error) {
+	ents, err := n.versions()
+	if err != nil {
+		n.fs.errorf("versionsDir(%q).ReadDir: %v", n.file.fullPath(), err)
+		return nil, fuse.EIO
+	}
+	n.mu.Lock()
+	n.ents = ents
+	n.mu.Unlock()
+	var dirents []fuse.Dirent
+	for name := range ents {
+		dirents = append(dirents, fuse.Dirent{Name: name, Type: fuse.DT_File})
+	}
+	return dirents, nil
+}
+
+func (n *versionsDir) Lookup(name string, intr fuse.Intr) (fuse.Node, fuse.Error) {
+	if strings.HasPrefix(name, agoPrefix) {
+		return n.lookupAgo(name)
+	}
+	n.mu.Lock()
+	ents := n.ents
+	n.mu.Unlock()
+	if ents[name] == nil {
+		// Not listed yet, or a version added since.
+		var err error
+		if ents, err = n.versions(); err != nil {
+			n.fs.errorf("versionsDir(%q).Lookup: %v", n.file.fullPath(), err)
+			return nil, fuse.EIO
+		}
+		n.mu.Lock()
+		n.ents = ents
+		n.mu.Unlock()
+	}
+	if ver := ents[name]; ver != nil {
+		return ver, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+// lookupAgo looks up name, the agoPrefix and a number of versions
+// before the current one.
+func (n *versionsDir) lookupAgo(name string) (fuse.Node, fuse.Error) {
+	ago, err := strconv.Atoi(name[len(agoPrefix):])
+	if err != nil || ago < 0 || name != agoPrefix+strconv.Itoa(ago) {
+		return nil, fuse.ENOENT
+	}
+	ents, err := n.versions()
+	if err != nil {
+		n.fs.errorf("versionsDir(%q).Lookup: %v", n.file.fullPath(), err)
+		return nil, fuse.EIO
+	}
+	n.mu.Lock()
+	n.ents = ents
+	n.mu.Unlock()
+	if ago >= len(ents) {
+		return nil, fuse.ENOENT
+	}
+	// Version names sort by date.
+	names := make([]string, 0, len(ents))
+	for name := range ents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return ents[names[len(names)-1-ago]], nil
+}
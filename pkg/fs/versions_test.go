@@ -0,0 +1,166 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"camlistore.org/pkg/schema"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func TestVersions(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file.txt", "one")
+	for _, contents := range []string{"two", "three"} {
+		br, err := schema.WriteFileFromReader(fs.client, "file.txt", strings.NewReader(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mf.setContent(br, int64(len(contents))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := dir.Lookup("file.txt.versions", nil); err != fuse.ENOENT {
+		t.Fatalf("Lookup of versions with Versions unset = %v; want ENOENT", err)
+	}
+	fs.Versions = true
+	if _, err := dir.Lookup("nope.versions", nil); err != fuse.ENOENT {
+		t.Errorf("Lookup of versions of missing file = %v; want ENOENT", err)
+	}
+	vnode, err := dir.Lookup("file.txt.versions", nil)
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	vdir := vnode.(*versionsDir)
+	if !vdir.Attr().Mode.IsDir() {
+		t.Errorf("versions mode = %v; want a directory", vdir.Attr().Mode)
+	}
+	ents, err := vdir.ReadDir(nil)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var got []string
+	for _, ent := range ents {
+		vn, err := vdir.Lookup(ent.Name, nil)
+		if err != nil {
+			t.Fatalf("Lookup(%q): %v", ent.Name, err)
+		}
+		h, err := vn.(*node).Open(&fuse.OpenRequest{}, &fuse.OpenResponse{}, nil)
+		if err != nil {
+			t.Fatalf("Open(%q): %v", ent.Name, err)
+		}
+		var res fuse.ReadResponse
+		if err := h.(*nodeReader).Read(&fuse.ReadRequest{Size: 100}, &res, nil); err != nil {
+			t.Fatalf("Read(%q): %v", ent.Name, err)
+		}
+		h.(*nodeReader).Release(nil, nil)
+		got = append(got, string(res.Data))
+	}
+	sort.Strings(got)
+	if want := []string{"one", "three", "two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("versions = %q; want %q", got, want)
+	}
+
+	// Versions aren't listed with the directory.
+	dents, err := dir.ReadDir(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ent := range dents {
+		if strings.HasSuffix(ent.Name, versionsSuffix) {
+			t.Errorf("ReadDir listed %q", ent.Name)
+		}
+	}
+	if _, err := vdir.Lookup("1999-01-01T00.00.00.000000000Z", nil); err != fuse.ENOENT {
+		t.Errorf("Lookup of missing version = %v; want ENOENT", err)
+	}
+}
+
+func TestVersionsAgo(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	fs.Versions = true
+	mf := newFileWithContent(t, dir, "file.txt", "one")
+	vnode, err := dir.Lookup("file.txt.versions", nil)
+	if err != nil {
+		t.Fatalf("Lookup: %v", err)
+	}
+	vdir := vnode.(*versionsDir)
+
+	read := func(name string) string {
+		vn, err := vdir.Lookup(name, nil)
+		if err != nil {
+			t.Fatalf("Lookup(%q): %v", name, err)
+		}
+		h, err := vn.(*node).Open(&fuse.OpenRequest{}, &fuse.OpenResponse{}, nil)
+		if err != nil {
+			t.Fatalf("Open(%q): %v", name, err)
+		}
+		defer h.(*nodeReader).Release(nil, nil)
+		var res fuse.ReadResponse
+		if err := h.(*nodeReader).Read(&fuse.ReadRequest{Size: 100}, &res, nil); err != nil {
+			t.Fatalf("Read(%q): %v", name, err)
+		}
+		return string(res.Data)
+	}
+	if got := read("~0"); got != "one" {
+		t.Errorf("~0 = %q; want %q", got, "one")
+	}
+
+	// Looked up again each time, so the same name follows
+	// the file's changes.
+	for _, contents := range []string{"two", "three"} {
+		br, err := schema.WriteFileFromReader(fs.client, "file.txt", strings.NewReader(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mf.setContent(br, int64(len(contents))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{"~0": "three", "~1": "two", "~2": "one"} {
+		if got := read(name); got != want {
+			t.Errorf("%s = %q; want %q", name, got, want)
+		}
+	}
+	for _, name := range []string{"~3", "~-1", "~01", "~", "~x"} {
+		if _, err := vdir.Lookup(name, nil); err != fuse.ENOENT {
+			t.Errorf("Lookup(%q) = %v; want ENOENT", name, err)
+		}
+	}
+
+	// They're not listed.
+	ents, err := vdir.ReadDir(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 3 {
+		t.Errorf("listed %d versions; want 3", len(ents))
+	}
+	for _, ent := range ents {
+		if strings.HasPrefix(ent.Name, agoPrefix) {
+			t.Errorf("ReadDir listed %q", ent.Name)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"sync"
+	"time"
+)
+
+// writeBehind tracks, for a shared temporary file, the writes not
+// yet stored, to store them in the background per
+// CamliFileSystem.WriteBehindBytes and WriteBehindInterval.
+type writeBehind struct {
+	mu      sync.Mutex
+	dirty   int64       // bytes written since the last store began
+	timer   *time.Timer // pending store after WriteBehindInterval, or nil
+	storing bool        // a background store is running
+	stopped bool        // the file was released
+}
+
+// wrote records that nb bytes were written to b, and starts or
+// schedules a background store of b's contents if they are due.
+func (n *mutFile) wrote(b *sharedBacking, nb int) {
+	if n.fs.WriteBehindBytes <= 0 && n.fs.WriteBehindInterval <= 0 {
+		return
+	}
+	w := &b.wb
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dirty += int64(nb)
+	n.scheduleStore(b)
+}
+
+// scheduleStore starts a background store of b if enough bytes are
+// unstored, or else arranges for one after WriteBehindInterval.
+// b.wb.mu must be held.
+func (n *mutFile) scheduleStore(b *sharedBacking) {
+	w := &b.wb
+	if w.storing || w.stopped || w.dirty == 0 {
+		return
+	}
+	if max := n.fs.WriteBehindBytes; max > 0 && w.dirty >= max {
+		n.startStore(b)
+		return
+	}
+	if d := n.fs.WriteBehindInterval; d > 0 && w.timer == nil {
+		w.timer = time.AfterFunc(d, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.timer = nil
+			if !w.storing && !w.stopped {
+				n.startStore(b)
+			}
+		})
+	}
+}
+
+// startStore stores b's contents in the background, so they survive
+// a crash before the file is released. b.wb.mu must be held.
+func (n *mutFile) startStore(b *sharedBacking) {
+	w := &b.wb
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.storing = true
+	w.dirty = 0
+	mutFileWriteBehind.Incr()
+	go func() {
+		if err := n.store(b); err != nil {
+			n.fs.warnf("mutFile(%q): write-behind: %v", n.fullPath(), err)
+		}
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.storing = false
+		n.scheduleStore(b)
+	}()
+}
+
+// stop cancels any scheduled store, once the file is released.
+func (w *writeBehind) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
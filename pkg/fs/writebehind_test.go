@@ -0,0 +1,113 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// waitStored waits for at least n bytes of mf's contents to be
+// stored, and returns them.
+func waitStored(t *testing.T, mf *mutFile, n int) string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := storedContents(t, mf)
+		if len(got) >= n {
+			return got
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stored %d bytes after 5s; want at least %d", len(got), n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWriteBehindCrash(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	fs.WriteBehindBytes = 1000
+	mf := newFileWithContent(t, dir, "file", "")
+	h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fh := h.(*mutFileHandle)
+	contents := strings.Repeat("0123456789", 150)
+	for off := 0; off < len(contents); off += 500 {
+		req := &fuse.WriteRequest{Offset: int64(off), Data: []byte(contents[off : off+500])}
+		if err := fh.Write(req, &fuse.WriteResponse{}, nil); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if off == 0 {
+			if got := storedContents(t, mf); got != "" {
+				t.Errorf("stored %d bytes before reaching WriteBehindBytes; want 0", len(got))
+			}
+		}
+	}
+	waitStored(t, mf, 1000)
+
+	// Crash: the handle is never released. A new mount sees
+	// what was stored so far.
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	node, err := cold.Lookup("file", nil)
+	if err != nil {
+		t.Fatalf("Lookup after crash: %v", err)
+	}
+	got := storedContents(t, node.(*mutFile))
+	if len(got) < 1000 || !strings.HasPrefix(contents, got) {
+		t.Errorf("contents after crash = %d bytes; want a prefix of the written data of at least 1000 bytes", len(got))
+	}
+
+	if err := fh.Release(nil, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if got := storedContents(t, mf); got != contents {
+		t.Errorf("stored %d bytes after Release; want all %d", len(got), len(contents))
+	}
+}
+
+func TestWriteBehindInterval(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	fs.WriteBehindInterval = 20 * time.Millisecond
+	mf := newFileWithContent(t, dir, "file", "")
+	h, err := mf.Open(&fuse.OpenRequest{Flags: syscall.O_RDWR}, &fuse.OpenResponse{}, nil)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	fh := h.(*mutFileHandle)
+	if err := fh.Write(&fuse.WriteRequest{Data: []byte("hello")}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := waitStored(t, mf, 5); got != "hello" {
+		t.Errorf("stored %q; want %q", got, "hello")
+	}
+	if err := fh.Write(&fuse.WriteRequest{Offset: 5, Data: []byte(", world")}, &fuse.WriteResponse{}, nil); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if got := waitStored(t, mf, 12); got != "hello, world" {
+		t.Errorf("stored %q; want %q", got, "hello, world")
+	}
+	if err := fh.Release(nil, nil); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+}
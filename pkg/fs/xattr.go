@@ -0,0 +1,218 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/base64"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/schema"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+// xattrPrefix is the prefix of the permanode attributes holding a
+// mutable node's extended attributes. Values are base64-encoded, as
+// extended attributes may be binary.
+const xattrPrefix = "camliXattr:"
+
+// Flags of setxattr(2).
+const (
+	xattrCreate  = 1 // fail if the attribute exists
+	xattrReplace = 2 // fail if the attribute doesn't exist
+)
+
+// xattrsFromAttrs returns the extended attributes stored in a
+// permanode's attributes. It never returns nil.
+func xattrsFromAttrs(attrs url.Values) map[string][]byte {
+	m := make(map[string][]byte)
+	for k, v := range attrs {
+		if !strings.HasPrefix(k, xattrPrefix) || len(v) < 1 {
+			continue
+		}
+		val, err := base64.StdEncoding.DecodeString(v[0])
+		if err != nil {
+			log.Printf("fs: bad %s attribute value %q: %v", k, v[0], err)
+			continue
+		}
+		m[k[len(xattrPrefix):]] = val
+	}
+	return m
+}
+
+// xattr implements the extended attribute methods of a mutable
+// node, whose mu guards its xattrs map.
+type xattr struct {
+	typeName  string // for logging
+	fs        *CamliFileSystem
+	permanode *blobref.BlobRef
+	mu        *sync.Mutex
+	xattrs    *map[string][]byte
+}
+
+func (x *xattr) getxattr(req *fuse.GetxattrRequest, res *fuse.GetxattrResponse) fuse.Error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	val, ok := (*x.xattrs)[req.Name]
+	if !ok {
+		return fuse.ENOATTR
+	}
+	res.Xattr = val
+	return nil
+}
+
+func (x *xattr) listxattr(req *fuse.ListxattrRequest, res *fuse.ListxattrResponse) fuse.Error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var names []string
+	for name := range *x.xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	res.Append(names...)
+	return nil
+}
+
+func (x *xattr) setxattr(req *fuse.SetxattrRequest) fuse.Error {
+	if x.fs.readOnly() {
+		return fuse.EPERM
+	}
+	x.mu.Lock()
+	_, exists := (*x.xattrs)[req.Name]
+	x.mu.Unlock()
+	if exists && req.Flags&xattrCreate != 0 {
+		return fuse.Errno(syscall.EEXIST)
+	}
+	if !exists && req.Flags&xattrReplace != 0 {
+		return fuse.ENOATTR
+	}
+
+	claim := schema.NewSetAttributeClaim(x.permanode, xattrPrefix+req.Name,
+		base64.StdEncoding.EncodeToString(req.Xattr))
+	if err := x.fs.uploadClaim(claim); err != nil {
+		x.fs.errorf("%s.Setxattr(%q): %v", x.typeName, req.Name, err)
+		return x.fs.uploadError(err)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if *x.xattrs == nil {
+		*x.xattrs = make(map[string][]byte)
+	}
+	(*x.xattrs)[req.Name] = append([]byte(nil), req.Xattr...)
+	return nil
+}
+
+func (x *xattr) removexattr(req *fuse.RemovexattrRequest) fuse.Error {
+	if x.fs.readOnly() {
+		return fuse.EPERM
+	}
+	x.mu.Lock()
+	_, exists := (*x.xattrs)[req.Name]
+	x.mu.Unlock()
+	if !exists {
+		return fuse.ENOATTR
+	}
+
+	claim := schema.NewDelAttributeClaim(x.permanode, xattrPrefix+req.Name)
+	if err := x.fs.uploadClaim(claim); err != nil {
+		x.fs.errorf("%s.Removexattr(%q): %v", x.typeName, req.Name, err)
+		return x.fs.uploadError(err)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(*x.xattrs, req.Name)
+	return nil
+}
+
+func (n *mutDir) xattr() *xattr {
+	return &xattr{"mutDir", n.fs, n.permanode, &n.mu, &n.xattrs}
+}
+
+// loadXattrs populates n if its extended attributes aren't known
+// yet, which is only the case for the top mutable directories.
+// Subdirectories get theirs from their parent's populate.
+func (n *mutDir) loadXattrs(intr fuse.Intr) fuse.Error {
+	n.mu.Lock()
+	known := n.xattrs != nil
+	n.mu.Unlock()
+	if known {
+		return nil
+	}
+	if err := n.populateIntr(intr); err != nil {
+		n.fs.errorf("populate: %v", err)
+		return populateError(err)
+	}
+	return nil
+}
+
+func (n *mutDir) Getxattr(req *fuse.GetxattrRequest, res *fuse.GetxattrResponse, intr fuse.Intr) fuse.Error {
+	if err := n.loadXattrs(intr); err != nil {
+		return err
+	}
+	return n.xattr().getxattr(req, res)
+}
+
+func (n *mutDir) Listxattr(req *fuse.ListxattrRequest, res *fuse.ListxattrResponse, intr fuse.Intr) fuse.Error {
+	if err := n.loadXattrs(intr); err != nil {
+		return err
+	}
+	return n.xattr().listxattr(req, res)
+}
+
+func (n *mutDir) Setxattr(req *fuse.SetxattrRequest, intr fuse.Intr) fuse.Error {
+	if err := n.loadXattrs(intr); err != nil {
+		return err
+	}
+	return n.xattr().setxattr(req)
+}
+
+func (n *mutDir) Removexattr(req *fuse.RemovexattrRequest, intr fuse.Intr) fuse.Error {
+	if err := n.loadXattrs(intr); err != nil {
+		return err
+	}
+	return n.xattr().removexattr(req)
+}
+
+func (n *mutFile) xattr() *xattr {
+	return &xattr{"mutFile", n.fs, n.permanode, &n.mu, &n.xattrs}
+}
+
+func (n *mutFile) Getxattr(req *fuse.GetxattrRequest, res *fuse.GetxattrResponse, intr fuse.Intr) fuse.Error {
+	return n.xattr().getxattr(req, res)
+}
+
+func (n *mutFile) Listxattr(req *fuse.ListxattrRequest, res *fuse.ListxattrResponse, intr fuse.Intr) fuse.Error {
+	return n.xattr().listxattr(req, res)
+}
+
+func (n *mutFile) Setxattr(req *fuse.SetxattrRequest, intr fuse.Intr) fuse.Error {
+	return n.xattr().setxattr(req)
+}
+
+func (n *mutFile) Removexattr(req *fuse.RemovexattrRequest, intr fuse.Intr) fuse.Error {
+	return n.xattr().removexattr(req)
+}
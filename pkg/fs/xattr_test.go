@@ -0,0 +1,108 @@
+// +build linux darwin
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+
+	"camlistore.org/third_party/code.google.com/p/rsc/fuse"
+)
+
+func getxattr(t *testing.T, n interface {
+	Getxattr(*fuse.GetxattrRequest, *fuse.GetxattrResponse, fuse.Intr) fuse.Error
+}, name string) (string, fuse.Error) {
+	var res fuse.GetxattrResponse
+	err := n.Getxattr(&fuse.GetxattrRequest{Name: name}, &res, nil)
+	return string(res.Xattr), err
+}
+
+func TestXattrs(t *testing.T) {
+	fs, _, dir := newFakeFS(t)
+	mf := newFileWithContent(t, dir, "file", "contents")
+	sub, cerr := dir.creat("sub", dirType)
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	const binary = "\x00\xff\x80 bytes"
+	sets := []struct {
+		n interface {
+			Setxattr(*fuse.SetxattrRequest, fuse.Intr) fuse.Error
+		}
+		name, val string
+	}{
+		{mf, "user.rating", "5"},
+		{mf, "user.blob", binary},
+		{mf, "user.gone", "soon"},
+		{sub.(*mutDir), "user.tag", "vacation"},
+	}
+	for _, s := range sets {
+		req := &fuse.SetxattrRequest{Name: s.name, Xattr: []byte(s.val)}
+		if err := s.n.Setxattr(req, nil); err != nil {
+			t.Fatalf("Setxattr(%q): %v", s.name, err)
+		}
+	}
+	if err := mf.Removexattr(&fuse.RemovexattrRequest{Name: "user.gone"}, nil); err != nil {
+		t.Fatalf("Removexattr: %v", err)
+	}
+	if err := mf.Removexattr(&fuse.RemovexattrRequest{Name: "user.gone"}, nil); err != fuse.ENOATTR {
+		t.Errorf("second Removexattr = %v; want ENOATTR", err)
+	}
+	err := mf.Setxattr(&fuse.SetxattrRequest{Name: "user.rating", Xattr: []byte("1"), Flags: xattrCreate}, nil)
+	if err != fuse.Errno(syscall.EEXIST) {
+		t.Errorf("Setxattr with XATTR_CREATE on existing attribute = %v; want EEXIST", err)
+	}
+	err = mf.Setxattr(&fuse.SetxattrRequest{Name: "user.new", Xattr: []byte("1"), Flags: xattrReplace}, nil)
+	if err != fuse.ENOATTR {
+		t.Errorf("Setxattr with XATTR_REPLACE on missing attribute = %v; want ENOATTR", err)
+	}
+
+	// A fresh tree on the same permanode, as if remounted.
+	cold := &mutDir{fs: fs, permanode: dir.permanode, name: "cold"}
+	node, ferr := cold.Lookup("file", nil)
+	if ferr != nil {
+		t.Fatalf("Lookup: %v", ferr)
+	}
+	cf := node.(*mutFile)
+	for _, n := range []*mutFile{mf, cf} {
+		if v, err := getxattr(t, n, "user.rating"); err != nil || v != "5" {
+			t.Errorf("user.rating = %q, %v; want 5", v, err)
+		}
+		if v, err := getxattr(t, n, "user.blob"); err != nil || v != binary {
+			t.Errorf("user.blob = %q, %v; want %q", v, err, binary)
+		}
+		if _, err := getxattr(t, n, "user.gone"); err != fuse.ENOATTR {
+			t.Errorf("removed attribute error = %v; want ENOATTR", err)
+		}
+		var res fuse.ListxattrResponse
+		if err := n.Listxattr(&fuse.ListxattrRequest{}, &res, nil); err != nil {
+			t.Fatalf("Listxattr: %v", err)
+		}
+		if got, want := string(res.Xattr), "user.blob\x00user.rating\x00"; got != want {
+			t.Errorf("Listxattr = %q; want %q", got, want)
+		}
+	}
+	node, ferr = cold.Lookup("sub", nil)
+	if ferr != nil {
+		t.Fatalf("Lookup: %v", ferr)
+	}
+	if v, err := getxattr(t, node.(*mutDir), "user.tag"); err != nil || v != "vacation" {
+		t.Errorf("dir user.tag = %q, %v; want vacation", v, err)
+	}
+}
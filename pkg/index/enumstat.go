@@ -27,7 +27,7 @@ import (
 
 func (ix *Index) EnumerateBlobs(dest chan<- blobref.SizedBlobRef, after string, limit int, wait time.Duration) error {
 	defer close(dest)
-	it := ix.s.Find("have:" + after)
+	it := ix.s.Find("have:"+after, PrefixEnd("have:"))
 	n := int(0)
 	for n < limit && it.Next() {
 		k := it.Key()
@@ -0,0 +1,93 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/types"
+
+	"camlistore.org/third_party/github.com/camlistore/goexif/exif"
+	"camlistore.org/third_party/github.com/camlistore/goexif/tiff"
+)
+
+// indexEXIF adds the rows derived from the EXIF data of the image
+// file fileRef, whose first bytes are head: its capture time and
+// GPS position, if it has them.
+func indexEXIF(fileRef *blobref.BlobRef, head []byte, bm BatchMutation) {
+	ex, err := exif.Decode(bytes.NewReader(head))
+	if err != nil {
+		return
+	}
+	if ct, err := ex.DateTime(); err == nil {
+		bm.Set(keyEXIFTime.Key(types.Time3339(ct).String(), fileRef), "1")
+	}
+	if lat, long, err := exifLatLong(ex); err == nil {
+		bm.Set(keyEXIFGPS.Key(fileRef), keyEXIFGPS.Val(fmt.Sprintf("%.7f", lat), fmt.Sprintf("%.7f", long)))
+	}
+}
+
+var errNoGPS = errors.New("index: no GPS position in EXIF")
+
+// exifLatLong returns the position in ex's GPS fields, in decimal
+// degrees, negative for south and west.
+func exifLatLong(ex *exif.Exif) (lat, long float64, err error) {
+	lat, err = exifDegrees(ex, "GPSLatitude", "GPSLatitudeRef", "S")
+	if err != nil {
+		return
+	}
+	long, err = exifDegrees(ex, "GPSLongitude", "GPSLongitudeRef", "W")
+	if err != nil {
+		return
+	}
+	if lat < -90 || lat > 90 || long < -180 || long > 180 {
+		return 0, 0, fmt.Errorf("index: bogus EXIF GPS position %v,%v", lat, long)
+	}
+	return lat, long, nil
+}
+
+// exifDegrees returns the degrees, minutes and seconds in field as
+// decimal degrees, negated if refField is negRef.
+func exifDegrees(ex *exif.Exif, field, refField exif.FieldName, negRef string) (float64, error) {
+	tag, err := ex.Get(field)
+	if err != nil {
+		return 0, errNoGPS
+	}
+	ref, err := ex.Get(refField)
+	if err != nil {
+		return 0, errNoGPS
+	}
+	if tag.Format() != tiff.RatVal || tag.Ncomp != 3 {
+		return 0, fmt.Errorf("index: bogus EXIF %s %v", field, tag)
+	}
+	var deg float64
+	for i, unit := range []float64{1, 60, 3600} {
+		num, den := tag.Rat2(i)
+		if den == 0 {
+			return 0, fmt.Errorf("index: bogus EXIF %s %v", field, tag)
+		}
+		deg += float64(num) / float64(den) / unit
+	}
+	if strings.TrimRight(string(ref.Val), "\x00") == negRef {
+		deg = -deg
+	}
+	return deg, nil
+}
@@ -49,13 +49,32 @@ type Storage interface {
 	CommitBatch(b BatchMutation) error
 
 	// Find returns an iterator positioned before the first key/value pair
-	// whose key is 'greater than or equal to' the given key. There may be no
-	// such pair, in which case the iterator will return false on Next.
+	// whose key is 'greater than or equal to' the given start key. There may
+	// be no such pair, in which case the iterator will return false on Next.
+	//
+	// The end key is the exclusive upper bound of the iteration. If it is
+	// the empty string, the iteration continues to the last key.
 	//
 	// Any error encountered will be implicitly returned via the iterator. An
 	// error-iterator will yield no key/value pairs and closing that iterator
 	// will return that error.
-	Find(key string) Iterator
+	Find(start, end string) Iterator
+}
+
+// Checker is implemented by Storage implementations that can verify
+// their backend is usable, e.g. before a server starts serving queries.
+type Checker interface {
+	// Check returns a descriptive error if the backend is unreachable
+	// or not at the expected schema version.
+	Check() error
+}
+
+// Check runs s's Check method if s is a Checker. Otherwise it returns nil.
+func Check(s Storage) error {
+	if c, ok := s.(Checker); ok {
+		return c.Check()
+	}
+	return nil
 }
 
 // Iterator iterates over an index Storage's key/value pairs in key order.
@@ -177,10 +196,24 @@ func (x *Index) queryPrefix(key *keyType, args ...interface{}) *prefixIter {
 func (x *Index) queryPrefixString(prefix string) *prefixIter {
 	return &prefixIter{
 		prefix:   prefix,
-		Iterator: x.s.Find(prefix),
+		Iterator: x.s.Find(prefix, PrefixEnd(prefix)),
 	}
 }
 
+// PrefixEnd returns the smallest key greater than all the keys
+// starting with prefix, for use as the end of a Find over them. It
+// returns the empty string, meaning no bound, if there is none.
+func PrefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
 func closeIterator(it Iterator, perr *error) {
 	err := it.Close()
 	if err != nil && *perr == nil {
@@ -302,6 +335,56 @@ func (x *Index) GetOwnerClaims(permaNode, owner *blobref.BlobRef) (cl search.Cla
 	return
 }
 
+// claimTimeFormat is the layout of the dates of keyClaimTime keys:
+// RFC 3339 in UTC, with all nine fractional digits, so that the keys
+// sort by date.
+const claimTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+func claimTimeString(t time.Time) string {
+	return t.UTC().Format(claimTimeFormat)
+}
+
+// EnumerateSince sends dest the claims modifying permanodes dated at
+// or after since, in date order, e.g. for a sync tool to pick up the
+// changes made after those it last saw. It closes dest before
+// returning.
+//
+// The claims are found by their claimtime rows, which indexes made
+// before those rows existed lack; the SQL backends' schema versions
+// were bumped for them, so such an index must be rebuilt first.
+func (x *Index) EnumerateSince(dest chan<- *search.Claim, since time.Time) (err error) {
+	defer close(dest)
+	prefix := keyClaimTime.Prefix()
+	it := &prefixIter{
+		prefix:   prefix,
+		Iterator: x.s.Find(prefix+claimTimeString(since), PrefixEnd(prefix)),
+	}
+	defer closeIterator(it, &err)
+	for it.Next() {
+		keyPart := strings.Split(it.Key(), "|")
+		valPart := strings.Split(it.Value(), "|")
+		if len(keyPart) != 3 || len(valPart) != 5 {
+			continue
+		}
+		date, perr := time.Parse(claimTimeFormat, keyPart[1])
+		claimRef := blobref.Parse(keyPart[2])
+		permaNode := blobref.Parse(valPart[0])
+		if perr != nil || claimRef == nil || permaNode == nil {
+			continue
+		}
+		dest <- &search.Claim{
+			BlobRef:   claimRef,
+			Signer:    blobref.Parse(valPart[1]),
+			Permanode: permaNode,
+			Date:      date,
+			Type:      urld(valPart[2]),
+			Attr:      urld(valPart[3]),
+			Value:     urld(valPart[4]),
+		}
+	}
+	return
+}
+
 func (x *Index) GetBlobMIMEType(blob *blobref.BlobRef) (mime string, size int64, err error) {
 	key := "meta:" + blob.String()
 	meta, err := x.s.Get(key)
@@ -628,9 +711,40 @@ func (x *Index) GetImageInfo(fileRef *blobref.BlobRef) (*search.ImageInfo, error
 		Width:  width,
 		Height: height,
 	}
+	loc, err := x.getImageLocation(fileRef)
+	if err != nil {
+		return nil, err
+	}
+	imgInfo.Location = loc
 	return imgInfo, nil
 }
 
+// getImageLocation returns the EXIF GPS position of the image file
+// fileRef, or nil if it has none.
+func (x *Index) getImageLocation(fileRef *blobref.BlobRef) (*search.Location, error) {
+	key := keyEXIFGPS.Key(fileRef)
+	v, err := x.s.Get(key)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	valPart := strings.Split(v, "|")
+	if len(valPart) != 2 {
+		return nil, fmt.Errorf("index: bogus key %q = %q", key, v)
+	}
+	lat, err := strconv.ParseFloat(valPart[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("index: bogus latitude in key %q: %q", key, valPart[0])
+	}
+	long, err := strconv.ParseFloat(valPart[1], 64)
+	if err != nil {
+		return nil, fmt.Errorf("index: bogus longitude in key %q: %q", key, valPart[1])
+	}
+	return &search.Location{Latitude: lat, Longitude: long}, nil
+}
+
 func (x *Index) EdgesTo(ref *blobref.BlobRef, opts *search.EdgesToOpts) (edges []*search.Edge, err error) {
 	it := x.queryPrefix(keyEdgeBackward, ref)
 	defer closeIterator(it, &err)
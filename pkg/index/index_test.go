@@ -59,6 +59,71 @@ func TestEdgesTo_Memory(t *testing.T) {
 	indextest.EdgesTo(t, index.NewMemoryIndex)
 }
 
+func TestFind_Memory(t *testing.T) {
+	indextest.Find(t, index.NewMemoryIndex)
+}
+
+func TestClaimsSince_Memory(t *testing.T) {
+	indextest.ClaimsSince(t, index.NewMemoryIndex)
+}
+
+// newLimitedMemoryIndex returns a memory index whose key limit is
+// too high for the indextest tests to reach.
+func newLimitedMemoryIndex() *index.Index {
+	return index.New(index.NewMemoryStorageLimit(1 << 20))
+}
+
+func TestIndex_MemoryLimit(t *testing.T) {
+	indextest.Index(t, newLimitedMemoryIndex)
+}
+
+func TestPathsOfSignerTarget_MemoryLimit(t *testing.T) {
+	indextest.PathsOfSignerTarget(t, newLimitedMemoryIndex)
+}
+
+func TestFiles_MemoryLimit(t *testing.T) {
+	indextest.Files(t, newLimitedMemoryIndex)
+}
+
+func TestEdgesTo_MemoryLimit(t *testing.T) {
+	indextest.EdgesTo(t, newLimitedMemoryIndex)
+}
+
+func TestClaimsSince_MemoryLimit(t *testing.T) {
+	indextest.ClaimsSince(t, newLimitedMemoryIndex)
+}
+
+func TestMemoryStorageLimit(t *testing.T) {
+	s := index.NewMemoryStorageLimit(3)
+	for _, k := range []string{"a", "b", "c"} {
+		if err := s.Set(k, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rewriting a makes b the oldest.
+	if err := s.Set("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	bm := s.BeginBatch()
+	bm.Set("d", "1")
+	bm.Delete("c")
+	bm.Set("e", "1")
+	if err := s.CommitBatch(bm); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	it := s.Find("", "")
+	for it.Next() {
+		keys = append(keys, it.Key()+"="+it.Value())
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(keys, " "), "a=2 d=1 e=1"; got != want {
+		t.Errorf("rows = %q; want %q", got, want)
+	}
+}
+
 var (
 	// those dirs are not packages implementing indexers,
 	// hence we do not want to check them.
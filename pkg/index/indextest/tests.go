@@ -71,7 +71,7 @@ func (id *IndexDeps) Get(key string) string {
 
 func (id *IndexDeps) dumpIndex(t *testing.T) {
 	t.Logf("Begin index dump:")
-	it := id.Index.Storage().Find("")
+	it := id.Index.Storage().Find("", "")
 	for it.Next() {
 		t.Logf("  %q = %q", it.Key(), it.Value())
 	}
@@ -265,6 +265,7 @@ func Index(t *testing.T, initIdx func() *index.Index) {
 	// Upload a basic image.
 	var jpegFileRef *blobref.BlobRef
 	var exifFileRef *blobref.BlobRef
+	var gpsFileRef *blobref.BlobRef
 	{
 		camliRootPath, err := osutil.GoPackagePath("camlistore.org")
 		if err != nil {
@@ -281,6 +282,14 @@ func Index(t *testing.T, initIdx func() *index.Index) {
 		}
 		jpegFileRef = uploadFile("dude.jpg", noTime)
 		exifFileRef = uploadFile("dude-exif.jpg", time.Unix(1361248796, 0))
+
+		// An image with GPS EXIF fields.
+		gpsName := filepath.Join(camliRootPath, "third_party", "github.com", "camlistore", "goexif", "exif", "sample1.jpg")
+		contents, err := ioutil.ReadFile(gpsName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gpsFileRef, _ = id.UploadFile("sample1.jpg", string(contents), noTime)
 	}
 
 	lastPermanodeMutation := id.lastTime()
@@ -305,6 +314,42 @@ func Index(t *testing.T, initIdx func() *index.Index) {
 		t.Errorf("EXIF dude-exif.jpg key %q = %q; want %q", key, g, e)
 	}
 
+	key = "exiftime|2013-02-18T01:11:20Z|" + exifFileRef.String()
+	if g, e := id.Get(key), "1"; g != e {
+		t.Errorf("EXIF dude-exif.jpg key %q = %q; want %q", key, g, e)
+	}
+	key = "exifgps|" + exifFileRef.String()
+	if g, e := id.Get(key), ""; g != e {
+		t.Errorf("EXIF dude-exif.jpg key %q = %q; want %q", key, g, e)
+	}
+	key = "exiftime|2003-11-23T18:07:37Z|" + gpsFileRef.String()
+	if g, e := id.Get(key), "1"; g != e {
+		t.Errorf("EXIF sample1.jpg key %q = %q; want %q", key, g, e)
+	}
+	key = "exifgps|" + gpsFileRef.String()
+	if g, e := id.Get(key), "39.9155556|116.3908333"; g != e {
+		t.Errorf("EXIF sample1.jpg key %q = %q; want %q", key, g, e)
+	}
+
+	// GetImageInfo
+	{
+		ii, err := id.Index.GetImageInfo(gpsFileRef)
+		if err != nil {
+			t.Fatalf("GetImageInfo(sample1.jpg): %v", err)
+		}
+		want := &search.Location{Latitude: 39.9155556, Longitude: 116.3908333}
+		if ii.Location == nil || *ii.Location != *want {
+			t.Errorf("GetImageInfo(sample1.jpg).Location = %+v; want %+v", ii.Location, want)
+		}
+		ii, err = id.Index.GetImageInfo(jpegFileRef)
+		if err != nil {
+			t.Fatalf("GetImageInfo(dude.jpg): %v", err)
+		}
+		if ii.Location != nil {
+			t.Errorf("GetImageInfo(dude.jpg).Location = %+v; want nil", ii.Location)
+		}
+	}
+
 	key = "have:" + pn.String()
 	pnSizeStr := id.Get(key)
 	if pnSizeStr == "" {
@@ -648,3 +693,113 @@ func EdgesTo(t *testing.T, initIdx func() *index.Index) {
 		}
 	}
 }
+
+// ClaimsSince tests that EnumerateSince returns the claims dated at or
+// after a time, in date order.
+func ClaimsSince(t *testing.T, initIdx func() *index.Index) {
+	idx := initIdx()
+	id := NewIndexDeps(idx)
+	id.Fataler = t
+
+	pn := id.NewPermanode()
+	c1 := id.SetAttribute(pn, "title", "one")
+	t1 := id.lastTime()
+	c2 := id.AddAttribute(pn, "tag", "two")
+	t2 := id.lastTime()
+	c4 := id.SetAttribute(pn, "title", "four")
+	t4 := id.lastTime()
+
+	// A claim between c2 and c4 with a fractional second, which must
+	// still sort between them.
+	m := schema.NewSetAttributeClaim(pn, "title", "three")
+	m.SetClaimDate(t2.Add(500 * time.Millisecond))
+	c3 := id.uploadAndSign(m)
+
+	id.dumpIndex(t)
+
+	claimsSince := func(since time.Time) (got []string) {
+		ch := make(chan *search.Claim, 10)
+		errc := make(chan error, 1)
+		go func() { errc <- idx.EnumerateSince(ch, since) }()
+		for cl := range ch {
+			if !cl.Permanode.Equal(pn) {
+				t.Errorf("claim %v: permanode = %v; want %v", cl.BlobRef, cl.Permanode, pn)
+			}
+			got = append(got, cl.BlobRef.String())
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("EnumerateSince(%v): %v", since, err)
+		}
+		return
+	}
+	strs := func(brs ...*blobref.BlobRef) (s []string) {
+		for _, br := range brs {
+			s = append(s, br.String())
+		}
+		return
+	}
+	tests := []struct {
+		since time.Time
+		want  []string
+	}{
+		{time.Time{}, strs(c1, c2, c3, c4)},
+		{t1, strs(c1, c2, c3, c4)},
+		{t1.Add(time.Nanosecond), strs(c2, c3, c4)},
+		{t2.Add(time.Second / 2), strs(c3, c4)},
+		{t4, strs(c4)},
+		{t4.Add(time.Nanosecond), nil},
+	}
+	for _, tt := range tests {
+		if got := claimsSince(tt.since); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("EnumerateSince(%v) = %q; want %q", tt.since, got, tt.want)
+		}
+	}
+
+	// The claim's other fields come back too.
+	ch := make(chan *search.Claim, 10)
+	if err := idx.EnumerateSince(ch, t4); err != nil {
+		t.Fatal(err)
+	}
+	cl := <-ch
+	if cl == nil || cl.Type != "set-attribute" || cl.Attr != "title" || cl.Value != "four" ||
+		!cl.Date.Equal(t4) || !cl.Signer.Equal(id.SignerBlobRef) {
+		t.Errorf("claim since %v = %+v", t4, cl)
+	}
+}
+
+// Find tests the range scans of the index's Storage.
+func Find(t *testing.T, initIdx func() *index.Index) {
+	s := initIdx().Storage()
+	for _, k := range []string{"a", "b", "camliPath:x", "camliPath:y", "camliPath;", "camliPatz", "d"} {
+		if err := s.Set(k, "v-"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		start, end string
+		want       []string
+	}{
+		{"", "", []string{"a", "b", "camliPath:x", "camliPath:y", "camliPath;", "camliPatz", "d"}},
+		{"b", "", []string{"b", "camliPath:x", "camliPath:y", "camliPath;", "camliPatz", "d"}},
+		{"ab", "camliPath:y", []string{"b", "camliPath:x"}},
+		{"camliPath:", index.PrefixEnd("camliPath:"), []string{"camliPath:x", "camliPath:y"}},
+		{"c", "c", nil},
+		{"e", "", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		it := s.Find(tt.start, tt.end)
+		for it.Next() {
+			if v := it.Value(); v != "v-"+it.Key() {
+				t.Errorf("Find(%q, %q): value of %q = %q", tt.start, tt.end, it.Key(), v)
+			}
+			got = append(got, it.Key())
+		}
+		if err := it.Close(); err != nil {
+			t.Errorf("Find(%q, %q): Close = %v", tt.start, tt.end, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Find(%q, %q) = %q; want %q", tt.start, tt.end, got, tt.want)
+		}
+	}
+}
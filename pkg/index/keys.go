@@ -199,6 +199,23 @@ var (
 		},
 	}
 
+	// Claims modifying permanodes, by claim date, for enumerating
+	// the changes since a time (see EnumerateSince).
+	keyClaimTime = &keyType{
+		"claimtime",
+		[]part{
+			{"date", typeTime}, // claimTimeString, so keys sort by it
+			{"claim", typeBlobRef},
+		},
+		[]part{
+			{"permanode", typeBlobRef},
+			{"signer", typeBlobRef},
+			{"type", typeStr},
+			{"attr", typeStr},
+			{"value", typeStr},
+		},
+	}
+
 	// TODO(mpl): we might want to add signer/owner
 	keyDeleted = &keyType{
 		"deleted",
@@ -240,4 +257,29 @@ var (
 			{"height", typeStr},
 		},
 	}
+
+	// Image files by EXIF capture time, for finding the
+	// images taken within a time range.
+	keyEXIFTime = &keyType{
+		"exiftime",
+		[]part{
+			{"time", typeTime}, // types.Time3339
+			{"fileref", typeBlobRef},
+		},
+		[]part{
+			{"1", typeStr},
+		},
+	}
+
+	// Where an image was taken, from its EXIF GPS fields.
+	keyEXIFGPS = &keyType{
+		"exifgps",
+		[]part{
+			{"fileref", typeBlobRef}, // blobref of "file" schema blob
+		},
+		[]part{
+			{"lat", typeStr},  // decimal degrees, negative south
+			{"long", typeStr}, // decimal degrees, negative west
+		},
+	}
 )
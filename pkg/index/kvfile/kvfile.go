@@ -0,0 +1,416 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kvfile implements the Camlistore index storage abstraction
+// on top of a single append-only file, in pure Go.
+//
+// All key/value pairs are kept in memory. Every mutation (or batch
+// of mutations) is appended to the file as a leveldb log record and
+// synced before it's acknowledged. When the file is opened, the log
+// is replayed and rewritten, dropping overwritten and deleted keys.
+//
+// So unlike a real on-disk store, it needs memory for the whole index,
+// and opening it takes time in proportion to the index's size. It's
+// meant for small and medium indexes where a cgo database isn't
+// available. Only one process may have the file open at once; on
+// systems with flock(2), a second NewStorage of it fails.
+package kvfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"camlistore.org/pkg/blobserver"
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/jsonconfig"
+
+	"camlistore.org/third_party/code.google.com/p/leveldb-go/leveldb/db"
+	"camlistore.org/third_party/code.google.com/p/leveldb-go/leveldb/memdb"
+	"camlistore.org/third_party/code.google.com/p/leveldb-go/leveldb/record"
+)
+
+// Operations in a log record.
+const (
+	opSet    = 's'
+	opDelete = 'd'
+)
+
+type storage struct {
+	file string
+
+	lock io.Closer // releases the lock on file; see lockFile
+
+	mu  sync.Mutex // guards db, f and w
+	db  db.DB
+	f   *os.File
+	w   *record.Writer
+	err error // sticky write error
+}
+
+var _ index.Storage = (*storage)(nil)
+
+// NewStorage returns an index.Storage implementation backed by the
+// named file, which is created if it doesn't exist. It holds a lock
+// on file+".lock" until the storage is closed, so that no other
+// process uses the file meanwhile.
+func NewStorage(file string) (index.Storage, error) {
+	lock, err := lockFile(file + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	mdb := memdb.New(nil)
+	if err := replay(file, mdb); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	f, w, err := compact(file, mdb)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return &storage{
+		file: file,
+		lock: lock,
+		db:   mdb,
+		f:    f,
+		w:    w,
+	}, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// replay reads the log in file into mdb.
+//
+// A record we failed to finish writing (e.g. on a crash) was never
+// acknowledged, so an unreadable record in the log's final block is
+// dropped, along with anything after it. Any other unreadable record
+// is corruption, and an error, so that the records after it aren't
+// lost to the compaction.
+func replay(file string, mdb db.DB) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// The record reader reads whole blocks, so cr.n is the end
+	// of the block holding the record being read.
+	cr := &countingReader{r: f}
+	r := record.NewReader(cr)
+	for n := 0; ; n++ {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		var buf []byte
+		if err == nil {
+			buf, err = ioutil.ReadAll(rec)
+		}
+		if err != nil {
+			if cr.n < fi.Size() {
+				return fmt.Errorf("kvfile: %s: record %d, before offset %d: %v", file, n, cr.n, err)
+			}
+			log.Printf("kvfile: %s: discarding torn log tail after record %d: %v", file, n, err)
+			return nil
+		}
+		if err := applyRecord(mdb, buf); err != nil {
+			return fmt.Errorf("kvfile: %s: record %d: %v", file, n, err)
+		}
+	}
+}
+
+// compact writes the contents of mdb to a new log which replaces file.
+// It returns the new file and its log writer, for further appends. The
+// record writer can only start at a block boundary, so it's kept
+// rather than re-created after the partial final block.
+func compact(file string, mdb db.DB) (*os.File, *record.Writer, error) {
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	fail := func(err error) (*os.File, *record.Writer, error) {
+		f.Close()
+		os.Remove(tmp)
+		return nil, nil, err
+	}
+	w := record.NewWriter(f)
+	it := mdb.Find(nil, nil)
+	for it.Next() {
+		rw, err := w.Next()
+		if err != nil {
+			it.Close()
+			return fail(err)
+		}
+		var buf bytes.Buffer
+		appendMutation(&buf, opSet, it.Key(), it.Value())
+		if _, err := rw.Write(buf.Bytes()); err != nil {
+			it.Close()
+			return fail(err)
+		}
+	}
+	if err := it.Close(); err != nil {
+		return fail(err)
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return fail(err)
+	}
+	return f, w, nil
+}
+
+// appendMutation encodes one mutation onto buf. Keys and values are
+// prefixed by their uvarint length; deletes have no value.
+func appendMutation(buf *bytes.Buffer, op byte, key, value []byte) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	buf.WriteByte(op)
+	buf.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(key)))])
+	buf.Write(key)
+	if op == opDelete {
+		return
+	}
+	buf.Write(lenBuf[:binary.PutUvarint(lenBuf[:], uint64(len(value)))])
+	buf.Write(value)
+}
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// applyRecord applies the mutations encoded in buf to mdb.
+func applyRecord(mdb db.DB, buf []byte) error {
+	readBytes := func() ([]byte, bool) {
+		n, vlen := binary.Uvarint(buf)
+		if vlen <= 0 || uint64(len(buf)-vlen) < n {
+			return nil, false
+		}
+		b := buf[vlen : vlen+int(n)]
+		buf = buf[vlen+int(n):]
+		return b, true
+	}
+	for len(buf) > 0 {
+		op := buf[0]
+		buf = buf[1:]
+		key, ok := readBytes()
+		if !ok {
+			return errCorruptRecord
+		}
+		switch op {
+		case opSet:
+			value, ok := readBytes()
+			if !ok {
+				return errCorruptRecord
+			}
+			if err := mdb.Set(key, value, nil); err != nil {
+				return err
+			}
+		case opDelete:
+			if err := mdb.Delete(key, nil); err != nil && err != db.ErrNotFound {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown op %q", op)
+		}
+	}
+	return nil
+}
+
+// writeRecord appends buf to the log and syncs it.
+// s.mu must be held.
+func (s *storage) writeRecord(buf []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	rw, err := s.w.Next()
+	if err == nil {
+		_, err = rw.Write(buf)
+	}
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err == nil {
+		err = s.f.Sync()
+	}
+	if err != nil {
+		// The log is now in an unknown state; refuse
+		// further writes rather than diverge from it.
+		s.err = fmt.Errorf("kvfile: writing %s: %v", s.file, err)
+	}
+	return s.err
+}
+
+// stringIterator converts from leveldb's db.Iterator interface, which
+// operates on []byte, to Camlistore's index.Iterator, which operates
+// on string.
+type stringIterator struct {
+	db.Iterator
+	end string // exclusive upper bound on the keys, if non-empty
+}
+
+func (s stringIterator) Next() bool {
+	if !s.Iterator.Next() {
+		return false
+	}
+	return s.end == "" || string(s.Iterator.Key()) < s.end
+}
+
+func (s stringIterator) Key() string {
+	return string(s.Iterator.Key())
+}
+
+func (s stringIterator) Value() string {
+	return string(s.Iterator.Value())
+}
+
+func (s *storage) Get(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, err := s.db.Get([]byte(key), nil)
+	if err == db.ErrNotFound {
+		return "", index.ErrNotFound
+	}
+	return string(v), err
+}
+
+func (s *storage) Find(start, end string) index.Iterator {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return stringIterator{s.db.Find([]byte(start), nil), end}
+}
+
+func (s *storage) Set(key, value string) error {
+	var buf bytes.Buffer
+	appendMutation(&buf, opSet, []byte(key), []byte(value))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeRecord(buf.Bytes()); err != nil {
+		return err
+	}
+	return s.db.Set([]byte(key), []byte(value), nil)
+}
+
+func (s *storage) Delete(key string) error {
+	var buf bytes.Buffer
+	appendMutation(&buf, opDelete, []byte(key), nil)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeRecord(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := s.db.Delete([]byte(key), nil); err != nil && err != db.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+func (s *storage) BeginBatch() index.BatchMutation {
+	return index.NewBatchMutation()
+}
+
+type batch interface {
+	Mutations() []index.Mutation
+}
+
+func (s *storage) CommitBatch(bm index.BatchMutation) error {
+	b, ok := bm.(batch)
+	if !ok {
+		return errors.New("invalid batch type")
+	}
+	muts := b.Mutations()
+	var buf bytes.Buffer
+	for _, m := range muts {
+		if m.IsDelete() {
+			appendMutation(&buf, opDelete, []byte(m.Key()), nil)
+		} else {
+			appendMutation(&buf, opSet, []byte(m.Key()), []byte(m.Value()))
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeRecord(buf.Bytes()); err != nil {
+		return err
+	}
+	return applyRecord(s.db, buf.Bytes())
+}
+
+// Close closes the underlying file, and unlocks it.
+func (s *storage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = errors.New("kvfile: storage closed")
+	}
+	err := s.f.Close()
+	if lerr := s.lock.Close(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
+	var (
+		blobPrefix = config.RequiredString("blobSource")
+		file       = config.RequiredString("file")
+	)
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	sto, err := ld.GetStorage(blobPrefix)
+	if err != nil {
+		return nil, err
+	}
+	is, err := NewStorage(file)
+	if err != nil {
+		return nil, err
+	}
+
+	ix := index.New(is)
+	ix.BlobSource = sto
+	// Good enough, for now:
+	ix.KeyFetcher = ix.BlobSource
+
+	return ix, nil
+}
+
+func init() {
+	blobserver.RegisterStorageConstructor("kvfileindexer", blobserver.StorageConstructor(newFromConfig))
+}
@@ -0,0 +1,267 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvfile_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/index/indextest"
+	"camlistore.org/pkg/index/kvfile"
+)
+
+func makeStorage(t *testing.T) (s index.Storage, clean func()) {
+	dir, err := ioutil.TempDir("", "kvfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = kvfile.NewStorage(filepath.Join(dir, "index.kv"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	clean = func() {
+		s.(io.Closer).Close()
+		os.RemoveAll(dir)
+	}
+	return s, clean
+}
+
+type kvfileTester struct{}
+
+func (kvfileTester) test(t *testing.T, tfn func(*testing.T, func() *index.Index)) {
+	var mu sync.Mutex // guards cleanups
+	var cleanups []func()
+	defer func() {
+		mu.Lock() // never unlocked
+		for _, fn := range cleanups {
+			fn()
+		}
+	}()
+	makeIndex := func() *index.Index {
+		s, cleanup := makeStorage(t)
+		mu.Lock()
+		cleanups = append(cleanups, cleanup)
+		mu.Unlock()
+		return index.New(s)
+	}
+	tfn(t, makeIndex)
+}
+
+func TestIndex_KVFile(t *testing.T) {
+	kvfileTester{}.test(t, indextest.Index)
+}
+
+func TestPathsOfSignerTarget_KVFile(t *testing.T) {
+	kvfileTester{}.test(t, indextest.PathsOfSignerTarget)
+}
+
+func TestFiles_KVFile(t *testing.T) {
+	kvfileTester{}.test(t, indextest.Files)
+}
+
+func TestEdgesTo_KVFile(t *testing.T) {
+	kvfileTester{}.test(t, indextest.EdgesTo)
+}
+
+func TestFind_KVFile(t *testing.T) {
+	kvfileTester{}.test(t, indextest.Find)
+}
+
+func TestClaimsSince_KVFile(t *testing.T) {
+	kvfileTester{}.test(t, indextest.ClaimsSince)
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "index.kv")
+
+	s, err := kvfile.NewStorage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Big enough values to span several log blocks.
+	big := strings.Repeat("x", 10<<10)
+	for i := 0; i < 10; i++ {
+		if err := s.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("%d%s", i, big)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete("key3"); err != nil {
+		t.Fatal(err)
+	}
+	bm := s.BeginBatch()
+	bm.Set("key4", "four")
+	bm.Delete("key5")
+	bm.Set("batch", "yes")
+	if err := s.CommitBatch(bm); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"batch": "yes", "key4": "four"}
+	for _, i := range []int{0, 1, 2, 6, 7, 8, 9} {
+		want[fmt.Sprintf("key%d", i)] = fmt.Sprintf("%d%s", i, big)
+	}
+
+	// Reopen twice: once replaying the appended log, and once
+	// more appending to and replaying the compacted one.
+	for pass := 0; pass < 2; pass++ {
+		s.(io.Closer).Close()
+		s, err = kvfile.NewStorage(file)
+		if err != nil {
+			t.Fatalf("pass %d: reopen: %v", pass, err)
+		}
+		got := make(map[string]string)
+		it := s.Find("", "")
+		for it.Next() {
+			got[it.Key()] = it.Value()
+		}
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Errorf("pass %d: got %d keys; want %d", pass, len(got), len(want))
+		}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("pass %d: key %q = %.10q; want %.10q", pass, k, got[k], v)
+			}
+		}
+		if _, err := s.Get("key3"); err != index.ErrNotFound {
+			t.Errorf("pass %d: Get of deleted key = %v; want ErrNotFound", pass, err)
+		}
+		if err := s.Set("late", "value"); err != nil {
+			t.Fatal(err)
+		}
+		want["late"] = "value"
+	}
+	s.(io.Closer).Close()
+}
+
+// fillLog writes big values to a new storage in file, spanning
+// several log blocks, then a small one last, and closes it.
+func fillLog(t *testing.T, file string) {
+	s, err := kvfile.NewStorage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := strings.Repeat("x", 10<<10)
+	for i := 0; i < 10; i++ {
+		if err := s.Set(fmt.Sprintf("key%d", i), big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Set("last", "value"); err != nil {
+		t.Fatal(err)
+	}
+	s.(io.Closer).Close()
+}
+
+func TestTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "index.kv")
+	fillLog(t, file)
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As if the process died while appending the last record.
+	if err := os.Truncate(file, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := kvfile.NewStorage(file)
+	if err != nil {
+		t.Fatalf("NewStorage with a torn last record: %v", err)
+	}
+	defer s.(io.Closer).Close()
+	if _, err := s.Get("key9"); err != nil {
+		t.Errorf("Get of a key before the torn record: %v", err)
+	}
+	if _, err := s.Get("last"); err != index.ErrNotFound {
+		t.Errorf("Get of the torn record's key = %v; want ErrNotFound", err)
+	}
+}
+
+func TestCorruptLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "index.kv")
+	fillLog(t, file)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Damage the first record, well before the last block.
+	data[100] ^= 0xff
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := kvfile.NewStorage(file); err == nil {
+		s.(io.Closer).Close()
+		t.Fatal("NewStorage of a log corrupt in its middle succeeded")
+	}
+	after, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(data) {
+		t.Errorf("corrupt log rewritten by the failed NewStorage")
+	}
+}
+
+func TestLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvfile-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "index.kv")
+	s, err := kvfile.NewStorage(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2, err := kvfile.NewStorage(file); err == nil {
+		s2.(io.Closer).Close()
+		t.Errorf("second NewStorage of an open file succeeded")
+	}
+	s.(io.Closer).Close()
+	s, err = kvfile.NewStorage(file)
+	if err != nil {
+		t.Fatalf("NewStorage after Close: %v", err)
+	}
+	s.(io.Closer).Close()
+}
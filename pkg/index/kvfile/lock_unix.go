@@ -0,0 +1,44 @@
+// +build linux darwin freebsd netbsd openbsd
+
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kvfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive flock(2) on name, creating it if
+// needed. It fails rather than wait if another process holds it.
+// Closing the returned file unlocks it.
+func lockFile(name string) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("kvfile: %s is locked; is the index in use by another process?", name)
+		}
+		return nil, fmt.Errorf("kvfile: locking %s: %v", name, err)
+	}
+	return f, nil
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package index
 
 import (
+	"container/list"
 	"errors"
 	"sync"
 
@@ -44,8 +45,24 @@ func NewMemoryStorage() Storage {
 	return &memKeys{db: db}
 }
 
+// NewMemoryStorageLimit is like NewMemoryStorage but holds at most
+// maxKeys rows, for throwaway indexes that mustn't grow without
+// bound. Setting a key when full evicts the one written longest ago,
+// so the index forgets about some blobs. A maxKeys of zero or less
+// means no limit.
+func NewMemoryStorageLimit(maxKeys int) Storage {
+	mk := &memKeys{db: memdb.New(nil)}
+	if maxKeys > 0 {
+		mk.max = maxKeys
+		mk.order = list.New()
+		mk.elems = make(map[string]*list.Element)
+	}
+	return mk
+}
+
 func newMemoryIndexFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
 	blobPrefix := config.RequiredString("blobSource")
+	maxKeys := config.OptionalInt("maxKeys", 0)
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
@@ -54,7 +71,7 @@ func newMemoryIndexFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blob
 		return nil, err
 	}
 
-	ix := NewMemoryIndex()
+	ix := New(NewMemoryStorageLimit(maxKeys))
 	ix.BlobSource = sto
 
 	// Good enough, for now:
@@ -66,8 +83,46 @@ func newMemoryIndexFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blob
 // memKeys is a naive in-memory implementation of index.Storage for test & development
 // purposes only.
 type memKeys struct {
-	mu sync.Mutex // guards db
+	mu sync.Mutex // guards db, order and elems
 	db db.DB
+
+	// If max is positive, only that many keys are kept, and order
+	// lists the keys from least to most recently set, each element
+	// being elems' entry for its key.
+	max   int
+	order *list.List
+	elems map[string]*list.Element
+}
+
+// set sets key to value, evicting the oldest keys if need be.
+// mk.mu must be held.
+func (mk *memKeys) set(key, value string) error {
+	if err := mk.db.Set([]byte(key), []byte(value), nil); err != nil {
+		return err
+	}
+	if mk.max <= 0 {
+		return nil
+	}
+	if e, ok := mk.elems[key]; ok {
+		mk.order.MoveToBack(e)
+		return nil
+	}
+	mk.elems[key] = mk.order.PushBack(key)
+	for mk.order.Len() > mk.max {
+		if err := mk.delete(mk.order.Front().Value.(string)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete removes key. mk.mu must be held.
+func (mk *memKeys) delete(key string) error {
+	if e, ok := mk.elems[key]; ok {
+		mk.order.Remove(e)
+		delete(mk.elems, key)
+	}
+	return mk.db.Delete([]byte(key), nil)
 }
 
 // stringIterator converts from leveldb's db.Iterator interface, which
@@ -75,6 +130,14 @@ type memKeys struct {
 // on string.
 type stringIterator struct {
 	db.Iterator
+	end string // exclusive upper bound on the keys, if non-empty
+}
+
+func (s stringIterator) Next() bool {
+	if !s.Iterator.Next() {
+		return false
+	}
+	return s.end == "" || string(s.Iterator.Key()) < s.end
 }
 
 func (s stringIterator) Key() string {
@@ -95,23 +158,23 @@ func (mk *memKeys) Get(key string) (string, error) {
 	return string(k), err
 }
 
-func (mk *memKeys) Find(key string) Iterator {
+func (mk *memKeys) Find(start, end string) Iterator {
 	mk.mu.Lock()
 	defer mk.mu.Unlock()
-	dit := mk.db.Find([]byte(key), nil)
-	return stringIterator{dit}
+	dit := mk.db.Find([]byte(start), nil)
+	return stringIterator{dit, end}
 }
 
 func (mk *memKeys) Set(key, value string) error {
 	mk.mu.Lock()
 	defer mk.mu.Unlock()
-	return mk.db.Set([]byte(key), []byte(value), nil)
+	return mk.set(key, value)
 }
 
 func (mk *memKeys) Delete(key string) error {
 	mk.mu.Lock()
 	defer mk.mu.Unlock()
-	return mk.db.Delete([]byte(key), nil)
+	return mk.delete(key)
 }
 
 func (mk *memKeys) BeginBatch() BatchMutation {
@@ -127,11 +190,11 @@ func (mk *memKeys) CommitBatch(bm BatchMutation) error {
 	defer mk.mu.Unlock()
 	for _, m := range b.Mutations() {
 		if m.IsDelete() {
-			if err := mk.db.Delete([]byte(m.Key()), nil); err != nil {
+			if err := mk.delete(m.Key()); err != nil {
 				return err
 			}
 		} else {
-			if err := mk.db.Set([]byte(m.Key()), []byte(m.Value()), nil); err != nil {
+			if err := mk.set(m.Key(), m.Value()); err != nil {
 				return err
 			}
 		}
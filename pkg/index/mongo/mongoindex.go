@@ -22,7 +22,6 @@ import (
 	"errors"
 	"os"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -211,13 +210,14 @@ func (mk *mongoKeys) Get(key string) (string, error) {
 	return res[mgoValue].(string), err
 }
 
-func (mk *mongoKeys) Find(key string) index.Iterator {
+func (mk *mongoKeys) Find(start, end string) index.Iterator {
 	mk.mu.Lock()
 	defer mk.mu.Unlock()
-	// TODO(mpl): escape other special chars, or maybe replace $regex with something
-	// more suited if possible.
-	cleanedKey := strings.Replace(key, "|", `\|`, -1)
-	iter := mk.db.Find(&bson.M{mgoKey: &bson.M{"$regex": "^" + cleanedKey}}).Sort(mgoKey).Iter()
+	cond := bson.M{"$gte": start}
+	if end != "" {
+		cond["$lt"] = end
+	}
+	iter := mk.db.Find(&bson.M{mgoKey: cond}).Sort(mgoKey).Iter()
 	return mongoStrIterator{res: bson.M{}, Iter: iter}
 }
 
@@ -97,3 +97,11 @@ func TestFiles_Mongo(t *testing.T) {
 func TestEdgesTo_Mongo(t *testing.T) {
 	mongoTester{}.test(t, indextest.EdgesTo)
 }
+
+func TestFind_Mongo(t *testing.T) {
+	mongoTester{}.test(t, indextest.Find)
+}
+
+func TestClaimsSince_Mongo(t *testing.T) {
+	mongoTester{}.test(t, indextest.ClaimsSince)
+}
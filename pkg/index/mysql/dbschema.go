@@ -16,7 +16,7 @@ limitations under the License.
 
 package mysql
 
-const requiredSchemaVersion = 21
+const requiredSchemaVersion = 22
 
 func SchemaVersion() int {
 	return requiredSchemaVersion
@@ -108,3 +108,11 @@ func TestFiles_MySQL(t *testing.T) {
 func TestEdgesTo_MySQL(t *testing.T) {
 	mysqlTester{}.test(t, indextest.EdgesTo)
 }
+
+func TestFind_MySQL(t *testing.T) {
+	mysqlTester{}.test(t, indextest.Find)
+}
+
+func TestClaimsSince_MySQL(t *testing.T) {
+	mysqlTester{}.test(t, indextest.ClaimsSince)
+}
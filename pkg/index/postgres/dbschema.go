@@ -16,7 +16,7 @@ limitations under the License.
 
 package postgres
 
-const requiredSchemaVersion = 1
+const requiredSchemaVersion = 2
 
 func SchemaVersion() int {
 	return requiredSchemaVersion
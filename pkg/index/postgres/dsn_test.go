@@ -0,0 +1,94 @@
+// +build with_postgres
+
+/*
+Copyright 2013 The Camlistore Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgres_test
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/index/indextest"
+	"camlistore.org/pkg/index/postgres"
+
+	_ "camlistore.org/third_party/github.com/lib/pq"
+)
+
+// These tests run against the database named by the CAMLI_TEST_PG
+// data source name (e.g. "user=camli dbname=camlitest sslmode=disable"),
+// whose rows and meta tables they drop and re-create.
+
+func dsnTest(t *testing.T, tfn func(*testing.T, func() *index.Index)) {
+	dsn := os.Getenv("CAMLI_TEST_PG")
+	if dsn == "" {
+		t.Skip("CAMLI_TEST_PG not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	exec := func(q string) {
+		if _, err := db.Exec(q); err != nil {
+			t.Fatalf("Error %v running SQL: %s", err, q)
+		}
+	}
+	tfn(t, func() *index.Index {
+		exec("DROP TABLE IF EXISTS rows")
+		exec("DROP TABLE IF EXISTS meta")
+		for _, q := range postgres.SQLCreateTables() {
+			exec(q)
+		}
+		for _, q := range postgres.SQLDefineReplace() {
+			exec(q)
+		}
+		exec(fmt.Sprintf("SELECT replaceintometa('version', '%d')", postgres.SchemaVersion()))
+		s, err := postgres.NewStorageDSN(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		postgres.SetPoolSize(s, 8, 4)
+		return index.New(s)
+	})
+}
+
+func TestIndex_PostgresDSN(t *testing.T) {
+	dsnTest(t, indextest.Index)
+}
+
+func TestPathsOfSignerTarget_PostgresDSN(t *testing.T) {
+	dsnTest(t, indextest.PathsOfSignerTarget)
+}
+
+func TestFiles_PostgresDSN(t *testing.T) {
+	dsnTest(t, indextest.Files)
+}
+
+func TestEdgesTo_PostgresDSN(t *testing.T) {
+	dsnTest(t, indextest.EdgesTo)
+}
+
+func TestFind_PostgresDSN(t *testing.T) {
+	dsnTest(t, indextest.Find)
+}
+
+func TestClaimsSince_PostgresDSN(t *testing.T) {
+	dsnTest(t, indextest.ClaimsSince)
+}
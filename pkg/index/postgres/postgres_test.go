@@ -150,3 +150,19 @@ func TestEdgesTo_Postgres(t *testing.T) {
 	}
 	postgresTester{}.test(t, indextest.EdgesTo)
 }
+
+func TestFind_Postgres(t *testing.T) {
+	if testing.Short() {
+		t.Logf("skipping test in short mode")
+		return
+	}
+	postgresTester{}.test(t, indextest.Find)
+}
+
+func TestClaimsSince_Postgres(t *testing.T) {
+	if testing.Short() {
+		t.Logf("skipping test in short mode")
+		return
+	}
+	postgresTester{}.test(t, indextest.ClaimsSince)
+}
@@ -32,6 +32,11 @@ import (
 	_ "camlistore.org/third_party/github.com/lib/pq"
 )
 
+// defaultMaxIdleConns is the default number of idle connections
+// kept to the database, enough for a few concurrent index readers
+// without reconnecting.
+const defaultMaxIdleConns = 4
+
 type myIndexStorage struct {
 	*sqlindex.Storage
 	host, user, password, database string
@@ -76,7 +81,22 @@ var replacePlaceHolders = func(query string) string {
 // This exists mostly for testing and does not initialize the schema.
 func NewStorage(host, user, password, dbname, sslmode string) (index.Storage, error) {
 	conninfo := fmt.Sprintf("user=%s dbname=%s host=%s password=%s sslmode=%s", user, dbname, host, password, sslmode)
-	db, err := sql.Open("postgres", conninfo)
+	s, err := NewStorageDSN(conninfo)
+	if err != nil {
+		return nil, err
+	}
+	is := s.(*myIndexStorage)
+	is.host, is.user, is.password, is.database = host, user, password, dbname
+	return is, nil
+}
+
+// NewStorageDSN is like NewStorage, but takes a lib/pq data source
+// name, either "key=value ..." or a postgres:// URL.
+//
+// The storage's *sql.DB is a connection pool shared by all index
+// operations; use SetPoolSize to bound it.
+func NewStorageDSN(dsn string) (index.Storage, error) {
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -88,13 +108,19 @@ func NewStorage(host, user, password, dbname, sslmode string) (index.Storage, er
 			BatchSetFunc:    altBatchSet,
 			PlaceHolderFunc: replacePlaceHolders,
 		},
-		host:     host,
-		user:     user,
-		password: password,
-		database: dbname,
 	}, nil
 }
 
+// SetPoolSize bounds the connections s, which must have been
+// returned by NewStorage or NewStorageDSN, keeps to the database:
+// at most maxOpen in use at once, and maxIdle kept open between
+// uses. Zero or negative maxOpen means no limit.
+func SetPoolSize(s index.Storage, maxOpen, maxIdle int) {
+	db := s.(*myIndexStorage).db
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+}
+
 func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
 	var (
 		blobPrefix = config.RequiredString("blobSource")
@@ -103,6 +129,8 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Stor
 		password   = config.OptionalString("password", "")
 		database   = config.RequiredString("database")
 		sslmode    = config.OptionalString("sslmode", "require")
+		maxOpen    = config.OptionalInt("maxOpenConns", 0)
+		maxIdle    = config.OptionalInt("maxIdleConns", defaultMaxIdleConns)
 	)
 	if err := config.Validate(); err != nil {
 		return nil, err
@@ -115,6 +143,7 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Stor
 	if err != nil {
 		return nil, err
 	}
+	SetPoolSize(isto, maxOpen, maxIdle)
 	is := isto.(*myIndexStorage)
 	if err := is.ping(); err != nil {
 		return nil, err
@@ -207,6 +207,7 @@ func (ix *Index) populateFile(blob *schema.Blob, bm BatchMutation) error {
 		} else {
 			log.Printf("filename %q exif = %v, %v", blob.FileName(), ft, err)
 		}
+		indexEXIF(blobRef, imageBuf.Bytes, bm)
 	}
 
 	var sortTimes []time.Time
@@ -290,6 +291,11 @@ func (ix *Index) populateClaim(blob *schema.Blob, bm BatchMutation) error {
 	recentKey := keyRecentPermanode.Key(verifiedKeyId, claim.ClaimDateString(), br)
 	bm.Set(recentKey, pnbr.String())
 
+	if date, err := blob.ClaimDate(); err == nil {
+		key := keyClaimTime.Key(claimTimeString(date), br)
+		bm.Set(key, keyClaimTime.Val(pnbr, vr.CamliSigner, claim.ClaimType(), attr, value))
+	}
+
 	claimKey := pipes("claim", pnbr, verifiedKeyId, claim.ClaimDateString(), br)
 	bm.Set(claimKey, pipes(urle(claim.ClaimType()), urle(attr), urle(value)))
 
@@ -0,0 +1,106 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index
+
+import (
+	"log"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/blobserver"
+)
+
+// A ReindexSource is a blob store an index can be rebuilt from.
+type ReindexSource interface {
+	blobserver.BlobEnumerator
+	blobref.StreamingFetcher
+}
+
+// ReindexStatus is the progress of a ReindexFrom.
+type ReindexStatus struct {
+	Seen    int // blobs enumerated so far
+	Indexed int // blobs indexed by this run
+	Skipped int // blobs already in the index
+	Failed  int // blobs that couldn't be fetched or were corrupt
+
+	Last *blobref.BlobRef // last blob seen, or nil
+}
+
+// reindexProgressEvery is how many blobs ReindexFrom goes through
+// between progress reports.
+const reindexProgressEvery = 100
+
+// ReindexFrom rebuilds the index from all the blobs in src, as if
+// each had just been received. As it works on the index's Storage,
+// it's the same for all backends.
+//
+// Blobs the index already has are skipped, so an interrupted
+// ReindexFrom can be resumed by running it again. The index's
+// BlobSource and KeyFetcher, needed to index files and claims, must
+// be set.
+//
+// If progress is non-nil, it's called every few blobs and once
+// more at the end. Blobs that can't be fetched or are corrupt are
+// logged and counted as failed; an error from the index's Storage
+// stops the reindex and is returned.
+func (ix *Index) ReindexFrom(src ReindexSource, progress func(ReindexStatus)) error {
+	var st ReindexStatus
+	report := func() {
+		if progress != nil {
+			progress(st)
+		}
+	}
+	err := blobserver.EnumerateAll(src, func(sb blobref.SizedBlobRef) error {
+		br := sb.BlobRef
+		st.Seen++
+		st.Last = br
+		defer func() {
+			if st.Seen%reindexProgressEvery == 0 {
+				report()
+			}
+		}()
+
+		if _, err := ix.s.Get("have:" + br.String()); err == nil {
+			st.Skipped++
+			return nil
+		} else if err != ErrNotFound {
+			return err
+		}
+
+		rc, _, err := src.FetchStreaming(br)
+		if err != nil {
+			log.Printf("index: reindex: fetching %v: %v", br, err)
+			st.Failed++
+			return nil
+		}
+		defer rc.Close()
+		if _, err := ix.ReceiveBlob(br, rc); err != nil {
+			if err == blobserver.ErrCorruptBlob {
+				log.Printf("index: reindex: %v is corrupt", br)
+				st.Failed++
+				return nil
+			}
+			return err
+		}
+		st.Indexed++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	report()
+	return nil
+}
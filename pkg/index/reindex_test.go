@@ -0,0 +1,183 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package index_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/index"
+	"camlistore.org/pkg/index/indextest"
+	"camlistore.org/pkg/jsonsign"
+	"camlistore.org/pkg/schema"
+	"camlistore.org/pkg/test"
+)
+
+// reindexCorpus is a small blob store with a file, and a signed
+// permanode pointing to it.
+type reindexCorpus struct {
+	blobs     *test.Fetcher
+	keys      *test.Fetcher // the signer's public key
+	signer    *blobref.BlobRef
+	file      *blobref.BlobRef
+	permanode *blobref.BlobRef
+}
+
+func newReindexCorpus(t *testing.T) *reindexCorpus {
+	id := indextest.NewIndexDeps(index.NewMemoryIndex())
+	id.Fataler = t
+	c := &reindexCorpus{
+		blobs:  new(test.Fetcher),
+		keys:   id.PublicKeyFetcher,
+		signer: id.SignerBlobRef,
+	}
+	var err error
+	c.file, err = schema.WriteFileFromReader(c.blobs, "foo.txt", strings.NewReader("some file contents"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signAt := time.Unix(1322443956, 0)
+	sign := func(b *schema.Builder) *blobref.BlobRef {
+		signAt = signAt.Add(time.Second)
+		b.SetSigner(c.signer)
+		unsigned, err := b.JSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed, err := (&jsonsign.SignRequest{
+			UnsignedJSON:  unsigned,
+			Fetcher:       id.PublicKeyFetcher,
+			EntityFetcher: id.EntityFetcher,
+			SignatureTime: signAt,
+		}).Sign()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tb := &test.Blob{Contents: signed}
+		c.blobs.AddBlob(tb)
+		return tb.BlobRef()
+	}
+	c.permanode = sign(schema.NewUnsignedPermanode())
+	for _, cl := range []*schema.Builder{
+		schema.NewSetAttributeClaim(c.permanode, "camliRoot", "root"),
+		schema.NewSetAttributeClaim(c.permanode, "camliContent", c.file.String()),
+	} {
+		cl.SetClaimDate(signAt)
+		sign(cl)
+	}
+	return c
+}
+
+// newIndex returns an empty memory index reading files and keys
+// from c, and its storage.
+func (c *reindexCorpus) newIndex() (*index.Index, index.Storage) {
+	s := index.NewMemoryStorage()
+	ix := index.New(s)
+	ix.BlobSource = c.blobs
+	ix.KeyFetcher = c.keys
+	return ix, s
+}
+
+func dumpRows(t *testing.T, s index.Storage) map[string]string {
+	rows := make(map[string]string)
+	it := s.Find("", "")
+	for it.Next() {
+		rows[it.Key()] = it.Value()
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+func TestReindexFrom(t *testing.T) {
+	c := newReindexCorpus(t)
+	all := c.blobs.BlobrefStrings()
+
+	// What the index has when receiving the blobs as usual.
+	want, wantStorage := c.newIndex()
+	for _, ref := range all {
+		br := blobref.MustParse(ref)
+		contents, _ := c.blobs.BlobContents(br)
+		if _, err := want.ReceiveBlob(br, strings.NewReader(contents)); err != nil {
+			t.Fatalf("ReceiveBlob(%v): %v", br, err)
+		}
+	}
+
+	ix, s := c.newIndex()
+	var reports []index.ReindexStatus
+	if err := ix.ReindexFrom(c.blobs, func(st index.ReindexStatus) { reports = append(reports, st) }); err != nil {
+		t.Fatalf("ReindexFrom: %v", err)
+	}
+	if len(reports) == 0 {
+		t.Fatal("no progress reported")
+	}
+	if st := reports[len(reports)-1]; st.Seen != len(all) || st.Indexed != len(all) || st.Skipped != 0 || st.Failed != 0 {
+		t.Errorf("final status = %+v; want all %d blobs indexed", st, len(all))
+	}
+
+	got, wantRows := dumpRows(t, s), dumpRows(t, wantStorage)
+	for k, v := range wantRows {
+		if got[k] != v {
+			t.Errorf("row %q = %q; want %q", k, got[k], v)
+		}
+	}
+	for k := range got {
+		if _, ok := wantRows[k]; !ok {
+			t.Errorf("unexpected row %q", k)
+		}
+	}
+
+	pn, err := ix.PermanodeOfSignerAttrValue(c.signer, "camliRoot", "root")
+	if err != nil || !pn.Equal(c.permanode) {
+		t.Errorf("PermanodeOfSignerAttrValue = %v, %v; want %v", pn, err, c.permanode)
+	}
+	fi, err := ix.GetFileInfo(c.file)
+	if err != nil || fi.FileName != "foo.txt" {
+		t.Errorf("GetFileInfo = %+v, %v; want foo.txt", fi, err)
+	}
+}
+
+func TestReindexFromResume(t *testing.T) {
+	c := newReindexCorpus(t)
+	all := c.blobs.BlobrefStrings()
+
+	// As if an earlier run stopped half-way.
+	ix, _ := c.newIndex()
+	done := len(all) / 2
+	for _, ref := range all[:done] {
+		br := blobref.MustParse(ref)
+		contents, _ := c.blobs.BlobContents(br)
+		if _, err := ix.ReceiveBlob(br, strings.NewReader(contents)); err != nil {
+			t.Fatalf("ReceiveBlob(%v): %v", br, err)
+		}
+	}
+
+	var last index.ReindexStatus
+	if err := ix.ReindexFrom(c.blobs, func(st index.ReindexStatus) { last = st }); err != nil {
+		t.Fatalf("ReindexFrom: %v", err)
+	}
+	if last.Skipped != done || last.Indexed != len(all)-done {
+		t.Errorf("status = %+v; want %d skipped and %d indexed", last, done, len(all)-done)
+	}
+	pn, err := ix.PermanodeOfSignerAttrValue(c.signer, "camliRoot", "root")
+	if err != nil || !pn.Equal(c.permanode) {
+		t.Errorf("PermanodeOfSignerAttrValue after resume = %v, %v; want %v", pn, err, c.permanode)
+	}
+}
@@ -48,7 +48,75 @@ type Storage struct {
 	// concurrency in most cases.
 	Serial bool
 
+	// MaxBatchKeys, if non-zero, is the most mutations a batch
+	// applies in one transaction. Larger batches are committed in
+	// order as several transactions, so a CommitBatch error may come
+	// after some of them were applied; see BatchError.
+	// If zero, a batch is one transaction, applied atomically.
+	MaxBatchKeys int
+
+	// CacheStatements, if true, makes the Storage prepare the
+	// statements of Get, Set, Delete, Find and batches once, and
+	// reuse them, instead of having the driver parse them on each
+	// call. They're closed by Close.
+	CacheStatements bool
+
 	mu sync.Mutex // the mutex used, if Serial is set
+
+	stmtMu sync.Mutex
+	stmts  map[string]*sql.Stmt // by query, if CacheStatements
+}
+
+// Statements of the Storage's hot paths, before PlaceHolderFunc.
+const (
+	getSQL     = "SELECT v FROM rows WHERE k=?"
+	replaceSQL = "REPLACE INTO rows (k, v) VALUES (?, ?)"
+	deleteSQL  = "DELETE FROM rows WHERE k=?"
+)
+
+// prepared returns the cached prepared statement for query, which
+// has already been through PlaceHolderFunc, preparing it if needed.
+func (s *Storage) prepared(query string) (*sql.Stmt, error) {
+	s.stmtMu.Lock()
+	defer s.stmtMu.Unlock()
+	if st, ok := s.stmts[query]; ok {
+		return st, nil
+	}
+	st, err := s.DB.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if s.stmts == nil {
+		s.stmts = make(map[string]*sql.Stmt)
+	}
+	s.stmts[query] = st
+	return st, nil
+}
+
+// exec runs query, through a cached statement if CacheStatements is set.
+func (s *Storage) exec(query string, args ...interface{}) error {
+	query = s.sql(query)
+	if !s.CacheStatements {
+		_, err := s.DB.Exec(query, args...)
+		return err
+	}
+	st, err := s.prepared(query)
+	if err != nil {
+		return err
+	}
+	_, err = st.Exec(args...)
+	return err
+}
+
+// Close closes the cached statements, if any, and the DB.
+func (s *Storage) Close() error {
+	s.stmtMu.Lock()
+	for q, st := range s.stmts {
+		st.Close()
+		delete(s.stmts, q)
+	}
+	s.stmtMu.Unlock()
+	return s.DB.Close()
 }
 
 func (s *Storage) sql(v string) string {
@@ -58,10 +126,34 @@ func (s *Storage) sql(v string) string {
 	return v
 }
 
+// BatchError is returned by CommitBatch when a batch split
+// into several transactions (see MaxBatchKeys) fails after some
+// of them were committed.
+type BatchError struct {
+	// Applied is the number of the batch's mutations, in the
+	// order they were added, which were committed.
+	Applied int
+	Err     error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("sqlindex: batch failed after applying its first %d mutations: %v", e.Applied, e.Err)
+}
+
 type batchTx struct {
+	s   *Storage
+	db  *sql.DB
 	tx  *sql.Tx
 	err error // sticky
 
+	// stmts are tx's versions of the Storage's cached statements,
+	// by query, if CacheStatements is set.
+	stmts map[string]*sql.Stmt
+
+	max     int // MaxBatchKeys
+	n       int // mutations in tx
+	applied int // mutations committed in previous transactions
+
 	// SetFunc is an optional func to use when REPLACE INTO does not exist
 	SetFunc func(*sql.Tx, string, string) error
 
@@ -77,22 +169,64 @@ func (b *batchTx) sql(v string) string {
 	return v
 }
 
+// exec runs query in the current transaction.
+func (b *batchTx) exec(query string, args ...interface{}) error {
+	query = b.sql(query)
+	if !b.s.CacheStatements {
+		_, err := b.tx.Exec(query, args...)
+		return err
+	}
+	st, ok := b.stmts[query]
+	if !ok {
+		shared, err := b.s.prepared(query)
+		if err != nil {
+			return err
+		}
+		st = b.tx.Stmt(shared)
+		if b.stmts == nil {
+			b.stmts = make(map[string]*sql.Stmt)
+		}
+		b.stmts[query] = st
+	}
+	_, err := st.Exec(args...)
+	return err
+}
+
+// split commits the current transaction and starts another, if
+// it holds as many mutations as it may.
+func (b *batchTx) split() {
+	if b.err != nil || b.max <= 0 || b.n < b.max {
+		return
+	}
+	if b.err = b.tx.Commit(); b.err != nil {
+		return
+	}
+	b.applied += b.n
+	b.n = 0
+	b.stmts = nil // closed with the transaction
+	b.tx, b.err = b.db.Begin()
+}
+
 func (b *batchTx) Set(key, value string) {
+	b.split()
 	if b.err != nil {
 		return
 	}
+	b.n++
 	if b.SetFunc != nil {
 		b.err = b.SetFunc(b.tx, key, value)
 		return
 	}
-	_, b.err = b.tx.Exec(b.sql("REPLACE INTO rows (k, v) VALUES (?, ?)"), key, value)
+	b.err = b.exec(replaceSQL, key, value)
 }
 
 func (b *batchTx) Delete(key string) {
+	b.split()
 	if b.err != nil {
 		return
 	}
-	_, b.err = b.tx.Exec(b.sql("DELETE FROM rows WHERE k=?"), key)
+	b.n++
+	b.err = b.exec(deleteSQL, key)
 }
 
 func (s *Storage) BeginBatch() index.BatchMutation {
@@ -101,8 +235,11 @@ func (s *Storage) BeginBatch() index.BatchMutation {
 	}
 	tx, err := s.DB.Begin()
 	return &batchTx{
+		s:               s,
+		db:              s.DB,
 		tx:              tx,
 		err:             err,
+		max:             s.MaxBatchKeys,
 		SetFunc:         s.BatchSetFunc,
 		PlaceHolderFunc: s.PlaceHolderFunc,
 	}
@@ -116,10 +253,16 @@ func (s *Storage) CommitBatch(b index.BatchMutation) error {
 	if !ok {
 		return fmt.Errorf("wrong BatchMutation type %T", b)
 	}
-	if bt.err != nil {
-		return bt.err
+	err := bt.err
+	if err == nil {
+		err = bt.tx.Commit()
+	} else if bt.tx != nil {
+		bt.tx.Rollback()
+	}
+	if err != nil && bt.applied > 0 {
+		return &BatchError{Applied: bt.applied, Err: err}
 	}
-	return bt.tx.Commit()
+	return err
 }
 
 func (s *Storage) Get(key string) (value string, err error) {
@@ -127,7 +270,15 @@ func (s *Storage) Get(key string) (value string, err error) {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 	}
-	err = s.DB.QueryRow(s.sql("SELECT v FROM rows WHERE k=?"), key).Scan(&value)
+	if s.CacheStatements {
+		var st *sql.Stmt
+		if st, err = s.prepared(s.sql(getSQL)); err != nil {
+			return
+		}
+		err = st.QueryRow(key).Scan(&value)
+	} else {
+		err = s.DB.QueryRow(s.sql(getSQL), key).Scan(&value)
+	}
 	if err == sql.ErrNoRows {
 		err = index.ErrNotFound
 	}
@@ -142,8 +293,7 @@ func (s *Storage) Set(key, value string) error {
 	if s.SetFunc != nil {
 		return s.SetFunc(s.DB, key, value)
 	}
-	_, err := s.DB.Exec(s.sql("REPLACE INTO rows (k, v) VALUES (?, ?)"), key, value)
-	return err
+	return s.exec(replaceSQL, key, value)
 }
 
 func (s *Storage) Delete(key string) error {
@@ -151,24 +301,25 @@ func (s *Storage) Delete(key string) error {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 	}
-	_, err := s.DB.Exec(s.sql("DELETE FROM rows WHERE k=?"), key)
-	return err
+	return s.exec(deleteSQL, key)
 }
 
-func (s *Storage) Find(key string) index.Iterator {
+func (s *Storage) Find(start, end string) index.Iterator {
 	return &iter{
-		s:   s,
-		low: key,
-		op:  ">=",
+		s:    s,
+		low:  start,
+		high: end,
+		op:   ">=",
 	}
 }
 
 // iter is a iterator over sorted key/value pairs in rows.
 type iter struct {
-	s   *Storage
-	low string
-	op  string // ">=" initially, then ">"
-	err error  // accumulated error, returned at Close
+	s    *Storage
+	low  string
+	high string // exclusive upper bound, if non-empty
+	op   string // ">=" initially, then ">"
+	err  error  // accumulated error, returned at Close
 
 	rows *sql.Rows // if non-nil, the rows we're reading from
 
@@ -203,9 +354,20 @@ func (t *iter) Next() bool {
 		if t.s.Serial {
 			t.s.mu.Lock()
 		}
-		t.rows, t.err = t.s.DB.Query(t.s.sql(
-			"SELECT k, v FROM rows WHERE k "+t.op+" ? ORDER BY k LIMIT "+strconv.Itoa(batchSize)),
-			t.low)
+		where, args := "k "+t.op+" ?", []interface{}{t.low}
+		if t.high != "" {
+			where += " AND k < ?"
+			args = append(args, t.high)
+		}
+		query := t.s.sql("SELECT k, v FROM rows WHERE " + where + " ORDER BY k LIMIT " + strconv.Itoa(batchSize))
+		if t.s.CacheStatements {
+			var st *sql.Stmt
+			if st, t.err = t.s.prepared(query); t.err == nil {
+				t.rows, t.err = st.Query(args...)
+			}
+		} else {
+			t.rows, t.err = t.s.DB.Query(query, args...)
+		}
 		if t.s.Serial {
 			t.s.mu.Unlock()
 		}
@@ -18,6 +18,8 @@ package sqlite
 
 import (
 	"bytes"
+	"database/sql"
+	"fmt"
 	"log"
 	"os"
 	"os/exec"
@@ -26,12 +28,86 @@ import (
 	"strings"
 )
 
-const requiredSchemaVersion = 1
+const requiredSchemaVersion = 2
 
 func SchemaVersion() int {
 	return requiredSchemaVersion
 }
 
+// A migration upgrades the schema from fromVersion to fromVersion+1.
+type migration struct {
+	fromVersion int
+	sql         []string
+}
+
+// migrations are the upgrade steps to requiredSchemaVersion, in order.
+// When bumping requiredSchemaVersion, append the step from the previous
+// version here, and update SQLCreateTables to match.
+//
+// There's no step from version 1: version 2 added the claimtime rows,
+// which only reindexing can make, so such a database must be wiped
+// and rebuilt.
+var migrations = []migration{}
+
+// migrate upgrades the schema of db, as found in its meta table, to
+// version target, running the needed steps from steps and recording
+// the new version after each. A database without a version (e.g. not
+// initialized yet) is left alone.
+func migrate(db *sql.DB, target int, steps []migration) error {
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='meta'").Scan(&tables); err != nil {
+		return fmt.Errorf("looking for the meta table: %v", err)
+	}
+	if tables == 0 {
+		return nil
+	}
+	var version int
+	switch err := db.QueryRow("SELECT value FROM meta WHERE metakey='version'").Scan(&version); {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return fmt.Errorf("reading the database schema version: %v", err)
+	}
+	if version > target {
+		return fmt.Errorf("database schema version is %d, newer than the %d this binary supports; upgrade camlistored", version, target)
+	}
+	for version < target {
+		step, ok := findMigration(steps, version)
+		if !ok {
+			return fmt.Errorf("no migration from database schema version %d to %d (need to re-init the database and reindex?)", version, version+1)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range step.sql {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migrating database schema from version %d: %v", version, err)
+			}
+		}
+		version++
+		if _, err := tx.Exec("REPLACE INTO meta VALUES ('version', ?)", fmt.Sprint(version)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("sqlite: migrated database schema to version %d", version)
+	}
+	return nil
+}
+
+func findMigration(steps []migration, from int) (migration, bool) {
+	for _, m := range steps {
+		if m.fromVersion == from {
+			return m, true
+		}
+	}
+	return migration{}, false
+}
+
 func SQLCreateTables() []string {
 	return []string{
 		`CREATE TABLE rows (
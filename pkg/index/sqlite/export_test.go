@@ -0,0 +1,32 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sqlite
+
+import "camlistore.org/pkg/index"
+
+// ExpSetCacheStatements sets whether s, which must come from
+// NewStorage, caches its prepared statements.
+func ExpSetCacheStatements(s index.Storage, v bool) {
+	s.(*storage).CacheStatements = v
+}
+
+// ExpPragma returns the value of the integer pragma name on a
+// connection of s, which must come from NewStorage.
+func ExpPragma(s index.Storage, name string) (v int64, err error) {
+	err = s.(*storage).db.QueryRow("PRAGMA " + name).Scan(&v)
+	return
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2013 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sqlite
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newMigrateDB(t *testing.T, version string) (db *sql.DB, clean func()) {
+	if !compiled {
+		t.Skip("SQLite support not compiled in")
+	}
+	f, err := ioutil.TempFile("", "sqlite-migrate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	db, err = sql.Open("sqlite3", f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean = func() {
+		db.Close()
+		os.Remove(f.Name())
+	}
+	for _, stmt := range append(SQLCreateTables(), "REPLACE INTO meta VALUES ('version', '"+version+"')") {
+		if _, err := db.Exec(stmt); err != nil {
+			clean()
+			t.Fatal(err)
+		}
+	}
+	return db, clean
+}
+
+func schemaVersion(t *testing.T, db *sql.DB) (version int) {
+	if err := db.QueryRow("SELECT value FROM meta WHERE metakey='version'").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestMigrate(t *testing.T) {
+	db, clean := newMigrateDB(t, "1")
+	defer clean()
+	// Out of order, to check they're looked up by version.
+	steps := []migration{
+		{fromVersion: 2, sql: []string{`INSERT INTO extra VALUES ('x')`}},
+		{fromVersion: 1, sql: []string{`CREATE TABLE extra (v VARCHAR(255))`}},
+	}
+	if err := migrate(db, 3, steps); err != nil {
+		t.Fatal(err)
+	}
+	if v := schemaVersion(t, db); v != 3 {
+		t.Errorf("version after migration = %d; want 3", v)
+	}
+	var got string
+	if err := db.QueryRow("SELECT v FROM extra").Scan(&got); err != nil || got != "x" {
+		t.Errorf("migrated table row = %q, %v; want \"x\"", got, err)
+	}
+	// Nothing left to do.
+	if err := migrate(db, 3, nil); err != nil {
+		t.Errorf("migrate at target version: %v", err)
+	}
+}
+
+func TestMigrateFailedStep(t *testing.T) {
+	db, clean := newMigrateDB(t, "1")
+	defer clean()
+	steps := []migration{
+		{fromVersion: 1, sql: []string{`CREATE TABLE extra (v VARCHAR(255))`}},
+		{fromVersion: 2, sql: []string{`CREATE TABLE more (v VARCHAR(255))`, `BOGUS SQL`}},
+	}
+	if err := migrate(db, 3, steps); err == nil {
+		t.Fatal("migrate with a bad step succeeded")
+	}
+	// The first step stuck; the second was rolled back.
+	if v := schemaVersion(t, db); v != 2 {
+		t.Errorf("version after failed migration = %d; want 2", v)
+	}
+	if _, err := db.Exec("SELECT * FROM more"); err == nil {
+		t.Errorf("table from rolled back step exists")
+	}
+}
+
+func TestMigrateErrors(t *testing.T) {
+	db, clean := newMigrateDB(t, "5")
+	defer clean()
+	if err := migrate(db, 3, nil); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("migrate from a newer version: err = %v; want newer version error", err)
+	}
+	if err := migrate(db, 7, nil); err == nil {
+		t.Errorf("migrate without steps succeeded")
+	}
+	if v := schemaVersion(t, db); v != 5 {
+		t.Errorf("version = %d; want unchanged 5", v)
+	}
+
+	// A version that can't be read is an error, not a missing one.
+	if _, err := db.Exec("REPLACE INTO meta VALUES ('version', 'bogus')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db, 7, nil); err == nil {
+		t.Errorf("migrate with an unreadable version succeeded")
+	}
+}
+
+func TestMigrateUninitialized(t *testing.T) {
+	db, clean := newMigrateDB(t, "1")
+	defer clean()
+	if _, err := db.Exec("DELETE FROM meta"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db, 3, nil); err != nil {
+		t.Errorf("migrate without a version row: %v", err)
+	}
+	if _, err := db.Exec("DROP TABLE meta"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(db, 3, nil); err != nil {
+		t.Errorf("migrate without a meta table: %v", err)
+	}
+}
@@ -22,7 +22,12 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"camlistore.org/pkg/blobserver"
 	"camlistore.org/pkg/index"
@@ -56,30 +61,174 @@ func compileHint() string {
 	return ""
 }
 
+// DefaultBusyTimeout is how long NewStorage's connections wait on a
+// locked database before failing with SQLITE_BUSY.
+const DefaultBusyTimeout = 5 * time.Second
+
+// driverName is the database/sql driver registered by sqlite_cond.go.
+// It wraps the go-sqlite3 driver to set the busy timeout encoded in
+// the DSN on every new connection.
+const driverName = "camli-sqlite3"
+
+// maxBatchKeys bounds the size of the transactions batches are
+// committed with, so a huge batch doesn't grow one unboundedly.
+const maxBatchKeys = 10000
+
+const (
+	busyTimeoutKey   = "_busy_timeout"
+	busyTimeoutParam = "?" + busyTimeoutKey + "="
+	cacheSizeKey     = "_cache_size"
+)
+
+// makeDSN returns the DSN for file with the given busy timeout and,
+// unless zero, cache size (as for Options.CacheSize).
+func makeDSN(file string, busyTimeout time.Duration, cacheSize int) string {
+	dsn := file + busyTimeoutParam + strconv.FormatInt(int64(busyTimeout/time.Millisecond), 10)
+	if cacheSize != 0 {
+		dsn += "&" + cacheSizeKey + "=" + strconv.Itoa(cacheSize)
+	}
+	return dsn
+}
+
+// parseDSN is the inverse of makeDSN. The busy timeout is in
+// milliseconds; a zero cache size means SQLite's default.
+func parseDSN(dsn string) (file string, busyTimeoutMs, cacheSize int64, err error) {
+	i := strings.LastIndex(dsn, busyTimeoutParam)
+	if i < 0 {
+		return dsn, int64(DefaultBusyTimeout / time.Millisecond), 0, nil
+	}
+	params, err := url.ParseQuery(dsn[i+1:])
+	if err != nil {
+		return "", 0, 0, err
+	}
+	busyTimeoutMs, err = strconv.ParseInt(params.Get(busyTimeoutKey), 10, 64)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if v := params.Get(cacheSizeKey); v != "" {
+		if cacheSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	return dsn[:i], busyTimeoutMs, cacheSize, nil
+}
+
+// Options are the settings of the storage returned by
+// NewStorageOptions. Their zero values are the defaults.
+type Options struct {
+	// BusyTimeout is how long connections wait on a locked
+	// database. Zero means DefaultBusyTimeout.
+	BusyTimeout time.Duration
+
+	// PageSize, if non-zero, is the database page size in bytes,
+	// a power of two from 512 to 65536. SQLite only changes it
+	// while the database has no tables, so it's meant for a new,
+	// empty file; see also PageSizePragma. Larger pages suit large
+	// indexes on disks with large blocks.
+	PageSize int
+
+	// CacheSize, if non-zero, is each connection's page cache
+	// size, as the cache_size pragma takes it: a number of pages
+	// if positive, or of KiB if negative. A cache holding the
+	// working set of the index spares most reads from disk.
+	CacheSize int
+}
+
+// PageSizePragma returns the statement setting the page size of a
+// new database to size bytes, to run before its tables are created.
+func PageSizePragma(size int) string {
+	return fmt.Sprintf("PRAGMA page_size = %d", size)
+}
+
 // NewStorage returns an index.Storage implementation of the described SQLite database.
-// This exists mostly for testing and does not initialize the schema.
+// This exists mostly for testing and does not initialize the schema, but an
+// initialized schema older than SchemaVersion is upgraded in place.
+// It is equivalent to NewStorageBusyTimeout(file, DefaultBusyTimeout).
 func NewStorage(file string) (index.Storage, error) {
+	return NewStorageBusyTimeout(file, DefaultBusyTimeout)
+}
+
+// NewStorageBusyTimeout is like NewStorage, but its connections wait up to
+// busyTimeout for a locked database instead of DefaultBusyTimeout.
+func NewStorageBusyTimeout(file string, busyTimeout time.Duration) (index.Storage, error) {
+	return NewStorageOptions(file, Options{BusyTimeout: busyTimeout})
+}
+
+// NewStorageOptions is like NewStorage, but with the given options.
+//
+// The database is switched to Write-Ahead Logging, so readers don't
+// block the writer. If that fails (e.g. SQLite < 3.7.0), accesses are
+// serialized instead. The statements of the hot paths are prepared
+// once and kept until the storage's Close.
+func NewStorageOptions(file string, opts Options) (index.Storage, error) {
 	if !compiled {
 		return nil, ErrNotCompiled
 	}
-	db, err := sql.Open("sqlite3", file)
+	busyTimeout := opts.BusyTimeout
+	if busyTimeout == 0 {
+		busyTimeout = DefaultBusyTimeout
+	}
+	db, err := sql.Open(driverName, makeDSN(file, busyTimeout, opts.CacheSize))
 	if err != nil {
 		return nil, err
 	}
+	if opts.PageSize != 0 {
+		// Before enabling WAL, which fixes the page size.
+		if err := setPageSize(db, opts.PageSize); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("sqlite: %s: %v", file, err)
+		}
+	}
+	var mode string
+	if err := db.QueryRow(EnableWAL()).Scan(&mode); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: enabling WAL on %s: %v", file, err)
+	}
+	wal := strings.ToLower(mode) == "wal"
+	if !wal {
+		log.Printf("sqlite: %s: journal mode is %q, not WAL; serializing accesses. See http://camlistore.org/issues/114", file, mode)
+	}
+	if err := migrate(db, requiredSchemaVersion, migrations); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: %s: %v", file, err)
+	}
 	return &storage{
 		file: file,
 		db:   db,
 		Storage: &sqlindex.Storage{
-			DB: db,
-			Serial: true,
+			DB:              db,
+			Serial:          !wal,
+			MaxBatchKeys:    maxBatchKeys,
+			CacheStatements: true,
 		},
 	}, nil
 }
 
+// setPageSize sets the page size of db, which only takes effect if
+// it has no tables yet. Otherwise the page size in use is logged.
+func setPageSize(db *sql.DB, size int) error {
+	if size < 512 || size > 65536 || size&(size-1) != 0 {
+		return fmt.Errorf("invalid page size %d; want a power of two from 512 to 65536", size)
+	}
+	if _, err := db.Exec(PageSizePragma(size)); err != nil {
+		return err
+	}
+	var got int
+	if err := db.QueryRow("PRAGMA page_size").Scan(&got); err != nil {
+		return err
+	}
+	if got != size {
+		log.Printf("sqlite: page size is %d, not %d: it can't be changed once tables exist", got, size)
+	}
+	return nil
+}
+
 func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Storage, error) {
 	var (
 		blobPrefix = config.RequiredString("blobSource")
 		file       = config.RequiredString("file")
+		busyMillis = config.OptionalInt("busyTimeoutMillis", int(DefaultBusyTimeout/time.Millisecond))
+		cacheSize  = config.OptionalInt("cacheSize", 0)
 	)
 	if err := config.Validate(); err != nil {
 		return nil, err
@@ -92,7 +241,10 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Stor
 	if os.IsNotExist(err) || (err == nil && fi.Size() == 0) {
 		return nil, fmt.Errorf(`You need to initialize your SQLite index database with: camtool dbinit --dbname=%s --dbtype=sqlite`, file)
 	}
-	isto, err := NewStorage(file)
+	isto, err := NewStorageOptions(file, Options{
+		BusyTimeout: time.Duration(busyMillis) * time.Millisecond,
+		CacheSize:   cacheSize,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -103,10 +255,6 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Stor
 		return nil, fmt.Errorf("error getting schema version (need to init database with 'camtool dbinit %s'?): %v", file, err)
 	}
 
-	if err := is.ping(); err != nil {
-		return nil, err
-	}
-
 	if version != requiredSchemaVersion {
 		if os.Getenv("CAMLI_ADVERTISED_PASSWORD") != "" {
 			// Good signal that we're using the dev-server script, so help out
@@ -116,6 +264,9 @@ func newFromConfig(ld blobserver.Loader, config jsonconfig.Obj) (blobserver.Stor
 		return nil, fmt.Errorf("database schema version is %d; expect %d (need to re-init/upgrade database?)",
 			version, requiredSchemaVersion)
 	}
+	if err := is.Check(); err != nil {
+		return nil, err
+	}
 
 	ix := index.New(is)
 	ix.BlobSource = sto
@@ -129,10 +280,53 @@ func init() {
 	blobserver.RegisterStorageConstructor("sqliteindexer", blobserver.StorageConstructor(newFromConfig))
 }
 
-func (mi *storage) ping() error {
-	// TODO(bradfitz): something more efficient here?
-	_, err := mi.SchemaVersion()
-	return err
+// Compact rebuilds the database file to reclaim the space of deleted
+// rows, and refreshes the query planner's statistics. It may take a
+// while on a large index, and fails if another statement is in progress,
+// so it should be called while the storage is otherwise idle.
+func (mi *storage) Compact() error {
+	for _, stmt := range []string{
+		"VACUUM",
+		"ANALYZE",
+		// Truncate the write-ahead log VACUUM just filled.
+		"PRAGMA wal_checkpoint(TRUNCATE)",
+	} {
+		if _, err := mi.db.Exec(stmt); err != nil {
+			return fmt.Errorf("sqlite: compacting %s: %s: %v", mi.file, stmt, err)
+		}
+	}
+	return nil
+}
+
+var _ index.Checker = (*storage)(nil)
+
+// Check verifies that the database file can be opened, that it has
+// the tables of SQLCreateTables, and that its schema version is
+// SchemaVersion.
+func (mi *storage) Check() error {
+	if err := mi.db.Ping(); err != nil {
+		return fmt.Errorf("sqlite: opening %s: %v", mi.file, err)
+	}
+	for _, table := range []string{"rows", "meta"} {
+		var n int
+		if err := mi.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?", table).Scan(&n); err != nil {
+			return fmt.Errorf("sqlite: %s: looking up table %q: %v", mi.file, table, err)
+		}
+		if n == 0 {
+			return fmt.Errorf("sqlite: %s: missing table %q (need to init database with 'camtool dbinit'?)", mi.file, table)
+		}
+	}
+	version, err := mi.SchemaVersion()
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("sqlite: %s: no schema version in meta table", mi.file)
+	}
+	if err != nil {
+		return fmt.Errorf("sqlite: %s: getting schema version: %v", mi.file, err)
+	}
+	if version != requiredSchemaVersion {
+		return fmt.Errorf("sqlite: %s: database schema version is %d; expect %d", mi.file, version, requiredSchemaVersion)
+	}
+	return nil
 }
 
 func (mi *storage) SchemaVersion() (version int, err error) {
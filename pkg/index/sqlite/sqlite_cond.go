@@ -3,9 +3,46 @@
 package sqlite
 
 import (
-	_ "camlistore.org/third_party/github.com/mattn/go-sqlite3"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+
+	sqlite3 "camlistore.org/third_party/github.com/mattn/go-sqlite3"
 )
 
 func init() {
 	compiled = true
+	sql.Register(driverName, busyDriver{})
+}
+
+// busyDriver is the go-sqlite3 driver, but setting each new
+// connection's busy timeout and cache size from the DSN built by
+// makeDSN.
+type busyDriver struct{}
+
+func (busyDriver) Open(dsn string) (driver.Conn, error) {
+	file, busyTimeoutMs, cacheSize, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := new(sqlite3.SQLiteDriver).Open(file)
+	if err != nil {
+		return nil, err
+	}
+	pragmas := []string{fmt.Sprintf("PRAGMA busy_timeout = %d", busyTimeoutMs)}
+	if cacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size = %d", cacheSize))
+	}
+	for _, pragma := range pragmas {
+		stmt, err := conn.Prepare(pragma)
+		if err == nil {
+			_, err = stmt.Exec(nil)
+			stmt.Close()
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
 }
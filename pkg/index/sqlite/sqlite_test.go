@@ -19,8 +19,10 @@ package sqlite_test
 import (
 	"database/sql"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 
@@ -45,13 +47,21 @@ func do(db *sql.DB, sql string) {
 	panic(fmt.Sprintf("Error %v running SQL: %s", err, sql))
 }
 
-func makeStorage(t *testing.T) (s index.Storage, clean func()) {
+func makeStorage(t testing.TB) (s index.Storage, clean func()) {
+	s, _, clean = makeStorageFile(t)
+	return
+}
+
+func makeStorageFile(t testing.TB) (s index.Storage, file string, clean func()) {
 	f, err := ioutil.TempFile("", "sqlite-test")
 	if err != nil {
 		t.Fatal(err)
 	}
 	clean = func() {
 		os.Remove(f.Name())
+		// Left behind by Write-Ahead Logging.
+		os.Remove(f.Name() + "-wal")
+		os.Remove(f.Name() + "-shm")
 	}
 	db, err := sql.Open("sqlite3", f.Name())
 	if err != nil {
@@ -65,7 +75,7 @@ func makeStorage(t *testing.T) (s index.Storage, clean func()) {
 	if err != nil {
 		panic(err)
 	}
-	return s, clean
+	return s, f.Name(), clean
 }
 
 type sqliteTester struct{}
@@ -105,6 +115,14 @@ func TestEdgesTo_SQLite(t *testing.T) {
 	sqliteTester{}.test(t, indextest.EdgesTo)
 }
 
+func TestFind_SQLite(t *testing.T) {
+	sqliteTester{}.test(t, indextest.Find)
+}
+
+func TestClaimsSince_SQLite(t *testing.T) {
+	sqliteTester{}.test(t, indextest.ClaimsSince)
+}
+
 func TestConcurrency(t *testing.T) {
 	if testing.Short() {
 		t.Logf("skipping for short mode")
@@ -129,3 +147,290 @@ func TestConcurrency(t *testing.T) {
 		}
 	}
 }
+
+func TestWALAndBusyTimeout(t *testing.T) {
+	s, file, clean := makeStorageFile(t)
+	defer clean()
+	// Force connections beyond the first, which must all wait
+	// on the lock rather than fail with "database is locked".
+	const n = 20
+	ch := make(chan error)
+	for i := 0; i < n; i++ {
+		i := i
+		go func() {
+			bm := s.BeginBatch()
+			for j := 0; j < 10; j++ {
+				bm.Set(fmt.Sprintf("key-%d-%d", i, j), fmt.Sprintf("val-%d", j))
+			}
+			ch <- s.CommitBatch(bm)
+		}()
+	}
+	for i := 0; i < n; i++ {
+		if err := <-ch; err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+
+	// The journal mode is persistent, so a fresh connection sees it too.
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var mode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	if mode != "wal" {
+		t.Errorf("journal_mode = %q; want wal", mode)
+	}
+}
+
+func TestNewStorageNewerSchema(t *testing.T) {
+	_, file, clean := makeStorageFile(t)
+	defer clean()
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	do(db, fmt.Sprintf(`REPLACE INTO meta VALUES ('version', '%d')`, sqlite.SchemaVersion()+1))
+	if _, err := sqlite.NewStorage(file); err == nil {
+		t.Errorf("NewStorage succeeded on a database with a newer schema version")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	s, file, clean := makeStorageFile(t)
+	defer clean()
+	defer s.(io.Closer).Close()
+	if err := index.Check(s); err != nil {
+		t.Fatalf("Check on a fresh database = %v", err)
+	}
+	db, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, tt := range []struct {
+		sql     string
+		wantErr string
+	}{
+		{fmt.Sprintf(`REPLACE INTO meta VALUES ('version', '%d')`, sqlite.SchemaVersion()+1), "schema version is"},
+		{`DELETE FROM meta WHERE metakey='version'`, "no schema version"},
+		{`DROP TABLE rows`, `missing table "rows"`},
+	} {
+		do(db, tt.sql)
+		err := index.Check(s)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("after %s, Check = %v; want error containing %q", tt.sql, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	s, file, clean := makeStorageFile(t)
+	defer clean()
+	const n = 2000
+	bm := s.BeginBatch()
+	for i := 0; i < n; i++ {
+		bm.Set(fmt.Sprintf("key-%04d", i), strings.Repeat("v", 100))
+	}
+	if err := s.CommitBatch(bm); err != nil {
+		t.Fatal(err)
+	}
+	bm = s.BeginBatch()
+	for i := 0; i < n; i += 2 {
+		bm.Delete(fmt.Sprintf("key-%04d", i))
+	}
+	if err := s.CommitBatch(bm); err != nil {
+		t.Fatal(err)
+	}
+	// With WAL, recent pages live in the log, not the main file.
+	size := func() (n int64) {
+		for _, name := range []string{file, file + "-wal"} {
+			if fi, err := os.Stat(name); err == nil {
+				n += fi.Size()
+			}
+		}
+		return
+	}
+	before := size()
+
+	if err := s.(interface {
+		Compact() error
+	}).Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+
+	if after := size(); after >= before {
+		t.Errorf("database size after Compact = %d; want less than %d", after, before)
+	}
+	if _, err := s.Get("key-0000"); err != index.ErrNotFound {
+		t.Errorf("Get of deleted key = %v; want ErrNotFound", err)
+	}
+	if v, err := s.Get("key-0001"); err != nil || v != strings.Repeat("v", 100) {
+		t.Errorf("Get of kept key = %q, %v", v, err)
+	}
+}
+
+func TestHugeBatch(t *testing.T) {
+	s, clean := makeStorage(t)
+	defer clean()
+	// More than one transaction's worth of keys.
+	const n = 25000
+	bm := s.BeginBatch()
+	for i := 0; i < n; i++ {
+		bm.Set(fmt.Sprintf("key-%05d", i), fmt.Sprint(i))
+	}
+	bm.Delete("key-00000")
+	if err := s.CommitBatch(bm); err != nil {
+		t.Fatal(err)
+	}
+	it := s.Find("", "")
+	i := 1
+	for ; it.Next(); i++ {
+		if want := fmt.Sprintf("key-%05d", i); it.Key() != want || it.Value() != fmt.Sprint(i) {
+			t.Fatalf("row %d = %q, %q; want %q, %q", i, it.Key(), it.Value(), want, fmt.Sprint(i))
+		}
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if i != n {
+		t.Errorf("found %d rows; want %d", i-1, n-1)
+	}
+}
+
+func TestBatchSetAndDelete(t *testing.T) {
+	s, clean := makeStorage(t)
+	defer clean()
+	for _, k := range []string{"kept", "stale", "replaced"} {
+		if err := s.Set(k, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bm := s.BeginBatch()
+	bm.Delete("stale")
+	bm.Set("added", "new")
+	bm.Set("temp", "new")
+	bm.Delete("temp")
+	bm.Delete("replaced")
+	bm.Set("replaced", "new")
+	bm.Delete("never-set")
+	if err := s.CommitBatch(bm); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"added":    "new",
+		"kept":     "old",
+		"replaced": "new",
+		"stale":    "",
+		"temp":     "",
+	}
+	for k, wantv := range want {
+		v, err := s.Get(k)
+		if wantv == "" {
+			if err != index.ErrNotFound {
+				t.Errorf("Get(%q) = %q, %v; want ErrNotFound", k, v, err)
+			}
+			continue
+		}
+		if err != nil || v != wantv {
+			t.Errorf("Get(%q) = %q, %v; want %q", k, v, err, wantv)
+		}
+	}
+}
+
+func TestCloseStatements(t *testing.T) {
+	s, clean := makeStorage(t)
+	defer clean()
+	if err := s.Set("foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get("foo"); err != nil || v != "bar" {
+		t.Fatalf("Get = %q, %v; want bar", v, err)
+	}
+	if err := s.(io.Closer).Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := s.Get("foo"); err == nil {
+		t.Error("Get after Close succeeded")
+	}
+}
+
+func benchmarkCommitBatch(b *testing.B, cache bool) {
+	s, clean := makeStorage(b)
+	defer clean()
+	defer s.(io.Closer).Close()
+	sqlite.ExpSetCacheStatements(s, cache)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bm := s.BeginBatch()
+		for j := 0; j < 10; j++ {
+			bm.Set(fmt.Sprintf("key-%d-%d", i, j), "value")
+		}
+		if err := s.CommitBatch(bm); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCommitBatchCached(b *testing.B)   { benchmarkCommitBatch(b, true) }
+func BenchmarkCommitBatchUncached(b *testing.B) { benchmarkCommitBatch(b, false) }
+
+func TestPragmas(t *testing.T) {
+	f, err := ioutil.TempFile("", "sqlite-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer func() {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			os.Remove(f.Name() + suffix)
+		}
+	}()
+	s, err := sqlite.NewStorageOptions(f.Name(), sqlite.Options{PageSize: 8192, CacheSize: -4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.(io.Closer).Close()
+	for pragma, want := range map[string]int64{"page_size": 8192, "cache_size": -4096} {
+		got, err := sqlite.ExpPragma(s, pragma)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("%s = %d; want %d", pragma, got, want)
+		}
+	}
+	// The page size is the database's, the cache size only the
+	// storage's connections'.
+	db, err := sql.Open("sqlite3", f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var pageSize, cacheSize int64
+	if err := db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		t.Fatal(err)
+	}
+	if pageSize != 8192 {
+		t.Errorf("page_size of another connection = %d; want 8192", pageSize)
+	}
+	if err := db.QueryRow("PRAGMA cache_size").Scan(&cacheSize); err != nil {
+		t.Fatal(err)
+	}
+
+	// By default, neither is changed.
+	s2, clean := makeStorage(t)
+	defer clean()
+	defer s2.(io.Closer).Close()
+	if got, err := sqlite.ExpPragma(s2, "cache_size"); err != nil || got != cacheSize {
+		t.Errorf("default cache_size = %d, %v; want SQLite's %d", got, err, cacheSize)
+	}
+
+	if _, err := sqlite.NewStorageOptions(f.Name(), sqlite.Options{PageSize: 1000}); err == nil {
+		t.Errorf("NewStorageOptions with a page size of 1000 succeeded")
+	}
+}
@@ -22,9 +22,12 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sync"
 	"testing"
 
+	"camlistore.org/pkg/blobref"
 	"camlistore.org/pkg/test"
+	"camlistore.org/pkg/types"
 )
 
 var testFetcher = &test.Fetcher{}
@@ -109,6 +112,7 @@ var readTests = []readTest{
 	{parts(part(blobA, 5, 5), part(blobB, 0, 5), part(blobC, 4, 2)), 1, "aaaaBBBBBCc"},
 	{parts(all(blobA), zero(2), all(blobB)), 5, "aaaaa\x00\x00BBBBBbbbbb"},
 	{parts(all(blobB), part(blobC, 4, 2)), 0, "BBBBBbbbbbCc"},
+	{parts(part(blobA, 2, 5), all(blobB)), 1, "AAaa" + "BBBBBbbbbb"},
 	{parts(
 		all(blobA),
 		filePart(parts(all(blobB), part(blobC, 4, 2)), 0),
@@ -232,3 +236,61 @@ func (s summary) String() string {
 	}
 	return fmt.Sprintf("%d bytes, starting with %q", len(s), []byte(s[:plen]))
 }
+
+// countingFetcher counts the blobs fetched through it.
+type countingFetcher struct {
+	blobref.SeekFetcher
+	mu sync.Mutex
+	n  int
+}
+
+func (cf *countingFetcher) Fetch(br *blobref.BlobRef) (types.ReadSeekCloser, int64, error) {
+	cf.mu.Lock()
+	cf.n++
+	cf.mu.Unlock()
+	return cf.SeekFetcher.Fetch(br)
+}
+
+func (cf *countingFetcher) count() int {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	return cf.n
+}
+
+func TestReadAtFetchesBounded(t *testing.T) {
+	const fileSize = 20 << 20
+	sto := new(test.Fetcher)
+	fileref, err := WriteFileFromReader(sto, "big", &randReader{seed: 1, length: fileSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nblobs int
+	all := make(chan blobref.SizedBlobRef)
+	go sto.EnumerateBlobs(all, "", 100000, 0)
+	for _ = range all {
+		nblobs++
+	}
+
+	want, _ := ioutil.ReadAll(&randReader{seed: 1, length: fileSize})
+	cf := &countingFetcher{SeekFetcher: sto}
+	fr, err := NewFileReader(cf, fileref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+	buf := make([]byte, 4096)
+	off := int64(fileSize - 10000)
+	if _, err := fr.ReadAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, want[off:off+int64(len(buf))]) {
+		t.Errorf("ReadAt returned the wrong bytes")
+	}
+	// The file schema blob, the "bytes" blobs on the way down the
+	// tree, and a chunk or two.
+	if n := cf.count(); n > 10 {
+		t.Errorf("ReadAt fetched %d blobs (of %d in the file); want at most 10", n, nblobs)
+	} else {
+		t.Logf("ReadAt fetched %d of %d blobs", n, nblobs)
+	}
+}
@@ -146,6 +146,9 @@ var _ interface {
 	Size() int64
 } = (*FileReader)(nil)
 
+// ReadAt reads len(p) bytes at offset. Only the blobs holding
+// that range (and the "bytes" schema blobs leading to them) are
+// fetched, so it's suited to random access in large files.
 func (fr *FileReader) ReadAt(p []byte, offset int64) (n int, err error) {
 	if offset < 0 {
 		return 0, errors.New("schema/filereader: negative offset")
@@ -325,6 +328,9 @@ func (fr *FileReader) readerForOffset(off int64) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Only the rest of this part, which may not extend to the end
+	// of its blob.
+	partRemain := int64(p0.Size) - offRemain
 	offRemain += int64(p0.Offset)
 	if offRemain > 0 {
 		newPos, err := rsc.Seek(offRemain, os.SEEK_SET)
@@ -339,7 +345,7 @@ func (fr *FileReader) readerForOffset(off int64) (io.ReadCloser, error) {
 		io.Reader
 		io.Closer
 	}{
-		io.LimitReader(rsc, int64(p0.Size)),
+		io.LimitReader(rsc, partRemain),
 		rsc,
 	}, nil
 }
@@ -58,19 +58,101 @@ const (
 	tooSmallThreshold = 64 << 10
 )
 
+// ChunkOptions controls how a file's contents are cut into chunks.
+// Small chunks dedup better among similar files, but cost more
+// blobs and more schema per byte.
+// The zero value (or a nil *ChunkOptions) is the default chunking.
+type ChunkOptions struct {
+	// Fixed, if true, cuts chunks of exactly MaxSize bytes (the
+	// last may be shorter) rather than at rolling checksum
+	// boundaries.
+	Fixed bool
+
+	// MinSize is the size below which a chunk isn't cut at a
+	// rolling checksum boundary. Zero means 64 KB, or MaxSize if
+	// that's smaller.
+	MinSize int
+
+	// MaxSize is the size at which a chunk is always cut. Zero
+	// means, and it may be at most, 1 MB.
+	MaxSize int
+
+	// NoFirstChunk, if true, cuts the start of the file at rolling
+	// checksum boundaries too, rather than keeping its first 256 KB
+	// whole (for tools reading metadata at the start of files) or,
+	// if MaxSize is smaller, cut every MaxSize bytes. Bytes inserted
+	// or removed there then only change the chunks around them,
+	// rather than all those up to 256 KB.
+	NoFirstChunk bool
+}
+
+func (o *ChunkOptions) minSize() int {
+	if o == nil || o.MinSize == 0 {
+		if max := o.maxSize(); max < tooSmallThreshold {
+			return max
+		}
+		return tooSmallThreshold
+	}
+	return o.MinSize
+}
+
+func (o *ChunkOptions) maxSize() int {
+	if o == nil || o.MaxSize == 0 {
+		return maxBlobSize
+	}
+	return o.MaxSize
+}
+
+func (o *ChunkOptions) fixed() bool {
+	return o != nil && o.Fixed
+}
+
+func (o *ChunkOptions) firstChunk() bool {
+	return o == nil || !o.NoFirstChunk
+}
+
+// Validate returns an error if o's sizes are out of range.
+func (o *ChunkOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.MinSize < 0 || o.MaxSize < 0 || o.MaxSize > maxBlobSize {
+		return fmt.Errorf("schema: invalid chunk sizes %d to %d; maximum chunk size is %d", o.MinSize, o.MaxSize, maxBlobSize)
+	}
+	if o.minSize() > o.maxSize() {
+		return fmt.Errorf("schema: minimum chunk size %d larger than maximum %d", o.minSize(), o.maxSize())
+	}
+	return nil
+}
+
 // WriteFileFromReader creates and uploads a "file" JSON schema
 // composed of chunks of r, also uploading the chunks.  The returned
 // BlobRef is of the JSON file schema blob.
 func WriteFileFromReader(bs blobserver.StatReceiver, filename string, r io.Reader) (*blobref.BlobRef, error) {
+	return WriteFileFromReaderChunked(bs, filename, r, nil)
+}
+
+// WriteFileFromReaderChunked is like WriteFileFromReader, but cuts
+// r into chunks as specified by opts.
+func WriteFileFromReaderChunked(bs blobserver.StatReceiver, filename string, r io.Reader, opts *ChunkOptions) (*blobref.BlobRef, error) {
 	m := NewFileMap(filename)
-	return WriteFileMap(bs, m, r)
+	return WriteFileMapChunked(bs, m, r, opts)
 }
 
 // WriteFileMap uploads chunks of r to bs while populating file and
 // finally uploading file's Blob. The returned blobref is of file's
 // JSON blob.
 func WriteFileMap(bs blobserver.StatReceiver, file *Builder, r io.Reader) (*blobref.BlobRef, error) {
-	return writeFileMapRolling(bs, file, r)
+	return writeFileMapRolling(bs, file, r, nil)
+}
+
+// WriteFileMapChunked is like WriteFileMap, but cuts r into chunks
+// as specified by opts.
+func WriteFileMapChunked(bs blobserver.StatReceiver, file *Builder, r io.Reader, opts *ChunkOptions) (*blobref.BlobRef, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return writeFileMapRolling(bs, file, r, opts)
 }
 
 // This is the simple 1MB chunk version. The rolling checksum version is below.
@@ -122,7 +204,7 @@ func writeFileMapOld(bs blobserver.StatReceiver, file *Builder, r io.Reader) (*b
 	if err != nil {
 		return nil, err
 	}
-	br := blobref.SHA1FromString(json)
+	br := blobref.FromString(json)
 	sb, err := bs.ReceiveBlob(br, strings.NewReader(json))
 	if err != nil {
 		return nil, err
@@ -225,7 +307,7 @@ func uploadBytes(bs blobserver.StatReceiver, bb *Builder, size int64, s []span)
 	}
 
 	json := bb.Blob().JSON()
-	br := blobref.SHA1FromString(json)
+	br := blobref.FromString(json)
 	future.br = br
 	go func() {
 		_, err := uploadString(bs, br, json)
@@ -303,8 +385,8 @@ func addBytesParts(bs blobserver.StatReceiver, dst *[]BytesPart, spans []span, p
 // writeFileMap uploads chunks of r to bs while populating fileMap and
 // finally uploading fileMap. The returned blobref is of fileMap's
 // JSON blob. It uses rolling checksum for the chunks sizes.
-func writeFileMapRolling(bs blobserver.StatReceiver, file *Builder, r io.Reader) (*blobref.BlobRef, error) {
-	n, spans, err := writeFileChunks(bs, file, r)
+func writeFileMapRolling(bs blobserver.StatReceiver, file *Builder, r io.Reader, opts *ChunkOptions) (*blobref.BlobRef, error) {
+	n, spans, err := writeFileChunks(bs, file, r, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -315,7 +397,7 @@ func writeFileMapRolling(bs blobserver.StatReceiver, file *Builder, r io.Reader)
 // WriteFileChunks uploads chunks of r to bs while populating file.
 // It does not upload file.
 func WriteFileChunks(bs blobserver.StatReceiver, file *Builder, r io.Reader) error {
-	size, spans, err := writeFileChunks(bs, file, r)
+	size, spans, err := writeFileChunks(bs, file, r, nil)
 	if err != nil {
 		return err
 	}
@@ -329,7 +411,9 @@ func WriteFileChunks(bs blobserver.StatReceiver, file *Builder, r io.Reader) err
 	return file.PopulateParts(size, parts)
 }
 
-func writeFileChunks(bs blobserver.StatReceiver, file *Builder, r io.Reader) (n int64, spans []span, outerr error) {
+func writeFileChunks(bs blobserver.StatReceiver, file *Builder, r io.Reader, opts *ChunkOptions) (n int64, spans []span, outerr error) {
+	maxSize, minSize, fixed := opts.maxSize(), opts.minSize(), opts.fixed()
+	firstChunk := opts.firstChunk()
 	src := &noteEOFReader{r: r}
 	bufr := bufio.NewReaderSize(src, bufioReaderSize)
 	spans = []span{} // the tree of spans, cut on interesting rollsum boundaries
@@ -348,7 +432,7 @@ func writeFileChunks(bs blobserver.StatReceiver, file *Builder, r io.Reader) (n
 	uploadLastSpan := func() bool {
 		chunk := buf.String()
 		buf.Reset()
-		br := blobref.SHA1FromString(chunk)
+		br := blobref.FromString(chunk)
 		spans[len(spans)-1].br = br
 		select {
 		case outerr = <-firsterrc:
@@ -392,14 +476,16 @@ func writeFileChunks(bs blobserver.StatReceiver, file *Builder, r io.Reader) (n
 		var bits int
 		onRollSplit := rs.OnSplit()
 		switch {
-		case blobSize == maxBlobSize:
+		case blobSize == maxSize:
 			bits = 20 // arbitrary node weight; 1<<20 == 1MB
+		case fixed:
+			continue
 		case src.sawEOF:
 			// Don't split. End is coming soon enough.
 			continue
-		case onRollSplit && n > firstChunkSize && blobSize > tooSmallThreshold:
+		case onRollSplit && (n > firstChunkSize || !firstChunk) && blobSize > minSize:
 			bits = rs.Bits()
-		case n == firstChunkSize:
+		case n == firstChunkSize && firstChunk:
 			bits = 18 // 1 << 18 == 256KB
 		default:
 			// Don't split.
@@ -17,6 +17,7 @@ limitations under the License.
 package schema
 
 import (
+	"bytes"
 	"io"
 	"io/ioutil"
 	"math/rand"
@@ -26,6 +27,7 @@ import (
 	"time"
 
 	"camlistore.org/pkg/blobref"
+	"camlistore.org/pkg/test"
 )
 
 func TestWriteFileMap(t *testing.T) {
@@ -143,3 +145,128 @@ func (sr *statsStatReceiver) StatBlobs(dest chan<- blobref.SizedBlobRef, blobs [
 	}
 	return nil
 }
+
+func TestWriteFileSHA256(t *testing.T) {
+	if err := blobref.SetRecommendedHash("sha256"); err != nil {
+		t.Fatal(err)
+	}
+	defer blobref.SetRecommendedHash("sha1")
+
+	const size = 1 << 20
+	sto := new(test.Fetcher)
+	br, err := WriteFileFromReader(sto, "foo", &randReader{seed: 123, length: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if br.HashName() != "sha256" {
+		t.Errorf("file blobref = %v; want sha256", br)
+	}
+	all := make(chan blobref.SizedBlobRef)
+	go sto.EnumerateBlobs(all, "", 1000, 0)
+	for sb := range all {
+		if sb.HashName() != "sha256" {
+			t.Errorf("wrote blob %v; want sha256", sb.BlobRef)
+		}
+	}
+
+	fr, err := NewFileReader(sto, br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+	got, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := ioutil.ReadAll(&randReader{seed: 123, length: size})
+	if !bytes.Equal(got, want) {
+		t.Errorf("read back %d bytes, differing from the %d written", len(got), len(want))
+	}
+}
+
+// chunkSizes returns the sizes of the chunks of file br, which is
+// size bytes long, in order.
+func chunkSizes(t *testing.T, sto blobref.SeekFetcher, br *blobref.BlobRef, size int64) []int64 {
+	fr, err := NewFileReader(sto, br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+	c := make(chan int64)
+	errc := make(chan error, 1)
+	go func() { errc <- fr.GetChunkOffsets(c) }()
+	var offs []int
+	for off := range c {
+		offs = append(offs, int(off))
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(offs)
+	offs = append(offs, int(size))
+	var sizes []int64
+	for i := 1; i < len(offs); i++ {
+		sizes = append(sizes, int64(offs[i]-offs[i-1]))
+	}
+	return sizes
+}
+
+func TestWriteFileChunked(t *testing.T) {
+	const size = 1<<20 + 123
+	tests := []struct {
+		opts ChunkOptions
+		max  int64
+	}{
+		{ChunkOptions{MaxSize: 64 << 10}, 64 << 10},
+		{ChunkOptions{MaxSize: 16 << 10}, 16 << 10},
+		{ChunkOptions{MinSize: 8 << 10, MaxSize: 100 << 10}, 100 << 10},
+		{ChunkOptions{Fixed: true, MaxSize: 100 << 10}, 100 << 10},
+		{ChunkOptions{Fixed: true}, 1 << 20},
+	}
+	for _, tt := range tests {
+		opts := tt.opts
+		sto := new(test.Fetcher)
+		br, err := WriteFileFromReaderChunked(sto, "foo", &randReader{seed: 123, length: size}, &opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		sizes := chunkSizes(t, sto, br, size)
+		for i, n := range sizes {
+			if n > tt.max {
+				t.Errorf("%+v: chunk %d is %d bytes; want at most %d", opts, i, n, tt.max)
+			}
+			if opts.Fixed && i < len(sizes)-1 && n != tt.max {
+				t.Errorf("%+v: chunk %d is %d bytes; want exactly %d", opts, i, n, tt.max)
+			}
+		}
+		if opts.Fixed {
+			if g, w := len(sizes), int((size+tt.max-1)/tt.max); g != w {
+				t.Errorf("%+v: %d chunks; want %d", opts, g, w)
+			}
+		}
+
+		fr, err := NewFileReader(sto, br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(fr)
+		fr.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := ioutil.ReadAll(&randReader{seed: 123, length: size})
+		if !bytes.Equal(got, want) {
+			t.Errorf("%+v: read back %d bytes, differing from the %d written", opts, len(got), len(want))
+		}
+	}
+
+	for _, opts := range []ChunkOptions{
+		{MaxSize: 2 << 20},
+		{MaxSize: -1},
+		{MinSize: 128 << 10, MaxSize: 64 << 10},
+	} {
+		if _, err := WriteFileFromReaderChunked(new(test.Fetcher), "foo", &randReader{seed: 1, length: 10}, &opts); err == nil {
+			t.Errorf("%+v: no error", opts)
+		}
+	}
+}
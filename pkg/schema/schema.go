@@ -23,7 +23,6 @@ package schema
 import (
 	"bytes"
 	"crypto/rand"
-	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -31,7 +30,6 @@ import (
 	"hash"
 	"io"
 	"os"
-	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -46,8 +44,6 @@ import (
 // a schema blob may be.
 const MaxSchemaBlobSize = 1 << 20
 
-var sha1Type = reflect.TypeOf(sha1.New())
-
 var (
 	ErrNoCamliVersion = errors.New("schema: no camliVersion key in map")
 )
@@ -458,7 +454,7 @@ func (d *defaultStatHasher) Lstat(fileName string) (os.FileInfo, error) {
 }
 
 func (d *defaultStatHasher) Hash(fileName string) (*blobref.BlobRef, error) {
-	s1 := sha1.New()
+	s1 := blobref.NewHash()
 	file, err := os.Open(fileName)
 	if err != nil {
 		return nil, err
@@ -513,12 +509,10 @@ func NewPlannedPermanode(key string) *Builder {
 }
 
 // NewHashPlannedPermanode returns a planned permanode with the sum
-// of the hash, prefixed with "sha1-", as the key.
+// of the hash, as a blobref (e.g. "sha1-..."), as the key.
+// The hash must be of a type supported by blobref.FromHash.
 func NewHashPlannedPermanode(h hash.Hash) *Builder {
-	if reflect.TypeOf(h) != sha1Type {
-		panic("Hash not supported. Only sha1 for now.")
-	}
-	return NewPlannedPermanode(fmt.Sprintf("sha1-%x", h.Sum(nil)))
+	return NewPlannedPermanode(blobref.FromHash(h).String())
 }
 
 // Map returns a Camli map of camliType "static-set"
@@ -731,6 +725,17 @@ func NewDelAttributeClaim(permaNode *blobref.BlobRef, attr string) *Builder {
 	})
 }
 
+// NewDelAttributeValueClaim is like NewDelAttributeClaim, but only
+// deletes value from attr's values.
+func NewDelAttributeValueClaim(permaNode *blobref.BlobRef, attr, value string) *Builder {
+	return NewClaim(&claimParam{
+		permanode: permaNode,
+		claimType: DelAttribute,
+		attribute: attr,
+		value:     value,
+	})
+}
+
 // ShareHaveRef is the auth type specifying that if you "have the
 // reference" (know the blobref to the haveref share blob), then you
 // have access to the referenced object from that share blob.
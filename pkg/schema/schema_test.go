@@ -167,6 +167,17 @@ func TestAttribute(t *testing.T) {
   "claimDate": "1970-01-01T00:02:03.000000456Z",
   "claimType": "del-attribute",
   "permaNode": "xxx-123"
+}`,
+		},
+		{
+			bb: NewDelAttributeValueClaim(br, "tag", "funny"),
+			want: `{"camliVersion": 1,
+  "attribute": "tag",
+  "camliType": "claim",
+  "claimDate": "1970-01-01T00:02:03.000000456Z",
+  "claimType": "del-attribute",
+  "permaNode": "xxx-123",
+  "value": "funny"
 }`,
 		},
 		{
@@ -274,6 +274,10 @@ type ClaimsRequest struct {
 	Permanode *blobref.BlobRef
 }
 
+func (r *ClaimsRequest) URLSuffix() string {
+	return fmt.Sprintf("camli/search/claims?permanode=%v", r.Permanode)
+}
+
 // fromHTTP panics with an httputil value on failure
 func (r *ClaimsRequest) fromHTTP(req *http.Request) {
 	r.Permanode = httputil.MustGetBlobRef(req, "permanode")
@@ -285,6 +289,10 @@ type SignerPathsRequest struct {
 	Target *blobref.BlobRef
 }
 
+func (r *SignerPathsRequest) URLSuffix() string {
+	return fmt.Sprintf("camli/search/signerpaths?signer=%v&target=%v", r.Signer, r.Target)
+}
+
 // fromHTTP panics with an httputil value on failure
 func (r *SignerPathsRequest) fromHTTP(req *http.Request) {
 	r.Signer = httputil.MustGetBlobRef(req, "signer")
@@ -358,6 +366,19 @@ func (r *WithAttrResponse) Err() error {
 // ClaimsResponse is the JSON response from $searchRoot/camli/search/claims.
 type ClaimsResponse struct {
 	Claims []*ClaimsItem `json:"claims"`
+
+	Error     string `json:"error,omitempty"`
+	ErrorType string `json:"errorType,omitempty"`
+}
+
+func (r *ClaimsResponse) Err() error {
+	if r.Error != "" || r.ErrorType != "" {
+		if r.ErrorType != "" {
+			return fmt.Errorf("%s: %s", r.ErrorType, r.Error)
+		}
+		return errors.New(r.Error)
+	}
+	return nil
 }
 
 // SignerPathsResponse is the JSON response from $searchRoot/camli/search/signerpaths.
@@ -591,6 +612,13 @@ type DescribeRequest struct {
 	// root BlobRef. If zero, a default is used.
 	Depth int
 
+	// Attrs, if non-empty, limits the attributes of described
+	// permanodes to those named, and only those are followed to
+	// describe more blobs. A name ending in "*" stands for all the
+	// attributes starting with what's before it, as in
+	// "camliPath:*".
+	Attrs []string
+
 	// Internal details, used while loading.
 	// Initialized by sh.initDescribeRequest.
 	sh *Handler
@@ -613,6 +641,10 @@ func (r *DescribeRequest) URLSuffix() string {
 		buf.WriteString("&blobref=")
 		buf.WriteString(r.BlobRef.String())
 	}
+	for _, attr := range r.Attrs {
+		buf.WriteString("&attr=")
+		buf.WriteString(url.QueryEscape(attr))
+	}
 	return buf.String()
 }
 
@@ -631,6 +663,25 @@ func (r *DescribeRequest) fromHTTP(req *http.Request) {
 		r.BlobRef = httputil.MustGetBlobRef(req, "blobref")
 	}
 	r.Depth = httputil.OptionalInt(req, "depth")
+	r.Attrs = req.Form["attr"]
+}
+
+// wantAttr reports whether the attribute named attr of described
+// permanodes is asked for. See Attrs.
+func (r *DescribeRequest) wantAttr(attr string) bool {
+	if len(r.Attrs) == 0 {
+		return true
+	}
+	for _, want := range r.Attrs {
+		if strings.HasSuffix(want, "*") {
+			if strings.HasPrefix(attr, want[:len(want)-1]) {
+				return true
+			}
+		} else if attr == want {
+			return true
+		}
+	}
+	return false
 }
 
 type DescribedBlob struct {
@@ -864,6 +915,11 @@ func (b *DescribedBlob) thumbnail(thumbSize int) (path string, width, height int
 
 type DescribedPermanode struct {
 	Attr url.Values `json:"attr"` // a map[string][]string
+
+	// FirstClaimDate is the date of the permanode's earliest
+	// claim, roughly when it was first set up. It's zero if the
+	// permanode has no claims.
+	FirstClaimDate time.Time `json:"firstClaimDate"`
 }
 
 func (dp *DescribedPermanode) jsonMap() map[string]interface{} {
@@ -878,6 +934,9 @@ func (dp *DescribedPermanode) jsonMap() map[string]interface{} {
 			am[k] = vl
 		}
 	}
+	if !dp.FirstClaimDate.IsZero() {
+		m["firstClaimDate"] = dp.FirstClaimDate.UTC().Format(time.RFC3339Nano)
+	}
 	return m
 }
 
@@ -1158,6 +1217,9 @@ func (dr *DescribeRequest) populatePermanodeFields(pi *DescribedPermanode, pn, s
 	}
 
 	sort.Sort(claims)
+	if len(claims) > 0 {
+		pi.FirstClaimDate = claims[0].Date
+	}
 claimLoop:
 	for _, cl := range claims {
 		switch cl.Type {
@@ -1195,6 +1257,11 @@ claimLoop:
 			attr[cl.Attr] = append(sl, cl.Value)
 		}
 	}
+	for k := range attr {
+		if !dr.wantAttr(k) {
+			delete(attr, k)
+		}
+	}
 
 	// If the content permanode is now known, look up its type
 	if content, ok := attr["camliContent"]; ok && len(content) > 0 {
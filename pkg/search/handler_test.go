@@ -143,6 +143,7 @@ var handlerTests = []handlerTest{
 					"camliType": "permanode",
 					"size":      123,
 					"permanode": {
+						"firstClaimDate": "1970-01-01T00:00:01Z",
 						"attr": {
 							"camliContent": [ "foo-232" ],
 							"only-delete-b": [ "a", "c" ]
@@ -179,6 +180,7 @@ var handlerTests = []handlerTest{
       "camliType": "permanode",
       "size": 123,
       "permanode": {
+        "firstClaimDate": "1970-01-01T00:00:01Z",
         "attr": {
           "camliPath:foo": [
             "bar-123"
@@ -216,6 +218,7 @@ var handlerTests = []handlerTest{
 		 "camliType": "permanode",
                  "mimeType": "application/json; camliType=permanode",
                  "permanode": {
+                   "firstClaimDate": "2011-11-28T01:32:37.000123456Z",
                    "attr": { "title": [ "Some title" ] }
                  },
                  "size": 534
@@ -266,6 +269,7 @@ var handlerTests = []handlerTest{
 		 "camliType": "permanode",
                  "mimeType": "application/json; camliType=permanode",
                  "permanode": {
+		        "firstClaimDate": "2011-11-28T01:32:37.000123456Z",
 		        "attr": {
 		          "camliContent": [
 		            "sha1-e3f0ee86622dda4d7e8a4a4af51117fb79dbdbbb"
@@ -347,6 +351,7 @@ var handlerTests = []handlerTest{
 		      "camliType": "permanode",
 		      "size": 534,
 		      "permanode": {
+		        "firstClaimDate": "2011-11-28T01:32:38.000123456Z",
 		        "attr": {
 		          "camliMember": [
 		            "sha1-7ca7743e38854598680d94ef85348f2c48a44513"
@@ -360,6 +365,7 @@ var handlerTests = []handlerTest{
 		      "camliType": "permanode",
 		      "size": 534,
 		      "permanode": {
+		        "firstClaimDate": "2011-11-28T01:32:37.000123456Z",
 		        "attr": {
 		          "camliContent": [
 		            "sha1-e3f0ee86622dda4d7e8a4a4af51117fb79dbdbbb"
@@ -412,6 +418,7 @@ var handlerTests = []handlerTest{
 		 "camliType": "permanode",
                  "mimeType": "application/json; camliType=permanode",
                  "permanode": {
+                   "firstClaimDate": "2011-11-28T01:32:37.000123456Z",
                    "attr": { "title": [ "Some title" ] }
                  },
                  "size": 534,
@@ -72,8 +72,7 @@ func (cl ClaimList) Len() int {
 }
 
 func (cl ClaimList) Less(i, j int) bool {
-	// TODO: memoize Seconds in unexported Claim field
-	return cl[i].Date.Unix() < cl[j].Date.Unix()
+	return cl[i].Date.Before(cl[j].Date)
 }
 
 func (cl ClaimList) Swap(i, j int) {
@@ -121,6 +120,15 @@ type ImageInfo struct {
 	Width int `json:"width"`
 	// Height is the visible height of the image (after any necessary EXIF rotation).
 	Height int `json:"height"`
+	// Location is where the image was taken, from its EXIF GPS
+	// data, or nil if unknown.
+	Location *Location `json:"location,omitempty"`
+}
+
+// Location is a position on Earth, in decimal degrees.
+type Location struct {
+	Latitude  float64 `json:"latitude"`  // negative is south
+	Longitude float64 `json:"longitude"` // negative is west
 }
 
 type Path struct {
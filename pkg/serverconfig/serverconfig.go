@@ -118,6 +118,9 @@ func camliHandlerUsingStorage(req *http.Request, action string, storage blobserv
 			op = auth.OpGet
 		case "stat":
 			handler = handlers.CreateStatHandler(storage).ServeHTTP
+		case "capacity":
+			handler = handlers.CreateCapacityHandler(storage).ServeHTTP
+			op = auth.OpStat
 		default:
 			handler = handlers.CreateGetHandler(storage).ServeHTTP
 			op = auth.OpGet
@@ -44,12 +44,18 @@ type Fetcher struct {
 var _ blobserver.Storage = (*Fetcher)(nil)
 
 func (tf *Fetcher) AddBlob(b *Blob) {
+	tf.addBlob(b.BlobRef(), b)
+}
+
+// addBlob adds b as br, which may be of another hash type
+// than b.BlobRef.
+func (tf *Fetcher) addBlob(br *blobref.BlobRef, b *Blob) {
 	tf.l.Lock()
 	defer tf.l.Unlock()
 	if tf.m == nil {
 		tf.m = make(map[string]*Blob)
 	}
-	key := b.BlobRef().String()
+	key := br.String()
 	tf.m[key] = b
 	tf.sorted = append(tf.sorted, key)
 	sort.Strings(tf.sorted)
@@ -107,7 +113,7 @@ func (tf *Fetcher) ReceiveBlob(br *blobref.BlobRef, source io.Reader) (blobref.S
 		return sb, fmt.Errorf("Hash mismatch receiving blob %s", br)
 	}
 	blob := &Blob{Contents: string(all)}
-	tf.AddBlob(blob)
+	tf.addBlob(br, blob)
 	return blobref.SizedBlobRef{br, int64(len(all))}, nil
 }
 
@@ -151,7 +157,7 @@ func (tf *Fetcher) EnumerateBlobs(dest chan<- blobref.SizedBlobRef,
 			continue
 		}
 		b := tf.m[k]
-		dest <- blobref.SizedBlobRef{b.BlobRef(), b.Size()}
+		dest <- blobref.SizedBlobRef{blobref.MustParse(k), b.Size()}
 		n++
 		if limit > 0 && n == limit {
 			break
@@ -119,15 +119,16 @@ func (is *indexStorage) Delete(key string) error {
 	return datastore.Delete(c, is.key(c, key))
 }
 
-func (is *indexStorage) Find(key string) index.Iterator {
+func (is *indexStorage) Find(start, end string) index.Iterator {
 	c := ctxPool.Get()
 	if indexDebug {
-		c.Infof("IndexStorage Find(%q)", key)
+		c.Infof("IndexStorage Find(%q, %q)", start, end)
 	}
 	it := &iter{
 		is:    is,
 		cl:    c,
-		after: key,
+		after: start,
+		end:   end,
 		nsk:   datastore.NewKey(c, indexRowKind, is.ns, 0, nil),
 	}
 	it.Closer = &onceCloser{fn: func() {
@@ -140,6 +141,7 @@ func (is *indexStorage) Find(key string) index.Iterator {
 type iter struct {
 	cl    ContextLoan
 	after string
+	end   string // exclusive upper bound, if non-empty
 	io.Closer
 	nsk *datastore.Key
 	is  *indexStorage
@@ -176,6 +178,9 @@ func (it *iter) Next() bool {
 		it.cl.Warningf("Error iterating over index after %q: %v", it.after, err)
 		return false
 	}
+	if it.end != "" && key.StringID() >= it.end {
+		return false
+	}
 	it.n++
 	it.key = key.StringID()
 	it.value = string(ent.Value)
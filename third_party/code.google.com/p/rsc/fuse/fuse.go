@@ -188,6 +188,11 @@ const (
 	ENOENT = Errno(syscall.ENOENT)
 	EIO    = Errno(syscall.EIO)
 	EPERM  = Errno(syscall.EPERM)
+	ENOSPC = Errno(syscall.ENOSPC)
+	ERANGE = Errno(syscall.ERANGE)
+	EINTR  = Errno(syscall.EINTR)
+	EAGAIN = Errno(syscall.EAGAIN)
+	EACCES = Errno(syscall.EACCES)
 )
 
 type errno int
@@ -280,6 +285,9 @@ func fileMode(unixMode uint32) os.FileMode {
 	if unixMode&syscall.S_ISGID != 0 {
 		mode |= os.ModeSetgid
 	}
+	if unixMode&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
 	return mode
 }
 
@@ -575,7 +583,9 @@ func (c *Conn) ReadRequest() (Request, error) {
 			if m.len() < unsafe.Sizeof(*in) {
 				goto corrupt
 			}
-			r = &SetxattrRequest{}
+			r = &SetxattrRequest{
+				Flags: in.Flags,
+			}
 			size = in.Size
 			m.off += int(unsafe.Sizeof(*in))
 		}
@@ -594,26 +604,35 @@ func (c *Conn) ReadRequest() (Request, error) {
 		req = r
 
 	case opGetxattr:
+		var r *GetxattrRequest
 		if runtime.GOOS == "darwin" {
 			in := (*getxattrInOSX)(m.data())
 			if m.len() < unsafe.Sizeof(*in) {
 				goto corrupt
 			}
-			req = &GetxattrRequest{
-				Header:   m.Header(),
+			r = &GetxattrRequest{
 				Size:     in.Size,
 				Position: in.Position,
 			}
+			m.off += int(unsafe.Sizeof(*in))
 		} else {
 			in := (*getxattrIn)(m.data())
 			if m.len() < unsafe.Sizeof(*in) {
 				goto corrupt
 			}
-			req = &GetxattrRequest{
-				Header: m.Header(),
-				Size:   in.Size,
+			r = &GetxattrRequest{
+				Size: in.Size,
 			}
+			m.off += int(unsafe.Sizeof(*in))
 		}
+		r.Header = m.Header()
+		name := m.bytes()
+		i := bytes.IndexByte(name, '\x00')
+		if i < 0 {
+			goto corrupt
+		}
+		r.Name = string(name[:i])
+		req = r
 
 	case opListxattr:
 		if runtime.GOOS == "darwin" {
@@ -690,11 +709,29 @@ func (c *Conn) ReadRequest() (Request, error) {
 		}
 
 	case opGetlk:
-		panic("opGetlk")
-	case opSetlk:
-		panic("opSetlk")
-	case opSetlkw:
-		panic("opSetlkw")
+		in := (*lkIn)(m.data())
+		if m.len() < unsafe.Sizeof(*in) {
+			goto corrupt
+		}
+		req = &GetlkRequest{
+			Header: m.Header(),
+			Handle: HandleID(in.Fh),
+			Owner:  in.Owner,
+			Lock:   in.Lk.lock(),
+		}
+
+	case opSetlk, opSetlkw:
+		in := (*lkIn)(m.data())
+		if m.len() < unsafe.Sizeof(*in) {
+			goto corrupt
+		}
+		req = &SetlkRequest{
+			Header: m.Header(),
+			Handle: HandleID(in.Fh),
+			Owner:  in.Owner,
+			Lock:   in.Lk.lock(),
+			Wait:   m.hdr.Opcode == opSetlkw,
+		}
 
 	case opAccess:
 		in := (*accessIn)(m.data())
@@ -723,6 +760,19 @@ func (c *Conn) ReadRequest() (Request, error) {
 			Name:   string(name[:i]),
 		}
 
+	case opFallocate:
+		in := (*fallocateIn)(m.data())
+		if m.len() < unsafe.Sizeof(*in) {
+			goto corrupt
+		}
+		req = &FallocateRequest{
+			Header: m.Header(),
+			Handle: HandleID(in.Fh),
+			Offset: in.Offset,
+			Length: in.Length,
+			Mode:   in.Mode,
+		}
+
 	case opInterrupt:
 		in := (*interruptIn)(m.data())
 		if m.len() < unsafe.Sizeof(*in) {
@@ -841,6 +891,7 @@ func (r *StatfsRequest) Respond(resp *StatfsResponse) {
 			Bfree:   resp.Bfree,
 			Bavail:  resp.Bavail,
 			Files:   resp.Files,
+			Ffree:   resp.Ffree,
 			Bsize:   resp.Bsize,
 			Namelen: resp.Namelen,
 			Frsize:  resp.Frsize,
@@ -940,6 +991,9 @@ func (a *Attr) attr() (out attr) {
 	if a.Mode&os.ModeSetgid != 0 {
 		out.Mode |= syscall.S_ISGID
 	}
+	if a.Mode&os.ModeSticky != 0 {
+		out.Mode |= syscall.S_ISVTX
+	}
 	out.Nlink = a.Nlink
 	if out.Nlink < 1 {
 		out.Nlink = 1
@@ -985,21 +1039,40 @@ func (r *GetattrResponse) String() string {
 // A GetxattrRequest asks for the extended attributes associated with r.Node.
 type GetxattrRequest struct {
 	Header
-	Size     uint32 // maximum size to return
+	Name     string // name of extended attribute
+	Size     uint32 // maximum size to return; 0 asks for the size only
 	Position uint32 // offset within extended attributes
 }
 
 func (r *GetxattrRequest) String() string {
-	return fmt.Sprintf("Getxattr [%s] %d @%d", &r.Header, r.Size, r.Position)
+	return fmt.Sprintf("Getxattr [%s] %q %d @%d", &r.Header, r.Name, r.Size, r.Position)
 }
 
 // Respond replies to the request with the given response.
+// If the request only asked for the size of the attribute, only
+// the size is sent. If the attribute is larger than the requested
+// size, Respond replies with ERANGE.
 func (r *GetxattrRequest) Respond(resp *GetxattrResponse) {
-	out := &getxattrOut{
-		outHeader: outHeader{Unique: uint64(r.ID)},
-		Size:      uint32(len(resp.Xattr)),
+	r.respondXattr(r.Size, resp.Xattr)
+}
+
+// respondXattr replies to a getxattr or listxattr request for at
+// most size bytes with data.
+func (h *Header) respondXattr(size uint32, data []byte) {
+	if size == 0 {
+		out := &getxattrOut{
+			outHeader: outHeader{Unique: uint64(h.ID)},
+			Size:      uint32(len(data)),
+		}
+		h.Conn.respond(&out.outHeader, unsafe.Sizeof(*out))
+		return
+	}
+	if uint32(len(data)) > size {
+		h.RespondError(ERANGE)
+		return
 	}
-	r.Conn.respondData(&out.outHeader, unsafe.Sizeof(*out), resp.Xattr)
+	out := &outHeader{Unique: uint64(h.ID)}
+	h.Conn.respondData(out, unsafe.Sizeof(*out), data)
 }
 
 // A GetxattrResponse is the response to a GetxattrRequest.
@@ -1022,18 +1095,23 @@ func (r *ListxattrRequest) String() string {
 	return fmt.Sprintf("Listxattr [%s] %d @%d", &r.Header, r.Size, r.Position)
 }
 
-// Respond replies to the request with the given response.
+// Respond replies to the request with the given response, like
+// GetxattrRequest.Respond.
 func (r *ListxattrRequest) Respond(resp *ListxattrResponse) {
-	out := &getxattrOut{
-		outHeader: outHeader{Unique: uint64(r.ID)},
-		Size:      uint32(len(resp.Xattr)),
-	}
-	r.Conn.respondData(&out.outHeader, unsafe.Sizeof(*out), resp.Xattr)
+	r.respondXattr(r.Size, resp.Xattr)
 }
 
 // A ListxattrResponse is the response to a ListxattrRequest.
 type ListxattrResponse struct {
-	Xattr []byte
+	Xattr []byte // NUL-terminated names; see Append
+}
+
+// Append adds extended attribute names to the response.
+func (r *ListxattrResponse) Append(names ...string) {
+	for _, name := range names {
+		r.Xattr = append(r.Xattr, name...)
+		r.Xattr = append(r.Xattr, '\x00')
+	}
 }
 
 func (r *ListxattrResponse) String() string {
@@ -1313,18 +1391,35 @@ func (r *ForgetRequest) Respond() {
 
 // A Dirent represents a single directory entry.
 type Dirent struct {
-	Inode uint64 // inode this entry names
-	Type  uint32 // ?
-	Name  string // name of entry
+	Inode uint64     // inode this entry names
+	Type  DirentType // type of entry, or DT_Unknown
+	Name  string     // name of entry
 }
 
+// A DirentType is the type of a directory entry, as reported in
+// readdir's d_type. It lets tools like find skip a stat per entry.
+type DirentType uint32
+
+const (
+	// DT_Unknown means the type is not known; callers must stat
+	// the entry to find out.
+	DT_Unknown DirentType = 0
+	DT_Socket  DirentType = syscall.S_IFSOCK >> 12
+	DT_Link    DirentType = syscall.S_IFLNK >> 12
+	DT_File    DirentType = syscall.S_IFREG >> 12
+	DT_Block   DirentType = syscall.S_IFBLK >> 12
+	DT_Dir     DirentType = syscall.S_IFDIR >> 12
+	DT_Char    DirentType = syscall.S_IFCHR >> 12
+	DT_FIFO    DirentType = syscall.S_IFIFO >> 12
+)
+
 // AppendDirent appends the encoded form of a directory entry to data
 // and returns the resulting slice.
 func AppendDirent(data []byte, dir Dirent) []byte {
 	de := dirent{
 		Ino:     dir.Inode,
 		Namelen: uint32(len(dir.Name)),
-		Type:    dir.Type,
+		Type:    uint32(dir.Type),
 	}
 	de.Off = uint64(len(data) + direntSize + (len(dir.Name)+7)&^7)
 	data = append(data, (*[direntSize]byte)(unsafe.Pointer(&de))[:]...)
@@ -1637,6 +1732,147 @@ func (r *FsyncRequest) Respond() {
 	r.Conn.respond(out, unsafe.Sizeof(*out))
 }
 
+// A LockType is the type of a byte-range lock, or LockUnlock
+// to release one.
+type LockType uint32
+
+const (
+	LockRead   LockType = syscall.F_RDLCK
+	LockWrite  LockType = syscall.F_WRLCK
+	LockUnlock LockType = syscall.F_UNLCK
+)
+
+func (t LockType) String() string {
+	switch t {
+	case LockRead:
+		return "read"
+	case LockWrite:
+		return "write"
+	case LockUnlock:
+		return "unlock"
+	}
+	return fmt.Sprintf("LockType(%d)", uint32(t))
+}
+
+// A FileLock describes a POSIX byte-range lock on the bytes
+// Start through End, inclusive. An End of math.MaxUint64 (or,
+// from some kernels, math.MaxInt64) means to the end of the file.
+type FileLock struct {
+	Start uint64
+	End   uint64
+	Type  LockType
+	Pid   uint32 // process holding the lock, for GetlkResponse
+}
+
+func (l FileLock) String() string {
+	return fmt.Sprintf("%v %d-%d pid=%d", l.Type, l.Start, l.End, l.Pid)
+}
+
+func (l fileLock) lock() FileLock {
+	return FileLock{Start: l.Start, End: l.End, Type: LockType(l.Type), Pid: l.Pid}
+}
+
+// A GetlkRequest asks whether Lock could be taken by Owner
+// through the open file Handle, as for F_GETLK.
+type GetlkRequest struct {
+	Header
+	Handle HandleID
+	Owner  uint64
+	Lock   FileLock
+}
+
+func (r *GetlkRequest) String() string {
+	return fmt.Sprintf("Getlk [%s] %#x owner=%#x %v", &r.Header, r.Handle, r.Owner, r.Lock)
+}
+
+func (r *GetlkRequest) handle() HandleID {
+	return r.Handle
+}
+
+// A GetlkResponse is the response to a GetlkRequest: a lock that
+// conflicts with the requested one, or one of type LockUnlock if
+// there is none.
+type GetlkResponse struct {
+	Lock FileLock
+}
+
+func (r *GetlkResponse) String() string {
+	return fmt.Sprintf("Getlk %v", r.Lock)
+}
+
+// Respond replies to the request with the given response.
+func (r *GetlkRequest) Respond(resp *GetlkResponse) {
+	out := &lkOut{
+		outHeader: outHeader{Unique: uint64(r.ID)},
+		Lk: fileLock{
+			Start: resp.Lock.Start,
+			End:   resp.Lock.End,
+			Type:  uint32(resp.Lock.Type),
+			Pid:   resp.Lock.Pid,
+		},
+	}
+	r.Conn.respond(&out.outHeader, unsafe.Sizeof(*out))
+}
+
+// A SetlkRequest asks to take or, if Lock.Type is LockUnlock,
+// release a lock for Owner through the open file Handle, as for
+// F_SETLK or, if Wait is set, F_SETLKW.
+type SetlkRequest struct {
+	Header
+	Handle HandleID
+	Owner  uint64
+	Lock   FileLock
+	Wait   bool // block until the lock can be taken
+}
+
+func (r *SetlkRequest) String() string {
+	return fmt.Sprintf("Setlk [%s] %#x owner=%#x %v wait=%v", &r.Header, r.Handle, r.Owner, r.Lock, r.Wait)
+}
+
+func (r *SetlkRequest) handle() HandleID {
+	return r.Handle
+}
+
+// Respond replies to the request, indicating that the lock was
+// taken or released.
+func (r *SetlkRequest) Respond() {
+	out := &outHeader{Unique: uint64(r.ID)}
+	r.Conn.respond(out, unsafe.Sizeof(*out))
+}
+
+// Fallocate mode flags, as in fallocate(2).
+const (
+	FallocateKeepSize  = 0x1 // FALLOC_FL_KEEP_SIZE
+	FallocatePunchHole = 0x2 // FALLOC_FL_PUNCH_HOLE
+)
+
+// A FallocateRequest asks to allocate the Length bytes of the open
+// file at Offset, as fallocate(2) does. Unless Mode has
+// FallocateKeepSize set, a file shorter than Offset+Length grows to
+// that size.
+type FallocateRequest struct {
+	Header
+	Handle HandleID
+	Offset uint64
+	Length uint64
+	Mode   uint32
+}
+
+func (r *FallocateRequest) String() string {
+	return fmt.Sprintf("Fallocate [%s] %#x %d @%d mode=%#x", &r.Header, r.Handle, r.Length, r.Offset, r.Mode)
+}
+
+func (r *FallocateRequest) handle() HandleID {
+	return r.Handle
+}
+
+// Respond replies to the request, indicating that the bytes were
+// allocated.
+func (r *FallocateRequest) Respond() {
+	out := &outHeader{Unique: uint64(r.ID)}
+	r.Conn.respond(out, unsafe.Sizeof(*out))
+}
+
 type InterruptRequest struct {
 	Header
 	Unique uint64
@@ -254,6 +254,7 @@ const (
 	opDestroy     = 38
 	opIoctl       = 39 // Linux?
 	opPoll        = 40 // Linux?
+	opFallocate   = 43 // Linux
 
 	// OS X
 	opSetvolname = 61
@@ -472,6 +473,14 @@ type lkOut struct {
 	Lk fileLock
 }
 
+type fallocateIn struct {
+	Fh      uint64
+	Offset  uint64
+	Length  uint64
+	Mode    uint32
+	padding uint32
+}
+
 type accessIn struct {
 	Mask    uint32
 	Padding uint32
@@ -1,9 +1,14 @@
 package fuse
 
 import (
+	"syscall"
 	"time"
 )
 
+// ENOATTR is returned by Getxattr and Removexattr when the
+// attribute doesn't exist.
+const ENOATTR = Errno(syscall.ENOATTR)
+
 type attr struct {
 	Ino        uint64
 	Size       uint64
@@ -1,6 +1,13 @@
 package fuse
 
-import "time"
+import (
+	"syscall"
+	"time"
+)
+
+// ENOATTR is returned by Getxattr and Removexattr when the
+// attribute doesn't exist.
+const ENOATTR = Errno(syscall.ENODATA)
 
 type attr struct {
 	Ino       uint64
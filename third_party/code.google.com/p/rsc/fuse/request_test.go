@@ -0,0 +1,67 @@
+// Copyright 2013 The Go Authors.  All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fuse
+
+import (
+	"runtime"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// readMessage returns the request parsed from msg, an opcode's
+// input as the kernel would send it after the header.
+func readMessage(t *testing.T, opcode uint32, msg []byte) Request {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	hdr := inHeader{
+		Len:    uint32(inHeaderSize + len(msg)),
+		Opcode: opcode,
+		Unique: 1,
+		Nodeid: 1,
+	}
+	buf := make([]byte, inHeaderSize, int(hdr.Len))
+	copy(buf, (*[1 << 10]byte)(unsafe.Pointer(&hdr))[:inHeaderSize])
+	buf = append(buf, msg...)
+	if _, err := syscall.Write(fds[1], buf); err != nil {
+		t.Fatal(err)
+	}
+	c := &Conn{fd: fds[0]}
+	req, err := c.ReadRequest()
+	if err != nil {
+		t.Fatalf("ReadRequest: %v", err)
+	}
+	return req
+}
+
+func TestSetxattrFlags(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("setxattrIn is the Linux layout")
+	}
+	const (
+		xattrCreate  = 1
+		xattrReplace = 2
+	)
+	for _, flags := range []uint32{0, xattrCreate, xattrReplace} {
+		in := setxattrIn{Size: 3, Flags: flags}
+		msg := append([]byte{}, (*[1 << 10]byte)(unsafe.Pointer(&in))[:unsafe.Sizeof(in)]...)
+		msg = append(msg, "user.x\x00val"...)
+		req, ok := readMessage(t, opSetxattr, msg).(*SetxattrRequest)
+		if !ok {
+			t.Fatalf("flags %d: request isn't a *SetxattrRequest", flags)
+		}
+		if req.Flags != flags {
+			t.Errorf("Flags = %d; want %d", req.Flags, flags)
+		}
+		if req.Name != "user.x" || string(req.Xattr) != "val" {
+			t.Errorf("flags %d: got %q = %q; want %q = %q", flags, req.Name, req.Xattr, "user.x", "val")
+		}
+	}
+}
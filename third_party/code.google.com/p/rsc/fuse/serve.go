@@ -92,16 +92,17 @@ type FS interface {
 // but not the open(2) system call.  If Access is not implemented, the Node behaves
 // as if it always returns nil (permission granted), relying on checks in Open instead.
 //
-//	Getxattr
+//	Getxattr(req *GetxattrRequest, resp *GetxattrResponse, intr Intr) Error
 //
-// Getxattr obtains an extended attribute for the receiver.
-// XXX
+// Getxattr obtains an extended attribute for the receiver, storing
+// its full value in resp. It should return ENOATTR if there is no
+// such attribute. The request's size limit is handled by Respond.
+//
+//	Listxattr(req *ListxattrRequest, resp *ListxattrResponse, intr Intr) Error
 //
-//	Listxattr
-// 
 // Listxattr lists the extended attributes recorded for the receiver.
 //
-//	Removexattr
+//	Removexattr(req *RemovexattrRequest, intr Intr) Error
 //
 // Removexattr removes an extended attribute from the receiver.
 //
@@ -109,7 +110,7 @@ type FS interface {
 //
 // Setattr sets the standard metadata for the receiver.
 //
-//	Setxattr
+//	Setxattr(req *SetxattrRequest, intr Intr) Error
 //
 // Setxattr sets an extended attribute for the receiver.
 //
@@ -205,9 +206,18 @@ func nodeAttr(inode uint64, n Node) (attr Attr) {
 // the corresponding FUSE requests.  The most common to implement are
 // Read, ReadDir, and Write.
 //
+//	Fallocate(req *FallocateRequest, intr Intr) Error
+//
+// Fallocate allocates a range of the file, growing it unless
+// req.Mode has FallocateKeepSize set. For handles without it, which
+// answer ENOSYS, the kernel fails fallocate(2) with EOPNOTSUPP.
+//
 //	Fsync
 //
-//	Getlk
+//	Getlk(req *GetlkRequest, resp *GetlkResponse, intr Intr) Error
+//
+// Getlk reports in resp a lock conflicting with the requested
+// one, or a lock of type LockUnlock if there is none.
 //
 //	Read
 //
@@ -215,9 +225,15 @@ func nodeAttr(inode uint64, n Node) (attr Attr) {
 //
 //	Release
 //
-//	Setlk
+//	Setlk(req *SetlkRequest, intr Intr) Error
 //
-//	Setlkw
+// Setlk takes or releases a byte-range lock. Setlkw requests
+// arrive as Setlk with req.Wait set; they should block until the
+// lock can be taken or intr is closed, returning EINTR in the
+// latter case. Without Wait, a conflicting lock means EAGAIN.
+// The kernel only sends lock requests if the FS's Init sets
+// InitPosixLocks; it keeps locks locally for handles without
+// Getlk and Setlk, which answer ENOSYS.
 //
 //	Truncate
 //
@@ -401,7 +417,6 @@ func (c *Conn) serve(fs FS, r Request) {
 		}
 		handle = shandle.handle
 	}
-	intr = make(chan struct{})
 	if c.req[hdr.ID] != nil {
 		// This happens with OSXFUSE.  Assume it's okay and
 		// that we'll never see an interrupt for this one.
@@ -741,10 +756,75 @@ func (c *Conn) serve(fs FS, r Request) {
 		done(s)
 		r.Respond(s)
 
-	case *GetxattrRequest, *SetxattrRequest, *ListxattrRequest, *RemovexattrRequest:
-		// TODO: Use n.
-		done(ENOSYS)
-		r.RespondError(ENOSYS)
+	case *GetxattrRequest:
+		n, ok := node.(interface {
+			Getxattr(*GetxattrRequest, *GetxattrResponse, Intr) Error
+		})
+		if !ok {
+			done(ENOSYS)
+			r.RespondError(ENOSYS)
+			break
+		}
+		s := &GetxattrResponse{}
+		if err := n.Getxattr(r, s, intr); err != nil {
+			done(err)
+			r.RespondError(err)
+			break
+		}
+		done(s)
+		r.Respond(s)
+
+	case *ListxattrRequest:
+		n, ok := node.(interface {
+			Listxattr(*ListxattrRequest, *ListxattrResponse, Intr) Error
+		})
+		if !ok {
+			done(ENOSYS)
+			r.RespondError(ENOSYS)
+			break
+		}
+		s := &ListxattrResponse{}
+		if err := n.Listxattr(r, s, intr); err != nil {
+			done(err)
+			r.RespondError(err)
+			break
+		}
+		done(s)
+		r.Respond(s)
+
+	case *SetxattrRequest:
+		n, ok := node.(interface {
+			Setxattr(*SetxattrRequest, Intr) Error
+		})
+		if !ok {
+			done(ENOSYS)
+			r.RespondError(ENOSYS)
+			break
+		}
+		if err := n.Setxattr(r, intr); err != nil {
+			done(err)
+			r.RespondError(err)
+			break
+		}
+		done(nil)
+		r.Respond()
+
+	case *RemovexattrRequest:
+		n, ok := node.(interface {
+			Removexattr(*RemovexattrRequest, Intr) Error
+		})
+		if !ok {
+			done(ENOSYS)
+			r.RespondError(ENOSYS)
+			break
+		}
+		if err := n.Removexattr(r, intr); err != nil {
+			done(err)
+			r.RespondError(err)
+			break
+		}
+		done(nil)
+		r.Respond()
 
 	case *ForgetRequest:
 		n, ok := node.(interface {
@@ -954,10 +1034,81 @@ func (c *Conn) serve(fs FS, r Request) {
 		done(s)
 		r.Respond(s)
 
+	case *GetlkRequest:
+		h, ok := handle.(interface {
+			Getlk(*GetlkRequest, *GetlkResponse, Intr) Error
+		})
+		if !ok {
+			done(ENOSYS)
+			r.RespondError(ENOSYS)
+			break
+		}
+		s := &GetlkResponse{}
+		if err := h.Getlk(r, s, intr); err != nil {
+			done(err)
+			r.RespondError(err)
+			break
+		}
+		done(s)
+		r.Respond(s)
+
+	case *SetlkRequest:
+		h, ok := handle.(interface {
+			Setlk(*SetlkRequest, Intr) Error
+		})
+		if !ok {
+			done(ENOSYS)
+			r.RespondError(ENOSYS)
+			break
+		}
+		if err := h.Setlk(r, intr); err != nil {
+			done(err)
+			r.RespondError(err)
+			break
+		}
+		done(nil)
+		r.Respond()
+
+	case *FallocateRequest:
+		h, ok := handle.(interface {
+			Fallocate(*FallocateRequest, Intr) Error
+		})
+		if !ok {
+			done(ENOSYS)
+			r.RespondError(ENOSYS)
+			break
+		}
+		if err := h.Fallocate(r, intr); err != nil {
+			done(err)
+			r.RespondError(err)
+			break
+		}
+		done(nil)
+		r.Respond()
+
 	case *FsyncRequest:
-		n, ok := node.(interface {
+		type fsync interface {
 			Fsync(r *FsyncRequest, intr Intr) Error
-		})
+		}
+		// Prefer the open Handle, if it knows how to sync
+		// itself, since it may be holding unwritten data.
+		c.meta.Lock()
+		var hsync fsync
+		if id := r.Handle; id != 0 && id < HandleID(len(c.handle)) && c.handle[id] != nil {
+			hsync, _ = c.handle[id].handle.(fsync)
+		}
+		c.meta.Unlock()
+		if hsync != nil {
+			if err := hsync.Fsync(r, intr); err != nil {
+				done(err)
+				r.RespondError(err)
+				break
+			}
+			done(nil)
+			r.Respond()
+			break
+		}
+		n, ok := node.(fsync)
 		if !ok {
 			log.Printf("Node %T missing Fsync method", node)
 			done(EIO)
@@ -973,25 +1124,23 @@ func (c *Conn) serve(fs FS, r Request) {
 		done(nil)
 		r.Respond()
 
-		/*	case *FsyncdirRequest:
-				done(ENOSYS)
-				r.RespondError(ENOSYS)
+	case *InterruptRequest:
+		// Close the interrupted request's Intr, so blocking
+		// operations such as Setlkw can give up. The kernel
+		// expects no reply.
+		c.meta.Lock()
+		ireq := c.req[RequestID(r.Unique)]
+		if ireq != nil && ireq.Intr != nil {
+			close(ireq.Intr)
+			ireq.Intr = nil
+		}
+		c.meta.Unlock()
+		done(nil)
 
-			case *GetlkRequest, *SetlkRequest, *SetlkwRequest:
+		/*	case *FsyncdirRequest:
 				done(ENOSYS)
 				r.RespondError(ENOSYS)
 
-			// One of a kind.
-			case *InterruptRequest:
-				c.meta.Lock()
-				ireq := c.req[r.OldID]
-				if ireq != nil && ireq.Intr != nil {
-					close(ireq.Intr)
-					ireq.Intr = nil
-				}
-				c.meta.Unlock()
-				done(nil)
-				r.Respond()
 
 			case *BmapRequest:
 				done(ENOSYS)